@@ -3,37 +3,46 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"cloud-native-pg-restic-backup/internal/audit"
+	"cloud-native-pg-restic-backup/internal/config"
 	"cloud-native-pg-restic-backup/internal/logging"
 	"cloud-native-pg-restic-backup/internal/plugin"
-	"cloud-native-pg-restic-backup/internal/restic"
-)
-
-var (
-	listenAddr = flag.String("listen", ":8080", "HTTP server listen address")
-	logLevel   = flag.String("log-level", "info", "Log level (debug, info, warn, error)")
-	logJSON    = flag.Bool("log-json", false, "Output logs in JSON format")
+	"cloud-native-pg-restic-backup/internal/tenant"
+	"cloud-native-pg-restic-backup/internal/tracing"
 )
 
 func main() {
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfigCommand(os.Args[2:]))
+	}
+
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:], os.LookupEnv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
 	// Initialize logger
-	logger := logging.NewLogger(logging.Config{
-		Level:      *logLevel,
-		JSONOutput: *logJSON,
-	})
+	logger := logging.NewLogger(cfg.Logging)
 
 	mainLogger := logger.Component("main")
 	mainLogger.Info().
 		Str("version", "1.0.0").
-		Str("listen_addr", *listenAddr).
+		Str("listen_addr", cfg.Listen).
+		Str("config_file", cfg.File).
 		Msg("Starting CloudNativePG Restic backup plugin")
 
+	if err := cfg.Validate(); err != nil {
+		mainLogger.Fatal().Err(err).Msg("Invalid configuration")
+	}
+
 	// Create context that will be cancelled on SIGINT/SIGTERM
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -50,46 +59,82 @@ func main() {
 		cancel()
 	}()
 
-	// Initialize restic client with configuration from environment
-	config := restic.Config{
-		Repository:  os.Getenv("RESTIC_REPOSITORY"),
-		Password:    os.Getenv("RESTIC_PASSWORD"),
-		S3Endpoint:  os.Getenv("S3_ENDPOINT"),
-		S3AccessKey: os.Getenv("S3_ACCESS_KEY"),
-		S3SecretKey: os.Getenv("S3_SECRET_KEY"),
+	// Export spans, the OTLP exporter reads OTEL_EXPORTER_OTLP_* variables
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Config{
+		Exporter:    cfg.Tracing.Exporter,
+		ServiceName: "cnpg-restic-backup",
+	})
+	if err != nil {
+		mainLogger.Fatal().Err(err).Msg("Failed to set up tracing")
+	}
+
+	res, err := setup(cfg, logger)
+	if err != nil {
+		mainLogger.Fatal().Err(err).Msg("Invalid configuration")
 	}
 
-	// Validate required environment variables
-	if config.Repository == "" {
-		mainLogger.Fatal().Msg("RESTIC_REPOSITORY environment variable is required")
+	// Without principals anything that reaches the listen address may call
+	// the API
+	if res.auth == nil {
+		mainLogger.Warn().Msg("API authentication disabled, set --auth-config to require credentials")
 	}
-	if config.Password == "" {
-		mainLogger.Fatal().Msg("RESTIC_PASSWORD environment variable is required")
+	if !res.paths.Data.Restricted() && !res.paths.Restore.Restricted() {
+		mainLogger.Warn().Msg("Path sandboxing disabled, set --pgdata-roots and --restore-roots to confine request paths")
+	}
+
+	// Record the configuration the plugin starts with
+	var auditLog *audit.Log
+	if cfg.Audit.LogFile != "" {
+		if auditLog, err = audit.Open(cfg.Audit.LogFile); err != nil {
+			mainLogger.Fatal().Err(err).Msg("Failed to open audit log")
+		}
+		defer auditLog.Close()
+
+		event := audit.Event{Action: audit.ActionConfig, Params: configAuditParams(cfg, res.tenantConfig)}
+		if err := auditLog.Record(ctx, event, nil); err != nil {
+			mainLogger.Fatal().Err(err).Msg("Failed to record configuration in audit log")
+		}
 	}
 
 	// Create and initialize plugin
-	p := plugin.NewPlugin(config, logger.Component("plugin"))
+	p := plugin.NewPlugin(ctx, res.tenants, pluginOptions(cfg, res, auditLog), logger.Component("plugin"))
 
 	// Create HTTP server
 	server := &http.Server{
-		Addr:    *listenAddr,
-		Handler: p,
+		Addr:              cfg.Listen,
+		Handler:           p,
+		ReadHeaderTimeout: time.Duration(cfg.Timeouts.ReadHeader),
 	}
 
-	// Initialize repository
-	mainLogger.Info().Msg("Initializing repository...")
-	client := restic.NewClient(config)
-	if err := client.InitRepository(ctx); err != nil {
-		mainLogger.Fatal().Err(err).Msg("Failed to initialize repository")
+	// Serve HTTPS, picking up certificates rotated in the mounted files
+	if res.tls != nil {
+		server.TLSConfig = res.tls.TLSConfig()
+		go res.tls.Run(ctx)
+	}
+
+	// Initialize the default repository, tenant repositories are
+	// initialized on first use
+	if res.tenantConfig.Default != nil {
+		mainLogger.Info().Msg("Initializing repository...")
+		if err := p.InitTenant(ctx, tenant.Identity{}); err != nil {
+			mainLogger.Fatal().Err(err).Msg("Failed to initialize repository")
+		}
 	}
 
 	// Start HTTP server
 	mainLogger.Info().
 		Str("addr", server.Addr).
+		Bool("tls", server.TLSConfig != nil).
 		Msg("Starting HTTP server")
 
 	go func() {
-		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
 			mainLogger.Error().Err(err).Msg("HTTP server error")
 			cancel()
 		}
@@ -98,11 +143,19 @@ func main() {
 	// Wait for context cancellation
 	<-ctx.Done()
 
-	// Graceful shutdown
+	// Graceful shutdown, a zero timeout waits for all requests
 	mainLogger.Info().Msg("Shutting down HTTP server...")
-	if err := server.Shutdown(context.Background()); err != nil {
+	shutdownCtx, shutdownCancel := context.WithCancel(context.Background())
+	if cfg.Timeouts.Shutdown > 0 {
+		shutdownCtx, shutdownCancel = context.WithTimeout(context.Background(), time.Duration(cfg.Timeouts.Shutdown))
+	}
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
 		mainLogger.Error().Err(err).Msg("Error during server shutdown")
 	}
+	if err := shutdownTracing(context.Background()); err != nil {
+		mainLogger.Error().Err(err).Msg("Error flushing spans")
+	}
 
 	mainLogger.Info().Msg("Server shutdown complete")
 }
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"cloud-native-pg-restic-backup/internal/audit"
+	"cloud-native-pg-restic-backup/internal/auth"
+	"cloud-native-pg-restic-backup/internal/config"
+	"cloud-native-pg-restic-backup/internal/health"
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/plugin"
+	"cloud-native-pg-restic-backup/internal/restic"
+	"cloud-native-pg-restic-backup/internal/sandbox"
+	"cloud-native-pg-restic-backup/internal/tenant"
+	"cloud-native-pg-restic-backup/internal/tlsconfig"
+)
+
+// resources are the components built from the configuration before serving
+type resources struct {
+	tenantConfig tenant.Config
+	tenants      *tenant.Registry
+	// auth is nil if authentication is disabled
+	auth  *auth.Authenticator
+	paths plugin.Paths
+	// tls is nil if the plugin serves plain HTTP
+	tls *tlsconfig.Reloader
+}
+
+// setup builds the components of a validated configuration, reading the
+// files it refers to. Repositories are not contacted.
+func setup(cfg *config.Config, logger *logging.Logger) (*resources, error) {
+	res := &resources{
+		tenantConfig: tenant.Config{
+			DefaultIdentity: tenant.Identity{
+				ClusterName: os.Getenv("CLUSTER_NAME"),
+				Namespace:   os.Getenv("POD_NAMESPACE"),
+			},
+			DefaultSecondaries: cfg.Secondaries,
+			File:               cfg.Tenants.ConfigFile,
+			SecretsDir:         cfg.Tenants.SecretsDir,
+			RequireKnown:       cfg.Tenants.RequireKnown,
+		},
+	}
+	if cfg.Repository.Repository != "" {
+		repository := cfg.Repository
+		res.tenantConfig.Default = &repository
+	}
+
+	var err error
+	if res.tenants, err = tenant.NewRegistry(res.tenantConfig); err != nil {
+		return nil, fmt.Errorf("tenants: %v", err)
+	}
+
+	if cfg.Auth.Enabled() {
+		principals := auth.Config{Principals: cfg.Auth.Principals}
+		if cfg.Auth.ConfigFile != "" {
+			fromFile, err := auth.ReadConfig(cfg.Auth.ConfigFile)
+			if err != nil {
+				return nil, fmt.Errorf("auth: %v", err)
+			}
+			principals.Principals = append(principals.Principals, fromFile.Principals...)
+		}
+		if res.auth, err = auth.New(principals); err != nil {
+			return nil, fmt.Errorf("auth: %v", err)
+		}
+	}
+
+	if res.paths, err = newPaths(cfg.Paths); err != nil {
+		return nil, fmt.Errorf("paths: %v", err)
+	}
+
+	tlsConfig := tlsconfig.Config{
+		CertFile:       cfg.TLS.CertFile,
+		KeyFile:        cfg.TLS.KeyFile,
+		ClientCAFile:   cfg.TLS.ClientCAFile,
+		MinVersion:     cfg.TLS.MinVersion,
+		ReloadInterval: time.Duration(cfg.TLS.ReloadInterval),
+	}
+	if tlsConfig.Enabled() {
+		if res.tls, err = tlsconfig.New(tlsConfig, logger); err != nil {
+			return nil, fmt.Errorf("tls: %v", err)
+		}
+	}
+
+	return res, nil
+}
+
+// pluginOptions returns the plugin options of the configuration
+func pluginOptions(cfg *config.Config, res *resources, auditLog *audit.Log) plugin.Options {
+	return plugin.Options{
+		BackupExclude:           cfg.Backup.Exclude,
+		BackupManifest:          cfg.Backup.Manifest,
+		BackupMode:              cfg.Backup.Mode,
+		BasebackupStream:        cfg.Backup.Stream,
+		BackupCoordinate:        cfg.Backup.Coordinate,
+		BackupWALArchiveTimeout: time.Duration(cfg.Backup.WALArchiveTimeout),
+		BackupInstance:          backupInstance(cfg.Backup.Instance),
+		BackupUpload:            cfg.Backup.Upload,
+		Restore:                 cfg.Restore,
+		Logical:                 cfg.Logical.Options(),
+		ReplicationInterval:     time.Duration(cfg.Replication.Interval),
+		ReplicateAfterBackup:    cfg.Replication.AfterBackup,
+		VerifyScratchDir:        cfg.Verify.ScratchDir,
+		CheckInterval:           time.Duration(cfg.Check.Interval),
+		CheckOptions: restic.CheckOptions{
+			Mode:   restic.CheckMode(cfg.Check.Mode),
+			Subset: cfg.Check.Subset,
+		},
+		SnapshotMetricsInterval: time.Duration(cfg.Metrics.SnapshotInterval),
+		Health: health.Options{
+			CacheTTL:     time.Duration(cfg.Health.ProbeCacheTTL),
+			StaleLockAge: time.Duration(cfg.Health.StaleLockAge),
+			MaxWALAge:    time.Duration(cfg.Health.MaxWALAge),
+		},
+		Audit:             auditLog,
+		Auth:              res.auth,
+		Paths:             res.paths,
+		Retention:         cfg.Retention.Policy(),
+		RetentionInterval: time.Duration(cfg.Retention.Interval),
+		MaxWALOperations:  cfg.Concurrency.WALOperations,
+		MaxTenants:        cfg.Tenants.Max,
+		WALTimeout:        time.Duration(cfg.Timeouts.WALOperation),
+	}
+}
+
+// newPaths creates the sandboxes of request paths, the WAL and tablespace
+// roots default to the data directory roots
+func newPaths(cfg config.PathsConfig) (plugin.Paths, error) {
+	walDirs := cfg.WALRoots
+	if len(walDirs) == 0 {
+		walDirs = cfg.PGDataRoots
+	}
+	tablespaceDirs := cfg.TablespaceRoots
+	if len(tablespaceDirs) == 0 {
+		tablespaceDirs = cfg.PGDataRoots
+	}
+
+	var paths plugin.Paths
+	var err error
+	if paths.Data, err = sandbox.New(cfg.PGDataRoots...); err != nil {
+		return paths, err
+	}
+	if paths.WAL, err = sandbox.New(walDirs...); err != nil {
+		return paths, err
+	}
+	if paths.Tablespaces, err = sandbox.New(tablespaceDirs...); err != nil {
+		return paths, err
+	}
+	if paths.Restore, err = sandbox.New(cfg.RestoreRoots...); err != nil {
+		return paths, err
+	}
+	// An unrestricted side leaves WAL restores unrestricted
+	if paths.WAL.Restricted() && paths.Restore.Restricted() {
+		if paths.WALRestore, err = sandbox.New(append(append([]string{}, walDirs...), cfg.RestoreRoots...)...); err != nil {
+			return paths, err
+		}
+	}
+	return paths, nil
+}
+
+// runConfigCommand runs the config subcommands and returns the exit code
+func runConfigCommand(args []string) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "usage: plugin config validate [--config file] [flags]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	cfg, err := config.Load(fs, args[1:], os.LookupEnv)
+	if err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		return 1
+	}
+	if _, err := setup(cfg, &logging.Logger{Logger: zerolog.Nop()}); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		return 1
+	}
+
+	source := "flags and environment"
+	if cfg.File != "" {
+		source = cfg.File
+	}
+	fmt.Printf("Configuration from %s is valid\n", source)
+	return 0
+}
+
+// configAuditParams describes the configuration for the audit log without
+// secrets
+func configAuditParams(cfg *config.Config, tenantConfig tenant.Config) map[string]string {
+	params := map[string]string{
+		"configFile":        cfg.File,
+		"defaultTenant":     tenantConfig.DefaultIdentity.String(),
+		"defaultRepository": strconv.FormatBool(tenantConfig.Default != nil),
+		"secondaries":       strconv.Itoa(len(tenantConfig.DefaultSecondaries)),
+		"tenantsConfig":     tenantConfig.File,
+		"tenantSecretsDir":  tenantConfig.SecretsDir,
+	}
+	if sum := fileSHA256(cfg.File); sum != "" {
+		params["configFileSHA256"] = sum
+	}
+	if sum := fileSHA256(tenantConfig.File); sum != "" {
+		params["tenantsConfigSHA256"] = sum
+	}
+	return params
+}
+
+// fileSHA256 returns the hex SHA-256 of a file, empty if it can't be read
+func fileSHA256(file string) string {
+	if file == "" {
+		return ""
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// backupInstance returns the configured instance name, the hostname by
+// default, which is the pod name when the plugin runs as a sidecar
+func backupInstance(name string) string {
+	if name != "" {
+		return name
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
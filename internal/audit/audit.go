@@ -0,0 +1,275 @@
+// Package audit keeps an append-only, hash-chained log of restores, snapshot
+// deletions and configuration changes.
+package audit
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Actions recorded in the audit log
+const (
+	ActionRestore        = "restore"
+	ActionLogicalRestore = "logical-restore"
+	ActionForget         = "forget"
+	ActionConfig         = "config"
+)
+
+// Outcome values
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Actor identifies who requested an operation. An empty actor is the plugin
+// itself, e.g. a scheduled job.
+type Actor struct {
+	Principal  string `json:"principal,omitempty"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	UserAgent  string `json:"userAgent,omitempty"`
+	RequestID  string `json:"requestID,omitempty"`
+}
+
+// Event is an audit log entry
+type Event struct {
+	Seq     uint64            `json:"seq"`
+	Time    time.Time         `json:"time"`
+	Action  string            `json:"action"`
+	Tenant  string            `json:"tenant,omitempty"`
+	Actor   Actor             `json:"actor"`
+	Params  map[string]string `json:"params,omitempty"`
+	Outcome string            `json:"outcome"`
+	Error   string            `json:"error,omitempty"`
+	// PrevHash is the hash of the previous event, chaining the log
+	PrevHash string `json:"prevHash"`
+	// Hash is the SHA-256 of the event with an empty Hash
+	Hash string `json:"hash"`
+}
+
+// computeHash returns the hash of the event
+func (e Event) computeHash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// actorKey is the context key of the actor
+type actorKey struct{}
+
+// WithActor returns a context recording operations as requested by actor
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the actor of the context, empty if it has none
+func ActorFrom(ctx context.Context) Actor {
+	actor, _ := ctx.Value(actorKey{}).(Actor)
+	return actor
+}
+
+// Log is an append-only audit log stored as JSON lines
+type Log struct {
+	path string
+
+	mu       sync.Mutex
+	file     *os.File
+	seq      uint64
+	lastHash string
+	// size is the length of the events written so far. Readers don't
+	// take the lock while reading, only events within size are complete.
+	size int64
+}
+
+// Open opens the audit log at path, creating it if needed, and continues its
+// hash chain
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+
+	l := &Log{path: path, file: file, size: info.Size()}
+	events, err := l.read(l.size)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if len(events) > 0 {
+		last := events[len(events)-1]
+		l.seq = last.Seq
+		l.lastHash = last.Hash
+	}
+	return l, nil
+}
+
+// Close closes the audit log
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Record appends an event for an operation that ended with err, taking the
+// actor from the context
+func (l *Log) Record(ctx context.Context, event Event, opErr error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	event.Seq = l.seq + 1
+	event.Time = time.Now().UTC()
+	event.Actor = ActorFrom(ctx)
+	event.Outcome = OutcomeSuccess
+	event.Error = ""
+	if opErr != nil {
+		event.Outcome = OutcomeFailure
+		event.Error = opErr.Error()
+	}
+	event.PrevHash = l.lastHash
+
+	hash, err := event.computeHash()
+	if err != nil {
+		return fmt.Errorf("failed to hash audit event: %v", err)
+	}
+	event.Hash = hash
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit event: %v", err)
+	}
+	// Whatever reached the file counts, later events follow it
+	n, err := l.file.Write(append(data, '\n'))
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit event: %v", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync audit log: %v", err)
+	}
+
+	l.seq = event.Seq
+	l.lastHash = event.Hash
+	return nil
+}
+
+// tail returns the length of the events written so far and the sequence
+// number and hash of the last one
+func (l *Log) tail() (int64, uint64, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size, l.seq, l.lastHash
+}
+
+// Filter selects audit events
+type Filter struct {
+	Action string
+	Tenant string
+	Since  time.Time
+	// Limit keeps only the most recent events, all if zero
+	Limit int
+}
+
+// Query returns the events matching the filter, oldest first
+func (l *Log) Query(filter Filter) ([]Event, error) {
+	size, _, _ := l.tail()
+	events, err := l.read(size)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []Event
+	for _, e := range events {
+		if filter.Action != "" && e.Action != filter.Action {
+			continue
+		}
+		if filter.Tenant != "" && e.Tenant != filter.Tenant {
+			continue
+		}
+		if !filter.Since.IsZero() && e.Time.Before(filter.Since) {
+			continue
+		}
+		matched = append(matched, e)
+	}
+
+	if filter.Limit > 0 && len(matched) > filter.Limit {
+		matched = matched[len(matched)-filter.Limit:]
+	}
+	return matched, nil
+}
+
+// Verify checks the hash chain of the whole log up to the last event
+// recorded, returning an error naming the first event that was altered,
+// removed or inserted
+func (l *Log) Verify() error {
+	size, seq, lastHash := l.tail()
+	events, err := l.read(size)
+	if err != nil {
+		return err
+	}
+
+	prevHash := ""
+	var prevSeq uint64
+	for _, e := range events {
+		if e.Seq != prevSeq+1 {
+			return fmt.Errorf("event %d follows event %d", e.Seq, prevSeq)
+		}
+		if e.PrevHash != prevHash {
+			return fmt.Errorf("event %d does not chain to the previous event", e.Seq)
+		}
+		hash, err := e.computeHash()
+		if err != nil {
+			return err
+		}
+		if hash != e.Hash {
+			return fmt.Errorf("event %d was modified", e.Seq)
+		}
+		prevHash = e.Hash
+		prevSeq = e.Seq
+	}
+	if prevSeq != seq || prevHash != lastHash {
+		return fmt.Errorf("log ends at event %d, event %d was recorded", prevSeq, seq)
+	}
+	return nil
+}
+
+// read parses the events within the first size bytes of the log file.
+// Events recorded meanwhile are left out, Record doesn't wait for the read.
+func (l *Log) read(size int64) ([]Event, error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %v", err)
+	}
+	defer file.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(io.LimitReader(file, size))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("failed to parse audit log line %d: %v", line, err)
+		}
+		events = append(events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %v", err)
+	}
+	return events, nil
+}
@@ -0,0 +1,231 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+// mockResticClient implements the restic.Client interface for testing
+type mockResticClient struct {
+	restic.Client
+	deleteErr error
+}
+
+func (m *mockResticClient) DeleteSnapshots(_ context.Context, _ []string) error {
+	return m.deleteErr
+}
+
+func openTestLog(t *testing.T) (*Log, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l, path
+}
+
+func TestLog_RecordAndQuery(t *testing.T) {
+	l, _ := openTestLog(t)
+	ctx := WithActor(context.Background(), Actor{RemoteAddr: "10.0.0.7:41234", RequestID: "req-1"})
+
+	events := []struct {
+		event Event
+		err   error
+	}{
+		{event: Event{Action: ActionConfig}},
+		{event: Event{Action: ActionRestore, Tenant: "db/pg-a", Params: map[string]string{"backupID": "abc"}}},
+		{event: Event{Action: ActionForget, Tenant: "db/pg-b"}, err: fmt.Errorf("repository locked")},
+		{event: Event{Action: ActionRestore, Tenant: "db/pg-b"}},
+	}
+	for _, e := range events {
+		if err := l.Record(ctx, e.event, e.err); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+
+	all, err := l.Query(Filter{})
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if len(all) != 4 {
+		t.Fatalf("Query() returned %d events, want 4", len(all))
+	}
+	if all[1].Actor.RequestID != "req-1" || all[1].Params["backupID"] != "abc" {
+		t.Errorf("restore event = %+v", all[1])
+	}
+	if all[2].Outcome != OutcomeFailure || all[2].Error != "repository locked" {
+		t.Errorf("failed forget event = %+v", all[2])
+	}
+
+	restores, _ := l.Query(Filter{Action: ActionRestore})
+	if len(restores) != 2 {
+		t.Errorf("Query(restore) returned %d events, want 2", len(restores))
+	}
+	tenantB, _ := l.Query(Filter{Tenant: "db/pg-b", Limit: 1})
+	if len(tenantB) != 1 || tenantB[0].Seq != 4 {
+		t.Errorf("Query(db/pg-b, limit 1) = %+v, want the latest event", tenantB)
+	}
+	future, _ := l.Query(Filter{Since: time.Now().Add(time.Hour)})
+	if len(future) != 0 {
+		t.Errorf("Query(since future) returned %d events", len(future))
+	}
+
+	if err := l.Verify(); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+}
+
+func TestLog_Reopen(t *testing.T) {
+	l, path := openTestLog(t)
+	if err := l.Record(context.Background(), Event{Action: ActionConfig}, nil); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer reopened.Close()
+	if err := reopened.Record(context.Background(), Event{Action: ActionConfig}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reopened.Verify(); err != nil {
+		t.Errorf("Verify() after reopening error = %v", err)
+	}
+	events, _ := reopened.Query(Filter{})
+	if len(events) != 2 || events[1].Seq != 2 {
+		t.Errorf("events = %+v, want the chain continued", events)
+	}
+}
+
+func TestLog_Tampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(lines [][]byte) [][]byte
+	}{
+		{
+			name: "modified event",
+			tamper: func(lines [][]byte) [][]byte {
+				lines[1] = bytes.Replace(lines[1], []byte(`"backupID":"abc"`), []byte(`"backupID":"xyz"`), 1)
+				return lines
+			},
+		},
+		{
+			name: "removed event",
+			tamper: func(lines [][]byte) [][]byte {
+				return append(lines[:1], lines[2:]...)
+			},
+		},
+		{
+			name: "removed last event",
+			tamper: func(lines [][]byte) [][]byte {
+				return lines[:2]
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, path := openTestLog(t)
+			for i := 0; i < 3; i++ {
+				event := Event{Action: ActionRestore, Params: map[string]string{"backupID": "abc"}}
+				if err := l.Record(context.Background(), event, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+			lines = tt.tamper(lines)
+			if err := os.WriteFile(path, append(bytes.Join(lines, []byte("\n")), '\n'), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := l.Verify(); err == nil {
+				t.Error("Verify() of tampered log should return error")
+			}
+		})
+	}
+}
+
+func TestLog_ConcurrentReads(t *testing.T) {
+	l, _ := openTestLog(t)
+	const events = 50
+
+	// Readers see a complete chain of the events recorded so far, never
+	// one being written
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := l.Verify(); err != nil {
+				errs <- fmt.Errorf("Verify() error = %v", err)
+				return
+			}
+			got, err := l.Query(Filter{})
+			if err != nil {
+				errs <- fmt.Errorf("Query() error = %v", err)
+				return
+			}
+			for i, e := range got {
+				if e.Seq != uint64(i+1) {
+					errs <- fmt.Errorf("event %d has sequence number %d", i, e.Seq)
+					return
+				}
+			}
+		}
+	}()
+
+	for i := 0; i < events; i++ {
+		if err := l.Record(context.Background(), Event{Action: ActionRestore, Params: map[string]string{"backupID": fmt.Sprint(i)}}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+
+	if got, _ := l.Query(Filter{}); len(got) != events {
+		t.Errorf("Query() returned %d events, want %d", len(got), events)
+	}
+}
+
+func TestWrapClient(t *testing.T) {
+	l, _ := openTestLog(t)
+	logger := logging.NewLogger(logging.Config{Level: "info"})
+
+	client := WrapClient(&mockResticClient{deleteErr: fmt.Errorf("lock failed")}, l, "db/pg-a", logger)
+	if err := client.DeleteSnapshots(context.Background(), []string{"a1", "b2"}); err == nil {
+		t.Error("DeleteSnapshots() should return the client error")
+	}
+
+	events, _ := l.Query(Filter{Action: ActionForget})
+	if len(events) != 1 {
+		t.Fatalf("recorded %d forget events, want 1", len(events))
+	}
+	if events[0].Params["snapshots"] != "a1,b2" || events[0].Tenant != "db/pg-a" || events[0].Outcome != OutcomeFailure {
+		t.Errorf("forget event = %+v", events[0])
+	}
+}
@@ -0,0 +1,45 @@
+package audit
+
+import (
+	"context"
+	"strings"
+
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+// auditedClient records the snapshot deletions of a Client
+type auditedClient struct {
+	restic.Client
+	log    *Log
+	tenant string
+	logger *logging.Logger
+}
+
+// WrapClient returns a Client recording every snapshot deletion, i.e. restic
+// forget --prune, of the tenant in the audit log
+func WrapClient(client restic.Client, log *Log, tenant string, logger *logging.Logger) restic.Client {
+	return &auditedClient{
+		Client: client,
+		log:    log,
+		tenant: tenant,
+		logger: logger.Component("audit"),
+	}
+}
+
+func (c *auditedClient) DeleteSnapshots(ctx context.Context, snapshotIDs []string) error {
+	err := c.Client.DeleteSnapshots(ctx, snapshotIDs)
+
+	event := Event{
+		Action: ActionForget,
+		Tenant: c.tenant,
+		Params: map[string]string{
+			"snapshots": strings.Join(snapshotIDs, ","),
+			"prune":     "true",
+		},
+	}
+	if auditErr := c.log.Record(ctx, event, err); auditErr != nil {
+		c.logger.Context(ctx).Error().Err(auditErr).Msg("Failed to record snapshot deletion")
+	}
+	return err
+}
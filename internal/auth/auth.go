@@ -0,0 +1,225 @@
+// Package auth authenticates API callers by bearer token or client
+// certificate and authorizes them per operation and tenant.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"cloud-native-pg-restic-backup/internal/tenant"
+)
+
+// ErrUnauthenticated is returned when a request carries no valid credentials
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Operations that can be granted to principals
+const (
+	OpBackup      = "backup"
+	OpRestore     = "restore"
+	OpWALArchive  = "wal-archive"
+	OpWALRestore  = "wal-restore"
+	OpReplication = "replication"
+	OpVerify      = "verify"
+	OpCheck       = "check"
+	OpAudit       = "audit"
+	OpMetrics     = "metrics"
+	// OpLogicalBackup and OpLogicalRestore dump and restore single databases
+	OpLogicalBackup  = "logical-backup"
+	OpLogicalRestore = "logical-restore"
+
+	// OpAll grants every operation
+	OpAll = "*"
+)
+
+var operations = map[string]bool{
+	OpBackup: true, OpRestore: true, OpWALArchive: true, OpWALRestore: true,
+	OpReplication: true, OpVerify: true, OpCheck: true, OpAudit: true,
+	OpMetrics: true, OpLogicalBackup: true, OpLogicalRestore: true, OpAll: true,
+}
+
+// PrincipalConfig configures a caller and what it may do
+type PrincipalConfig struct {
+	Name string `json:"name"`
+	// Token authenticates the principal as a bearer token, read from
+	// TokenFile if set
+	Token     string `json:"token,omitempty"`
+	TokenFile string `json:"tokenFile,omitempty"`
+	// CertificateNames authenticate verified client certificates whose
+	// common name or a DNS name matches
+	CertificateNames []string `json:"certificateNames,omitempty"`
+	// Operations granted to the principal, "*" for all
+	Operations []string `json:"operations"`
+	// Tenants restricts the principal to namespace/cluster patterns such as
+	// "db/*", all tenants if empty
+	Tenants []string `json:"tenants,omitempty"`
+}
+
+// Config is the authentication configuration file
+type Config struct {
+	Principals []PrincipalConfig `json:"principals"`
+}
+
+// Principal is an authenticated caller
+type Principal struct {
+	Name       string
+	operations map[string]bool
+	tenants    []string
+}
+
+// Allows reports whether the principal may run the operation
+func (p *Principal) Allows(op string) bool {
+	return p.operations[OpAll] || p.operations[op]
+}
+
+// AllowsTenant reports whether the principal may act on the tenant
+func (p *Principal) AllowsTenant(id tenant.Identity) bool {
+	if len(p.tenants) == 0 {
+		return true
+	}
+	for _, pattern := range p.tenants {
+		if ok, _ := path.Match(pattern, id.String()); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Scoped reports whether the principal is restricted to some tenants
+func (p *Principal) Scoped() bool {
+	return len(p.tenants) > 0
+}
+
+// tokenEntry is the hash of a principal's token
+type tokenEntry struct {
+	hash      [sha256.Size]byte
+	principal *Principal
+}
+
+// Authenticator identifies the principal of requests
+type Authenticator struct {
+	tokens []tokenEntry
+	certs  map[string]*Principal
+}
+
+// ReadConfig reads the principals of a JSON file
+func ReadConfig(file string) (Config, error) {
+	var cfg Config
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read auth config: %v", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse auth config: %v", err)
+	}
+	return cfg, nil
+}
+
+// New creates an authenticator of the configured principals
+func New(cfg Config) (*Authenticator, error) {
+	a := &Authenticator{certs: make(map[string]*Principal)}
+
+	for _, pc := range cfg.Principals {
+		if pc.Name == "" {
+			return nil, fmt.Errorf("principal without name")
+		}
+
+		p := &Principal{
+			Name:       pc.Name,
+			operations: make(map[string]bool),
+			tenants:    pc.Tenants,
+		}
+		for _, op := range pc.Operations {
+			if !operations[op] {
+				return nil, fmt.Errorf("principal %s: unknown operation %q", pc.Name, op)
+			}
+			p.operations[op] = true
+		}
+		for _, pattern := range pc.Tenants {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("principal %s: invalid tenant pattern %q", pc.Name, pattern)
+			}
+		}
+
+		token := pc.Token
+		if pc.TokenFile != "" {
+			data, err := os.ReadFile(pc.TokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("principal %s: failed to read token: %v", pc.Name, err)
+			}
+			token = strings.TrimSpace(string(data))
+		}
+		if token != "" {
+			a.tokens = append(a.tokens, tokenEntry{hash: sha256.Sum256([]byte(token)), principal: p})
+		}
+
+		for _, name := range pc.CertificateNames {
+			if other, ok := a.certs[name]; ok {
+				return nil, fmt.Errorf("certificate name %s used by %s and %s", name, other.Name, pc.Name)
+			}
+			a.certs[name] = p
+		}
+
+		if token == "" && len(pc.CertificateNames) == 0 {
+			return nil, fmt.Errorf("principal %s has neither a token nor certificate names", pc.Name)
+		}
+	}
+
+	return a, nil
+}
+
+// Authenticate returns the principal of the request's bearer token or
+// verified client certificate
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		hash := sha256.Sum256([]byte(strings.TrimSpace(token)))
+
+		// Compare against every entry so timing doesn't reveal a match
+		var found *Principal
+		for _, entry := range a.tokens {
+			if subtle.ConstantTimeCompare(hash[:], entry.hash[:]) == 1 {
+				found = entry.principal
+			}
+		}
+		if found != nil {
+			return found, nil
+		}
+		return nil, fmt.Errorf("%w: invalid bearer token", ErrUnauthenticated)
+	}
+
+	// Only certificates verified against the client CA identify a caller
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+		for _, name := range names {
+			if p, ok := a.certs[name]; ok && name != "" {
+				return p, nil
+			}
+		}
+		return nil, fmt.Errorf("%w: client certificate %s matches no principal", ErrUnauthenticated, cert.Subject.CommonName)
+	}
+
+	return nil, fmt.Errorf("%w: no credentials", ErrUnauthenticated)
+}
+
+// principalKey is the context key of the principal
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying the authenticated principal
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the principal of the context, nil if authentication
+// is disabled
+func PrincipalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cloud-native-pg-restic-backup/internal/tenant"
+)
+
+// withCert returns r as if it presented a client certificate verified
+// against the client CA
+func withCert(r *http.Request, commonName string, dnsNames ...string) *http.Request {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}, DNSNames: dnsNames}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return r
+}
+
+func TestAuthenticator_Authenticate(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New(Config{Principals: []PrincipalConfig{
+		{Name: "operator", Token: "operator-token", Operations: []string{OpAll}},
+		{Name: "monitoring", TokenFile: tokenFile, Operations: []string{OpMetrics}},
+		{Name: "instance", CertificateNames: []string{"pg-a.db.svc"}, Operations: []string{OpWALArchive}},
+	}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		request   func() *http.Request
+		principal string
+	}{
+		{
+			name: "bearer token",
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodPost, "/backup", nil)
+				r.Header.Set("Authorization", "Bearer operator-token")
+				return r
+			},
+			principal: "operator",
+		},
+		{
+			name: "token from file",
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+				r.Header.Set("Authorization", "Bearer file-token")
+				return r
+			},
+			principal: "monitoring",
+		},
+		{
+			name: "invalid token",
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodPost, "/backup", nil)
+				r.Header.Set("Authorization", "Bearer wrong")
+				return r
+			},
+		},
+		{
+			name: "invalid token with valid certificate",
+			request: func() *http.Request {
+				r := withCert(httptest.NewRequest(http.MethodPost, "/backup", nil), "pg-a.db.svc")
+				r.Header.Set("Authorization", "Bearer wrong")
+				return r
+			},
+		},
+		{
+			name: "certificate common name",
+			request: func() *http.Request {
+				return withCert(httptest.NewRequest(http.MethodPost, "/wal-archive", nil), "pg-a.db.svc")
+			},
+			principal: "instance",
+		},
+		{
+			name: "certificate DNS name",
+			request: func() *http.Request {
+				return withCert(httptest.NewRequest(http.MethodPost, "/wal-archive", nil), "", "other", "pg-a.db.svc")
+			},
+			principal: "instance",
+		},
+		{
+			name: "unknown certificate",
+			request: func() *http.Request {
+				return withCert(httptest.NewRequest(http.MethodPost, "/wal-archive", nil), "pg-b.db.svc")
+			},
+		},
+		{
+			name: "unverified certificate",
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodPost, "/wal-archive", nil)
+				r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "pg-a.db.svc"}}}}
+				return r
+			},
+		},
+		{
+			name: "no credentials",
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/backup", nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := a.Authenticate(tt.request())
+			if tt.principal == "" {
+				if !errors.Is(err, ErrUnauthenticated) {
+					t.Errorf("Authenticate() error = %v, want ErrUnauthenticated", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Authenticate() error = %v", err)
+			}
+			if p.Name != tt.principal {
+				t.Errorf("Authenticate() principal = %s, want %s", p.Name, tt.principal)
+			}
+		})
+	}
+}
+
+func TestPrincipal_Allows(t *testing.T) {
+	a, err := New(Config{Principals: []PrincipalConfig{
+		{Name: "admin", Token: "a", Operations: []string{OpAll}},
+		{Name: "backup", Token: "b", Operations: []string{OpBackup, OpWALArchive}, Tenants: []string{"db/*"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, backup := a.tokens[0].principal, a.tokens[1].principal
+
+	if !admin.Allows(OpRestore) || admin.Scoped() {
+		t.Error("Expected admin to be allowed every operation on every tenant")
+	}
+	if !backup.Allows(OpBackup) || backup.Allows(OpRestore) {
+		t.Error("Expected backup principal to be allowed backup only")
+	}
+	if !backup.Scoped() {
+		t.Error("Expected backup principal to be scoped")
+	}
+	if !backup.AllowsTenant(tenant.Identity{Namespace: "db", ClusterName: "pg-a"}) {
+		t.Error("Expected db/pg-a to match db/*")
+	}
+	if backup.AllowsTenant(tenant.Identity{Namespace: "other", ClusterName: "pg-a"}) {
+		t.Error("Expected other/pg-a not to match db/*")
+	}
+	if backup.AllowsTenant(tenant.Identity{}) {
+		t.Error("Expected the default tenant not to match db/*")
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal []PrincipalConfig
+	}{
+		{
+			name:      "missing name",
+			principal: []PrincipalConfig{{Token: "t", Operations: []string{OpBackup}}},
+		},
+		{
+			name:      "unknown operation",
+			principal: []PrincipalConfig{{Name: "p", Token: "t", Operations: []string{"delete"}}},
+		},
+		{
+			name:      "invalid tenant pattern",
+			principal: []PrincipalConfig{{Name: "p", Token: "t", Operations: []string{OpBackup}, Tenants: []string{"db/["}}},
+		},
+		{
+			name:      "no credentials",
+			principal: []PrincipalConfig{{Name: "p", Operations: []string{OpBackup}}},
+		},
+		{
+			name:      "missing token file",
+			principal: []PrincipalConfig{{Name: "p", TokenFile: "/nonexistent/token", Operations: []string{OpBackup}}},
+		},
+		{
+			name: "duplicate certificate name",
+			principal: []PrincipalConfig{
+				{Name: "p1", CertificateNames: []string{"pg"}, Operations: []string{OpBackup}},
+				{Name: "p2", CertificateNames: []string{"pg"}, Operations: []string{OpBackup}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(Config{Principals: tt.principal}); err == nil {
+				t.Error("New() expected error")
+			}
+		})
+	}
+}
@@ -3,51 +3,134 @@ package backup
 import (
 	"context"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+
+	"cloud-native-pg-restic-backup/internal/basebackup"
 	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/metrics"
+	"cloud-native-pg-restic-backup/internal/pgbackup"
+	"cloud-native-pg-restic-backup/internal/pgdata"
 	"cloud-native-pg-restic-backup/internal/restic"
+	"cloud-native-pg-restic-backup/internal/sandbox"
+	"cloud-native-pg-restic-backup/internal/tracing"
 	"cloud-native-pg-restic-backup/internal/wal"
 )
 
 // Handler interface defines the operations for backup handling
 type Handler interface {
-	CreateBackup(ctx context.Context, dataDir string) error
-	ArchiveWAL(ctx context.Context, walPath string) error
+	CreateBackup(ctx context.Context, dataDir string, opts CreateOptions) error
+	StreamBackup(ctx context.Context, opts StreamOptions) error
+	ArchiveWAL(ctx context.Context, walPath, dataDir string) error
+}
+
+// Base backup modes
+const (
+	// ModeFilesystem backs up the data directory from a shared volume
+	ModeFilesystem = "filesystem"
+	// ModeStream streams a pg_basebackup tar over a replication connection
+	ModeStream = "stream"
+)
+
+// ValidMode reports whether mode is a base backup mode, empty meaning the
+// filesystem one
+func ValidMode(mode string) bool {
+	return mode == "" || mode == ModeFilesystem || mode == ModeStream
+}
+
+// CreateOptions adjusts a filesystem backup
+type CreateOptions struct {
+	// Upload tunes how restic writes the snapshot
+	Upload restic.UploadOptions
+}
+
+// StreamOptions adjusts a streamed backup
+type StreamOptions struct {
+	// Incremental takes the backup incremental to the latest streamed one,
+	// falling back to a full backup when there is none to build on
+	Incremental bool
+}
+
+// Options configures base backups
+type Options struct {
+	// Exclude are restic patterns skipped in addition to the files
+	// PostgreSQL does not need restored
+	Exclude []string
+	// Tablespaces confines the tablespace locations backed up, nil allows
+	// every location
+	Tablespaces *sandbox.Sandbox
+	// Stream configures pg_basebackup for streamed backups
+	Stream basebackup.Config
+	// Manifest stores a backup_manifest of each filesystem backup, built by
+	// reading the snapshot back
+	Manifest bool
+	// Coordinate runs filesystem backups between pg_backup_start and
+	// pg_backup_stop on the instance owning the data directory, which may be
+	// a standby
+	Coordinate pgbackup.Config
+	// WALArchiveTimeout bounds the wait for the WAL a coordinated backup
+	// ends in to be archived, 0 means no limit
+	WALArchiveTimeout time.Duration
+	// Instance names the instance backups are taken on, recorded in their
+	// tags
+	Instance string
 }
 
 // handlerImpl implements the Handler interface
 type handlerImpl struct {
 	client     restic.Client
 	walManager *wal.Manager
+	options    Options
 	logger     *logging.Logger
 }
 
 // NewHandler creates a new backup handler
-func NewHandler(client restic.Client) Handler {
-	logger := logging.NewLogger(logging.Config{
-		Level:      "info",
-		JSONOutput: false,
-	}).Component("backup")
+func NewHandler(client restic.Client, opts Options, logger *logging.Logger) Handler {
+	logger = logger.Component("backup")
 
 	return &handlerImpl{
 		client:     client,
 		walManager: wal.NewManager(client, logger),
+		options:    opts,
 		logger:     logger,
 	}
 }
 
 // CreateBackup performs a full backup of the specified PostgreSQL data directory
-func (h *handlerImpl) CreateBackup(ctx context.Context, dataDir string) error {
+func (h *handlerImpl) CreateBackup(ctx context.Context, dataDir string, opts CreateOptions) (err error) {
 	if dataDir == "" {
 		return fmt.Errorf("data directory not specified")
 	}
 
-	logger := h.logger.Operation("create_backup").WithFields(map[string]interface{}{
+	ctx, span := tracing.Start(ctx, "backup.CreateBackup", attribute.String("data_dir", dataDir))
+	started := time.Now()
+	var processed uint64
+	defer func() {
+		metrics.ObserveBackup(ctx, time.Since(started), processed, err)
+		tracing.End(span, err)
+	}()
+
+	logger := h.logger.Context(ctx).Operation("create_backup").WithFields(map[string]interface{}{
 		"data_dir": dataDir,
 	})
 
+	// Identify the instance owning the data directory
+	instanceTags, err := pgdata.InstanceTags(dataDir)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to read instance metadata")
+		return fmt.Errorf("failed to read instance metadata: %v", err)
+	}
+	if instanceTags == nil {
+		logger.Warn().Msg("Data directory has no pg_control, backing up without instance tags")
+	}
+
 	// Get current WAL timeline
-	timeline, err := h.walManager.GetWALTimeline(ctx)
+	timeline, err := h.walManager.GetWALTimeline(ctx, instanceTags...)
 	if err != nil {
 		logger.Error().Err(err).Msg("Failed to get WAL timeline")
 		return fmt.Errorf("failed to get WAL timeline: %v", err)
@@ -63,29 +146,266 @@ func (h *handlerImpl) CreateBackup(ctx context.Context, dataDir string) error {
 		"type:full",
 		fmt.Sprintf("timeline:%d", timeline),
 	}
+	tags = append(tags, instanceTags...)
 
-	if err := h.client.Backup(ctx, dataDir, tags); err != nil {
+	// Back up tablespaces in the same snapshot, recording where they were
+	tablespaces, err := pgdata.ReadTablespaces(dataDir)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to read tablespaces")
+		return fmt.Errorf("failed to read tablespaces: %v", err)
+	}
+	var paths []string
+	for _, tablespace := range tablespaces {
+		if _, err := h.options.Tablespaces.Path(tablespace.Location); err != nil {
+			logger.Error().Err(err).Str("tablespace", tablespace.OID).Msg("Tablespace location not allowed")
+			return fmt.Errorf("tablespace %s: %v", tablespace.OID, err)
+		}
+		paths = append(paths, tablespace.Location)
+		tags = append(tags, tablespace.Tag())
+	}
+	if len(tablespaces) > 0 {
+		logger = logger.WithFields(map[string]interface{}{
+			"tablespaces": len(tablespaces),
+		})
+	}
+
+	// Skip files PostgreSQL recreates or discards on startup
+	exclude, err := pgdata.ExcludePatterns(dataDir)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to list excluded files")
+		return fmt.Errorf("failed to list excluded files: %v", err)
+	}
+	exclude = append(exclude, h.options.Exclude...)
+
+	if h.options.Instance != "" {
+		tags = append(tags, InstanceTagPrefix+h.options.Instance)
+	}
+
+	// A coordinated backup runs on the primary or a standby, the server
+	// tells which
+	var session *pgbackup.Session
+	if h.options.Coordinate.Enabled() {
+		session, err = pgbackup.Start(ctx, h.options.Coordinate, "cnpg-restic "+started.UTC().Format(time.RFC3339))
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to start backup on the server")
+			return fmt.Errorf("failed to start backup on the server: %v", err)
+		}
+		tags = append(tags, BackupFromTagPrefix+session.Server.From())
+		logger = logger.WithFields(map[string]interface{}{
+			"backup_from": session.Server.From(),
+		})
+		logger.Info().Msg("Backup started on the server")
+	}
+
+	summary, err := h.client.Backup(ctx, dataDir, tags, restic.BackupOptions{Paths: paths, Exclude: exclude, Upload: opts.Upload})
+	if err == nil && summary == nil && session != nil {
+		err = fmt.Errorf("restic reported no snapshot")
+	}
+	if err != nil {
+		if session != nil {
+			session.Close()
+		}
 		logger.Error().Err(err).Msg("Backup failed")
 		return fmt.Errorf("failed to create backup: %v", err)
 	}
 
+	var stop *pgbackup.Result
+	if session != nil {
+		stop, err = h.finishCoordinated(ctx, session, summary.SnapshotID, instanceTags, logger)
+		if err != nil {
+			logger.Error().Err(err).Str("snapshot_id", summary.SnapshotID).Msg("Failed to finish backup, deleting its snapshot")
+			if derr := h.client.DeleteSnapshots(context.WithoutCancel(ctx), []string{summary.SnapshotID}); derr != nil {
+				logger.Warn().Err(derr).Msg("Unusable snapshot not deleted")
+			}
+			return fmt.Errorf("failed to finish backup: %v", err)
+		}
+	}
+
+	if summary != nil {
+		processed = summary.TotalBytesProcessed
+		logger = logger.WithFields(map[string]interface{}{
+			"snapshot_id": summary.SnapshotID,
+			"bytes":       summary.TotalBytesProcessed,
+		})
+
+		// The backup is restorable without its manifest, which only
+		// verifications need
+		if h.options.Manifest {
+			if err := h.storeManifest(ctx, summary.SnapshotID, dataDir, tablespaces, stop); err != nil {
+				logger.Warn().Err(err).Msg("Backup manifest not stored")
+			}
+		}
+	}
+
 	logger.Info().Msg("Backup completed successfully")
 	return nil
 }
 
-// ArchiveWAL archives a WAL segment using Restic
-func (h *handlerImpl) ArchiveWAL(ctx context.Context, walPath string) error {
+// StreamBackup takes a base backup with pg_basebackup over a replication
+// connection and pipes its tar stream into the repository. The backup
+// manifest is also stored on its own, for later backups to be incremental to.
+func (h *handlerImpl) StreamBackup(ctx context.Context, opts StreamOptions) (err error) {
+	if !h.options.Stream.Enabled() {
+		return fmt.Errorf("streamed backups not configured")
+	}
+
+	ctx, span := tracing.Start(ctx, "backup.StreamBackup")
+	started := time.Now()
+	var processed uint64
+	defer func() {
+		metrics.ObserveBackup(ctx, time.Since(started), processed, err)
+		tracing.End(span, err)
+	}()
+
+	logger := h.logger.Context(ctx).Operation("stream_backup")
+
+	// The instance is only known to the server
+	instanceTags, err := basebackup.InstanceTags(ctx, h.options.Stream)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to identify the server")
+		return fmt.Errorf("failed to identify the server: %v", err)
+	}
+
+	timeline, err := h.walManager.GetWALTimeline(ctx, instanceTags...)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to get WAL timeline")
+		return fmt.Errorf("failed to get WAL timeline: %v", err)
+	}
+
+	logger = logger.WithFields(map[string]interface{}{
+		"timeline": timeline,
+	})
+	logger.Info().Msg("Starting streamed backup")
+
+	tags := []string{
+		"type:full",
+		fmt.Sprintf("timeline:%d", timeline),
+		basebackup.FormatTag,
+	}
+	tags = append(tags, instanceTags...)
+
+	var manifestPath string
+	if opts.Incremental {
+		parent, manifest, err := h.incrementalParent(ctx, instanceTags, logger)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to find the backup to build on")
+			return fmt.Errorf("failed to find the backup to build on: %v", err)
+		}
+		if parent != nil {
+			dir, err := os.MkdirTemp("", "cnpg-restic-manifest-")
+			if err != nil {
+				return fmt.Errorf("failed to create manifest directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			manifestPath = filepath.Join(dir, basebackup.ManifestFileName)
+			if err := basebackup.FetchManifest(ctx, h.client, manifest, manifestPath); err != nil {
+				logger.Error().Err(err).Msg("Failed to fetch the parent backup manifest")
+				return fmt.Errorf("failed to fetch the parent backup manifest: %v", err)
+			}
+			tags = append(tags, basebackup.IncrementalTag, basebackup.ParentTag(parent.ID))
+			logger = logger.WithFields(map[string]interface{}{
+				"parent_id": parent.ID,
+			})
+		}
+	}
+
+	label := "cnpg-restic " + started.UTC().Format(time.RFC3339)
+	capture := basebackup.NewManifestCapture()
+	summary, err := restic.BackupFrom(ctx, h.client, basebackup.FileName, tags, func(ctx context.Context, w io.Writer) error {
+		return basebackup.Stream(ctx, h.options.Stream, label, manifestPath, io.MultiWriter(w, capture))
+	})
+	manifest, manifestErr := capture.Manifest()
+	if err != nil {
+		logger.Error().Err(err).Msg("Backup failed")
+		return fmt.Errorf("failed to create backup: %v", err)
+	}
+	if summary != nil {
+		processed = summary.TotalBytesProcessed
+		logger = logger.WithFields(map[string]interface{}{
+			"snapshot_id": summary.SnapshotID,
+			"bytes":       summary.TotalBytesProcessed,
+		})
+
+		// The backup is complete without its manifest, only later
+		// incremental backups need it
+		if manifestErr == nil {
+			manifestErr = basebackup.StoreManifest(ctx, h.client, summary.SnapshotID, manifest)
+		}
+		if manifestErr != nil {
+			logger.Warn().Err(manifestErr).Msg("Backup manifest not stored, the next backup can't be incremental to this one")
+		}
+	}
+
+	logger.Info().Msg("Streamed backup completed successfully")
+	return nil
+}
+
+// incrementalParent returns the latest streamed backup of the instance and
+// the snapshot of its manifest, nil if the next backup must be a full one
+func (h *handlerImpl) incrementalParent(ctx context.Context, instanceTags []string, logger *logging.Logger) (*restic.Snapshot, *restic.Snapshot, error) {
+	snapshots, err := h.client.FindSnapshots(ctx, append([]string{"type:full", basebackup.FormatTag}, instanceTags...))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(snapshots) == 0 {
+		logger.Info().Msg("No streamed backup to build on, taking a full backup")
+		return nil, nil, nil
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.After(snapshots[j].Time)
+	})
+	parent := snapshots[0]
+
+	if limit := h.options.Stream.MaxIncrementals; limit > 0 {
+		chain, err := basebackup.Chain(ctx, h.client, parent)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(chain)-1 >= limit {
+			logger.Info().Int("incrementals", len(chain)-1).Msg("Chain of incremental backups is complete, taking a full backup")
+			return nil, nil, nil
+		}
+	}
+
+	manifest, err := basebackup.FindManifest(ctx, h.client, parent.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if manifest == nil {
+		logger.Warn().Str("parent_id", parent.ID).Msg("Latest streamed backup has no manifest, taking a full backup")
+		return nil, nil, nil
+	}
+	return parent, manifest, nil
+}
+
+// ArchiveWAL archives a WAL segment of the instance owning dataDir using
+// Restic
+func (h *handlerImpl) ArchiveWAL(ctx context.Context, walPath, dataDir string) (err error) {
 	if walPath == "" {
 		return fmt.Errorf("WAL path not specified")
 	}
+	if dataDir == "" {
+		return fmt.Errorf("data directory not specified")
+	}
 
-	logger := h.logger.Operation("archive_wal").WithFields(map[string]interface{}{
+	ctx, span := tracing.Start(ctx, "backup.ArchiveWAL", attribute.String("wal_path", walPath))
+	defer func() { tracing.End(span, err) }()
+
+	logger := h.logger.Context(ctx).Operation("archive_wal").WithFields(map[string]interface{}{
 		"wal_path": walPath,
+		"data_dir": dataDir,
 	})
 
 	logger.Info().Msg("Starting WAL archival")
 
-	if err := h.walManager.ArchiveWAL(ctx, walPath); err != nil {
+	// Segments are only ever found by the instance they are tagged with
+	instanceTags, err := pgdata.RequireInstanceTags(dataDir)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to read instance metadata")
+		return fmt.Errorf("failed to read instance metadata: %v", err)
+	}
+
+	if err := h.walManager.ArchiveWAL(ctx, walPath, instanceTags); err != nil {
 		logger.Error().Err(err).Msg("WAL archival failed")
 		return fmt.Errorf("failed to archive WAL: %v", err)
 	}
@@ -1,13 +1,25 @@
 package backup
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 
+	"cloud-native-pg-restic-backup/internal/basebackup"
 	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/pgbackup"
+	"cloud-native-pg-restic-backup/internal/pgdata"
 	"cloud-native-pg-restic-backup/internal/restic"
+	"cloud-native-pg-restic-backup/internal/sandbox"
 	"cloud-native-pg-restic-backup/internal/wal"
 )
 
@@ -16,30 +28,75 @@ type mockResticClient struct {
 	backupErr error
 	snapshots []*restic.Snapshot
 	tags      []string
+	exclude   []string
+	paths     []string
+	// stdin is what a streamed backup read
+	stdin   []byte
+	deleted []string
+	// streamed are the contents of the snapshots taken from stdin
+	streamed map[string][]byte
 }
 
 func (m *mockResticClient) InitRepository(_ context.Context) error {
 	return nil
 }
 
-func (m *mockResticClient) Backup(_ context.Context, _ string, tags []string) error {
+func (m *mockResticClient) Backup(_ context.Context, _ string, tags []string, opts restic.BackupOptions) (*restic.BackupSummary, error) {
 	m.tags = tags
-	return m.backupErr
+	m.exclude = opts.Exclude
+	m.paths = opts.Paths
+	if m.backupErr != nil {
+		return nil, m.backupErr
+	}
+	return &restic.BackupSummary{SnapshotID: "new-snapshot"}, nil
+}
+
+func (m *mockResticClient) BackupStdin(_ context.Context, filename string, tags []string, stdin io.Reader) (*restic.BackupSummary, error) {
+	// Like restic, a failing stream ends the input rather than the backup
+	data, _ := io.ReadAll(stdin)
+	if filename == basebackup.FileName {
+		m.tags = tags
+		m.stdin = data
+	}
+	if m.backupErr != nil {
+		return nil, m.backupErr
+	}
+	id := fmt.Sprintf("stream-%d", len(m.streamed)+1)
+	m.snapshots = append(m.snapshots, &restic.Snapshot{
+		ID:    id,
+		Time:  time.Now().Add(time.Duration(len(m.snapshots)) * time.Second),
+		Tags:  tags,
+		Paths: []string{"/" + filename},
+	})
+	m.streamed[id] = data
+	return &restic.BackupSummary{SnapshotID: id, TotalBytesProcessed: uint64(len(data))}, nil
 }
 
-func (m *mockResticClient) Restore(_ context.Context, _, _ string) error {
+func (m *mockResticClient) Restore(_ context.Context, _, _ string, _ restic.RestoreOptions) error {
 	return nil
 }
 
+func (m *mockResticClient) Dump(_ context.Context, snapshotID, _ string, w io.Writer) error {
+	_, err := w.Write(m.streamed[snapshotID])
+	return err
+}
+
 func (m *mockResticClient) RestoreFile(_ context.Context, _, _, _ string) error {
 	return nil
 }
 
-func (m *mockResticClient) FindSnapshots(_ context.Context, _ []string) ([]*restic.Snapshot, error) {
-	return m.snapshots, nil
+func (m *mockResticClient) FindSnapshots(_ context.Context, tags []string) ([]*restic.Snapshot, error) {
+	var found []*restic.Snapshot
+	for _, s := range m.snapshots {
+		if !slices.ContainsFunc(tags, func(tag string) bool { return !slices.Contains(s.Tags, tag) }) {
+			found = append(found, s)
+		}
+	}
+	return found, nil
 }
 
-func (m *mockResticClient) DeleteSnapshots(_ context.Context, _ []string) error {
+func (m *mockResticClient) DeleteSnapshots(_ context.Context, ids []string) error {
+	m.deleted = append(m.deleted, ids...)
 	return nil
 }
 
@@ -47,13 +104,26 @@ func (m *mockResticClient) EnsureDirectory(_ context.Context, _ string) error {
 	return nil
 }
 
+func (m *mockResticClient) Copy(_ context.Context, _ restic.Config, _ []string) error {
+	return nil
+}
+
+func (m *mockResticClient) Check(_ context.Context, _ restic.CheckOptions) (*restic.CheckResult, error) {
+	return &restic.CheckResult{OK: true}, nil
+}
+
+func (m *mockResticClient) Locks(_ context.Context) ([]*restic.Lock, error) {
+	return nil, nil
+}
+
 func newMockResticClient() *mockResticClient {
 	return &mockResticClient{
+		streamed: make(map[string][]byte),
 		snapshots: []*restic.Snapshot{
 			{
 				ID:   "test-snapshot-1",
 				Time: time.Now(),
-				Tags: []string{"type:wal", "000000010000000000000001"},
+				Tags: []string{"type:wal", "wal_file:000000010000000000000001"},
 			},
 		},
 	}
@@ -106,7 +176,7 @@ func TestCreateBackup(t *testing.T) {
 			}
 
 			// Execute backup
-			err := handler.CreateBackup(context.Background(), tt.dataDir)
+			err := handler.CreateBackup(context.Background(), tt.dataDir, CreateOptions{})
 
 			// Verify results
 			if (err != nil) != tt.wantErr {
@@ -136,10 +206,387 @@ func TestCreateBackup(t *testing.T) {
 	}
 }
 
+func TestCreateBackup_Exclude(t *testing.T) {
+	dataDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dataDir, "base", "5"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	// An unlogged relation, only its init fork is backed up
+	for _, file := range []string{"16384", "16384_init", "16385"} {
+		if err := os.WriteFile(filepath.Join(dataDir, "base", "5", file), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mockClient := newMockResticClient()
+	handler := NewHandler(mockClient, Options{Exclude: []string{"*.log"}}, logging.NewLogger(logging.Config{Level: "info"}))
+	if err := handler.CreateBackup(context.Background(), dataDir, CreateOptions{}); err != nil {
+		t.Fatalf("CreateBackup() error = %v", err)
+	}
+
+	excluded := make(map[string]bool)
+	for _, pattern := range mockClient.exclude {
+		excluded[pattern] = true
+	}
+	for _, want := range []string{
+		filepath.Join(dataDir, "pg_wal", "*"),
+		filepath.Join(dataDir, "postmaster.pid"),
+		filepath.Join(dataDir, "base", "5", "16384"),
+		"*.log",
+	} {
+		if !excluded[want] {
+			t.Errorf("exclude patterns lack %q: %v", want, mockClient.exclude)
+		}
+	}
+	if excluded[filepath.Join(dataDir, "base", "5", "16385")] || excluded[filepath.Join(dataDir, "base", "5", "16384_init")] {
+		t.Errorf("exclude patterns skip logged relation or init fork: %v", mockClient.exclude)
+	}
+}
+
+func TestCreateBackup_Tablespaces(t *testing.T) {
+	dataDir := t.TempDir()
+	location := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dataDir, "pg_tblspc"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(location, filepath.Join(dataDir, "pg_tblspc", "16385")); err != nil {
+		t.Fatal(err)
+	}
+	logger := logging.NewLogger(logging.Config{Level: "info"})
+
+	mockClient := newMockResticClient()
+	if err := NewHandler(mockClient, Options{}, logger).CreateBackup(context.Background(), dataDir, CreateOptions{}); err != nil {
+		t.Fatalf("CreateBackup() error = %v", err)
+	}
+	if len(mockClient.paths) != 1 || mockClient.paths[0] != location {
+		t.Errorf("backed up paths = %v, want [%s]", mockClient.paths, location)
+	}
+	if !slices.Contains(mockClient.tags, "tablespace:16385:"+location) {
+		t.Errorf("tags %v lack tablespace", mockClient.tags)
+	}
+
+	// Tablespaces outside the allowed roots are refused
+	roots, err := sandbox.New(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewHandler(newMockResticClient(), Options{Tablespaces: roots}, logger).CreateBackup(context.Background(), dataDir, CreateOptions{}); err == nil {
+		t.Error("CreateBackup() of tablespace outside the roots should fail")
+	}
+}
+
+func TestCreateBackup_Manifest(t *testing.T) {
+	// restic dumps the data directory by its path in the snapshot
+	dataDir := "/var/lib/postgresql/data"
+	control := make([]byte, 8192)
+	binary.LittleEndian.PutUint64(control, 7300000000000000042)
+	label := "START WAL LOCATION: 0/2000028 (file 000000010000000000000002)\nSTART TIMELINE: 1\n"
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, entry := range []struct{ name, body string }{
+		{"var/lib/postgresql/data/PG_VERSION", "17\n"},
+		{"var/lib/postgresql/data/backup_label", label},
+		{"var/lib/postgresql/data/global/pg_control", string(control)},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: entry.name, Mode: 0600, Size: int64(len(entry.body)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mockClient := newMockResticClient()
+	mockClient.streamed["new-snapshot"] = archive.Bytes()
+	handler := NewHandler(mockClient, Options{Manifest: true}, logging.NewLogger(logging.Config{Level: "info"}))
+	if err := handler.CreateBackup(context.Background(), dataDir, CreateOptions{}); err != nil {
+		t.Fatalf("CreateBackup() error = %v", err)
+	}
+
+	snapshots, _ := mockClient.FindSnapshots(context.Background(), basebackup.ManifestTags("new-snapshot"))
+	if len(snapshots) != 1 {
+		t.Fatalf("manifest snapshots = %v, want 1", snapshots)
+	}
+	manifest, err := pgdata.ParseManifest(mockClient.streamed[snapshots[0].ID])
+	if err != nil {
+		t.Fatalf("ParseManifest() error = %v", err)
+	}
+	var paths []string
+	for _, f := range manifest.Files {
+		paths = append(paths, f.Path)
+	}
+	if want := []string{"PG_VERSION", "backup_label", "global/pg_control"}; !slices.Equal(paths, want) {
+		t.Errorf("manifest files = %v, want %v", paths, want)
+	}
+	if manifest.Version != 2 || manifest.SystemIdentifier != 7300000000000000042 {
+		t.Errorf("manifest version %d, system identifier %d", manifest.Version, manifest.SystemIdentifier)
+	}
+	if len(manifest.WALRanges) != 1 || manifest.WALRanges[0] != (pgdata.WALRange{Timeline: 1, StartLSN: "0/2000028", EndLSN: "0/2000028"}) {
+		t.Errorf("manifest WAL ranges = %+v", manifest.WALRanges)
+	}
+}
+
+// fakePsql writes a psql coordinating a backup on a PostgreSQL 17 standby
+// that stops at 0/3000100
+func fakePsql(t *testing.T, label string) string {
+	t.Helper()
+	encoded := base64.StdEncoding.EncodeToString([]byte(label))
+	script := `#!/bin/sh
+while read -r line; do
+	case "$line" in
+	'\warn cnpg-restic:info'*) echo "cnpg-restic:info 170002 t 16777216" >&2 ;;
+	'\warn cnpg-restic:start'*) echo "cnpg-restic:start 0/3000028" >&2 ;;
+	'\warn cnpg-restic:stop'*) echo "cnpg-restic:stop 0/3000100 ` + encoded + `" >&2 ;;
+	esac
+done
+`
+	command := filepath.Join(t.TempDir(), "psql")
+	if err := os.WriteFile(command, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return command
+}
+
+func TestCreateBackup_Coordinated(t *testing.T) {
+	walPollInterval = 10 * time.Millisecond
+	label := "START WAL LOCATION: 0/3000028 (file 000000010000000000000003)\nBACKUP FROM: standby\nSTART TIMELINE: 1\n"
+
+	tests := []struct {
+		name        string
+		walArchived bool
+		wantErr     bool
+	}{
+		{name: "WAL archived by the primary", walArchived: true},
+		{name: "WAL not archived in time", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := newMockResticClient()
+			if tt.walArchived {
+				mockClient.snapshots = append(mockClient.snapshots, &restic.Snapshot{
+					ID:   "wal-3",
+					Tags: []string{"type:wal", "wal_file:000000010000000000000003"},
+				})
+			}
+			opts := Options{
+				Manifest:          true,
+				Coordinate:        pgbackup.Config{ConnInfo: "host=/controller/run", PsqlCommand: fakePsql(t, label)},
+				WALArchiveTimeout: 50 * time.Millisecond,
+				Instance:          "pg-2",
+			}
+			handler := NewHandler(mockClient, opts, logging.NewLogger(logging.Config{Level: "info"}))
+
+			err := handler.CreateBackup(context.Background(), "/var/lib/postgresql/data", CreateOptions{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CreateBackup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, tag := range []string{"backup_from:standby", "instance:pg-2"} {
+				if !slices.Contains(mockClient.tags, tag) {
+					t.Errorf("tags = %v, missing %s", mockClient.tags, tag)
+				}
+			}
+
+			labels, _ := mockClient.FindSnapshots(context.Background(), basebackup.LabelTags("new-snapshot"))
+			if tt.wantErr {
+				if !slices.Equal(mockClient.deleted, []string{"new-snapshot"}) || len(labels) != 0 {
+					t.Errorf("deleted = %v, labels = %v, want the snapshot deleted", mockClient.deleted, labels)
+				}
+				return
+			}
+			if len(labels) != 1 || string(mockClient.streamed[labels[0].ID]) != label {
+				t.Fatalf("label snapshots = %v", labels)
+			}
+
+			manifests, _ := mockClient.FindSnapshots(context.Background(), basebackup.ManifestTags("new-snapshot"))
+			if len(manifests) != 1 {
+				t.Fatalf("manifest snapshots = %v, want 1", manifests)
+			}
+			manifest, err := pgdata.ParseManifest(mockClient.streamed[manifests[0].ID])
+			if err != nil {
+				t.Fatalf("ParseManifest() error = %v", err)
+			}
+			if len(manifest.Files) != 1 || manifest.Files[0].Path != "backup_label" {
+				t.Errorf("manifest files = %+v, want the backup label", manifest.Files)
+			}
+			if len(manifest.WALRanges) != 1 || manifest.WALRanges[0] != (pgdata.WALRange{Timeline: 1, StartLSN: "0/3000028", EndLSN: "0/3000100"}) {
+				t.Errorf("manifest WAL ranges = %+v", manifest.WALRanges)
+			}
+		})
+	}
+}
+
+func TestStreamBackup(t *testing.T) {
+	tests := []struct {
+		name        string
+		script      string
+		backupErr   error
+		wantErr     bool
+		wantStdin   string
+		wantDeleted bool
+	}{
+		{
+			name:      "successful streamed backup",
+			script:    "printf 'tar of %s' \"$1\"",
+			wantStdin: "tar of --pgdata=-",
+		},
+		{
+			name:        "pg_basebackup failure",
+			script:      "printf partial; echo 'connection refused' >&2; exit 1",
+			wantErr:     true,
+			wantStdin:   "partial",
+			wantDeleted: true,
+		},
+		{
+			name:      "restic failure",
+			script:    "printf 'tar'",
+			backupErr: fmt.Errorf("repository locked"),
+			wantErr:   true,
+			wantStdin: "tar",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command := filepath.Join(t.TempDir(), "pg_basebackup")
+			if err := os.WriteFile(command, []byte("#!/bin/sh\n"+tt.script+"\n"), 0700); err != nil {
+				t.Fatal(err)
+			}
+
+			mockClient := newMockResticClient()
+			mockClient.backupErr = tt.backupErr
+			handler := NewHandler(mockClient, Options{
+				Stream: basebackup.Config{Command: command, ConnInfo: "host=pg-rw user=streaming_replica", PsqlCommand: writePsql(t, 42)},
+			}, logging.NewLogger(logging.Config{Level: "info"}))
+
+			err := handler.StreamBackup(context.Background(), StreamOptions{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("StreamBackup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(mockClient.stdin) != tt.wantStdin {
+				t.Errorf("streamed %q, want %q", mockClient.stdin, tt.wantStdin)
+			}
+			if !slices.Contains(mockClient.tags, basebackup.FormatTag) {
+				t.Errorf("tags %v lack %s", mockClient.tags, basebackup.FormatTag)
+			}
+			if deleted := len(mockClient.deleted) > 0; deleted != tt.wantDeleted {
+				t.Errorf("incomplete snapshot deleted = %v, want %v", deleted, tt.wantDeleted)
+			}
+		})
+	}
+
+	// Without a server to stream from the mode is unavailable
+	handler := NewHandler(newMockResticClient(), Options{}, logging.NewLogger(logging.Config{Level: "info"}))
+	if err := handler.StreamBackup(context.Background(), StreamOptions{}); err == nil {
+		t.Error("StreamBackup() without connection string should fail")
+	}
+
+	// Nothing is streamed from a server that can't be identified
+	psql := filepath.Join(t.TempDir(), "psql")
+	if err := os.WriteFile(psql, []byte("#!/bin/sh\necho 'no pg_hba.conf entry' >&2\nexit 2\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	mockClient := newMockResticClient()
+	handler = NewHandler(mockClient, Options{
+		Stream: basebackup.Config{Command: "/nonexistent/pg_basebackup", ConnInfo: "host=pg-rw", PsqlCommand: psql},
+	}, logging.NewLogger(logging.Config{Level: "info"}))
+	if err := handler.StreamBackup(context.Background(), StreamOptions{}); err == nil {
+		t.Error("StreamBackup() of an unidentified server should fail")
+	}
+	if mockClient.stdin != nil {
+		t.Errorf("streamed %q, want nothing", mockClient.stdin)
+	}
+}
+
+func TestStreamBackup_Incremental(t *testing.T) {
+	// pg_basebackup keeps the manifest it was given and streams a tar
+	// holding a manifest naming its --incremental argument
+	dir := t.TempDir()
+	command := filepath.Join(dir, "pg_basebackup")
+	script := `#!/bin/sh
+parent=full
+for arg; do
+	case "$arg" in --incremental=*) cp "${arg#--incremental=}" ` + dir + `/parent-manifest; parent=incremental;; esac
+done
+cat ` + dir + `/$parent.tar
+`
+	if err := os.WriteFile(command, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"full", "incremental"} {
+		var archive bytes.Buffer
+		tw := tar.NewWriter(&archive)
+		body := "manifest of " + name
+		if err := tw.WriteHeader(&tar.Header{Name: basebackup.ManifestFileName, Mode: 0600, Size: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name+".tar"), archive.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mockClient := newMockResticClient()
+	// The latest streamed backup with a manifest is of another instance
+	// sharing the repository, which backups of this one can't build on
+	foreignTags := append([]string{"type:full", basebackup.FormatTag}, pgdata.FormatInstanceTags(7, "16")...)
+	mockClient.snapshots = append(mockClient.snapshots,
+		&restic.Snapshot{ID: "foreign", Time: time.Now().Add(time.Hour), Tags: foreignTags, Paths: []string{"/" + basebackup.FileName}},
+		&restic.Snapshot{ID: "foreign-manifest", Time: time.Now().Add(time.Hour), Tags: basebackup.ManifestTags("foreign")},
+	)
+	mockClient.streamed["foreign-manifest"] = []byte("manifest of foreign")
+	handler := NewHandler(mockClient, Options{
+		Stream: basebackup.Config{Command: command, ConnInfo: "host=pg-rw", MaxIncrementals: 1, PsqlCommand: writePsql(t, 42)},
+	}, logging.NewLogger(logging.Config{Level: "info"}))
+	incremental := StreamOptions{Incremental: true}
+
+	// Without a backup to build on the first one is full
+	if err := handler.StreamBackup(context.Background(), incremental); err != nil {
+		t.Fatalf("StreamBackup() error = %v", err)
+	}
+	if slices.Contains(mockClient.tags, basebackup.IncrementalTag) {
+		t.Errorf("first backup tagged %v, want a full backup", mockClient.tags)
+	}
+	full := mockClient.snapshots[len(mockClient.snapshots)-2]
+	manifests, _ := mockClient.FindSnapshots(context.Background(), basebackup.ManifestTags(full.ID))
+	if len(manifests) != 1 || string(mockClient.streamed[manifests[0].ID]) != "manifest of full" {
+		t.Fatalf("manifest of %s = %v", full.ID, manifests)
+	}
+
+	if err := handler.StreamBackup(context.Background(), incremental); err != nil {
+		t.Fatalf("StreamBackup() error = %v", err)
+	}
+	if !slices.Contains(mockClient.tags, basebackup.ParentTag(full.ID)) || !slices.Contains(mockClient.tags, basebackup.IncrementalTag) {
+		t.Errorf("incremental backup tagged %v, want parent %s", mockClient.tags, full.ID)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "parent-manifest")); err != nil || string(data) != "manifest of full" {
+		t.Errorf("pg_basebackup got manifest %q, %v", data, err)
+	}
+
+	// The chain reached maxIncrementals
+	if err := handler.StreamBackup(context.Background(), incremental); err != nil {
+		t.Fatalf("StreamBackup() error = %v", err)
+	}
+	if slices.Contains(mockClient.tags, basebackup.IncrementalTag) {
+		t.Errorf("backup after a complete chain tagged %v, want a full backup", mockClient.tags)
+	}
+}
+
 func TestArchiveWAL(t *testing.T) {
+	dataDir := writeDataDir(t, 42)
+
 	tests := []struct {
 		name      string
 		walPath   string
+		dataDir   string
 		backupErr error
 		wantErr   bool
 	}{
@@ -167,6 +614,12 @@ func TestArchiveWAL(t *testing.T) {
 			backupErr: nil,
 			wantErr:   true,
 		},
+		{
+			name:    "data directory without a cluster",
+			walPath: "/wal/000000010000000000000001",
+			dataDir: t.TempDir(),
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -189,7 +642,11 @@ func TestArchiveWAL(t *testing.T) {
 			}
 
 			// Execute WAL archive
-			err := handler.ArchiveWAL(context.Background(), tt.walPath)
+			dir := tt.dataDir
+			if dir == "" {
+				dir = dataDir
+			}
+			err := handler.ArchiveWAL(context.Background(), tt.walPath, dir)
 
 			// Verify results
 			if (err != nil) != tt.wantErr {
@@ -218,3 +675,108 @@ func TestArchiveWAL(t *testing.T) {
 		})
 	}
 }
+
+// writeDataDir creates a minimal data directory with pg_control and PG_VERSION
+func writeDataDir(t *testing.T, systemID uint64) string {
+	t.Helper()
+	dir := t.TempDir()
+
+	control := make([]byte, 8192)
+	binary.LittleEndian.PutUint64(control, systemID)
+
+	for _, sub := range []string{"global", "pg_wal"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "global", "pg_control"), control, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "PG_VERSION"), []byte("16\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// writePsql creates a psql stub identifying the server as systemID running
+// PostgreSQL 16
+func writePsql(t *testing.T, systemID uint64) string {
+	t.Helper()
+	command := filepath.Join(t.TempDir(), "psql")
+	script := fmt.Sprintf("#!/bin/sh\ncat >/dev/null\necho %d 160004\n", systemID)
+	if err := os.WriteFile(command, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return command
+}
+
+func TestInstanceTags(t *testing.T) {
+	dataDir := writeDataDir(t, 7301234567890123456)
+	wantTags := []string{"system_id:7301234567890123456", "pg_version:16"}
+
+	pgBasebackup := filepath.Join(t.TempDir(), "pg_basebackup")
+	if err := os.WriteFile(pgBasebackup, []byte("#!/bin/sh\nprintf tar\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		options Options
+		run     func(h Handler) error
+	}{
+		{
+			name: "base backup",
+			run: func(h Handler) error {
+				return h.CreateBackup(context.Background(), dataDir, CreateOptions{})
+			},
+		},
+		{
+			name: "WAL archive",
+			run: func(h Handler) error {
+				return h.ArchiveWAL(context.Background(), filepath.Join(dataDir, "pg_wal", "000000010000000000000001"), dataDir)
+			},
+		},
+		{
+			name: "streamed backup",
+			options: Options{
+				Stream: basebackup.Config{Command: pgBasebackup, ConnInfo: "host=pg-rw", PsqlCommand: writePsql(t, 7301234567890123456)},
+			},
+			run: func(h Handler) error {
+				return h.StreamBackup(context.Background(), StreamOptions{})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := newMockResticClient()
+			logger := logging.NewLogger(logging.Config{
+				Level:      "info",
+				JSONOutput: false,
+			})
+			handler := &handlerImpl{
+				client:     mockClient,
+				walManager: wal.NewManager(mockClient, logger),
+				options:    tt.options,
+				logger:     logger,
+			}
+
+			if err := tt.run(handler); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for _, want := range wantTags {
+				found := false
+				for _, tag := range mockClient.tags {
+					if tag == want {
+						found = true
+						break
+					}
+				}
+				if !found {
+					t.Errorf("tags %v do not contain %q", mockClient.tags, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package backup
+
+import (
+	"context"
+	"time"
+
+	"cloud-native-pg-restic-backup/internal/basebackup"
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/pgbackup"
+	"cloud-native-pg-restic-backup/internal/pgdata"
+	"cloud-native-pg-restic-backup/internal/wal"
+)
+
+const (
+	// BackupFromTagPrefix prefixes the tag recording whether a coordinated
+	// backup was taken on a primary or a standby
+	BackupFromTagPrefix = "backup_from:"
+	// InstanceTagPrefix prefixes the tag naming the instance a backup was
+	// taken on
+	InstanceTagPrefix = "instance:"
+)
+
+// walPollInterval is how often the repository is checked for the WAL a
+// coordinated backup ends in
+var walPollInterval = 5 * time.Second
+
+// finishCoordinated stops the backup on the server and waits for the WAL it
+// ends in to be archived. A standby can't switch WAL segments, so the wait
+// lasts until the primary archives the segment. The backup label is stored
+// next to the snapshot, which is unusable without it.
+func (h *handlerImpl) finishCoordinated(ctx context.Context, session *pgbackup.Session, snapshotID string, instanceTags []string, logger *logging.Logger) (*pgbackup.Result, error) {
+	result, err := session.Stop()
+	if err != nil {
+		return nil, err
+	}
+	label, err := pgdata.ParseBackupLabel(result.Label)
+	if err != nil {
+		return nil, err
+	}
+	stopLSN, err := wal.ParseLSN(result.StopLSN)
+	if err != nil {
+		return nil, err
+	}
+
+	// A standby backup fails if the standby is promoted meanwhile, so the
+	// backup ends on the timeline it started on
+	segment := wal.EndSegment(wal.Timeline(label.StartTimeline), stopLSN, session.Server.SegmentSize)
+	logger.Info().
+		Str("stop_lsn", result.StopLSN).
+		Str("wal_file", segment.FileName()).
+		Msg("Backup stopped, waiting for its WAL to be archived")
+
+	waitCtx := ctx
+	if h.options.WALArchiveTimeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, h.options.WALArchiveTimeout)
+		defer cancel()
+	}
+	if err := h.walManager.WaitForWALSegment(waitCtx, segment.FileName(), walPollInterval, instanceTags...); err != nil {
+		return nil, err
+	}
+
+	if err := basebackup.StoreLabel(ctx, h.client, snapshotID, result.Label); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,126 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud-native-pg-restic-backup/internal/basebackup"
+	"cloud-native-pg-restic-backup/internal/pgbackup"
+	"cloud-native-pg-restic-backup/internal/pgdata"
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+// storeManifest stores the manifest of a filesystem backup next to its
+// snapshot. The files are read back from the snapshot, as the data directory
+// changed while restic read it. A coordinated backup adds the backup label
+// pg_backup_stop returned, and ends where the server stopped it.
+func (h *handlerImpl) storeManifest(ctx context.Context, snapshotID, dataDir string, tablespaces []pgdata.Tablespace, stop *pgbackup.Result) error {
+	manifest := &pgdata.Manifest{Version: 1}
+	// The files describing the backup itself
+	kept := map[string][]byte{
+		pgdata.VersionFilePath: nil,
+		pgdata.ControlFilePath: nil,
+		pgdata.BackupLabelPath: nil,
+	}
+
+	err := restic.DumpTo(ctx, h.client, snapshotID, dataDir, func(r io.Reader) error {
+		return addTar(manifest, r, dataDir, "", kept)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read back data directory: %w", err)
+	}
+	for _, tablespace := range tablespaces {
+		prefix := path.Join(pgdata.TablespaceDir, tablespace.OID)
+		err := restic.DumpTo(ctx, h.client, snapshotID, tablespace.Location, func(r io.Reader) error {
+			return addTar(manifest, r, tablespace.Location, prefix, nil)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read back tablespace %s: %w", tablespace.OID, err)
+		}
+	}
+
+	endLSN := ""
+	if stop != nil {
+		if err := manifest.AddFile(pgdata.BackupLabelPath, time.Now(), bytes.NewReader(stop.Label)); err != nil {
+			return err
+		}
+		kept[pgdata.BackupLabelPath] = stop.Label
+		endLSN = stop.StopLSN
+	}
+
+	// PostgreSQL 17 writes version 2, recording the system identifier
+	major, _ := strconv.Atoi(strings.TrimSpace(string(kept[pgdata.VersionFilePath])))
+	control, controlErr := pgdata.ParseControlData(kept[pgdata.ControlFilePath])
+	if major >= 17 && controlErr == nil {
+		manifest.Version = 2
+		manifest.SystemIdentifier = control.SystemIdentifier
+	}
+
+	// Without coordination the backup ends at a location only the server
+	// knows, so the range ends where it starts
+	if label, err := pgdata.ParseBackupLabel(kept[pgdata.BackupLabelPath]); err == nil {
+		if endLSN == "" {
+			endLSN = label.StartWALLocation
+		}
+		timeline := label.StartTimeline
+		if timeline == 0 && controlErr == nil {
+			timeline = control.TimelineID
+		}
+		manifest.WALRanges = append(manifest.WALRanges, pgdata.WALRange{
+			Timeline: timeline,
+			StartLSN: label.StartWALLocation,
+			EndLSN:   endLSN,
+		})
+	}
+
+	return basebackup.StoreManifest(ctx, h.client, snapshotID, manifest.Marshal())
+}
+
+// addTar adds the regular files of a tar dump of root to the manifest below
+// prefix, keeping the contents of the files named in kept
+func addTar(manifest *pgdata.Manifest, r io.Reader, root, prefix string, kept map[string][]byte) error {
+	// restic names dumped entries by their path in the snapshot
+	root = strings.TrimPrefix(path.Clean("/"+root), "/")
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read dump: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if rel, ok := strings.CutPrefix(name, root+"/"); ok {
+			name = rel
+		}
+		name = path.Join(prefix, name)
+		if name == pgdata.ManifestPath {
+			continue
+		}
+
+		var content io.Reader = tr
+		var buf bytes.Buffer
+		if _, ok := kept[name]; ok {
+			content = io.TeeReader(tr, &buf)
+		}
+		if err := manifest.AddFile(name, header.ModTime, content); err != nil {
+			return err
+		}
+		if _, ok := kept[name]; ok {
+			kept[name] = buf.Bytes()
+		}
+	}
+}
@@ -0,0 +1,219 @@
+// Package basebackup streams base backups taken over a replication
+// connection with pg_basebackup, so they can be stored without access to the
+// data directory
+package basebackup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"cloud-native-pg-restic-backup/internal/pgconn"
+	"cloud-native-pg-restic-backup/internal/pgdata"
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+const (
+	// FileName is the name streamed base backups are stored under in their
+	// snapshot, the one pg_basebackup gives the main tar file
+	FileName = "base.tar"
+	// FormatTag marks snapshots holding a tar stream rather than a data
+	// directory
+	FormatTag = "format:tar"
+
+	// defaultCommand is run unless Config.Command is set
+	defaultCommand = "pg_basebackup"
+	// defaultCombineCommand is run unless Config.CombineCommand is set
+	defaultCombineCommand = "pg_combinebackup"
+	// defaultPsqlCommand is run unless Config.PsqlCommand is set
+	defaultPsqlCommand = "psql"
+)
+
+// identifyScript reports the system identifier and version of the server.
+// IDENTIFY_SYSTEM needs a replication connection, the one pg_basebackup is
+// allowed.
+const identifyScript = `IDENTIFY_SYSTEM \gset
+\echo :systemid :SERVER_VERSION_NUM
+`
+
+// checkpointModes are the checkpoint modes pg_basebackup accepts
+var checkpointModes = map[string]bool{"": true, "fast": true, "spread": true}
+
+// Config configures pg_basebackup
+type Config struct {
+	// Command is the pg_basebackup binary, found in PATH by default
+	Command string `json:"command,omitempty"`
+	// ConnInfo is the libpq connection string of the server. Its password
+	// is passed in PGPASSWORD, arguments are visible to other processes.
+	ConnInfo string `json:"connInfo,omitempty"`
+	// Checkpoint is fast or spread, the pg_basebackup default
+	Checkpoint string `json:"checkpoint,omitempty"`
+	// Incremental makes streamed backups incremental to the previous one
+	// unless the request chooses otherwise. It needs PostgreSQL 17 with
+	// summarize_wal enabled.
+	Incremental bool `json:"incremental,omitempty"`
+	// MaxIncrementals is the number of incremental backups chained to a full
+	// one before the next backup is full again, 0 means no limit
+	MaxIncrementals int `json:"maxIncrementals,omitempty"`
+	// CombineCommand is the pg_combinebackup binary restores of incremental
+	// backups run, found in PATH by default
+	CombineCommand string `json:"combineCommand,omitempty"`
+	// PsqlCommand is the psql binary identifying the server, found in PATH
+	// by default
+	PsqlCommand string `json:"psqlCommand,omitempty"`
+}
+
+// Enabled reports whether a server to stream backups from is configured
+func (c Config) Enabled() bool {
+	return c.ConnInfo != ""
+}
+
+// Validate checks the configuration
+func (c Config) Validate() error {
+	if !checkpointModes[c.Checkpoint] {
+		return fmt.Errorf("invalid checkpoint mode %q, must be fast or spread", c.Checkpoint)
+	}
+	if c.MaxIncrementals < 0 {
+		return fmt.Errorf("maxIncrementals must not be negative")
+	}
+	return nil
+}
+
+// args returns the pg_basebackup arguments writing a tar stream to stdout.
+// WAL is fetched into the tar as it can't be streamed alongside, so the
+// backup is consistent on its own. An incremental backup only holds the
+// blocks changed since the backup whose manifest is given.
+func (c Config) args(connInfo, label, manifest string) []string {
+	args := []string{"--pgdata=-", "--format=tar", "--wal-method=fetch", "--no-password"}
+	if connInfo != "" {
+		args = append(args, "--dbname="+connInfo)
+	}
+	if c.Checkpoint != "" {
+		args = append(args, "--checkpoint="+c.Checkpoint)
+	}
+	if label != "" {
+		args = append(args, "--label="+label)
+	}
+	if manifest != "" {
+		args = append(args, "--incremental="+manifest)
+	}
+	return args
+}
+
+// Stream runs pg_basebackup and writes the tar stream of the base backup to
+// w, incremental to the backup of manifest if not empty
+func Stream(ctx context.Context, cfg Config, label, manifest string, w io.Writer) error {
+	command := cfg.Command
+	if command == "" {
+		command = defaultCommand
+	}
+
+	connInfo, password := pgconn.SplitPassword(cfg.ConnInfo)
+	cmd := exec.CommandContext(ctx, command, cfg.args(connInfo, label, manifest)...)
+	cmd.Env = pgconn.Env(password)
+	var stderr bytes.Buffer
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_basebackup failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// InstanceTags returns the snapshot tags identifying the server backups are
+// streamed from, the ones filesystem backups read from the data directory
+func InstanceTags(ctx context.Context, cfg Config) ([]string, error) {
+	command := cfg.PsqlCommand
+	if command == "" {
+		command = defaultPsqlCommand
+	}
+
+	connInfo, password := pgconn.SplitPassword(cfg.ConnInfo)
+	args := []string{"--no-psqlrc", "--no-password", "--quiet", "--set=ON_ERROR_STOP=1",
+		"--dbname=" + replicationConnInfo(connInfo)}
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Env = pgconn.Env(password)
+	cmd.Stdin = strings.NewReader(identifyScript)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to identify the server: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	fields := strings.Fields(stdout.String())
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("unexpected server identification %q", stdout.String())
+	}
+	systemID, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid system identifier %q", fields[0])
+	}
+	version, err := strconv.Atoi(fields[1])
+	if err != nil || version <= 0 {
+		return nil, fmt.Errorf("invalid server version %q", fields[1])
+	}
+	return pgdata.FormatInstanceTags(systemID, majorVersion(version)), nil
+}
+
+// replicationConnInfo turns a connection string into one for a physical
+// replication connection, whatever the form it is written in
+func replicationConnInfo(connInfo string) string {
+	if strings.HasPrefix(connInfo, "postgresql://") || strings.HasPrefix(connInfo, "postgres://") {
+		if strings.Contains(connInfo, "?") {
+			return connInfo + "&replication=true"
+		}
+		return connInfo + "?replication=true"
+	}
+	return connInfo + " replication=true"
+}
+
+// majorVersion returns the major version of a server_version_num as
+// PG_VERSION holds it: 16 for 160004, 9.6 for 90624
+func majorVersion(versionNum int) string {
+	if versionNum >= 100000 {
+		return strconv.Itoa(versionNum / 10000)
+	}
+	return fmt.Sprintf("%d.%d", versionNum/10000, versionNum/100%100)
+}
+
+// RestoreSnapshot extracts the streamed base backup of a snapshot into dir,
+// piping it out of the repository. An incremental backup is combined with
+// the backups it depends on.
+func RestoreSnapshot(ctx context.Context, client restic.Client, cfg Config, snapshot *restic.Snapshot, dir string) error {
+	if ParentID(snapshot) == "" {
+		return extractSnapshot(ctx, client, snapshot, dir)
+	}
+	chain, err := Chain(ctx, client, snapshot)
+	if err != nil {
+		return err
+	}
+	return restoreChain(ctx, client, cfg, chain, dir)
+}
+
+// extractSnapshot extracts the tar stream of a single snapshot into dir
+func extractSnapshot(ctx context.Context, client restic.Client, snapshot *restic.Snapshot, dir string) error {
+	return restic.DumpTo(ctx, client, snapshot.ID, Path(snapshot), func(r io.Reader) error {
+		return Extract(r, dir)
+	})
+}
+
+// IsStreamed reports whether a snapshot holds a streamed base backup
+func IsStreamed(snapshot *restic.Snapshot) bool {
+	return snapshot != nil && slices.Contains(snapshot.Tags, FormatTag)
+}
+
+// Path returns the path of the tar stream in a streamed snapshot
+func Path(snapshot *restic.Snapshot) string {
+	if len(snapshot.Paths) > 0 {
+		return snapshot.Paths[0]
+	}
+	return "/" + FileName
+}
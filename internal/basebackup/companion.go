@@ -0,0 +1,156 @@
+package basebackup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+// Companion snapshots hold a single file describing a base backup, stored
+// next to it and deleted with it
+const (
+	// ManifestFileName is the name of the backup manifest, in the tar stream
+	// and in the snapshot it is stored in on its own
+	ManifestFileName = "backup_manifest"
+	// ManifestTypeTag marks the snapshots holding the manifest of a base
+	// backup, which verifications check restores against and incremental
+	// backups are taken against
+	ManifestTypeTag = "type:manifest"
+	// LabelFileName is the name of the backup label pg_backup_stop returns
+	LabelFileName = "backup_label"
+	// LabelTypeTag marks the snapshots holding the backup label of a
+	// coordinated filesystem backup, which the server needs to recover it
+	LabelTypeTag = "type:label"
+
+	backupTagPrefix = "backup:"
+)
+
+// CompanionTypeTags are the type tags of the snapshots stored next to base
+// backups
+var CompanionTypeTags = []string{ManifestTypeTag, LabelTypeTag}
+
+// companionTags returns the tags of a companion snapshot of a base backup
+func companionTags(typeTag, snapshotID string) []string {
+	return []string{typeTag, backupTagPrefix + snapshotID}
+}
+
+// ManifestTags returns the tags of the snapshot holding the manifest of a
+// base backup
+func ManifestTags(snapshotID string) []string {
+	return companionTags(ManifestTypeTag, snapshotID)
+}
+
+// LabelTags returns the tags of the snapshot holding the backup label of a
+// base backup
+func LabelTags(snapshotID string) []string {
+	return companionTags(LabelTypeTag, snapshotID)
+}
+
+// CompanionOf returns the base backup a companion snapshot belongs to
+func CompanionOf(snapshot *restic.Snapshot) string {
+	for _, tag := range snapshot.Tags {
+		if id, ok := strings.CutPrefix(tag, backupTagPrefix); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+// findCompanion returns the latest companion snapshot of a base backup, nil
+// if it has none
+func findCompanion(ctx context.Context, client restic.Client, typeTag, snapshotID string) (*restic.Snapshot, error) {
+	snapshots, err := client.FindSnapshots(ctx, companionTags(typeTag, snapshotID))
+	if err != nil {
+		return nil, err
+	}
+	var found *restic.Snapshot
+	for _, s := range snapshots {
+		if found == nil || s.Time.After(found.Time) {
+			found = s
+		}
+	}
+	return found, nil
+}
+
+// fetchCompanion writes the file stored in a companion snapshot to path
+func fetchCompanion(ctx context.Context, client restic.Client, companion *restic.Snapshot, fileName, path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = restic.DumpTo(ctx, client, companion.ID, "/"+fileName, func(r io.Reader) error {
+		_, err := io.Copy(file, r)
+		return err
+	})
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// FindManifest returns the snapshot holding the manifest of a base backup,
+// nil if it has none
+func FindManifest(ctx context.Context, client restic.Client, snapshotID string) (*restic.Snapshot, error) {
+	manifest, err := findCompanion(ctx, client, ManifestTypeTag, snapshotID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find backup manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// FetchManifest writes the manifest stored in a manifest snapshot to path
+func FetchManifest(ctx context.Context, client restic.Client, manifest *restic.Snapshot, path string) error {
+	if err := fetchCompanion(ctx, client, manifest, ManifestFileName, path); err != nil {
+		return fmt.Errorf("failed to fetch backup manifest: %w", err)
+	}
+	return nil
+}
+
+// RestoreManifest writes the stored manifest of a base backup to
+// backup_manifest in dataDir, reporting whether the backup has one
+func RestoreManifest(ctx context.Context, client restic.Client, snapshotID, dataDir string) (bool, error) {
+	manifest, err := FindManifest(ctx, client, snapshotID)
+	if err != nil || manifest == nil {
+		return false, err
+	}
+	return true, FetchManifest(ctx, client, manifest, filepath.Join(dataDir, ManifestFileName))
+}
+
+// StoreManifest stores the manifest of a base backup in a snapshot of its own
+func StoreManifest(ctx context.Context, client restic.Client, snapshotID string, manifest []byte) error {
+	if _, err := client.BackupStdin(ctx, ManifestFileName, ManifestTags(snapshotID), bytes.NewReader(manifest)); err != nil {
+		return fmt.Errorf("failed to store backup manifest: %w", err)
+	}
+	return nil
+}
+
+// StoreLabel stores the backup label of a base backup in a snapshot of its
+// own
+func StoreLabel(ctx context.Context, client restic.Client, snapshotID string, label []byte) error {
+	if _, err := client.BackupStdin(ctx, LabelFileName, LabelTags(snapshotID), bytes.NewReader(label)); err != nil {
+		return fmt.Errorf("failed to store backup label: %w", err)
+	}
+	return nil
+}
+
+// RestoreLabel writes the stored backup label of a base backup to
+// backup_label in dataDir, reporting whether the backup has one
+func RestoreLabel(ctx context.Context, client restic.Client, snapshotID, dataDir string) (bool, error) {
+	label, err := findCompanion(ctx, client, LabelTypeTag, snapshotID)
+	if err != nil {
+		return false, fmt.Errorf("failed to find backup label: %w", err)
+	}
+	if label == nil {
+		return false, nil
+	}
+	if err := fetchCompanion(ctx, client, label, LabelFileName, filepath.Join(dataDir, LabelFileName)); err != nil {
+		return true, fmt.Errorf("failed to fetch backup label: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,103 @@
+package basebackup
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Extract unpacks the tar stream of a base backup into dir, which is created
+// with mode 0700 as PostgreSQL requires. Entries leaving dir, or reusing or
+// passing through a symlink extracted before, are rejected.
+func Extract(r io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %w", dir, err)
+	}
+
+	symlinks := make(map[string]bool)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read backup: %w", err)
+		}
+
+		name, err := entryName(hdr.Name, symlinks)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		mode := hdr.FileInfo().Mode().Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0700); err != nil {
+				return fmt.Errorf("failed to create %s: %w", name, err)
+			}
+			if err := os.Chmod(path, mode|0700); err != nil {
+				return fmt.Errorf("failed to set permissions of %s: %w", name, err)
+			}
+		case tar.TypeReg:
+			if err := writeFile(path, tr, mode|0600); err != nil {
+				return fmt.Errorf("failed to extract %s: %w", name, err)
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				return fmt.Errorf("failed to create %s: %w", filepath.Dir(name), err)
+			}
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return fmt.Errorf("failed to extract %s: %w", name, err)
+			}
+			symlinks[name] = true
+		default:
+			return fmt.Errorf("unsupported entry %s of type %c", name, hdr.Typeflag)
+		}
+	}
+}
+
+// entryName returns the cleaned relative name of a tar entry, empty for the
+// root itself
+func entryName(name string, symlinks map[string]bool) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(name))
+	if cleaned == "." {
+		return "", nil
+	}
+	if filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid entry %q in backup", name)
+	}
+	for parent := cleaned; parent != "."; parent = filepath.Dir(parent) {
+		if symlinks[parent] {
+			return "", fmt.Errorf("entry %q in backup passes through a symlink", name)
+		}
+	}
+	return cleaned, nil
+}
+
+// writeFile writes the contents of a regular file, replacing an existing one
+func writeFile(path string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,105 @@
+package basebackup
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tarEntry is an entry of a test archive
+type tarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+}
+
+func writeTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0600, Linkname: e.linkname, Size: int64(len(e.body))}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0700
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExtract(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "pgdata")
+	archive := writeTar(t, []tarEntry{
+		{name: "PG_VERSION", typeflag: tar.TypeReg, body: "16\n"},
+		{name: "base/", typeflag: tar.TypeDir},
+		{name: "base/1/1259", typeflag: tar.TypeReg, body: "relation"},
+		{name: "pg_wal/", typeflag: tar.TypeDir},
+		{name: "pg_tblspc/16385", typeflag: tar.TypeSymlink, linkname: "/mnt/ts1"},
+	})
+
+	if err := Extract(archive, dir); err != nil {
+		t.Fatalf("Extract() error = %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "base", "1", "1259")); err != nil || string(data) != "relation" {
+		t.Errorf("base/1/1259 = %q, %v", data, err)
+	}
+	if link, err := os.Readlink(filepath.Join(dir, "pg_tblspc", "16385")); err != nil || link != "/mnt/ts1" {
+		t.Errorf("pg_tblspc/16385 -> %q, %v", link, err)
+	}
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("data directory mode = %v, %v, want 0700", info.Mode().Perm(), err)
+	}
+}
+
+func TestExtract_Rejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{
+			name:    "parent traversal",
+			entries: []tarEntry{{name: "../escape", typeflag: tar.TypeReg, body: "x"}},
+		},
+		{
+			name:    "absolute path",
+			entries: []tarEntry{{name: "/etc/passwd", typeflag: tar.TypeReg, body: "x"}},
+		},
+		{
+			name: "write through a symlink",
+			entries: []tarEntry{
+				{name: "pg_tblspc/16385", typeflag: tar.TypeSymlink, linkname: "/etc"},
+				{name: "pg_tblspc/16385/passwd", typeflag: tar.TypeReg, body: "x"},
+			},
+		},
+		{
+			name: "overwrite a symlink",
+			entries: []tarEntry{
+				{name: "PG_VERSION", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"},
+				{name: "PG_VERSION", typeflag: tar.TypeReg, body: "x"},
+			},
+		},
+		{
+			name:    "device",
+			entries: []tarEntry{{name: "null", typeflag: tar.TypeChar}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Extract(writeTar(t, tt.entries), t.TempDir()); err == nil {
+				t.Error("Extract() should fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package basebackup
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+const (
+	// IncrementalTag marks incremental base backups
+	IncrementalTag = "incremental"
+
+	parentTagPrefix = "parent:"
+)
+
+// ParentTag returns the tag linking an incremental backup to the snapshot it
+// was taken against
+func ParentTag(snapshotID string) string {
+	return parentTagPrefix + snapshotID
+}
+
+// ParentID returns the snapshot an incremental backup was taken against,
+// empty for a full backup
+func ParentID(snapshot *restic.Snapshot) string {
+	if snapshot == nil {
+		return ""
+	}
+	for _, tag := range snapshot.Tags {
+		if id, ok := strings.CutPrefix(tag, parentTagPrefix); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+// Chain returns the backups restoring snapshot needs, starting with the full
+// backup and ending with snapshot
+func Chain(ctx context.Context, client restic.Client, snapshot *restic.Snapshot) ([]*restic.Snapshot, error) {
+	snapshots, err := client.FindSnapshots(ctx, []string{FormatTag})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list streamed backups: %w", err)
+	}
+	// Parents are tagged with the ID they were taken with, which copies
+	// keep as original
+	byID := make(map[string]*restic.Snapshot, len(snapshots))
+	for _, s := range snapshots {
+		byID[s.SourceID()] = s
+	}
+
+	chain := []*restic.Snapshot{snapshot}
+	for parentID := ParentID(snapshot); parentID != ""; parentID = ParentID(chain[0]) {
+		parent, ok := byID[parentID]
+		if !ok {
+			return nil, fmt.Errorf("backup %s needs backup %s, which is missing", chain[0].ID, parentID)
+		}
+		if len(chain) > len(snapshots) {
+			return nil, fmt.Errorf("backup %s has a cyclic chain of parents", snapshot.ID)
+		}
+		chain = append([]*restic.Snapshot{parent}, chain...)
+	}
+	return chain, nil
+}
+
+// ManifestCapture keeps the backup manifest of a tar stream written to it
+type ManifestCapture struct {
+	pw       *io.PipeWriter
+	done     chan struct{}
+	manifest []byte
+	err      error
+}
+
+// NewManifestCapture starts scanning what is written to the capture
+func NewManifestCapture() *ManifestCapture {
+	pr, pw := io.Pipe()
+	c := &ManifestCapture{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		c.manifest, c.err = findManifest(pr)
+		// Writers must never block on a stream that stopped being parsed
+		_, _ = io.Copy(io.Discard, pr)
+	}()
+	return c
+}
+
+// findManifest reads the backup manifest out of a tar stream
+func findManifest(r io.Reader) ([]byte, error) {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("tar stream holds no %s", ManifestFileName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar stream: %w", err)
+		}
+		if strings.TrimPrefix(header.Name, "./") == ManifestFileName {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// Write passes p to the scan
+func (c *ManifestCapture) Write(p []byte) (int, error) {
+	return c.pw.Write(p)
+}
+
+// Manifest ends the scan and returns the manifest found in the stream
+func (c *ManifestCapture) Manifest() ([]byte, error) {
+	c.pw.Close()
+	<-c.done
+	return c.manifest, c.err
+}
+
+// restoreChain extracts each backup of a chain into a staging directory next
+// to dir and has pg_combinebackup reconstruct the last one into dir
+func restoreChain(ctx context.Context, client restic.Client, cfg Config, chain []*restic.Snapshot, dir string) error {
+	dir = filepath.Clean(dir)
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return fmt.Errorf("failed to create parent of %s: %w", dir, err)
+	}
+	staging, err := os.MkdirTemp(filepath.Dir(dir), ".combine-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	inputs := make([]string, 0, len(chain))
+	for i, snapshot := range chain {
+		input := filepath.Join(staging, fmt.Sprintf("%d", i))
+		if err := extractSnapshot(ctx, client, snapshot, input); err != nil {
+			return fmt.Errorf("failed to extract backup %s: %w", snapshot.ID, err)
+		}
+		inputs = append(inputs, input)
+	}
+	return combine(ctx, cfg, inputs, dir)
+}
+
+// combine runs pg_combinebackup on backup directories, oldest first
+func combine(ctx context.Context, cfg Config, inputs []string, output string) error {
+	command := cfg.CombineCommand
+	if command == "" {
+		command = defaultCombineCommand
+	}
+
+	cmd := exec.CommandContext(ctx, command, append([]string{"--output=" + output}, inputs...)...)
+	cmd.Env = []string{}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_combinebackup failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
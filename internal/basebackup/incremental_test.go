@@ -0,0 +1,146 @@
+package basebackup
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+// mockResticClient serves snapshots and the tar streams stored in them
+type mockResticClient struct {
+	restic.Client
+	snapshots []*restic.Snapshot
+	contents  map[string][]byte
+}
+
+func (m *mockResticClient) FindSnapshots(_ context.Context, tags []string) ([]*restic.Snapshot, error) {
+	var found []*restic.Snapshot
+	for _, s := range m.snapshots {
+		if !slices.ContainsFunc(tags, func(tag string) bool { return !slices.Contains(s.Tags, tag) }) {
+			found = append(found, s)
+		}
+	}
+	return found, nil
+}
+
+func (m *mockResticClient) Dump(_ context.Context, snapshotID, _ string, w io.Writer) error {
+	_, err := w.Write(m.contents[snapshotID])
+	return err
+}
+
+func streamed(id, parent string) *restic.Snapshot {
+	tags := []string{"type:full", FormatTag}
+	if parent != "" {
+		tags = append(tags, IncrementalTag, ParentTag(parent))
+	}
+	return &restic.Snapshot{ID: id, Tags: tags, Paths: []string{"/" + FileName}}
+}
+
+func TestChain(t *testing.T) {
+	client := &mockResticClient{snapshots: []*restic.Snapshot{
+		streamed("full", ""),
+		streamed("inc-1", "full"),
+		streamed("inc-2", "inc-1"),
+		streamed("orphan", "deleted"),
+	}}
+
+	chain, err := Chain(context.Background(), client, client.snapshots[2])
+	if err != nil {
+		t.Fatalf("Chain() error = %v", err)
+	}
+	var ids []string
+	for _, s := range chain {
+		ids = append(ids, s.ID)
+	}
+	if strings.Join(ids, ",") != "full,inc-1,inc-2" {
+		t.Errorf("Chain() = %v, want full,inc-1,inc-2", ids)
+	}
+
+	if _, err := Chain(context.Background(), client, client.snapshots[3]); err == nil {
+		t.Error("Chain() with a missing parent should fail")
+	}
+}
+
+func TestManifestCapture(t *testing.T) {
+	archive := writeTar(t, []tarEntry{
+		{name: "PG_VERSION", typeflag: tar.TypeReg, body: "17\n"},
+		{name: "backup_manifest", typeflag: tar.TypeReg, body: `{"PostgreSQL-Backup-Manifest-Version": 2}`},
+	}).Bytes()
+
+	capture := NewManifestCapture()
+	for len(archive) > 0 {
+		n := min(len(archive), 100)
+		if _, err := capture.Write(archive[:n]); err != nil {
+			t.Fatal(err)
+		}
+		archive = archive[n:]
+	}
+	manifest, err := capture.Manifest()
+	if err != nil || string(manifest) != `{"PostgreSQL-Backup-Manifest-Version": 2}` {
+		t.Errorf("Manifest() = %q, %v", manifest, err)
+	}
+
+	// A stream that isn't a tar is still consumed
+	capture = NewManifestCapture()
+	if _, err := capture.Write([]byte(strings.Repeat("not a tar", 1000))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := capture.Manifest(); err == nil {
+		t.Error("Manifest() of a stream without manifest should fail")
+	}
+}
+
+func TestRestoreSnapshot_Incremental(t *testing.T) {
+	// pg_combinebackup is stood in for by copying the backups over each
+	// other, oldest first
+	dir := t.TempDir()
+	command := filepath.Join(dir, "pg_combinebackup")
+	script := "#!/bin/sh\necho \"$@\" > " + dir + "/args\nout=${1#--output=}\nshift\nmkdir -p \"$out\"\nfor input; do cp -R \"$input\"/. \"$out\"; done\n"
+	if err := os.WriteFile(command, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &mockResticClient{
+		snapshots: []*restic.Snapshot{streamed("full", ""), streamed("inc", "full")},
+		contents: map[string][]byte{
+			"full": writeTar(t, []tarEntry{
+				{name: "PG_VERSION", typeflag: tar.TypeReg, body: "17\n"},
+				{name: "base/1/1259", typeflag: tar.TypeReg, body: "full"},
+			}).Bytes(),
+			"inc": writeTar(t, []tarEntry{
+				{name: "base/1/INCREMENTAL.1259", typeflag: tar.TypeReg, body: "changed"},
+			}).Bytes(),
+		},
+	}
+
+	target := filepath.Join(t.TempDir(), "pgdata")
+	cfg := Config{CombineCommand: command}
+	if err := RestoreSnapshot(context.Background(), client, cfg, client.snapshots[1], target); err != nil {
+		t.Fatalf("RestoreSnapshot() error = %v", err)
+	}
+	for name, want := range map[string]string{"base/1/1259": "full", "base/1/INCREMENTAL.1259": "changed"} {
+		if data, err := os.ReadFile(filepath.Join(target, name)); err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+	args, _ := os.ReadFile(filepath.Join(dir, "args"))
+	if fields := strings.Fields(string(args)); len(fields) != 3 || fields[0] != "--output="+target {
+		t.Errorf("pg_combinebackup args = %q", args)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(target)); len(entries) != 1 {
+		t.Errorf("staging directory left behind: %v", entries)
+	}
+
+	// A chain with a missing backup can't be combined
+	client.snapshots = client.snapshots[1:]
+	if err := RestoreSnapshot(context.Background(), client, cfg, client.snapshots[0], filepath.Join(t.TempDir(), "pgdata")); err == nil {
+		t.Error("RestoreSnapshot() of a broken chain should fail")
+	}
+}
@@ -0,0 +1,420 @@
+// Package config loads the plugin configuration from a YAML or JSON file,
+// environment variables and command-line flags, in increasing precedence.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"cloud-native-pg-restic-backup/internal/auth"
+	"cloud-native-pg-restic-backup/internal/backup"
+	"cloud-native-pg-restic-backup/internal/basebackup"
+	"cloud-native-pg-restic-backup/internal/health"
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/logical"
+	"cloud-native-pg-restic-backup/internal/pgbackup"
+	"cloud-native-pg-restic-backup/internal/pgdata"
+	"cloud-native-pg-restic-backup/internal/restic"
+	"cloud-native-pg-restic-backup/internal/retention"
+	"cloud-native-pg-restic-backup/internal/tlsconfig"
+	"cloud-native-pg-restic-backup/internal/tracing"
+)
+
+// Duration is a time.Duration written as a Go duration string such as "5m"
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations must be strings such as \"30s\" or \"5m\"")
+	}
+	return d.Set(s)
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Set parses a duration string, implementing flag.Value
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// List is a list of strings, comma-separated in flags and environment
+// variables
+type List []string
+
+// Set parses a comma-separated list, implementing flag.Value
+func (l *List) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+func (l List) String() string {
+	return strings.Join(l, ",")
+}
+
+// TLSConfig configures HTTPS serving
+type TLSConfig struct {
+	CertFile       string   `json:"certFile,omitempty"`
+	KeyFile        string   `json:"keyFile,omitempty"`
+	ClientCAFile   string   `json:"clientCAFile,omitempty"`
+	MinVersion     string   `json:"minVersion,omitempty"`
+	ReloadInterval Duration `json:"reloadInterval,omitempty"`
+}
+
+// TenantsConfig configures the per-cluster repositories
+type TenantsConfig struct {
+	ConfigFile string `json:"configFile,omitempty"`
+	SecretsDir string `json:"secretsDir,omitempty"`
+	// RequireKnown rejects clusters the tenants file and secrets directory
+	// don't configure instead of serving them from the default repository
+	RequireKnown bool `json:"requireKnown,omitempty"`
+	// Max limits the tenants initialized, zero means no limit
+	Max int `json:"max,omitempty"`
+}
+
+// PathsConfig configures the roots request paths are confined to
+type PathsConfig struct {
+	PGDataRoots  List `json:"pgdataRoots,omitempty"`
+	WALRoots     List `json:"walRoots,omitempty"`
+	RestoreRoots List `json:"restoreRoots,omitempty"`
+	// TablespaceRoots default to the data directory roots
+	TablespaceRoots List `json:"tablespaceRoots,omitempty"`
+}
+
+// BackupConfig configures base backups
+type BackupConfig struct {
+	// Exclude are restic patterns skipped besides the built-in PostgreSQL
+	// exclusions
+	Exclude List `json:"exclude,omitempty"`
+	// Mode is the default base backup mode, filesystem or stream
+	Mode string `json:"mode,omitempty"`
+	// Stream configures pg_basebackup for the stream mode
+	Stream basebackup.Config `json:"stream"`
+	// Manifest stores a backup_manifest of each filesystem backup
+	Manifest bool `json:"manifest"`
+	// Coordinate runs filesystem backups between pg_backup_start and
+	// pg_backup_stop on the instance owning the data directory, primary or
+	// standby
+	Coordinate pgbackup.Config `json:"coordinate"`
+	// WALArchiveTimeout bounds the wait for the WAL a coordinated backup
+	// ends in to be archived
+	WALArchiveTimeout Duration `json:"walArchiveTimeout,omitempty"`
+	// Instance names the instance backups are taken on, the hostname by
+	// default
+	Instance string `json:"instance,omitempty"`
+	// Upload tunes how filesystem backups write to the repository
+	Upload restic.UploadOptions `json:"upload"`
+}
+
+// ReplicationConfig schedules replication to secondary repositories
+type ReplicationConfig struct {
+	Interval    Duration `json:"interval,omitempty"`
+	AfterBackup bool     `json:"afterBackup,omitempty"`
+}
+
+// CheckConfig schedules repository integrity checks
+type CheckConfig struct {
+	Interval Duration `json:"interval,omitempty"`
+	Mode     string   `json:"mode,omitempty"`
+	Subset   string   `json:"subset,omitempty"`
+}
+
+// RetentionConfig schedules deleting old base backups and WAL segments
+type RetentionConfig struct {
+	Interval   Duration `json:"interval,omitempty"`
+	KeepLast   int      `json:"keepLast,omitempty"`
+	KeepWithin Duration `json:"keepWithin,omitempty"`
+}
+
+// Policy returns the retention policy
+func (c RetentionConfig) Policy() retention.Policy {
+	return retention.Policy{KeepLast: c.KeepLast, KeepWithin: time.Duration(c.KeepWithin)}
+}
+
+// MetricsConfig configures the exported metrics
+type MetricsConfig struct {
+	SnapshotInterval Duration `json:"snapshotInterval,omitempty"`
+}
+
+// HealthConfig configures the readiness probe
+type HealthConfig struct {
+	ProbeCacheTTL Duration `json:"probeCacheTTL,omitempty"`
+	StaleLockAge  Duration `json:"staleLockAge,omitempty"`
+	MaxWALAge     Duration `json:"maxWALAge,omitempty"`
+}
+
+// ConcurrencyConfig limits concurrent work
+type ConcurrencyConfig struct {
+	WALOperations int `json:"walOperations,omitempty"`
+}
+
+// TimeoutsConfig bounds the duration of requests and shutdown
+type TimeoutsConfig struct {
+	ReadHeader   Duration `json:"readHeader,omitempty"`
+	Shutdown     Duration `json:"shutdown,omitempty"`
+	WALOperation Duration `json:"walOperation,omitempty"`
+}
+
+// AuthConfig configures the principals allowed to call the API
+type AuthConfig struct {
+	// ConfigFile is a JSON file of principals, added to Principals
+	ConfigFile string                 `json:"configFile,omitempty"`
+	Principals []auth.PrincipalConfig `json:"principals,omitempty"`
+}
+
+// Enabled reports whether authentication is configured
+func (c AuthConfig) Enabled() bool {
+	return c.ConfigFile != "" || len(c.Principals) > 0
+}
+
+// AuditConfig configures the audit log
+type AuditConfig struct {
+	LogFile string `json:"logFile,omitempty"`
+}
+
+// TracingConfig configures span export
+type TracingConfig struct {
+	Exporter string `json:"exporter,omitempty"`
+}
+
+// VerifyConfig configures restore verification
+type VerifyConfig struct {
+	ScratchDir string `json:"scratchDir,omitempty"`
+}
+
+// LogicalConfig configures logical backups with the PostgreSQL client tools
+type LogicalConfig struct {
+	// ConnInfo is the libpq connection string, logical backups are disabled
+	// without one
+	ConnInfo  string `json:"connInfo,omitempty"`
+	Databases List   `json:"databases,omitempty"`
+
+	PGDumpCommand    string `json:"pgDumpCommand,omitempty"`
+	PGDumpAllCommand string `json:"pgDumpAllCommand,omitempty"`
+	PGRestoreCommand string `json:"pgRestoreCommand,omitempty"`
+	PsqlCommand      string `json:"psqlCommand,omitempty"`
+}
+
+// Options returns the logical backup configuration
+func (c LogicalConfig) Options() logical.Config {
+	return logical.Config{
+		ConnInfo:         c.ConnInfo,
+		Databases:        c.Databases,
+		PGDumpCommand:    c.PGDumpCommand,
+		PGDumpAllCommand: c.PGDumpAllCommand,
+		PGRestoreCommand: c.PGRestoreCommand,
+		PsqlCommand:      c.PsqlCommand,
+	}
+}
+
+// Config is the plugin configuration
+type Config struct {
+	Listen  string         `json:"listen,omitempty"`
+	TLS     TLSConfig      `json:"tls"`
+	Logging logging.Config `json:"logging"`
+	// Repository is the default repository, optional when tenants are
+	// configured
+	Repository  restic.Config     `json:"repository"`
+	Secondaries []restic.Config   `json:"secondaries,omitempty"`
+	Tenants     TenantsConfig     `json:"tenants"`
+	Paths       PathsConfig       `json:"paths"`
+	Backup      BackupConfig      `json:"backup"`
+	Replication ReplicationConfig `json:"replication"`
+	Check       CheckConfig       `json:"check"`
+	Retention   RetentionConfig   `json:"retention"`
+	Metrics     MetricsConfig     `json:"metrics"`
+	Health      HealthConfig      `json:"health"`
+	Concurrency ConcurrencyConfig `json:"concurrency"`
+	Timeouts    TimeoutsConfig    `json:"timeouts"`
+	Auth        AuthConfig        `json:"auth"`
+	Audit       AuditConfig       `json:"audit"`
+	Tracing     TracingConfig     `json:"tracing"`
+	Verify      VerifyConfig      `json:"verify"`
+	Logical     LogicalConfig     `json:"logical"`
+	// Restore tunes how restores read filesystem backups
+	Restore restic.RestoreOptions `json:"restore"`
+
+	// File is the configuration file the configuration was read from
+	File string `json:"-"`
+}
+
+// Default returns the configuration used for unset values
+func Default() *Config {
+	return &Config{
+		Listen:  ":8080",
+		Logging: logging.Config{Level: "info"},
+		TLS: TLSConfig{
+			MinVersion:     "1.2",
+			ReloadInterval: Duration(tlsconfig.DefaultReloadInterval),
+		},
+		Backup:  BackupConfig{Manifest: true, WALArchiveTimeout: Duration(10 * time.Minute)},
+		Check:   CheckConfig{Mode: string(restic.CheckStructure)},
+		Metrics: MetricsConfig{SnapshotInterval: Duration(5 * time.Minute)},
+		Health: HealthConfig{
+			ProbeCacheTTL: Duration(health.DefaultCacheTTL),
+			StaleLockAge:  Duration(health.DefaultStaleLockAge),
+		},
+		Timeouts: TimeoutsConfig{
+			ReadHeader: Duration(10 * time.Second),
+			Shutdown:   Duration(30 * time.Second),
+		},
+		Tracing: TracingConfig{Exporter: tracing.ExporterNone},
+	}
+}
+
+// MultiTenant reports whether tenants are configured besides the default
+// repository
+func (c *Config) MultiTenant() bool {
+	return c.Tenants.ConfigFile != "" || c.Tenants.SecretsDir != ""
+}
+
+// Validate checks the configuration, reporting every problem found
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Listen == "" {
+		fail("listen: address is required")
+	}
+	if _, err := zerolog.ParseLevel(c.Logging.Level); err != nil || c.Logging.Level == "" {
+		fail("logging.level: unknown level %q", c.Logging.Level)
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		fail("tls: certFile and keyFile must be set together")
+	}
+	if c.TLS.ClientCAFile != "" && c.TLS.CertFile == "" {
+		fail("tls.clientCAFile: requires certFile and keyFile")
+	}
+	if _, err := tlsconfig.ParseMinVersion(c.TLS.MinVersion); err != nil {
+		fail("tls.minVersion: %v", err)
+	}
+
+	if c.Repository.Repository == "" && !c.MultiTenant() {
+		fail("repository.repository: required unless tenants are configured (RESTIC_REPOSITORY)")
+	}
+	if c.Repository.Repository != "" && !c.Repository.HasPassword() {
+		fail("repository.password: required (RESTIC_PASSWORD, RESTIC_PASSWORD_FILE or RESTIC_PASSWORD_COMMAND)")
+	}
+	if err := c.Repository.Validate(); err != nil {
+		fail("repository: %v", err)
+	}
+	if !restic.ValidCompression(c.Repository.Compression) {
+		fail("repository.compression: unknown mode %q, use auto, off or max", c.Repository.Compression)
+	}
+	for i, secondary := range c.Secondaries {
+		if secondary.Repository == "" || !secondary.HasPassword() {
+			fail("secondaries[%d]: repository and password are required", i)
+		}
+		if err := secondary.Validate(); err != nil {
+			fail("secondaries[%d]: %v", i, err)
+		}
+		if !restic.ValidCompression(secondary.Compression) {
+			fail("secondaries[%d].compression: unknown mode %q", i, secondary.Compression)
+		}
+	}
+
+	if err := pgdata.ValidateExcludePatterns(c.Backup.Exclude); err != nil {
+		fail("backup.exclude: %v", err)
+	}
+	if !backup.ValidMode(c.Backup.Mode) {
+		fail("backup.mode: unknown mode %q, use filesystem or stream", c.Backup.Mode)
+	}
+	if c.Backup.Mode == backup.ModeStream && !c.Backup.Stream.Enabled() {
+		fail("backup.stream.connInfo: required by the stream mode")
+	}
+	if err := c.Backup.Stream.Validate(); err != nil {
+		fail("backup.stream: %v", err)
+	}
+	if err := c.Backup.Coordinate.Validate(); err != nil {
+		fail("backup.coordinate: %v", err)
+	}
+	if err := c.Backup.Upload.Validate(); err != nil {
+		fail("backup.upload: %v", err)
+	}
+	if err := c.Restore.Validate(); err != nil {
+		fail("restore: %v", err)
+	}
+	if err := c.Logical.Options().Validate(); err != nil {
+		fail("logical: %v", err)
+	}
+
+	checkOptions := restic.CheckOptions{Mode: restic.CheckMode(c.Check.Mode), Subset: c.Check.Subset}
+	if err := checkOptions.Validate(); err != nil {
+		fail("check: %v", err)
+	}
+
+	if err := c.Retention.Policy().Validate(); err != nil {
+		fail("retention: %v", err)
+	}
+	if c.Retention.Interval > 0 && !c.Retention.Policy().Enabled() {
+		fail("retention.interval: requires keepLast or keepWithin")
+	}
+
+	if c.Tenants.Max < 0 {
+		fail("tenants.max: must not be negative")
+	}
+	if c.Concurrency.WALOperations < 0 {
+		fail("concurrency.walOperations: must not be negative")
+	}
+
+	durations := []struct {
+		name  string
+		value Duration
+	}{
+		{"tls.reloadInterval", c.TLS.ReloadInterval},
+		{"replication.interval", c.Replication.Interval},
+		{"check.interval", c.Check.Interval},
+		{"retention.interval", c.Retention.Interval},
+		{"metrics.snapshotInterval", c.Metrics.SnapshotInterval},
+		{"health.probeCacheTTL", c.Health.ProbeCacheTTL},
+		{"health.staleLockAge", c.Health.StaleLockAge},
+		{"health.maxWALAge", c.Health.MaxWALAge},
+		{"timeouts.readHeader", c.Timeouts.ReadHeader},
+		{"timeouts.shutdown", c.Timeouts.Shutdown},
+		{"timeouts.walOperation", c.Timeouts.WALOperation},
+		{"backup.walArchiveTimeout", c.Backup.WALArchiveTimeout},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			fail("%s: must not be negative", d.name)
+		}
+	}
+
+	if _, err := auth.New(auth.Config{Principals: c.Auth.Principals}); err != nil {
+		fail("auth.principals: %v", err)
+	}
+
+	switch c.Tracing.Exporter {
+	case "", tracing.ExporterNone, tracing.ExporterOTLP, tracing.ExporterStdout:
+	default:
+		fail("tracing.exporter: unknown exporter %q", c.Tracing.Exporter)
+	}
+
+	return errors.Join(errs...)
+}
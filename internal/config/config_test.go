@@ -0,0 +1,267 @@
+package config
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+// env returns a lookup function over a fixed environment
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := vars[key]
+		return v, ok
+	}
+}
+
+func load(t *testing.T, args []string, vars map[string]string) (*Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return Load(fs, args, env(vars))
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	file := writeFile(t, "config.yaml", `
+listen: ":9000"
+logging:
+  level: debug
+repository:
+  repository: s3:https://s3.example.com/file
+  password: from-file
+  compression: max
+check:
+  interval: 24h
+  mode: read-data-subset
+  subset: 10%
+retention:
+  keepLast: 7
+paths:
+  pgdataRoots: [/var/lib/postgresql/data]
+`)
+
+	cfg, err := load(t,
+		[]string{"--config", file, "--log-level", "warn", "--retention-keep-last", "3"},
+		map[string]string{
+			"RESTIC_PASSWORD":         "from-env",
+			"CNPG_RESTIC_LOG_LEVEL":   "error",
+			"CNPG_RESTIC_CHECK_MODE":  "",
+			"CNPG_RESTIC_WAL_ROOTS":   "/wal, /var/lib/postgresql/wal",
+			"CNPG_RESTIC_MAX_WAL_AGE": "15m",
+		})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"file over default", cfg.Listen, ":9000"},
+		{"file", cfg.Repository.Repository, "s3:https://s3.example.com/file"},
+		{"env over file", cfg.Repository.Password, "from-env"},
+		{"flag over env and file", cfg.Logging.Level, "warn"},
+		{"flag over file", cfg.Retention.KeepLast, 3},
+		{"empty env ignored", cfg.Check.Mode, "read-data-subset"},
+		{"env list", cfg.Paths.WALRoots.String(), "/wal,/var/lib/postgresql/wal"},
+		{"env duration", time.Duration(cfg.Health.MaxWALAge), 15 * time.Minute},
+		{"file duration", time.Duration(cfg.Check.Interval), 24 * time.Hour},
+		{"default kept", time.Duration(cfg.Health.StaleLockAge), 30 * time.Minute},
+		{"config file recorded", cfg.File, file},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
+
+func TestLoad_JSONFileFromEnv(t *testing.T) {
+	file := writeFile(t, "config.json", `{
+		"repository": {"repository": "/repo", "password": "secret"},
+		"secondaries": [{"repository": "/secondary", "password": "secret"}],
+		"auth": {"principals": [{"name": "operator", "token": "t", "operations": ["*"]}]}
+	}`)
+
+	cfg, err := load(t, nil, map[string]string{configEnv: file})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Repository.Repository != "/repo" || len(cfg.Secondaries) != 1 || !cfg.Auth.Enabled() {
+		t.Errorf("Load() = %+v", cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+
+	// The legacy variables replace the secondaries of the file
+	cfg, err = load(t, nil, map[string]string{
+		configEnv:                     file,
+		"RESTIC_SECONDARY_REPOSITORY": "/from-env",
+		"RESTIC_SECONDARY_PASSWORD":   "secret",
+	})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(cfg.Secondaries) != 1 || cfg.Secondaries[0].Repository != "/from-env" {
+		t.Errorf("Secondaries = %+v", cfg.Secondaries)
+	}
+}
+
+func TestLoad_PasswordSources(t *testing.T) {
+	cfg, err := load(t, []string{"--password-command", "/bin/vault-password"}, map[string]string{
+		"RESTIC_REPOSITORY":  "/repo",
+		"S3_ACCESS_KEY_FILE": "/secrets/AWS_ACCESS_KEY_ID",
+	})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Repository.PasswordCommand != "/bin/vault-password" || cfg.Repository.S3AccessKeyFile != "/secrets/AWS_ACCESS_KEY_ID" {
+		t.Errorf("Repository = %+v", cfg.Repository)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+
+	cfg, err = load(t, nil, map[string]string{
+		"RESTIC_REPOSITORY":    "/repo",
+		"RESTIC_PASSWORD":      "secret",
+		"RESTIC_PASSWORD_FILE": "/secrets/RESTIC_PASSWORD",
+	})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "mutually exclusive") {
+		t.Errorf("Validate() error = %v, want mutually exclusive sources", err)
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		args    []string
+		vars    map[string]string
+		wantErr string
+	}{
+		{
+			name:    "unknown field",
+			file:    "repository:\n  repo: /repo\n",
+			wantErr: `unknown field "repo"`,
+		},
+		{
+			name:    "numeric duration",
+			file:    "check:\n  interval: 3600\n",
+			wantErr: "durations must be strings",
+		},
+		{
+			name:    "invalid YAML",
+			file:    "listen: [\n",
+			wantErr: "failed to parse config file",
+		},
+		{
+			name:    "invalid env value",
+			vars:    map[string]string{"CNPG_RESTIC_LOG_JSON": "maybe"},
+			wantErr: "CNPG_RESTIC_LOG_JSON",
+		},
+		{
+			name:    "invalid flag value",
+			args:    []string{"--check-interval", "daily"},
+			wantErr: "check-interval",
+		},
+		{
+			name:    "missing file",
+			args:    []string{"--config", "/nonexistent/config.yaml"},
+			wantErr: "failed to read config file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"--config", writeFile(t, "config.yaml", tt.file)}, args...)
+			}
+			_, err := load(t, args, tt.vars)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	cfg := Default()
+	cfg.Logging.Level = "loud"
+	cfg.TLS.CertFile = "/tls/tls.crt"
+	cfg.Repository.Repository = "/repo"
+	cfg.Repository.Compression = "zstd"
+	cfg.Secondaries = []restic.Config{
+		{Repository: "/secondary", PasswordFile: "/p", PasswordCommand: "/bin/p"},
+		{Repository: "azure:container:/", Password: "p"},
+	}
+	cfg.Check.Mode = "read-data-subset"
+	cfg.Retention.Interval = Duration(time.Hour)
+	cfg.Concurrency.WALOperations = -1
+	cfg.Tenants.Max = -1
+	cfg.Timeouts.Shutdown = Duration(-time.Second)
+	cfg.Tracing.Exporter = "jaeger"
+	cfg.Backup.Mode = "stream"
+	cfg.Backup.Stream.Checkpoint = "immediate"
+	cfg.Backup.Coordinate.Checkpoint = "immediate"
+	cfg.Backup.WALArchiveTimeout = Duration(-time.Minute)
+	cfg.Backup.Upload.PackSize = 256
+	cfg.Restore.Connections = -1
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Validate() expected errors")
+	}
+	for _, want := range []string{
+		"logging.level",
+		"tls: certFile and keyFile",
+		"repository.password",
+		"repository.compression",
+		"secondaries[0]: password, passwordFile and passwordCommand",
+		"secondaries[1]: azure backend",
+		"check:",
+		"retention.interval",
+		"concurrency.walOperations",
+		"tenants.max",
+		"timeouts.shutdown",
+		"tracing.exporter",
+		"backup.stream.connInfo",
+		"backup.stream: invalid checkpoint",
+		"backup.coordinate: invalid checkpoint",
+		"backup.walArchiveTimeout",
+		"backup.upload: packSize",
+		"restore: connections",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() error does not report %q:\n%v", want, err)
+		}
+	}
+
+	if err := Default().Validate(); err == nil || !strings.Contains(err.Error(), "repository.repository") {
+		t.Errorf("Validate() of default = %v, want missing repository", err)
+	}
+}
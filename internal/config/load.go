@@ -0,0 +1,306 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+// envPrefix prefixes the environment variables of flags
+const envPrefix = "CNPG_RESTIC_"
+
+// configEnv names the configuration file, like the --config flag
+const configEnv = envPrefix + "CONFIG"
+
+// setting maps a configuration value to its flag and environment variable
+type setting struct {
+	// flag is empty for values only read from the environment, such as
+	// credentials
+	flag string
+	// env defaults to CNPG_RESTIC_<FLAG>
+	env   string
+	usage string
+	// value returns a *string, *bool, *int, *Duration or *List into the
+	// configuration
+	value func(*Config) interface{}
+}
+
+// envName returns the environment variable of the setting
+func (s setting) envName() string {
+	if s.env != "" {
+		return s.env
+	}
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(s.flag, "-", "_"))
+}
+
+var settings = []setting{
+	{flag: "listen", usage: "HTTP server listen address", value: func(c *Config) interface{} { return &c.Listen }},
+	{flag: "tls-cert-file", usage: "TLS certificate file, serves HTTPS when set with --tls-key-file", value: func(c *Config) interface{} { return &c.TLS.CertFile }},
+	{flag: "tls-key-file", usage: "TLS private key file", value: func(c *Config) interface{} { return &c.TLS.KeyFile }},
+	{flag: "tls-client-ca-file", usage: "CA bundle client certificates are verified against (empty disables mutual TLS)", value: func(c *Config) interface{} { return &c.TLS.ClientCAFile }},
+	{flag: "tls-min-version", usage: "Minimum TLS version (1.2, 1.3)", value: func(c *Config) interface{} { return &c.TLS.MinVersion }},
+	{flag: "tls-reload-interval", usage: "Interval between checks of the TLS files for rotated certificates", value: func(c *Config) interface{} { return &c.TLS.ReloadInterval }},
+	{flag: "log-level", usage: "Log level (debug, info, warn, error)", value: func(c *Config) interface{} { return &c.Logging.Level }},
+	{flag: "log-json", usage: "Output logs in JSON format", value: func(c *Config) interface{} { return &c.Logging.JSONOutput }},
+
+	{env: "RESTIC_REPOSITORY", value: func(c *Config) interface{} { return &c.Repository.Repository }},
+	{env: "RESTIC_PASSWORD", value: func(c *Config) interface{} { return &c.Repository.Password }},
+	{env: "S3_ENDPOINT", value: func(c *Config) interface{} { return &c.Repository.S3Endpoint }},
+	{env: "S3_ACCESS_KEY", value: func(c *Config) interface{} { return &c.Repository.S3AccessKey }},
+	{env: "S3_SECRET_KEY", value: func(c *Config) interface{} { return &c.Repository.S3SecretKey }},
+	{env: "S3_ACCESS_KEY_FILE", value: func(c *Config) interface{} { return &c.Repository.S3AccessKeyFile }},
+	{env: "S3_SECRET_KEY_FILE", value: func(c *Config) interface{} { return &c.Repository.S3SecretKeyFile }},
+	{env: "S3_SESSION_TOKEN", value: func(c *Config) interface{} { return &c.Repository.S3SessionToken }},
+	{env: "S3_SESSION_TOKEN_FILE", value: func(c *Config) interface{} { return &c.Repository.S3SessionTokenFile }},
+	{flag: "s3-region", env: "S3_REGION", usage: "Region of the default S3 repository", value: func(c *Config) interface{} { return &c.Repository.S3Region }},
+	{flag: "s3-path-style", env: "S3_PATH_STYLE", usage: "Address the buckets of the default S3 repository by path, as self-hosted servers such as MinIO require", value: func(c *Config) interface{} { return &c.Repository.S3PathStyle }},
+	{env: "AZURE_ACCOUNT_NAME", value: func(c *Config) interface{} { return &c.Repository.AzureAccountName }},
+	{env: "AZURE_ACCOUNT_KEY", value: func(c *Config) interface{} { return &c.Repository.AzureAccountKey }},
+	{env: "AZURE_ACCOUNT_KEY_FILE", value: func(c *Config) interface{} { return &c.Repository.AzureAccountKeyFile }},
+	{env: "AZURE_ACCOUNT_SAS", value: func(c *Config) interface{} { return &c.Repository.AzureAccountSAS }},
+	{env: "AZURE_ENDPOINT_SUFFIX", value: func(c *Config) interface{} { return &c.Repository.AzureEndpointSuffix }},
+	{env: "GOOGLE_PROJECT_ID", value: func(c *Config) interface{} { return &c.Repository.GCSProjectID }},
+	{env: "GOOGLE_APPLICATION_CREDENTIALS", value: func(c *Config) interface{} { return &c.Repository.GCSCredentialsFile }},
+	{env: "B2_ACCOUNT_ID", value: func(c *Config) interface{} { return &c.Repository.B2AccountID }},
+	{env: "B2_ACCOUNT_KEY", value: func(c *Config) interface{} { return &c.Repository.B2AccountKey }},
+	{env: "B2_ACCOUNT_KEY_FILE", value: func(c *Config) interface{} { return &c.Repository.B2AccountKeyFile }},
+	{env: "RESTIC_REST_USERNAME", value: func(c *Config) interface{} { return &c.Repository.RESTUsername }},
+	{env: "RESTIC_REST_PASSWORD", value: func(c *Config) interface{} { return &c.Repository.RESTPassword }},
+	{env: "RESTIC_REST_PASSWORD_FILE", value: func(c *Config) interface{} { return &c.Repository.RESTPasswordFile }},
+	{flag: "sftp-command", env: "RESTIC_SFTP_COMMAND", usage: "Command connecting to the SFTP server of the default repository, replacing ssh", value: func(c *Config) interface{} { return &c.Repository.SFTPCommand }},
+	{flag: "cacert", env: "RESTIC_CACERT", usage: "PEM bundle of CAs trusted by TLS connections to the default repository", value: func(c *Config) interface{} { return &c.Repository.CACertFile }},
+	{flag: "insecure-tls", env: "RESTIC_INSECURE_TLS", usage: "Skip verification of the TLS certificate of the default repository", value: func(c *Config) interface{} { return &c.Repository.InsecureTLS }},
+	{flag: "password-file", env: "RESTIC_PASSWORD_FILE", usage: "File holding the password of the default repository, read on every restic command", value: func(c *Config) interface{} { return &c.Repository.PasswordFile }},
+	{flag: "password-command", env: "RESTIC_PASSWORD_COMMAND", usage: "Command printing the password of the default repository, run on every restic command", value: func(c *Config) interface{} { return &c.Repository.PasswordCommand }},
+	{flag: "compression", env: "RESTIC_COMPRESSION", usage: "Compression mode of the default repository (auto, off, max)", value: func(c *Config) interface{} { return &c.Repository.Compression }},
+
+	{flag: "tenants-config", usage: "JSON file with per-cluster repository configuration", value: func(c *Config) interface{} { return &c.Tenants.ConfigFile }},
+	{flag: "tenant-secrets-dir", usage: "Directory of mounted Secrets laid out as <namespace>/<cluster>/<KEY>", value: func(c *Config) interface{} { return &c.Tenants.SecretsDir }},
+	{flag: "tenants-require-known", usage: "Reject clusters without a tenants file entry or Secret instead of serving them from the default repository", value: func(c *Config) interface{} { return &c.Tenants.RequireKnown }},
+	{flag: "max-tenants", usage: "Maximum clusters served (0 means no limit)", value: func(c *Config) interface{} { return &c.Tenants.Max }},
+	{flag: "pgdata-roots", usage: "Comma-separated directories backups may read data directories from (empty allows any absolute path)", value: func(c *Config) interface{} { return &c.Paths.PGDataRoots }},
+	{flag: "wal-roots", usage: "Comma-separated directories WAL segments may be archived from (default: --pgdata-roots)", value: func(c *Config) interface{} { return &c.Paths.WALRoots }},
+	{flag: "tablespace-roots", usage: "Comma-separated directories backups may read tablespaces from (default: --pgdata-roots)", value: func(c *Config) interface{} { return &c.Paths.TablespaceRoots }},
+	{flag: "restore-roots", usage: "Comma-separated directories restores may write to (empty allows any absolute path)", value: func(c *Config) interface{} { return &c.Paths.RestoreRoots }},
+
+	{flag: "backup-exclude", usage: "Comma-separated restic patterns base backups skip besides the built-in PostgreSQL exclusions", value: func(c *Config) interface{} { return &c.Backup.Exclude }},
+	{flag: "backup-manifest", usage: "Store a backup_manifest of each filesystem backup, read back from its snapshot", value: func(c *Config) interface{} { return &c.Backup.Manifest }},
+	{flag: "backup-conninfo", usage: "libpq connection string of the instance owning the data directory, filesystem backups run between pg_backup_start and pg_backup_stop on it when set", value: func(c *Config) interface{} { return &c.Backup.Coordinate.ConnInfo }},
+	{flag: "backup-checkpoint", usage: "Checkpoint mode coordinated backups start with (fast, spread)", value: func(c *Config) interface{} { return &c.Backup.Coordinate.Checkpoint }},
+	{flag: "backup-psql-command", usage: "psql binary coordinating filesystem backups (default: psql in PATH)", value: func(c *Config) interface{} { return &c.Backup.Coordinate.PsqlCommand }},
+	{flag: "backup-wal-archive-timeout", usage: "Time a coordinated backup waits for the WAL it ends in to be archived (0 means no limit)", value: func(c *Config) interface{} { return &c.Backup.WALArchiveTimeout }},
+	{flag: "backup-limit-upload", usage: "Upload rate limit of filesystem backups in KiB/s (0 means no limit)", value: func(c *Config) interface{} { return &c.Backup.Upload.LimitUpload }},
+	{flag: "backup-read-concurrency", usage: "Files filesystem backups read at once (default: restic default)", value: func(c *Config) interface{} { return &c.Backup.Upload.ReadConcurrency }},
+	{flag: "backup-pack-size", usage: "Target size of pack files written by filesystem backups in MiB, at most 128 (default: restic default)", value: func(c *Config) interface{} { return &c.Backup.Upload.PackSize }},
+	{flag: "instance-name", usage: "Name of the instance backups are taken on, recorded in their tags (default: hostname)", value: func(c *Config) interface{} { return &c.Backup.Instance }},
+	{flag: "backup-mode", usage: "Mode of base backups whose request doesn't choose one (filesystem, stream)", value: func(c *Config) interface{} { return &c.Backup.Mode }},
+	{flag: "basebackup-conninfo", usage: "libpq connection string pg_basebackup streams backups from", value: func(c *Config) interface{} { return &c.Backup.Stream.ConnInfo }},
+	{flag: "basebackup-command", usage: "pg_basebackup binary of streamed backups (default: pg_basebackup in PATH)", value: func(c *Config) interface{} { return &c.Backup.Stream.Command }},
+	{flag: "basebackup-checkpoint", usage: "Checkpoint mode of streamed backups (fast, spread)", value: func(c *Config) interface{} { return &c.Backup.Stream.Checkpoint }},
+	{flag: "basebackup-incremental", usage: "Make streamed backups incremental to the previous one unless the request chooses otherwise (PostgreSQL 17 with summarize_wal)", value: func(c *Config) interface{} { return &c.Backup.Stream.Incremental }},
+	{flag: "basebackup-max-incrementals", usage: "Incremental backups chained to a full one before the next backup is full (0 means no limit)", value: func(c *Config) interface{} { return &c.Backup.Stream.MaxIncrementals }},
+	{flag: "basebackup-psql-command", usage: "psql binary identifying the server backups are streamed from (default: psql in PATH)", value: func(c *Config) interface{} { return &c.Backup.Stream.PsqlCommand }},
+	{flag: "pg-combinebackup-command", usage: "pg_combinebackup binary restores of incremental backups run (default: pg_combinebackup in PATH)", value: func(c *Config) interface{} { return &c.Backup.Stream.CombineCommand }},
+	{flag: "replication-interval", usage: "Interval between replications to secondary repositories (0 disables the schedule)", value: func(c *Config) interface{} { return &c.Replication.Interval }},
+	{flag: "replicate-after-backup", usage: "Replicate to secondary repositories after each base backup", value: func(c *Config) interface{} { return &c.Replication.AfterBackup }},
+	{flag: "check-interval", usage: "Interval between repository integrity checks (0 disables the schedule)", value: func(c *Config) interface{} { return &c.Check.Interval }},
+	{flag: "check-mode", usage: "Scheduled check mode (structure, read-data, read-data-subset)", value: func(c *Config) interface{} { return &c.Check.Mode }},
+	{flag: "check-subset", usage: "Data read by read-data-subset checks, n/t or a percentage", value: func(c *Config) interface{} { return &c.Check.Subset }},
+	{flag: "retention-interval", usage: "Interval between retention policy runs (0 disables the schedule)", value: func(c *Config) interface{} { return &c.Retention.Interval }},
+	{flag: "retention-keep-last", usage: "Number of most recent base backups retention keeps", value: func(c *Config) interface{} { return &c.Retention.KeepLast }},
+	{flag: "retention-keep-within", usage: "Age up to which retention keeps base backups", value: func(c *Config) interface{} { return &c.Retention.KeepWithin }},
+	{flag: "snapshot-metrics-interval", usage: "Interval between repository snapshot counts exported as metrics (0 disables them)", value: func(c *Config) interface{} { return &c.Metrics.SnapshotInterval }},
+	{flag: "logical-conninfo", usage: "libpq connection string logical backups dump databases from (empty disables logical backups)", value: func(c *Config) interface{} { return &c.Logical.ConnInfo }},
+	{flag: "logical-databases", usage: "Comma-separated databases logical backups dump by default (default: all databases accepting connections)", value: func(c *Config) interface{} { return &c.Logical.Databases }},
+	{flag: "pg-dump-command", usage: "pg_dump binary of logical backups (default: pg_dump in PATH)", value: func(c *Config) interface{} { return &c.Logical.PGDumpCommand }},
+	{flag: "pg-dumpall-command", usage: "pg_dumpall binary dumping globals (default: pg_dumpall in PATH)", value: func(c *Config) interface{} { return &c.Logical.PGDumpAllCommand }},
+	{flag: "pg-restore-command", usage: "pg_restore binary of logical restores (default: pg_restore in PATH)", value: func(c *Config) interface{} { return &c.Logical.PGRestoreCommand }},
+	{flag: "psql-command", usage: "psql binary listing databases (default: psql in PATH)", value: func(c *Config) interface{} { return &c.Logical.PsqlCommand }},
+	{flag: "restore-connections", usage: "Backend connections restores download pack files over in parallel (default: restic default)", value: func(c *Config) interface{} { return &c.Restore.Connections }},
+	{flag: "restore-limit-download", usage: "Download rate limit of restores in KiB/s (0 means no limit)", value: func(c *Config) interface{} { return &c.Restore.LimitDownload }},
+	{flag: "restore-cache-dir", usage: "restic cache directory of restores (default: restic default)", value: func(c *Config) interface{} { return &c.Restore.CacheDir }},
+	{flag: "restore-verify", usage: "Read restored files back and check their contents", value: func(c *Config) interface{} { return &c.Restore.Verify }},
+	{flag: "restore-sparse", usage: "Restore runs of zeros as holes in sparse files", value: func(c *Config) interface{} { return &c.Restore.Sparse }},
+	{flag: "verify-scratch-dir", usage: "Directory verifications restore backups into (default: system temporary directory)", value: func(c *Config) interface{} { return &c.Verify.ScratchDir }},
+
+	{flag: "probe-cache-ttl", usage: "How long a readiness probe result is reused", value: func(c *Config) interface{} { return &c.Health.ProbeCacheTTL }},
+	{flag: "stale-lock-age", usage: "Age from which an exclusive repository lock fails the readiness probe", value: func(c *Config) interface{} { return &c.Health.StaleLockAge }},
+	{flag: "max-wal-age", usage: "Longest time without a WAL archival before the readiness probe fails (0 disables the check)", value: func(c *Config) interface{} { return &c.Health.MaxWALAge }},
+
+	{flag: "max-wal-operations", usage: "Maximum concurrent WAL archivals and restores (0 means no limit)", value: func(c *Config) interface{} { return &c.Concurrency.WALOperations }},
+	{flag: "read-header-timeout", usage: "Time allowed to read request headers", value: func(c *Config) interface{} { return &c.Timeouts.ReadHeader }},
+	{flag: "shutdown-timeout", usage: "Time running requests get to finish on shutdown", value: func(c *Config) interface{} { return &c.Timeouts.Shutdown }},
+	{flag: "wal-operation-timeout", usage: "Time allowed for a WAL archival or restore (0 means no timeout)", value: func(c *Config) interface{} { return &c.Timeouts.WALOperation }},
+
+	{flag: "auth-config", usage: "JSON file of the principals allowed to call the API (empty disables authentication)", value: func(c *Config) interface{} { return &c.Auth.ConfigFile }},
+	{flag: "audit-log", usage: "Append-only audit log file of restores, snapshot deletions and configuration changes (empty disables it)", value: func(c *Config) interface{} { return &c.Audit.LogFile }},
+	{flag: "trace-exporter", usage: "OpenTelemetry span exporter (none, otlp, stdout)", value: func(c *Config) interface{} { return &c.Tracing.Exporter }},
+}
+
+// Load reads the configuration file named by --config or CNPG_RESTIC_CONFIG,
+// then applies the environment and finally the flags set in args. The flags
+// are registered on fs.
+func Load(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	// Flags are parsed into a separate configuration so only the ones
+	// actually set override the file and environment
+	flags := Default()
+	var file string
+	fs.StringVar(&file, "config", "", fmt.Sprintf("YAML or JSON configuration file (env %s)", configEnv))
+	for _, s := range settings {
+		if s.flag != "" {
+			register(fs, s, flags)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if !set["config"] {
+		file, _ = lookupEnv(configEnv)
+	}
+
+	cfg := Default()
+	if file != "" {
+		if err := loadFile(file, cfg); err != nil {
+			return nil, err
+		}
+		cfg.File = file
+	}
+
+	for _, s := range settings {
+		value, ok := lookupEnv(s.envName())
+		if !ok || value == "" {
+			continue
+		}
+		if err := setString(s.value(cfg), value); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", s.envName(), err)
+		}
+	}
+	applySecondaryEnv(cfg, lookupEnv)
+
+	for _, s := range settings {
+		if s.flag != "" && set[s.flag] {
+			copyValue(s.value(cfg), s.value(flags))
+		}
+	}
+	return cfg, nil
+}
+
+// register adds the flag of a setting with the default of cfg
+func register(fs *flag.FlagSet, s setting, cfg *Config) {
+	usage := fmt.Sprintf("%s (env %s)", s.usage, s.envName())
+	switch p := s.value(cfg).(type) {
+	case *string:
+		fs.StringVar(p, s.flag, *p, usage)
+	case *bool:
+		fs.BoolVar(p, s.flag, *p, usage)
+	case *int:
+		fs.IntVar(p, s.flag, *p, usage)
+	case flag.Value:
+		fs.Var(p, s.flag, usage)
+	default:
+		panic(fmt.Sprintf("config: unsupported type %T of setting %s", p, s.flag))
+	}
+}
+
+// setString parses value into the setting pointed to by p
+func setString(p interface{}, value string) error {
+	switch p := p.(type) {
+	case *string:
+		*p = value
+	case *bool:
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*p = v
+	case *int:
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*p = v
+	case flag.Value:
+		return p.Set(value)
+	}
+	return nil
+}
+
+// copyValue assigns the setting pointed to by src to the one pointed to by dst
+func copyValue(dst, src interface{}) {
+	switch dst := dst.(type) {
+	case *string:
+		*dst = *src.(*string)
+	case *bool:
+		*dst = *src.(*bool)
+	case *int:
+		*dst = *src.(*int)
+	case *Duration:
+		*dst = *src.(*Duration)
+	case *List:
+		*dst = *src.(*List)
+	}
+}
+
+// applySecondaryEnv replaces the secondary repositories with the one of the
+// RESTIC_SECONDARY_* variables, if set
+func applySecondaryEnv(cfg *Config, lookupEnv func(string) (string, bool)) {
+	repository, _ := lookupEnv("RESTIC_SECONDARY_REPOSITORY")
+	if repository == "" {
+		return
+	}
+	get := func(key string) string {
+		value, _ := lookupEnv(key)
+		return value
+	}
+	cfg.Secondaries = []restic.Config{{
+		Repository:      repository,
+		Password:        get("RESTIC_SECONDARY_PASSWORD"),
+		PasswordFile:    get("RESTIC_SECONDARY_PASSWORD_FILE"),
+		PasswordCommand: get("RESTIC_SECONDARY_PASSWORD_COMMAND"),
+		S3Endpoint:      get("S3_SECONDARY_ENDPOINT"),
+		S3AccessKey:     get("S3_SECONDARY_ACCESS_KEY"),
+		S3SecretKey:     get("S3_SECONDARY_SECRET_KEY"),
+		S3AccessKeyFile: get("S3_SECONDARY_ACCESS_KEY_FILE"),
+		S3SecretKeyFile: get("S3_SECONDARY_SECRET_KEY_FILE"),
+	}}
+}
+
+// loadFile decodes a YAML or JSON file onto cfg, rejecting unknown fields
+func loadFile(file string, cfg *Config) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	// JSON is valid YAML, decoding both through YAML keeps the json tags
+	// the only schema
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", file, err)
+	}
+	if doc == nil {
+		return nil
+	}
+	normalized, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", file, err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(normalized))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", file, err)
+	}
+	return nil
+}
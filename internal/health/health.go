@@ -0,0 +1,217 @@
+// Package health probes whether the plugin can serve backups from its
+// repository, caching the result so probes don't hammer the storage.
+package health
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+const (
+	// DefaultCacheTTL is how long a probe result is reused
+	DefaultCacheTTL = 30 * time.Second
+	// DefaultStaleLockAge is the age from which an exclusive lock is
+	// considered stale
+	DefaultStaleLockAge = 30 * time.Minute
+
+	// walArchiveCheck is the name of the WAL archival check
+	walArchiveCheck = "wal_archive"
+)
+
+// Options configures the readiness probe
+type Options struct {
+	// CacheTTL is how long a probe result is reused, DefaultCacheTTL if zero
+	CacheTTL time.Duration
+	// StaleLockAge is the age from which an exclusive lock makes the
+	// repository unavailable, DefaultStaleLockAge if zero
+	StaleLockAge time.Duration
+	// MaxWALAge is the longest time without a WAL archival before the probe
+	// fails, zero disables the check
+	MaxWALAge time.Duration
+}
+
+// Check is the outcome of a single probe step
+type Check struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Details string `json:"details,omitempty"`
+}
+
+// Report is the outcome of a probe
+type Report struct {
+	Ready     bool      `json:"ready"`
+	CheckedAt time.Time `json:"checkedAt"`
+	Checks    []Check   `json:"checks"`
+}
+
+// RepositoryReady reports whether every check but the WAL archival passed.
+// A stalled archival concerns its cluster, not the plugin serving it.
+func (r *Report) RepositoryReady() bool {
+	for _, check := range r.Checks {
+		if !check.Passed && check.Name != walArchiveCheck {
+			return false
+		}
+	}
+	return true
+}
+
+// WALStale reports whether the WAL archival check failed
+func (r *Report) WALStale() bool {
+	for _, check := range r.Checks {
+		if !check.Passed && check.Name == walArchiveCheck {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Report) add(name string, passed bool, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, Check{
+		Name:    name,
+		Passed:  passed,
+		Details: fmt.Sprintf(format, args...),
+	})
+}
+
+// Prober probes the repository of a tenant
+type Prober struct {
+	client   restic.Client
+	options  Options
+	started  time.Time
+	lookPath func(string) (string, error)
+
+	// probing is held by the single probe in flight, mu only guards the
+	// fields below so archivals and cached reads don't wait for the probe
+	probing     sync.Mutex
+	mu          sync.Mutex
+	lastArchive time.Time
+	cached      *Report
+}
+
+// NewProber creates a new prober of the client's repository
+func NewProber(client restic.Client, options Options) *Prober {
+	if options.CacheTTL == 0 {
+		options.CacheTTL = DefaultCacheTTL
+	}
+	if options.StaleLockAge == 0 {
+		options.StaleLockAge = DefaultStaleLockAge
+	}
+
+	return &Prober{
+		client:   client,
+		options:  options,
+		started:  time.Now(),
+		lookPath: exec.LookPath,
+	}
+}
+
+// RecordWALArchive records a successful WAL archival
+func (p *Prober) RecordWALArchive(at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastArchive = at
+}
+
+// Probe returns the cached report if it is recent enough, otherwise it
+// probes the repository. Concurrent callers wait for a single probe.
+func (p *Prober) Probe(ctx context.Context) *Report {
+	if report := p.fresh(); report != nil {
+		return report
+	}
+
+	p.probing.Lock()
+	defer p.probing.Unlock()
+	// Another caller may have probed while this one waited
+	if report := p.fresh(); report != nil {
+		return report
+	}
+
+	report := &Report{CheckedAt: time.Now()}
+	p.probeBinary(report)
+	p.probeRepository(ctx, report)
+	p.probeWALArchive(report)
+
+	report.Ready = true
+	for _, check := range report.Checks {
+		report.Ready = report.Ready && check.Passed
+	}
+
+	p.mu.Lock()
+	p.cached = report
+	p.mu.Unlock()
+	return report
+}
+
+// fresh returns the cached report if it is recent enough
+func (p *Prober) fresh() *Report {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cached != nil && time.Since(p.cached.CheckedAt) < p.options.CacheTTL {
+		return p.cached
+	}
+	return nil
+}
+
+// probeBinary checks the restic binary can be found
+func (p *Prober) probeBinary(report *Report) {
+	path, err := p.lookPath("restic")
+	if err != nil {
+		report.add("restic_binary", false, "%v", err)
+		return
+	}
+	report.add("restic_binary", true, "%s", path)
+}
+
+// probeRepository opens the repository, which proves it is reachable with
+// valid credentials, and looks for stale exclusive locks
+func (p *Prober) probeRepository(ctx context.Context, report *Report) {
+	locks, err := p.client.Locks(ctx)
+	if err != nil {
+		report.add("repository", false, "%v", err)
+		return
+	}
+	report.add("repository", true, "reachable")
+
+	for _, lock := range locks {
+		if lock.Exclusive && time.Since(lock.Time) >= p.options.StaleLockAge {
+			// The holder is listed by restic list locks
+			report.add("locks", false, "exclusive lock %s held since %s",
+				lock.ID, lock.Time.Format(time.RFC3339))
+			return
+		}
+	}
+	report.add("locks", true, "%d locks held", len(locks))
+}
+
+// probeWALArchive checks a WAL segment was archived recently, counting from
+// the start of the process until the first archival
+func (p *Prober) probeWALArchive(report *Report) {
+	if p.options.MaxWALAge == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	lastArchive := p.lastArchive
+	p.mu.Unlock()
+
+	if lastArchive.IsZero() {
+		if age := time.Since(p.started); age >= p.options.MaxWALAge {
+			report.add(walArchiveCheck, false, "no WAL archived in %s since start", age.Round(time.Second))
+			return
+		}
+		report.add(walArchiveCheck, true, "no WAL archived since start")
+		return
+	}
+
+	age := time.Since(lastArchive)
+	if age >= p.options.MaxWALAge {
+		report.add(walArchiveCheck, false, "last WAL archived %s ago", age.Round(time.Second))
+		return
+	}
+	report.add(walArchiveCheck, true, "last WAL archived %s ago", age.Round(time.Second))
+}
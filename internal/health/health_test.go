@@ -0,0 +1,187 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+// mockResticClient implements the restic.Client interface for testing
+type mockResticClient struct {
+	restic.Client
+	locks []*restic.Lock
+	err   error
+	calls int
+}
+
+func (m *mockResticClient) Locks(_ context.Context) ([]*restic.Lock, error) {
+	m.calls++
+	return m.locks, m.err
+}
+
+func TestProber_Probe(t *testing.T) {
+	tests := []struct {
+		name        string
+		locks       []*restic.Lock
+		locksErr    error
+		binaryErr   error
+		maxWALAge   time.Duration
+		lastArchive time.Duration
+		wantReady   bool
+		// wantRepositoryReady defaults to wantReady
+		wantRepositoryReady bool
+		wantFailed          string
+	}{
+		{
+			name:      "ready",
+			locks:     []*restic.Lock{{ID: "a1", Time: time.Now(), Exclusive: false}},
+			wantReady: true,
+		},
+		{
+			name:       "restic binary missing",
+			binaryErr:  fmt.Errorf("executable file not found in $PATH"),
+			wantReady:  false,
+			wantFailed: "restic_binary",
+		},
+		{
+			name:       "repository unreachable",
+			locksErr:   fmt.Errorf("wrong password or no key found"),
+			wantReady:  false,
+			wantFailed: "repository",
+		},
+		{
+			name:       "stale exclusive lock",
+			locks:      []*restic.Lock{{ID: "b2", Time: time.Now().Add(-2 * time.Hour), Exclusive: true}},
+			wantReady:  false,
+			wantFailed: "locks",
+		},
+		{
+			name:      "recent exclusive lock",
+			locks:     []*restic.Lock{{ID: "c3", Time: time.Now(), Exclusive: true}},
+			wantReady: true,
+		},
+		{
+			name:        "recent WAL archive",
+			maxWALAge:   time.Hour,
+			lastArchive: time.Minute,
+			wantReady:   true,
+		},
+		{
+			name:        "WAL archiving stalled",
+			maxWALAge:   time.Hour,
+			lastArchive: 2 * time.Hour,
+			wantReady:   false,
+			// The repository still serves the other clusters
+			wantRepositoryReady: true,
+			wantFailed:          "wal_archive",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockResticClient{locks: tt.locks, err: tt.locksErr}
+			p := NewProber(client, Options{MaxWALAge: tt.maxWALAge})
+			p.lookPath = func(string) (string, error) {
+				return "/usr/bin/restic", tt.binaryErr
+			}
+			if tt.lastArchive > 0 {
+				p.RecordWALArchive(time.Now().Add(-tt.lastArchive))
+			}
+
+			report := p.Probe(context.Background())
+			if report.Ready != tt.wantReady {
+				t.Errorf("Ready = %v, want %v, checks: %+v", report.Ready, tt.wantReady, report.Checks)
+			}
+			if want := tt.wantReady || tt.wantRepositoryReady; report.RepositoryReady() != want {
+				t.Errorf("RepositoryReady() = %v, want %v", report.RepositoryReady(), want)
+			}
+			if stale := tt.wantFailed == "wal_archive"; report.WALStale() != stale {
+				t.Errorf("WALStale() = %v, want %v", report.WALStale(), stale)
+			}
+			for _, check := range report.Checks {
+				if check.Name == tt.wantFailed && check.Passed {
+					t.Errorf("check %s passed, want failure", check.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestProber_Cache(t *testing.T) {
+	client := &mockResticClient{}
+	p := NewProber(client, Options{CacheTTL: time.Hour})
+	p.lookPath = func(string) (string, error) { return "/usr/bin/restic", nil }
+
+	first := p.Probe(context.Background())
+	second := p.Probe(context.Background())
+	if first != second || client.calls != 1 {
+		t.Errorf("repository probed %d times, want the cached report reused", client.calls)
+	}
+
+	p.options.CacheTTL = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	p.Probe(context.Background())
+	if client.calls != 2 {
+		t.Errorf("repository probed %d times after expiry, want 2", client.calls)
+	}
+}
+
+// blockingClient holds Locks until released
+type blockingClient struct {
+	restic.Client
+	started chan struct{}
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (c *blockingClient) Locks(_ context.Context) ([]*restic.Lock, error) {
+	if c.calls.Add(1) == 1 {
+		close(c.started)
+	}
+	<-c.release
+	return nil, nil
+}
+
+func TestProber_ProbeInFlight(t *testing.T) {
+	client := &blockingClient{started: make(chan struct{}), release: make(chan struct{})}
+	p := NewProber(client, Options{CacheTTL: time.Hour, MaxWALAge: time.Hour})
+	p.lookPath = func(string) (string, error) { return "/usr/bin/restic", nil }
+
+	var wg sync.WaitGroup
+	reports := make([]*Report, 3)
+	for i := range reports {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reports[i] = p.Probe(context.Background())
+		}()
+	}
+	<-client.started
+
+	archived := make(chan struct{})
+	go func() {
+		p.RecordWALArchive(time.Now())
+		close(archived)
+	}()
+	select {
+	case <-archived:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RecordWALArchive blocked on the probe in flight")
+	}
+
+	close(client.release)
+	wg.Wait()
+	if calls := client.calls.Load(); calls != 1 {
+		t.Errorf("repository probed %d times, want a single probe", calls)
+	}
+	for _, report := range reports[1:] {
+		if report != reports[0] {
+			t.Error("concurrent callers got different reports, want the single probe's")
+		}
+	}
+}
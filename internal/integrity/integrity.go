@@ -0,0 +1,124 @@
+// Package integrity runs repository integrity checks on demand and on a
+// schedule, retaining their results.
+package integrity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/metrics"
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+// ErrInProgress is returned when a check is already running
+var ErrInProgress = errors.New("check already in progress")
+
+// historySize is the number of check results retained
+const historySize = 10
+
+// Status reports the outcome of past checks
+type Status struct {
+	Last      *restic.CheckResult   `json:"last,omitempty"`
+	LastError string                `json:"lastError,omitempty"`
+	History   []*restic.CheckResult `json:"history,omitempty"`
+}
+
+// Checker runs integrity checks against a repository
+type Checker struct {
+	client restic.Client
+	logger *logging.Logger
+
+	running sync.Mutex
+	mu      sync.Mutex
+	status  Status
+}
+
+// NewChecker creates a new checker
+func NewChecker(client restic.Client, logger *logging.Logger) *Checker {
+	return &Checker{
+		client: client,
+		logger: logger.Component("integrity"),
+	}
+}
+
+// Check runs a repository check and records its result
+func (c *Checker) Check(ctx context.Context, opts restic.CheckOptions) (*restic.CheckResult, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if !c.running.TryLock() {
+		return nil, ErrInProgress
+	}
+	defer c.running.Unlock()
+
+	logger := c.logger.Context(ctx).Operation("check").WithFields(map[string]interface{}{
+		"mode":   opts.Mode,
+		"subset": opts.Subset,
+	})
+	logger.Info().Msg("Starting repository check")
+
+	result, err := c.client.Check(ctx, opts)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		logger.Error().Err(err).Msg("Repository check failed")
+		metrics.ObserveCheck(ctx, 0, err)
+		c.status.LastError = err.Error()
+		return nil, fmt.Errorf("repository check failed: %v", err)
+	}
+
+	metrics.ObserveCheck(ctx, len(result.Errors), nil)
+	c.status.Last = result
+	c.status.LastError = ""
+	c.status.History = append([]*restic.CheckResult{result}, c.status.History...)
+	if len(c.status.History) > historySize {
+		c.status.History = c.status.History[:historySize]
+	}
+
+	if result.OK {
+		logger.Info().
+			Int("packs_checked", result.PacksChecked).
+			Dur("duration", result.Duration).
+			Msg("Repository check found no errors")
+	} else {
+		logger.Error().
+			Strs("errors", result.Errors).
+			Msg("Repository check found errors")
+	}
+
+	return result, nil
+}
+
+// Run checks the repository on every interval tick until the context is cancelled
+func (c *Checker) Run(ctx context.Context, interval time.Duration, opts restic.CheckOptions) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := c.Check(ctx, opts); err != nil && !errors.Is(err, ErrInProgress) {
+			c.logger.Error().Err(err).Msg("Scheduled repository check failed")
+		}
+	}
+}
+
+// Status returns the outcome of past checks
+func (c *Checker) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := c.status
+	status.History = append([]*restic.CheckResult(nil), c.status.History...)
+	return status
+}
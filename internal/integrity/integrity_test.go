@@ -0,0 +1,104 @@
+package integrity
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+// mockResticClient implements the restic.Client interface for testing
+type mockResticClient struct {
+	restic.Client
+	result *restic.CheckResult
+	err    error
+	opts   restic.CheckOptions
+}
+
+func (m *mockResticClient) Check(_ context.Context, opts restic.CheckOptions) (*restic.CheckResult, error) {
+	m.opts = opts
+	return m.result, m.err
+}
+
+func TestChecker_Check(t *testing.T) {
+	tests := []struct {
+		name          string
+		opts          restic.CheckOptions
+		result        *restic.CheckResult
+		checkErr      error
+		wantErr       bool
+		wantOK        bool
+		wantLastError bool
+	}{
+		{
+			name:   "no errors",
+			opts:   restic.CheckOptions{Mode: restic.CheckReadData},
+			result: &restic.CheckResult{OK: true, PacksChecked: 12},
+			wantOK: true,
+		},
+		{
+			name:   "errors found",
+			opts:   restic.CheckOptions{Mode: restic.CheckReadDataSubset, Subset: "10%"},
+			result: &restic.CheckResult{OK: false, Errors: []string{"Pack ID does not match"}},
+			wantOK: false,
+		},
+		{
+			name:          "check could not run",
+			checkErr:      fmt.Errorf("repository unreachable"),
+			wantErr:       true,
+			wantLastError: true,
+		},
+		{
+			name:    "invalid options",
+			opts:    restic.CheckOptions{Mode: restic.CheckReadDataSubset},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockResticClient{result: tt.result, err: tt.checkErr}
+			c := NewChecker(client, logging.NewLogger(logging.Config{Level: "info"}))
+
+			got, err := c.Check(context.Background(), tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			status := c.Status()
+			if (status.LastError != "") != tt.wantLastError {
+				t.Errorf("LastError = %q, wantLastError %v", status.LastError, tt.wantLastError)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if got.OK != tt.wantOK {
+				t.Errorf("OK = %v, want %v", got.OK, tt.wantOK)
+			}
+			if client.opts != tt.opts {
+				t.Errorf("client called with %+v, want %+v", client.opts, tt.opts)
+			}
+			if status.Last != got || len(status.History) != 1 {
+				t.Errorf("Status() = %+v, want the result retained", status)
+			}
+		})
+	}
+}
+
+func TestChecker_History(t *testing.T) {
+	client := &mockResticClient{result: &restic.CheckResult{OK: true}}
+	c := NewChecker(client, logging.NewLogger(logging.Config{Level: "info"}))
+
+	for i := 0; i < historySize+5; i++ {
+		if _, err := c.Check(context.Background(), restic.CheckOptions{}); err != nil {
+			t.Fatalf("Check() error = %v", err)
+		}
+	}
+
+	if got := len(c.Status().History); got != historySize {
+		t.Errorf("History holds %d results, want %d", got, historySize)
+	}
+}
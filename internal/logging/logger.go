@@ -1,12 +1,26 @@
 package logging
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"os"
+	"regexp"
 	"time"
 
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// RequestIDHeader is the HTTP header carrying request IDs
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDRegex matches the request IDs accepted from callers
+var requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestIDKey is the context key of the request ID
+type requestIDKey struct{}
+
 // Logger wraps zerolog.Logger to provide structured logging
 type Logger struct {
 	zerolog.Logger
@@ -80,6 +94,44 @@ func (l *Logger) WithFields(fields map[string]interface{}) *Logger {
 	}
 }
 
+// Context adds the request ID and trace ID carried by ctx to the logger
+func (l *Logger) Context(ctx context.Context) *Logger {
+	logCtx := l.With()
+	if id := RequestID(ctx); id != "" {
+		logCtx = logCtx.Str("request_id", id)
+	}
+	if span := trace.SpanContextFromContext(ctx); span.HasTraceID() {
+		logCtx = logCtx.Str("trace_id", span.TraceID().String())
+	}
+	return &Logger{
+		Logger: logCtx.Logger(),
+	}
+}
+
+// NewRequestID returns a random request ID
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ValidRequestID reports whether a request ID received from a caller is safe
+// to log and echo
+func ValidRequestID(id string) bool {
+	return requestIDRegex.MatchString(id)
+}
+
+// WithRequestID returns a context carrying the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, empty if it has none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
 // Printf implements the plugin.Logger interface
 func (l *Logger) Printf(format string, v ...interface{}) {
 	l.Info().Msgf(format, v...)
@@ -0,0 +1,55 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestLogger_Context(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &Logger{Logger: zerolog.New(&buf)}
+
+	ctx := WithRequestID(context.Background(), "req-42")
+	logger.Context(ctx).Component("backup").Info().Msg("Starting backup")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Failed to parse log line: %v", err)
+	}
+	if line["request_id"] != "req-42" {
+		t.Errorf("request_id = %v, want req-42", line["request_id"])
+	}
+	if _, ok := line["trace_id"]; ok {
+		t.Error("trace_id logged without a span in the context")
+	}
+
+	buf.Reset()
+	logger.Context(context.Background()).Info().Msg("Scheduled check")
+	if bytes.Contains(buf.Bytes(), []byte("request_id")) {
+		t.Error("request_id logged without a request ID in the context")
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{id: NewRequestID(), want: true},
+		{id: "7b2a1c9e-3f4d-4e5a-8b6c-1d2e3f4a5b6c", want: true},
+		{id: "", want: false},
+		{id: "id with spaces", want: false},
+		{id: "forged\nlog line", want: false},
+		{id: string(bytes.Repeat([]byte("a"), 129)), want: false},
+	}
+
+	for _, tt := range tests {
+		if got := ValidRequestID(tt.id); got != tt.want {
+			t.Errorf("ValidRequestID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
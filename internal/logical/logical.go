@@ -0,0 +1,389 @@
+// Package logical takes logical backups of single databases with pg_dump and
+// restores them with pg_restore, streaming through the repository
+package logical
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/pgconn"
+	"cloud-native-pg-restic-backup/internal/restic"
+	"cloud-native-pg-restic-backup/internal/tracing"
+)
+
+const (
+	// TypeTag marks logical backup snapshots
+	TypeTag = "type:logical"
+	// GlobalsTag marks the dump of roles and tablespaces
+	GlobalsTag = "globals"
+
+	// databaseTagPrefix prefixes the tag naming the dumped database
+	databaseTagPrefix = "database:"
+	// globalsFileName is the file the globals dump is stored as
+	globalsFileName = "globals.sql"
+)
+
+// listDatabasesQuery lists the databases dumped by default
+const listDatabasesQuery = "SELECT datname FROM pg_database WHERE datallowconn AND NOT datistemplate ORDER BY datname"
+
+// Config configures the PostgreSQL client tools
+type Config struct {
+	// ConnInfo is the libpq connection string of the server, in
+	// keyword/value form as the database name is appended to it
+	ConnInfo string
+	// Databases are dumped by default, all databases accepting connections
+	// if empty
+	Databases []string
+
+	// The client tools, found in PATH by default
+	PGDumpCommand    string
+	PGDumpAllCommand string
+	PGRestoreCommand string
+	PsqlCommand      string
+}
+
+// Enabled reports whether a server to dump is configured
+func (c Config) Enabled() bool {
+	return c.ConnInfo != ""
+}
+
+// Validate checks the configuration
+func (c Config) Validate() error {
+	if strings.Contains(c.ConnInfo, "://") {
+		return fmt.Errorf("connInfo must be a keyword/value connection string, not a URI")
+	}
+	for _, db := range c.Databases {
+		if err := validDatabase(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connString returns the connection string of the configured server with
+// dbname set. libpq uses the last of repeated keywords.
+func (c Config) connString(db string) string {
+	quoted := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(db)
+	return strings.TrimSpace(c.ConnInfo + " dbname='" + quoted + "'")
+}
+
+// command returns name unless overridden
+func command(override, name string) string {
+	if override != "" {
+		return override
+	}
+	return name
+}
+
+// DatabaseTag returns the tag of the logical backups of a database
+func DatabaseTag(db string) string {
+	return databaseTagPrefix + db
+}
+
+// validDatabase checks a database name can be recorded in a tag
+func validDatabase(db string) error {
+	if db == "" || strings.ContainsAny(db, ",\n") {
+		return fmt.Errorf("unsupported database name %q", db)
+	}
+	return nil
+}
+
+// dumpFileName returns the file a database dump is stored as. The name is
+// escaped as it may contain slashes.
+func dumpFileName(db string) string {
+	return url.PathEscape(db) + ".dump"
+}
+
+// Manager runs logical backups and restores of a repository
+type Manager struct {
+	client restic.Client
+	// config holds the connection string without its password, which the
+	// client tools get in their environment
+	config   Config
+	password string
+	logger   *logging.Logger
+}
+
+// NewManager creates a logical backup manager
+func NewManager(client restic.Client, cfg Config, logger *logging.Logger) *Manager {
+	m := &Manager{
+		client: client,
+		config: cfg,
+		logger: logger.Component("logical"),
+	}
+	m.config.ConnInfo, m.password = pgconn.SplitPassword(cfg.ConnInfo)
+	return m
+}
+
+// DumpResult is the outcome of a single dump
+type DumpResult struct {
+	Database   string `json:"database,omitempty"`
+	SnapshotID string `json:"snapshotID,omitempty"`
+	Bytes      uint64 `json:"bytes,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// BackupResult is the outcome of a logical backup
+type BackupResult struct {
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished"`
+	Globals  DumpResult   `json:"globals"`
+	Dumps    []DumpResult `json:"dumps"`
+}
+
+// Backup dumps the globals and each database into its own snapshot. The
+// configured databases, or all of them, are dumped if none are given. A
+// failing database doesn't stop the others.
+func (m *Manager) Backup(ctx context.Context, databases []string) (result *BackupResult, err error) {
+	ctx, span := tracing.Start(ctx, "logical.Backup")
+	defer func() { tracing.End(span, err) }()
+
+	logger := m.logger.Context(ctx).Operation("logical_backup")
+	result = &BackupResult{Started: time.Now()}
+
+	if len(databases) == 0 {
+		databases = m.config.Databases
+	}
+	if len(databases) == 0 {
+		if databases, err = m.listDatabases(ctx); err != nil {
+			logger.Error().Err(err).Msg("Failed to list databases")
+			return nil, fmt.Errorf("failed to list databases: %v", err)
+		}
+	}
+	logger.Info().Strs("databases", databases).Msg("Starting logical backup")
+
+	var errs []error
+	result.Globals = m.dump(ctx, globalsFileName, []string{TypeTag, GlobalsTag},
+		command(m.config.PGDumpAllCommand, "pg_dumpall"), "--globals-only", "--no-password", "--dbname="+m.config.ConnInfo)
+	if result.Globals.Error != "" {
+		errs = append(errs, fmt.Errorf("globals: %s", result.Globals.Error))
+	}
+
+	for _, db := range databases {
+		var dump DumpResult
+		if err := validDatabase(db); err != nil {
+			dump.Error = err.Error()
+		} else {
+			dump = m.dump(ctx, dumpFileName(db), []string{TypeTag, DatabaseTag(db)},
+				command(m.config.PGDumpCommand, "pg_dump"), "--format=custom", "--no-password", "--dbname="+m.config.connString(db))
+		}
+		dump.Database = db
+		if dump.Error != "" {
+			errs = append(errs, fmt.Errorf("%s: %s", db, dump.Error))
+		}
+		result.Dumps = append(result.Dumps, dump)
+	}
+	result.Finished = time.Now()
+
+	if err := errors.Join(errs...); err != nil {
+		logger.Error().Err(err).Msg("Logical backup failed")
+		return result, err
+	}
+	logger.Info().Dur("duration", result.Finished.Sub(result.Started)).Msg("Logical backup completed successfully")
+	return result, nil
+}
+
+// dump streams the output of a client tool into a snapshot
+func (m *Manager) dump(ctx context.Context, filename string, tags []string, name string, args ...string) DumpResult {
+	summary, err := restic.BackupFrom(ctx, m.client, filename, tags, func(ctx context.Context, w io.Writer) error {
+		return m.run(ctx, name, args, nil, w)
+	})
+	if err != nil {
+		return DumpResult{Error: err.Error()}
+	}
+	return DumpResult{SnapshotID: summary.SnapshotID, Bytes: summary.TotalBytesProcessed}
+}
+
+// listDatabases returns the databases accepting connections
+func (m *Manager) listDatabases(ctx context.Context) ([]string, error) {
+	var out bytes.Buffer
+	args := []string{"--no-psqlrc", "--no-password", "--tuples-only", "--no-align", "--record-separator-zero",
+		"--command=" + listDatabasesQuery, "--dbname=" + m.config.ConnInfo}
+	if err := m.run(ctx, command(m.config.PsqlCommand, "psql"), args, nil, &out); err != nil {
+		return nil, err
+	}
+
+	var databases []string
+	for _, db := range strings.Split(out.String(), "\x00") {
+		if db = strings.TrimSuffix(db, "\n"); db != "" {
+			databases = append(databases, db)
+		}
+	}
+	return databases, nil
+}
+
+// RestoreOptions selects a dump and what pg_restore restores of it
+type RestoreOptions struct {
+	// SnapshotID is the dump restored, the latest one of Database by default
+	SnapshotID string `json:"snapshotID,omitempty"`
+	// Database is the dumped database
+	Database string `json:"database,omitempty"`
+	// TargetDatabase is restored into, the dumped database by default. It
+	// must exist.
+	TargetDatabase string `json:"targetDatabase,omitempty"`
+	// Schemas and Tables restrict the restore to the named objects
+	Schemas []string `json:"schemas,omitempty"`
+	Tables  []string `json:"tables,omitempty"`
+	// Clean drops objects before recreating them
+	Clean      bool `json:"clean,omitempty"`
+	DataOnly   bool `json:"dataOnly,omitempty"`
+	SchemaOnly bool `json:"schemaOnly,omitempty"`
+	// NoOwner skips restoring object ownership
+	NoOwner bool `json:"noOwner,omitempty"`
+}
+
+// Validate checks the options
+func (o RestoreOptions) Validate() error {
+	if o.SnapshotID == "" && o.Database == "" {
+		return fmt.Errorf("snapshotID or database is required")
+	}
+	if o.DataOnly && o.SchemaOnly {
+		return fmt.Errorf("dataOnly and schemaOnly are mutually exclusive")
+	}
+	if o.Clean && o.DataOnly {
+		return fmt.Errorf("clean can't be combined with dataOnly")
+	}
+	return nil
+}
+
+// args returns the pg_restore arguments restoring into the database
+func (o RestoreOptions) args(connString string) []string {
+	args := []string{"--exit-on-error", "--no-password", "--dbname=" + connString}
+	for _, schema := range o.Schemas {
+		args = append(args, "--schema="+schema)
+	}
+	for _, table := range o.Tables {
+		args = append(args, "--table="+table)
+	}
+	if o.Clean {
+		args = append(args, "--clean", "--if-exists")
+	}
+	if o.DataOnly {
+		args = append(args, "--data-only")
+	}
+	if o.SchemaOnly {
+		args = append(args, "--schema-only")
+	}
+	if o.NoOwner {
+		args = append(args, "--no-owner")
+	}
+	return args
+}
+
+// Restore pipes a database dump into pg_restore
+func (m *Manager) Restore(ctx context.Context, opts RestoreOptions) (err error) {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	ctx, span := tracing.Start(ctx, "logical.Restore",
+		attribute.String("snapshot_id", opts.SnapshotID),
+		attribute.String("database", opts.Database),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	logger := m.logger.Context(ctx).Operation("logical_restore").WithFields(map[string]interface{}{
+		"snapshot_id": opts.SnapshotID,
+		"database":    opts.Database,
+	})
+
+	snapshot, db, err := m.findDump(ctx, opts.SnapshotID, opts.Database)
+	if err != nil {
+		logger.Error().Err(err).Msg("Dump not found")
+		return err
+	}
+	target := opts.TargetDatabase
+	if target == "" {
+		target = db
+	}
+	logger = logger.WithFields(map[string]interface{}{
+		"snapshot_id":     snapshot.ID,
+		"target_database": target,
+	})
+	logger.Info().Msg("Starting logical restore")
+
+	path := "/" + dumpFileName(db)
+	if len(snapshot.Paths) > 0 {
+		path = snapshot.Paths[0]
+	}
+	err = restic.DumpTo(ctx, m.client, snapshot.ID, path, func(r io.Reader) error {
+		return m.run(ctx, command(m.config.PGRestoreCommand, "pg_restore"), opts.args(m.config.connString(target)), r, io.Discard)
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("Logical restore failed")
+		return fmt.Errorf("failed to restore dump: %v", err)
+	}
+
+	logger.Info().Msg("Logical restore completed successfully")
+	return nil
+}
+
+// findDump returns the dump with the given ID, or the latest one of the
+// database, and the database it holds
+func (m *Manager) findDump(ctx context.Context, snapshotID, db string) (*restic.Snapshot, string, error) {
+	tags := []string{TypeTag}
+	if db != "" {
+		tags = append(tags, DatabaseTag(db))
+	}
+	snapshots, err := m.client.FindSnapshots(ctx, tags)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list logical backups: %v", err)
+	}
+	if snapshotID != "" {
+		snapshot, err := restic.FindByID(snapshots, snapshotID)
+		if err != nil {
+			return nil, "", err
+		}
+		name := dumpDatabase(snapshot)
+		if name == "" {
+			return nil, "", fmt.Errorf("snapshot %s is not a database dump", snapshotID)
+		}
+		return snapshot, name, nil
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Time.After(snapshots[j].Time) })
+	for _, snapshot := range snapshots {
+		if name := dumpDatabase(snapshot); name != "" {
+			return snapshot, name, nil
+		}
+	}
+	return nil, "", fmt.Errorf("no logical backup of database %s found", db)
+}
+
+// dumpDatabase returns the database a dump holds, empty if the snapshot is
+// not a database dump
+func dumpDatabase(snapshot *restic.Snapshot) string {
+	for _, tag := range snapshot.Tags {
+		if name, ok := strings.CutPrefix(tag, databaseTagPrefix); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// run runs a PostgreSQL client tool with the password of the server, and
+// without the plugin's repository credentials
+func (m *Manager) run(ctx context.Context, name string, args []string, stdin io.Reader, stdout io.Writer) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = pgconn.Env(m.password)
+	var stderr bytes.Buffer
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w: %s", name, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package logical
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+// mockResticClient stores streamed backups in memory
+type mockResticClient struct {
+	restic.Client
+	snapshots []*restic.Snapshot
+	contents  map[string][]byte
+	deleted   []string
+}
+
+func newMockResticClient() *mockResticClient {
+	return &mockResticClient{contents: make(map[string][]byte)}
+}
+
+func (m *mockResticClient) BackupStdin(_ context.Context, filename string, tags []string, stdin io.Reader) (*restic.BackupSummary, error) {
+	data, _ := io.ReadAll(stdin)
+	id := fmt.Sprintf("%08d", len(m.snapshots)+1)
+	m.snapshots = append(m.snapshots, &restic.Snapshot{
+		ID:    id,
+		Time:  time.Now().Add(time.Duration(len(m.snapshots)) * time.Second),
+		Tags:  tags,
+		Paths: []string{"/" + filename},
+	})
+	m.contents[id] = data
+	return &restic.BackupSummary{SnapshotID: id, TotalBytesProcessed: uint64(len(data))}, nil
+}
+
+func (m *mockResticClient) Dump(_ context.Context, snapshotID, _ string, w io.Writer) error {
+	_, err := w.Write(m.contents[snapshotID])
+	return err
+}
+
+func (m *mockResticClient) FindSnapshots(_ context.Context, tags []string) ([]*restic.Snapshot, error) {
+	var found []*restic.Snapshot
+	for _, s := range m.snapshots {
+		if !slices.ContainsFunc(tags, func(tag string) bool { return !slices.Contains(s.Tags, tag) }) {
+			found = append(found, s)
+		}
+	}
+	return found, nil
+}
+
+func (m *mockResticClient) DeleteSnapshots(_ context.Context, ids []string) error {
+	m.deleted = append(m.deleted, ids...)
+	return nil
+}
+
+// writeScript writes an executable shell script standing in for a client tool
+func writeScript(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testConfig returns a configuration whose client tools are scripts: pg_dump
+// prints its arguments, pg_restore records its arguments and input
+func testConfig(t *testing.T) (Config, string) {
+	dir := t.TempDir()
+	return Config{
+		ConnInfo:         "host=pg-rw user=postgres",
+		PGDumpCommand:    writeScript(t, dir, "pg_dump", `case "$*" in *broken*) echo 'database "broken" does not exist' >&2; exit 1;; esac; printf 'dump %s' "$3"`),
+		PGDumpAllCommand: writeScript(t, dir, "pg_dumpall", `printf 'CREATE ROLE app;'`),
+		PGRestoreCommand: writeScript(t, dir, "pg_restore", `echo "$@" > `+dir+`/restore-args; cat > `+dir+`/restore-input`),
+		PsqlCommand:      writeScript(t, dir, "psql", `printf 'app\000postgres\000'`),
+	}, dir
+}
+
+func TestManager_Backup(t *testing.T) {
+	cfg, _ := testConfig(t)
+	client := newMockResticClient()
+	manager := NewManager(client, cfg, logging.NewLogger(logging.Config{Level: "info"}))
+
+	result, err := manager.Backup(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+	if result.Globals.SnapshotID == "" || len(result.Dumps) != 2 {
+		t.Fatalf("Backup() = %+v, want globals and 2 dumps", result)
+	}
+	for _, dump := range result.Dumps {
+		snapshot := client.snapshots[slices.IndexFunc(client.snapshots, func(s *restic.Snapshot) bool { return s.ID == dump.SnapshotID })]
+		if !slices.Contains(snapshot.Tags, TypeTag) || !slices.Contains(snapshot.Tags, DatabaseTag(dump.Database)) {
+			t.Errorf("snapshot of %s tagged %v", dump.Database, snapshot.Tags)
+		}
+		want := "dump --dbname=host=pg-rw user=postgres dbname='" + dump.Database + "'"
+		if got := string(client.contents[dump.SnapshotID]); got != want {
+			t.Errorf("dump of %s = %q, want %q", dump.Database, got, want)
+		}
+	}
+
+	// A failing database is reported without stopping the others
+	result, err = manager.Backup(context.Background(), []string{"broken", "app", "a,b"})
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("Backup() error = %v, want pg_dump failure", err)
+	}
+	if result.Dumps[0].Error == "" || result.Dumps[1].SnapshotID == "" || result.Dumps[2].Error == "" {
+		t.Errorf("Backup() dumps = %+v", result.Dumps)
+	}
+	if len(client.deleted) != 1 {
+		t.Errorf("incomplete snapshots deleted = %v, want 1", client.deleted)
+	}
+}
+
+func TestManager_Restore(t *testing.T) {
+	cfg, dir := testConfig(t)
+	client := newMockResticClient()
+	manager := NewManager(client, cfg, logging.NewLogger(logging.Config{Level: "info"}))
+	if _, err := manager.Backup(context.Background(), []string{"app"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Backup(context.Background(), []string{"app"}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := manager.Restore(context.Background(), RestoreOptions{
+		Database:       "app",
+		TargetDatabase: "app_copy",
+		Tables:         []string{"orders"},
+		Clean:          true,
+	})
+	if err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	args, err := os.ReadFile(filepath.Join(dir, "restore-args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "--exit-on-error --no-password --dbname=host=pg-rw user=postgres dbname='app_copy' --table=orders --clean --if-exists\n"
+	if string(args) != want {
+		t.Errorf("pg_restore args = %q, want %q", args, want)
+	}
+	if input, _ := os.ReadFile(filepath.Join(dir, "restore-input")); !strings.HasPrefix(string(input), "dump ") {
+		t.Errorf("pg_restore input = %q", input)
+	}
+
+	for _, opts := range []RestoreOptions{
+		{Database: "missing"},
+		{SnapshotID: client.snapshots[0].ID},
+		{Database: "app", DataOnly: true, SchemaOnly: true},
+		{},
+	} {
+		if err := manager.Restore(context.Background(), opts); err == nil {
+			t.Errorf("Restore(%+v) should fail", opts)
+		}
+	}
+
+	// Snapshot IDs are prefixes of the dumps' IDs, naming a single one
+	for _, tt := range []struct {
+		snapshotID string
+		wantErr    error
+	}{
+		{snapshotID: "0000000", wantErr: restic.ErrSnapshotAmbiguous},
+		{snapshotID: "4fa1b2c3", wantErr: restic.ErrSnapshotNotFound},
+	} {
+		if err := manager.Restore(context.Background(), RestoreOptions{SnapshotID: tt.snapshotID}); !errors.Is(err, tt.wantErr) {
+			t.Errorf("Restore() of %s error = %v, want %v", tt.snapshotID, err, tt.wantErr)
+		}
+	}
+}
+
+func TestManager_Password(t *testing.T) {
+	t.Setenv("RESTIC_PASSWORD", "repository")
+	cfg, dir := testConfig(t)
+	cfg.ConnInfo = "host=pg-rw user=postgres password='s3cret'"
+	cfg.PGDumpAllCommand = writeScript(t, dir, "pg_dumpall", `printf '%s|%s|%s' "$PGPASSWORD" "$RESTIC_PASSWORD" "$*"`)
+	client := newMockResticClient()
+	manager := NewManager(client, cfg, logging.NewLogger(logging.Config{Level: "info"}))
+
+	result, err := manager.Backup(context.Background(), []string{"app"})
+	if err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+	// The password is in the environment, not in the arguments, and the
+	// repository credentials are in neither
+	want := "s3cret||--globals-only --no-password --dbname=host=pg-rw user=postgres"
+	if got := string(client.contents[result.Globals.SnapshotID]); got != want {
+		t.Errorf("pg_dumpall saw %q, want %q", got, want)
+	}
+}
+
+func TestConfig_ConnString(t *testing.T) {
+	cfg := Config{ConnInfo: "host=pg-rw dbname=postgres"}
+	if got, want := cfg.connString(`it's\odd`), `host=pg-rw dbname=postgres dbname='it\'s\\odd'`; got != want {
+		t.Errorf("connString() = %q, want %q", got, want)
+	}
+	if err := (Config{ConnInfo: "postgresql://pg-rw/app"}).Validate(); err == nil {
+		t.Error("Validate() of a URI should fail")
+	}
+}
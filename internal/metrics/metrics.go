@@ -0,0 +1,284 @@
+// Package metrics exports Prometheus metrics of backups, restores, WAL
+// archiving and the restic commands running them.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "cnpg_restic"
+
+// Result label values
+const (
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+var (
+	tenantLabels = []string{"cluster", "namespace"}
+	resultLabels = []string{"cluster", "namespace", "result"}
+
+	// durationBuckets span quick WAL operations up to multi-hour base backups
+	durationBuckets = prometheus.ExponentialBuckets(0.05, 3, 12)
+)
+
+var (
+	backupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backups_total",
+		Help:      "Base backups by result.",
+	}, resultLabels)
+	backupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "backup_duration_seconds",
+		Help:      "Duration of base backups.",
+		Buckets:   durationBuckets,
+	}, tenantLabels)
+	backupBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backup_bytes_total",
+		Help:      "Bytes processed by successful base backups.",
+	}, tenantLabels)
+	backupLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "backup_last_success_timestamp_seconds",
+		Help:      "Time of the last successful base backup.",
+	}, tenantLabels)
+
+	restoresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "restores_total",
+		Help:      "Base backup restores by result.",
+	}, resultLabels)
+	restoreDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "restore_duration_seconds",
+		Help:      "Duration of base backup restores.",
+		Buckets:   durationBuckets,
+	}, tenantLabels)
+
+	walArchivesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "wal_archives_total",
+		Help:      "WAL segment archivals by result.",
+	}, resultLabels)
+	walArchiveDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "wal_archive_duration_seconds",
+		Help:      "Duration of WAL segment archivals.",
+		Buckets:   durationBuckets,
+	}, tenantLabels)
+	walArchiveBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "wal_archive_bytes_total",
+		Help:      "Bytes of successfully archived WAL segments.",
+	}, tenantLabels)
+
+	walRestoresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "wal_restores_total",
+		Help:      "WAL segment restores by result.",
+	}, resultLabels)
+	walRestoreDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "wal_restore_duration_seconds",
+		Help:      "Duration of WAL segment restores.",
+		Buckets:   durationBuckets,
+	}, tenantLabels)
+	walRestoreBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "wal_restore_bytes_total",
+		Help:      "Bytes of successfully restored WAL segments.",
+	}, tenantLabels)
+
+	repositorySnapshots = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "repository_snapshots",
+		Help:      "Snapshots in the repository by type.",
+	}, []string{"cluster", "namespace", "type"})
+
+	resticCommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "restic_command_duration_seconds",
+		Help:      "Duration of restic subprocesses by command and result.",
+		Buckets:   durationBuckets,
+	}, []string{"cluster", "namespace", "command", "result"})
+
+	verificationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "verifications_total",
+		Help:      "Restore verifications by result (passed, failed, error).",
+	}, resultLabels)
+	verificationLastPassed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "verification_last_passed",
+		Help:      "Whether the last completed restore verification passed.",
+	}, tenantLabels)
+	verificationLastTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "verification_last_timestamp_seconds",
+		Help:      "Time of the last completed restore verification.",
+	}, tenantLabels)
+
+	checksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "repository_checks_total",
+		Help:      "Repository integrity checks by result (ok, errors, failure).",
+	}, resultLabels)
+	checkLastErrors = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "repository_check_last_errors",
+		Help:      "Errors found by the last completed repository check.",
+	}, tenantLabels)
+	checkLastTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "repository_check_last_timestamp_seconds",
+		Help:      "Time of the last completed repository check.",
+	}, tenantLabels)
+
+	lastArchivedWAL = newWALCollector()
+)
+
+// registry holds the plugin metrics and the Go runtime and process collectors
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		backupsTotal, backupDuration, backupBytes, backupLastSuccess,
+		restoresTotal, restoreDuration,
+		walArchivesTotal, walArchiveDuration, walArchiveBytes,
+		walRestoresTotal, walRestoreDuration, walRestoreBytes,
+		repositorySnapshots,
+		resticCommandDuration,
+		verificationsTotal, verificationLastPassed, verificationLastTimestamp,
+		checksTotal, checkLastErrors, checkLastTimestamp,
+		lastArchivedWAL,
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// tenantKey is the context key of the tenant labels
+type tenantKey struct{}
+
+// tenant identifies the cluster metrics are recorded for
+type tenant struct {
+	cluster   string
+	namespace string
+}
+
+// WithTenant returns a context recording metrics for the given cluster
+func WithTenant(ctx context.Context, cluster, namespace string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant{cluster: cluster, namespace: namespace})
+}
+
+// tenantFrom returns the tenant of the context, empty if it has none
+func tenantFrom(ctx context.Context) tenant {
+	t, _ := ctx.Value(tenantKey{}).(tenant)
+	return t
+}
+
+// result returns the result label value of an operation
+func result(err error) string {
+	if err != nil {
+		return resultFailure
+	}
+	return resultSuccess
+}
+
+// ObserveBackup records a base backup that processed the given bytes
+func ObserveBackup(ctx context.Context, duration time.Duration, bytes uint64, err error) {
+	t := tenantFrom(ctx)
+	backupsTotal.WithLabelValues(t.cluster, t.namespace, result(err)).Inc()
+	backupDuration.WithLabelValues(t.cluster, t.namespace).Observe(duration.Seconds())
+	if err == nil {
+		backupBytes.WithLabelValues(t.cluster, t.namespace).Add(float64(bytes))
+		backupLastSuccess.WithLabelValues(t.cluster, t.namespace).SetToCurrentTime()
+	}
+}
+
+// ObserveRestore records a base backup restore
+func ObserveRestore(ctx context.Context, duration time.Duration, err error) {
+	t := tenantFrom(ctx)
+	restoresTotal.WithLabelValues(t.cluster, t.namespace, result(err)).Inc()
+	restoreDuration.WithLabelValues(t.cluster, t.namespace).Observe(duration.Seconds())
+}
+
+// ObserveWALArchive records the archival of a WAL segment
+func ObserveWALArchive(ctx context.Context, walFile string, duration time.Duration, bytes int64, err error) {
+	t := tenantFrom(ctx)
+	walArchivesTotal.WithLabelValues(t.cluster, t.namespace, result(err)).Inc()
+	walArchiveDuration.WithLabelValues(t.cluster, t.namespace).Observe(duration.Seconds())
+	if err == nil {
+		walArchiveBytes.WithLabelValues(t.cluster, t.namespace).Add(float64(bytes))
+		lastArchivedWAL.set(t, walFile, time.Now())
+	}
+}
+
+// ObserveWALRestore records the restore of a WAL segment
+func ObserveWALRestore(ctx context.Context, duration time.Duration, bytes int64, err error) {
+	t := tenantFrom(ctx)
+	walRestoresTotal.WithLabelValues(t.cluster, t.namespace, result(err)).Inc()
+	walRestoreDuration.WithLabelValues(t.cluster, t.namespace).Observe(duration.Seconds())
+	if err == nil {
+		walRestoreBytes.WithLabelValues(t.cluster, t.namespace).Add(float64(bytes))
+	}
+}
+
+// ObserveResticCommand records the run of a restic subprocess
+func ObserveResticCommand(ctx context.Context, command string, duration time.Duration, err error) {
+	t := tenantFrom(ctx)
+	resticCommandDuration.WithLabelValues(t.cluster, t.namespace, command, result(err)).Observe(duration.Seconds())
+}
+
+// SetSnapshotCount records the number of snapshots of a type in the repository
+func SetSnapshotCount(ctx context.Context, snapshotType string, count int) {
+	t := tenantFrom(ctx)
+	repositorySnapshots.WithLabelValues(t.cluster, t.namespace, snapshotType).Set(float64(count))
+}
+
+// ObserveVerification records a restore verification, err is set if it
+// could not run
+func ObserveVerification(ctx context.Context, passed bool, err error) {
+	t := tenantFrom(ctx)
+	switch {
+	case err != nil:
+		verificationsTotal.WithLabelValues(t.cluster, t.namespace, "error").Inc()
+		return
+	case passed:
+		verificationsTotal.WithLabelValues(t.cluster, t.namespace, "passed").Inc()
+		verificationLastPassed.WithLabelValues(t.cluster, t.namespace).Set(1)
+	default:
+		verificationsTotal.WithLabelValues(t.cluster, t.namespace, "failed").Inc()
+		verificationLastPassed.WithLabelValues(t.cluster, t.namespace).Set(0)
+	}
+	verificationLastTimestamp.WithLabelValues(t.cluster, t.namespace).SetToCurrentTime()
+}
+
+// ObserveCheck records a repository check that found the given number of
+// errors, err is set if it could not run
+func ObserveCheck(ctx context.Context, errorsFound int, err error) {
+	t := tenantFrom(ctx)
+	switch {
+	case err != nil:
+		checksTotal.WithLabelValues(t.cluster, t.namespace, resultFailure).Inc()
+		return
+	case errorsFound == 0:
+		checksTotal.WithLabelValues(t.cluster, t.namespace, "ok").Inc()
+	default:
+		checksTotal.WithLabelValues(t.cluster, t.namespace, "errors").Inc()
+	}
+	checkLastErrors.WithLabelValues(t.cluster, t.namespace).Set(float64(errorsFound))
+	checkLastTimestamp.WithLabelValues(t.cluster, t.namespace).SetToCurrentTime()
+}
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveBackup(t *testing.T) {
+	ctx := WithTenant(context.Background(), "pg-backup", "db")
+
+	ObserveBackup(ctx, time.Second, 4096, nil)
+	ObserveBackup(ctx, time.Second, 1024, fmt.Errorf("repository locked"))
+
+	if got := testutil.ToFloat64(backupsTotal.WithLabelValues("pg-backup", "db", resultSuccess)); got != 1 {
+		t.Errorf("successful backups = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(backupsTotal.WithLabelValues("pg-backup", "db", resultFailure)); got != 1 {
+		t.Errorf("failed backups = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(backupBytes.WithLabelValues("pg-backup", "db")); got != 4096 {
+		t.Errorf("backup bytes = %v, want only the successful backup's 4096", got)
+	}
+	if got := testutil.ToFloat64(backupLastSuccess.WithLabelValues("pg-backup", "db")); got == 0 {
+		t.Error("last successful backup timestamp not set")
+	}
+}
+
+func TestObserveWALArchive(t *testing.T) {
+	ctx := WithTenant(context.Background(), "pg-wal", "db")
+
+	ObserveWALArchive(ctx, "000000010000000000000001", 10*time.Millisecond, 16, nil)
+	ObserveWALArchive(ctx, "000000010000000000000002", 10*time.Millisecond, 16, nil)
+	ObserveWALArchive(ctx, "000000010000000000000003", 10*time.Millisecond, 16, fmt.Errorf("failed"))
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+
+	want := `cnpg_restic_wal_last_archived_info{cluster="pg-wal",namespace="db",wal_file="000000010000000000000002"} 1`
+	if !strings.Contains(body, want) {
+		t.Errorf("metrics do not contain %q", want)
+	}
+	if strings.Contains(body, `wal_file="000000010000000000000001"`) {
+		t.Error("metrics still report the previously archived segment")
+	}
+	if !strings.Contains(body, `cnpg_restic_wal_last_archived_age_seconds{cluster="pg-wal",namespace="db"}`) {
+		t.Error("metrics do not report the age of the last archived segment")
+	}
+	if got := testutil.ToFloat64(walArchiveBytes.WithLabelValues("pg-wal", "db")); got != 32 {
+		t.Errorf("archived bytes = %v, want 32", got)
+	}
+}
+
+func TestObserveVerification(t *testing.T) {
+	ctx := WithTenant(context.Background(), "pg-verify", "db")
+
+	ObserveVerification(ctx, true, nil)
+	ObserveVerification(ctx, false, nil)
+	ObserveVerification(ctx, false, fmt.Errorf("no base backup found"))
+
+	for _, result := range []string{"passed", "failed", "error"} {
+		if got := testutil.ToFloat64(verificationsTotal.WithLabelValues("pg-verify", "db", result)); got != 1 {
+			t.Errorf("%s verifications = %v, want 1", result, got)
+		}
+	}
+	if got := testutil.ToFloat64(verificationLastPassed.WithLabelValues("pg-verify", "db")); got != 0 {
+		t.Errorf("last verification passed = %v, want 0", got)
+	}
+}
+
+func TestWithoutTenant(t *testing.T) {
+	ObserveResticCommand(context.Background(), "snapshots", time.Second, nil)
+
+	if got := testutil.CollectAndCount(resticCommandDuration); got == 0 {
+		t.Error("restic command duration not recorded without tenant")
+	}
+}
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	walLastArchivedInfo = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "wal_last_archived_info"),
+		"The last archived WAL segment, named by the wal_file label.",
+		[]string{"cluster", "namespace", "wal_file"}, nil,
+	)
+	walLastArchivedTimestamp = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "wal_last_archived_timestamp_seconds"),
+		"Time the last WAL segment was archived.",
+		tenantLabels, nil,
+	)
+	walLastArchivedAge = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "wal_last_archived_age_seconds"),
+		"Seconds since the last WAL segment was archived.",
+		tenantLabels, nil,
+	)
+)
+
+// archivedWAL is the last WAL segment archived for a tenant
+type archivedWAL struct {
+	name string
+	at   time.Time
+}
+
+// walCollector exports the last archived WAL segment of each tenant, computing
+// its age at scrape time
+type walCollector struct {
+	mu   sync.Mutex
+	last map[tenant]archivedWAL
+}
+
+func newWALCollector() *walCollector {
+	return &walCollector{last: make(map[tenant]archivedWAL)}
+}
+
+func (c *walCollector) set(t tenant, name string, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last[t] = archivedWAL{name: name, at: at}
+}
+
+// Describe implements prometheus.Collector
+func (c *walCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- walLastArchivedInfo
+	ch <- walLastArchivedTimestamp
+	ch <- walLastArchivedAge
+}
+
+// Collect implements prometheus.Collector
+func (c *walCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for t, wal := range c.last {
+		ch <- prometheus.MustNewConstMetric(walLastArchivedInfo, prometheus.GaugeValue, 1, t.cluster, t.namespace, wal.name)
+		ch <- prometheus.MustNewConstMetric(walLastArchivedTimestamp, prometheus.GaugeValue,
+			float64(wal.at.UnixNano())/1e9, t.cluster, t.namespace)
+		ch <- prometheus.MustNewConstMetric(walLastArchivedAge, prometheus.GaugeValue,
+			time.Since(wal.at).Seconds(), t.cluster, t.namespace)
+	}
+}
@@ -0,0 +1,247 @@
+// Package pgbackup runs non-exclusive base backups with pg_backup_start and
+// pg_backup_stop, on a primary or a hot standby, over a psql session kept
+// open for the duration of the backup
+package pgbackup
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"cloud-native-pg-restic-backup/internal/pgconn"
+)
+
+const (
+	// defaultPsqlCommand is run unless Config.PsqlCommand is set
+	defaultPsqlCommand = "psql"
+
+	// markerPrefix starts the lines psql reports step results on
+	markerPrefix = "cnpg-restic:"
+)
+
+// checkpointModes are the checkpoint modes a backup starts with
+var checkpointModes = map[string]bool{"": true, "fast": true, "spread": true}
+
+// Backup sources, as recorded in backup tags
+const (
+	FromPrimary = "primary"
+	FromStandby = "standby"
+)
+
+// Config configures the session backups are coordinated over
+type Config struct {
+	// ConnInfo is the libpq connection string of the instance owning the
+	// backed up data directory, coordination is disabled without one
+	ConnInfo string `json:"connInfo,omitempty"`
+	// Checkpoint is fast or spread, the default. A backup on a standby
+	// starts at the last restartpoint either way.
+	Checkpoint string `json:"checkpoint,omitempty"`
+	// PsqlCommand is the psql binary, found in PATH by default
+	PsqlCommand string `json:"psqlCommand,omitempty"`
+}
+
+// Enabled reports whether backups are coordinated with the server
+func (c Config) Enabled() bool {
+	return c.ConnInfo != ""
+}
+
+// Validate checks the configuration
+func (c Config) Validate() error {
+	if !checkpointModes[c.Checkpoint] {
+		return fmt.Errorf("invalid checkpoint mode %q, must be fast or spread", c.Checkpoint)
+	}
+	return nil
+}
+
+// Server describes the instance a backup runs on
+type Server struct {
+	// Version is the server_version_num of the server
+	Version int
+	// InRecovery is true on a standby
+	InRecovery bool
+	// SegmentSize is the WAL segment size in bytes
+	SegmentSize int64
+}
+
+// From returns where backups of the server are taken from
+func (s Server) From() string {
+	if s.InRecovery {
+		return FromStandby
+	}
+	return FromPrimary
+}
+
+// Result is what pg_backup_stop returns
+type Result struct {
+	// StopLSN is where the backup ends, WAL up to it must be replayed
+	StopLSN string
+	// Label is the backup_label of the backup, the server can't recover
+	// it without
+	Label []byte
+}
+
+// Session is a psql session a backup is in progress on. The server aborts
+// the backup if the session ends before Stop.
+type Session struct {
+	Server Server
+
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr *bufio.Reader
+}
+
+// steps are the psql scripts of a backup, each reporting its results on a
+// marker line. pg_backup_start and pg_backup_stop replaced the former
+// functions in PostgreSQL 15.
+const (
+	infoScript = `SELECT current_setting('server_version_num') AS version, pg_is_in_recovery() AS recovery, (SELECT setting FROM pg_settings WHERE name = 'wal_segment_size') AS segment_size \gset
+\warn ` + markerPrefix + `info :version :recovery :segment_size
+`
+	startScript = `SELECT pg_backup_start(:'label', :fast) AS start_lsn \gset
+\warn ` + markerPrefix + `start :start_lsn
+`
+	startScriptLegacy = `SELECT pg_start_backup(:'label', :fast, false) AS start_lsn \gset
+\warn ` + markerPrefix + `start :start_lsn
+`
+	stopScript = `SELECT lsn AS stop_lsn, translate(encode(convert_to(labelfile, 'UTF8'), 'base64'), E'\n', '') AS labelfile FROM pg_backup_stop(false) \gset
+\warn ` + markerPrefix + `stop :stop_lsn :labelfile
+`
+	stopScriptLegacy = `SELECT lsn AS stop_lsn, translate(encode(convert_to(labelfile, 'UTF8'), 'base64'), E'\n', '') AS labelfile FROM pg_stop_backup(false, false) \gset
+\warn ` + markerPrefix + `stop :stop_lsn :labelfile
+`
+)
+
+// Start connects to the server and starts a backup labelled label on it
+func Start(ctx context.Context, cfg Config, label string) (*Session, error) {
+	command := cfg.PsqlCommand
+	if command == "" {
+		command = defaultPsqlCommand
+	}
+	fast := "false"
+	if cfg.Checkpoint == "fast" {
+		fast = "true"
+	}
+
+	// The script is read from stdin as it is written, results come back on
+	// stderr, which psql doesn't buffer
+	connInfo, password := pgconn.SplitPassword(cfg.ConnInfo)
+	args := []string{"--no-psqlrc", "--no-password", "--quiet",
+		"--set=ON_ERROR_STOP=1", "--set=label=" + label, "--set=fast=" + fast,
+		"--dbname=" + connInfo}
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Env = pgconn.Env(password)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start psql: %w", err)
+	}
+	s := &Session{cmd: cmd, stdin: stdin, stderr: bufio.NewReader(stderr)}
+
+	info, err := s.run(infoScript, "info", 3)
+	if err == nil {
+		s.Server, err = parseServer(info)
+	}
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to query server: %w", err)
+	}
+
+	script := startScript
+	if s.Server.Version < 150000 {
+		script = startScriptLegacy
+	}
+	if _, err := s.run(script, "start", 1); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to start backup: %w", err)
+	}
+	return s, nil
+}
+
+// parseServer parses the results of the info step
+func parseServer(fields []string) (Server, error) {
+	version, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return Server{}, fmt.Errorf("invalid server version %q", fields[0])
+	}
+	segmentSize, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || segmentSize <= 0 {
+		return Server{}, fmt.Errorf("invalid WAL segment size %q", fields[2])
+	}
+	return Server{Version: version, InRecovery: fields[1] == "t", SegmentSize: segmentSize}, nil
+}
+
+// Stop stops the backup and ends the session
+func (s *Session) Stop() (*Result, error) {
+	script := stopScript
+	if s.Server.Version < 150000 {
+		script = stopScriptLegacy
+	}
+	fields, err := s.run(script, "stop", 2)
+	if closeErr := s.Close(); err == nil && closeErr != nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to stop backup: %w", err)
+	}
+
+	label, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup label: %w", err)
+	}
+	return &Result{StopLSN: fields[0], Label: label}, nil
+}
+
+// Close ends the session, aborting a backup still in progress
+func (s *Session) Close() error {
+	s.stdin.Close()
+	// Whatever psql still reports must be drained for it to exit
+	_, _ = io.Copy(io.Discard, s.stderr)
+	if err := s.cmd.Wait(); err != nil {
+		return fmt.Errorf("psql failed: %w", err)
+	}
+	return nil
+}
+
+// run sends a step script and returns the fields of its marker line. Other
+// lines psql writes are the errors and notices reported when the step fails.
+func (s *Session) run(script, step string, fields int) ([]string, error) {
+	// psql may have exited already, its errors explain why
+	var messages []string
+	if _, err := io.WriteString(s.stdin, script); err != nil {
+		messages = append(messages, err.Error())
+	}
+
+	marker := markerPrefix + step
+	for {
+		line, err := s.stderr.ReadString('\n')
+		line = strings.TrimRight(line, "\n")
+		if values, ok := strings.CutPrefix(line, marker); ok {
+			result := strings.Fields(values)
+			if len(result) != fields {
+				return nil, fmt.Errorf("unexpected %s result %q", step, values)
+			}
+			return result, nil
+		}
+		if line != "" {
+			messages = append(messages, line)
+		}
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("psql exited: %s", strings.Join(messages, "; "))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from psql: %w", err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package pgbackup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakePsql writes a psql answering each step of the script read from stdin
+// with the given marker lines, recording its arguments, passwords and
+// script in dir
+func fakePsql(t *testing.T, info, stop string) string {
+	t.Helper()
+	dir := t.TempDir()
+	script := `#!/bin/sh
+echo "$@" > "` + dir + `/args"
+echo "$PGPASSWORD|$RESTIC_PASSWORD" > "` + dir + `/passwords"
+while read -r line; do
+	echo "$line" >> "` + dir + `/script"
+	case "$line" in
+	'\warn cnpg-restic:info'*) echo "` + info + `" >&2 ;;
+	'\warn cnpg-restic:start'*) echo "cnpg-restic:start 0/3000028" >&2 ;;
+	'\warn cnpg-restic:stop'*) echo "NOTICE:  pg_backup_stop complete" >&2; echo "` + stop + `" >&2 ;;
+	esac
+done
+`
+	command := filepath.Join(dir, "psql")
+	if err := os.WriteFile(command, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return command
+}
+
+func TestSession(t *testing.T) {
+	label := "START WAL LOCATION: 0/3000028 (file 000000010000000000000003)\n"
+	encoded := "U1RBUlQgV0FMIExPQ0FUSU9OOiAwLzMwMDAwMjggKGZpbGUgMDAwMDAwMDEwMDAwMDAwMDAwMDAwMDAzKQo="
+
+	tests := []struct {
+		name       string
+		info       string
+		wantFrom   string
+		wantScript string
+	}{
+		{
+			name:       "standby",
+			info:       "cnpg-restic:info 170002 t 16777216",
+			wantFrom:   FromStandby,
+			wantScript: "pg_backup_stop(false)",
+		},
+		{
+			name:       "primary before PostgreSQL 15",
+			info:       "cnpg-restic:info 140011 f 16777216",
+			wantFrom:   FromPrimary,
+			wantScript: "pg_stop_backup(false, false)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RESTIC_PASSWORD", "repository")
+			command := fakePsql(t, tt.info, "cnpg-restic:stop 0/3000100 "+encoded)
+			cfg := Config{ConnInfo: "host=/controller/run user=postgres password=s3cret", Checkpoint: "fast", PsqlCommand: command}
+
+			session, err := Start(context.Background(), cfg, "nightly backup")
+			if err != nil {
+				t.Fatalf("Start() error = %v", err)
+			}
+			if session.Server.From() != tt.wantFrom || session.Server.SegmentSize != 16<<20 {
+				t.Errorf("Server = %+v", session.Server)
+			}
+
+			result, err := session.Stop()
+			if err != nil {
+				t.Fatalf("Stop() error = %v", err)
+			}
+			if result.StopLSN != "0/3000100" || string(result.Label) != label {
+				t.Errorf("Stop() = %+v", result)
+			}
+
+			dir := filepath.Dir(command)
+			args, _ := os.ReadFile(filepath.Join(dir, "args"))
+			if !strings.HasSuffix(string(args), "--set=label=nightly backup --set=fast=true --dbname=host=/controller/run user=postgres\n") {
+				t.Errorf("psql args = %s", args)
+			}
+			// The password is only in the environment, which holds no
+			// repository credentials
+			if passwords, _ := os.ReadFile(filepath.Join(dir, "passwords")); string(passwords) != "s3cret|\n" {
+				t.Errorf("psql passwords = %q, want the server's only", passwords)
+			}
+			script, _ := os.ReadFile(filepath.Join(dir, "script"))
+			if !strings.Contains(string(script), tt.wantScript) {
+				t.Errorf("script doesn't call %s:\n%s", tt.wantScript, script)
+			}
+		})
+	}
+}
+
+func TestStart_Error(t *testing.T) {
+	dir := t.TempDir()
+	command := filepath.Join(dir, "psql")
+	script := "#!/bin/sh\necho 'psql: error: connection to server failed' >&2\nexit 2\n"
+	if err := os.WriteFile(command, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Start(context.Background(), Config{ConnInfo: "host=pg", PsqlCommand: command}, "")
+	if err == nil || !strings.Contains(err.Error(), "connection to server failed") {
+		t.Errorf("Start() error = %v, want the psql error", err)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	if err := (Config{Checkpoint: "spread"}).Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+	if err := (Config{Checkpoint: "immediate"}).Validate(); err == nil {
+		t.Error("Validate() of unknown checkpoint mode should fail")
+	}
+}
@@ -0,0 +1,155 @@
+// Package pgconn prepares the connection of PostgreSQL client tools, keeping
+// passwords out of their arguments and the plugin's credentials out of their
+// environment.
+package pgconn
+
+import (
+	"net/url"
+	"os"
+	"strings"
+)
+
+// passedEnv are the variables of the plugin's environment client tools get,
+// to find themselves and their passfile. The rest of the environment holds
+// repository credentials.
+var passedEnv = []string{"PATH", "HOME", "TMPDIR", "PGPASSFILE", "PGSERVICEFILE", "PGSYSCONFDIR"}
+
+// Env returns the environment of a client tool: the variables of passedEnv
+// the plugin has set, and PGPASSWORD if password is not empty. It is never
+// nil, as a nil environment is inherited whole.
+func Env(password string) []string {
+	env := []string{}
+	for _, name := range passedEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	if password != "" {
+		env = append(env, "PGPASSWORD="+password)
+	}
+	return env
+}
+
+// SplitPassword removes the password from a connection string, in
+// keyword/value or URI form, and returns it separately. Arguments are
+// visible to other processes, so the password is passed in PGPASSWORD.
+// Connection strings without a password are returned as they are.
+func SplitPassword(connInfo string) (string, string) {
+	if strings.HasPrefix(connInfo, "postgresql://") || strings.HasPrefix(connInfo, "postgres://") {
+		return splitURIPassword(connInfo)
+	}
+	return splitKeywordPassword(connInfo)
+}
+
+// splitKeywordPassword removes the password of a keyword/value connection
+// string. libpq uses the last of repeated keywords. A string libpq can't
+// parse is returned as it is, the client tool reports why.
+func splitKeywordPassword(connInfo string) (string, string) {
+	var kept []string
+	var password string
+	found := false
+	for i := 0; ; {
+		for i < len(connInfo) && isSpace(connInfo[i]) {
+			i++
+		}
+		if i == len(connInfo) {
+			break
+		}
+		start := i
+		for i < len(connInfo) && connInfo[i] != '=' && !isSpace(connInfo[i]) {
+			i++
+		}
+		keyword := connInfo[start:i]
+		for i < len(connInfo) && isSpace(connInfo[i]) {
+			i++
+		}
+		if i == len(connInfo) || connInfo[i] != '=' {
+			return connInfo, ""
+		}
+		i++
+		for i < len(connInfo) && isSpace(connInfo[i]) {
+			i++
+		}
+
+		var value strings.Builder
+		quoted := i < len(connInfo) && connInfo[i] == '\''
+		if quoted {
+			i++
+		}
+		for ; i < len(connInfo); i++ {
+			c := connInfo[i]
+			if quoted && c == '\'' || !quoted && isSpace(c) {
+				break
+			}
+			if c == '\\' && i+1 < len(connInfo) {
+				i++
+				c = connInfo[i]
+			}
+			value.WriteByte(c)
+		}
+		if quoted {
+			if i == len(connInfo) {
+				return connInfo, ""
+			}
+			i++
+		}
+
+		if keyword == "password" {
+			password, found = value.String(), true
+			continue
+		}
+		kept = append(kept, connInfo[start:i])
+	}
+	if !found {
+		return connInfo, ""
+	}
+	return strings.Join(kept, " "), password
+}
+
+// splitURIPassword removes the password of a connection URI, given in its
+// user info or as a parameter
+func splitURIPassword(uri string) (string, string) {
+	scheme, rest, _ := strings.Cut(uri, "://")
+	end := strings.IndexAny(rest, "/?")
+	if end < 0 {
+		end = len(rest)
+	}
+	authority, path := rest[:end], rest[end:]
+
+	var password string
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		if user, encoded, ok := strings.Cut(authority[:at], ":"); ok {
+			password = unescape(encoded)
+			authority = user + authority[at:]
+		}
+	}
+	if base, query, ok := strings.Cut(path, "?"); ok {
+		var kept []string
+		for _, param := range strings.Split(query, "&") {
+			if encoded, ok := strings.CutPrefix(param, "password="); ok {
+				password = unescape(encoded)
+				continue
+			}
+			kept = append(kept, param)
+		}
+		path = base
+		if len(kept) > 0 {
+			path += "?" + strings.Join(kept, "&")
+		}
+	}
+	return scheme + "://" + authority + path, password
+}
+
+// unescape decodes a percent-encoded URI component, keeping it as it is if
+// it is malformed
+func unescape(s string) string {
+	if decoded, err := url.PathUnescape(s); err == nil {
+		return decoded
+	}
+	return s
+}
+
+// isSpace reports whether libpq separates connection string values at c
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
@@ -0,0 +1,88 @@
+package pgdata
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// BackupLabelPath is the location of backup_label relative to the data directory
+const BackupLabelPath = "backup_label"
+
+var (
+	// Example: START WAL LOCATION: 0/2000028 (file 000000010000000000000002)
+	startWALRegex = regexp.MustCompile(`^([0-9A-F]+/[0-9A-F]+) \(file ([0-9A-F]{24})\)$`)
+)
+
+// BackupLabel holds the contents of a backup_label file
+type BackupLabel struct {
+	StartWALLocation   string
+	StartWALFile       string
+	CheckpointLocation string
+	BackupMethod       string
+	BackupFrom         string
+	StartTime          string
+	Label              string
+	StartTimeline      uint32
+}
+
+// ReadBackupLabel reads backup_label from the given data directory
+func ReadBackupLabel(dataDir string) (*BackupLabel, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, BackupLabelPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup_label: %w", err)
+	}
+	return ParseBackupLabel(data)
+}
+
+// ParseBackupLabel parses the contents of a backup_label file
+func ParseBackupLabel(data []byte) (*BackupLabel, error) {
+	label := &BackupLabel{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ": ")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "START WAL LOCATION":
+			matches := startWALRegex.FindStringSubmatch(value)
+			if matches == nil {
+				return nil, fmt.Errorf("invalid START WAL LOCATION: %s", value)
+			}
+			label.StartWALLocation = matches[1]
+			label.StartWALFile = matches[2]
+		case "CHECKPOINT LOCATION":
+			label.CheckpointLocation = value
+		case "BACKUP METHOD":
+			label.BackupMethod = value
+		case "BACKUP FROM":
+			label.BackupFrom = value
+		case "START TIME":
+			label.StartTime = value
+		case "LABEL":
+			label.Label = value
+		case "START TIMELINE":
+			timeline, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid START TIMELINE: %s", value)
+			}
+			label.StartTimeline = uint32(timeline)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse backup_label: %w", err)
+	}
+
+	if label.StartWALFile == "" {
+		return nil, fmt.Errorf("backup_label has no START WAL LOCATION")
+	}
+	return label, nil
+}
@@ -0,0 +1,153 @@
+package pgdata
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ExcludedDirContents are the directories whose contents base backups skip,
+// as PostgreSQL rebuilds or discards them at startup. The directories
+// themselves must exist for the server to start.
+var ExcludedDirContents = []string{
+	"pg_wal",
+	"pg_stat_tmp",
+	"pg_replslot",
+	"pg_dynshmem",
+	"pg_notify",
+	"pg_serial",
+	"pg_snapshots",
+	"pg_subtrans",
+}
+
+// PlaceholderDirs are the directories restores recreate empty, the excluded
+// ones and those nested in them
+var PlaceholderDirs = append(append([]string{}, ExcludedDirContents...),
+	filepath.Join("pg_wal", "archive_status"),
+)
+
+// excludedRootFiles are files at the top of the data directory base backups skip
+var excludedRootFiles = []string{
+	"postmaster.pid",
+	"postmaster.opts",
+	"current_logfiles",
+	"postgresql.auto.conf.tmp",
+}
+
+// excludedAnywhere are patterns of files skipped in any directory: the
+// relation cache and temporary files
+var excludedAnywhere = []string{
+	"pg_internal.init",
+	"pgsql_tmp*",
+}
+
+// initForkRegex matches the init fork marking an unlogged relation
+var initForkRegex = regexp.MustCompile(`^([0-9]+)_init$`)
+
+// ExcludePatterns returns the restic exclude patterns of the files a base
+// backup of dataDir skips, following the PostgreSQL documentation on base
+// backups. Only the init fork of unlogged relations is kept, the server
+// resets them from it after a restore.
+func ExcludePatterns(dataDir string) ([]string, error) {
+	var patterns []string
+	for _, dir := range ExcludedDirContents {
+		patterns = append(patterns, filepath.Join(dataDir, dir, "*"))
+	}
+	for _, file := range excludedRootFiles {
+		patterns = append(patterns, filepath.Join(dataDir, file))
+	}
+	patterns = append(patterns, excludedAnywhere...)
+
+	unlogged, err := unloggedRelationPatterns(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return append(patterns, unlogged...), nil
+}
+
+// unloggedRelationPatterns returns patterns of the forks of unlogged
+// relations, except the init fork, in the database directories of dataDir
+// and of its tablespaces
+func unloggedRelationPatterns(dataDir string) ([]string, error) {
+	dirs := []string{filepath.Join(dataDir, "global")}
+	databases, err := os.ReadDir(filepath.Join(dataDir, "base"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+	for _, db := range databases {
+		if db.IsDir() {
+			dirs = append(dirs, filepath.Join(dataDir, "base", db.Name()))
+		}
+	}
+
+	tablespaces, err := ReadTablespaces(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, tablespace := range tablespaces {
+		tablespaceDirs, err := tablespaceDatabaseDirs(tablespace.Location)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, tablespaceDirs...)
+	}
+
+	var patterns []string
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list relations: %w", err)
+		}
+		for _, entry := range entries {
+			matches := initForkRegex.FindStringSubmatch(entry.Name())
+			if matches == nil {
+				continue
+			}
+			relation := filepath.Join(dir, matches[1])
+			patterns = append(patterns,
+				relation,
+				relation+".*",
+				relation+"_fsm*",
+				relation+"_vm*",
+			)
+		}
+	}
+	return patterns, nil
+}
+
+// CreatePlaceholderDirs recreates the directories whose contents base
+// backups skip, if missing from a restored data directory
+func CreatePlaceholderDirs(dataDir string) error {
+	for _, dir := range PlaceholderDirs {
+		if err := os.MkdirAll(filepath.Join(dataDir, dir), 0700); err != nil {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// IsDataDir reports whether dir holds a PostgreSQL data directory
+func IsDataDir(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, VersionFilePath))
+	return err == nil && !info.IsDir()
+}
+
+// ValidateExcludePatterns checks user supplied exclude patterns, which are
+// passed to restic one per line of an exclude file
+func ValidateExcludePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if strings.TrimSpace(pattern) == "" || strings.ContainsAny(pattern, "\n\r") {
+			return fmt.Errorf("invalid exclude pattern %q", pattern)
+		}
+		if _, err := filepath.Match(strings.TrimPrefix(pattern, "!"), ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package pgdata
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExcludePatterns(t *testing.T) {
+	dir := writeDataDir(t, 1, 1, "16")
+	for _, file := range []string{"base/1/16384", "base/1/16384_init", "base/1/16384_fsm", "base/1/16390", "global/16400_init"} {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	patterns, err := ExcludePatterns(dir)
+	if err != nil {
+		t.Fatalf("ExcludePatterns() error = %v", err)
+	}
+	got := make(map[string]bool)
+	for _, pattern := range patterns {
+		got[pattern] = true
+	}
+
+	for _, want := range []string{
+		filepath.Join(dir, "pg_wal", "*"),
+		filepath.Join(dir, "pg_replslot", "*"),
+		filepath.Join(dir, "postmaster.pid"),
+		filepath.Join(dir, "postmaster.opts"),
+		"pg_internal.init",
+		"pgsql_tmp*",
+		filepath.Join(dir, "base", "1", "16384"),
+		filepath.Join(dir, "base", "1", "16384.*"),
+		filepath.Join(dir, "base", "1", "16384_fsm*"),
+		filepath.Join(dir, "global", "16400"),
+	} {
+		if !got[want] {
+			t.Errorf("ExcludePatterns() lacks %q", want)
+		}
+	}
+	for _, unwanted := range []string{
+		filepath.Join(dir, "base", "1", "16384_init"),
+		filepath.Join(dir, "base", "1", "16390"),
+		filepath.Join(dir, "pg_wal"),
+	} {
+		if got[unwanted] {
+			t.Errorf("ExcludePatterns() contains %q", unwanted)
+		}
+	}
+
+	// A directory without databases yet
+	if _, err := ExcludePatterns(t.TempDir()); err != nil {
+		t.Errorf("ExcludePatterns() of empty directory error = %v", err)
+	}
+}
+
+func TestCreatePlaceholderDirs(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "pg_wal"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CreatePlaceholderDirs(dir); err != nil {
+		t.Fatalf("CreatePlaceholderDirs() error = %v", err)
+	}
+	for _, sub := range PlaceholderDirs {
+		info, err := os.Stat(filepath.Join(dir, sub))
+		if err != nil || !info.IsDir() {
+			t.Errorf("%s not created: %v", sub, err)
+			continue
+		}
+		if perm := info.Mode().Perm(); perm != 0700 {
+			t.Errorf("%s mode = %o, want 0700", sub, perm)
+		}
+	}
+}
+
+func TestValidateExcludePatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		wantErr  bool
+	}{
+		{[]string{"*.log", "/var/lib/postgresql/data/log/*", "!keep.log"}, false},
+		{[]string{""}, true},
+		{[]string{"a\nb"}, true},
+		{[]string{"[unclosed"}, true},
+	}
+
+	for _, tt := range tests {
+		if err := ValidateExcludePatterns(tt.patterns); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateExcludePatterns(%q) error = %v, wantErr %v", tt.patterns, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package pgdata
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ManifestPath is the location of backup_manifest relative to the data directory
+const ManifestPath = "backup_manifest"
+
+// manifestTimeFormat is the format of Last-Modified in a backup manifest
+const manifestTimeFormat = "2006-01-02 15:04:05 GMT"
+
+// manifestIgnored are the paths pg_verifybackup skips by default: WAL is
+// checked separately and the other files are written after the backup
+var manifestIgnored = []string{
+	ManifestPath,
+	"pg_wal",
+	"postgresql.auto.conf",
+	"recovery.signal",
+	"standby.signal",
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Manifest is a backup manifest in the format of pg_basebackup
+type Manifest struct {
+	Version int `json:"PostgreSQL-Backup-Manifest-Version"`
+	// SystemIdentifier is set from version 2, written by PostgreSQL 17
+	SystemIdentifier uint64         `json:"System-Identifier,omitempty"`
+	Files            []ManifestFile `json:"Files"`
+	WALRanges        []WALRange     `json:"WAL-Ranges"`
+}
+
+// ManifestFile describes a file of a backup
+type ManifestFile struct {
+	Path string `json:"Path,omitempty"`
+	// EncodedPath is the hex encoded path of a name that isn't valid UTF-8
+	EncodedPath       string `json:"Encoded-Path,omitempty"`
+	Size              int64  `json:"Size"`
+	LastModified      string `json:"Last-Modified"`
+	ChecksumAlgorithm string `json:"Checksum-Algorithm,omitempty"`
+	Checksum          string `json:"Checksum,omitempty"`
+}
+
+// WALRange is the WAL needed to make a backup consistent
+type WALRange struct {
+	Timeline uint32 `json:"Timeline"`
+	StartLSN string `json:"Start-LSN"`
+	EndLSN   string `json:"End-LSN"`
+}
+
+// ManifestReport lists the differences between a directory and its manifest
+type ManifestReport struct {
+	Files      int      `json:"files"`
+	Missing    []string `json:"missing,omitempty"`
+	Unexpected []string `json:"unexpected,omitempty"`
+	Mismatched []string `json:"mismatched,omitempty"`
+}
+
+// OK reports whether the directory matches its manifest
+func (r *ManifestReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Unexpected) == 0 && len(r.Mismatched) == 0
+}
+
+// AddFile adds a file to the manifest, checksumming it with CRC32C as
+// pg_basebackup does by default
+func (m *Manifest) AddFile(name string, modified time.Time, r io.Reader) error {
+	h := &crc32cLE{crc32.New(crc32cTable)}
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return fmt.Errorf("failed to checksum %s: %w", name, err)
+	}
+	m.Files = append(m.Files, ManifestFile{
+		Path:              name,
+		Size:              size,
+		LastModified:      modified.UTC().Format(manifestTimeFormat),
+		ChecksumAlgorithm: "CRC32C",
+		Checksum:          hex.EncodeToString(h.Sum(nil)),
+	})
+	return nil
+}
+
+// Marshal writes the manifest laid out as pg_basebackup does, ending with the
+// SHA-256 checksum of what precedes it
+func (m *Manifest) Marshal() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "{ \"PostgreSQL-Backup-Manifest-Version\": %d,\n", m.Version)
+	if m.Version >= 2 {
+		fmt.Fprintf(&b, "\"System-Identifier\": %d,\n", m.SystemIdentifier)
+	}
+	b.WriteString("\"Files\": [")
+	for i, f := range m.Files {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		if utf8.ValidString(f.Path) {
+			fmt.Fprintf(&b, "\n{ \"Path\": %s", quoteJSON(f.Path))
+		} else {
+			fmt.Fprintf(&b, "\n{ \"Encoded-Path\": \"%s\"", hex.EncodeToString([]byte(f.Path)))
+		}
+		fmt.Fprintf(&b, ", \"Size\": %d, \"Last-Modified\": \"%s\"", f.Size, f.LastModified)
+		if f.ChecksumAlgorithm != "" && f.ChecksumAlgorithm != "NONE" {
+			fmt.Fprintf(&b, ", \"Checksum-Algorithm\": \"%s\", \"Checksum\": \"%s\"", f.ChecksumAlgorithm, f.Checksum)
+		}
+		b.WriteString(" }")
+	}
+	b.WriteString("\n],\n\"WAL-Ranges\": [\n")
+	for i, r := range m.WALRanges {
+		if i > 0 {
+			b.WriteString(",\n")
+		}
+		fmt.Fprintf(&b, "{ \"Timeline\": %d, \"Start-LSN\": \"%s\", \"End-LSN\": \"%s\" }", r.Timeline, r.StartLSN, r.EndLSN)
+	}
+	b.WriteString("\n],\n")
+	sum := sha256.Sum256(b.Bytes())
+	fmt.Fprintf(&b, "\"Manifest-Checksum\": \"%s\"}\n", hex.EncodeToString(sum[:]))
+	return b.Bytes()
+}
+
+// quoteJSON quotes s as a JSON string without escaping HTML characters
+func quoteJSON(s string) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// ParseManifest parses a backup manifest and checks its checksum, which
+// covers everything before its last line
+func ParseManifest(data []byte) (*Manifest, error) {
+	var parsed struct {
+		Manifest
+		ManifestChecksum string `json:"Manifest-Checksum"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse backup manifest: %w", err)
+	}
+	if parsed.Version != 1 && parsed.Version != 2 {
+		return nil, fmt.Errorf("unsupported backup manifest version %d", parsed.Version)
+	}
+
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		return nil, fmt.Errorf("backup manifest does not end with a newline")
+	}
+	last := bytes.LastIndexByte(data[:len(data)-1], '\n')
+	if last < 0 {
+		return nil, fmt.Errorf("backup manifest has a single line")
+	}
+	sum := sha256.Sum256(data[:last+1])
+	if !strings.EqualFold(parsed.ManifestChecksum, hex.EncodeToString(sum[:])) {
+		return nil, fmt.Errorf("backup manifest checksum mismatch")
+	}
+
+	manifest := parsed.Manifest
+	for i, f := range manifest.Files {
+		if f.EncodedPath != "" {
+			decoded, err := hex.DecodeString(f.EncodedPath)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Encoded-Path %q: %w", f.EncodedPath, err)
+			}
+			manifest.Files[i].Path = string(decoded)
+		}
+	}
+	return &manifest, nil
+}
+
+// ReadManifest reads and parses backup_manifest from the given data directory
+func ReadManifest(dataDir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, ManifestPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup_manifest: %w", err)
+	}
+	return ParseManifest(data)
+}
+
+// VerifyManifest checks a data directory against its manifest like
+// pg_verifybackup, without parsing WAL: every file must be listed with its
+// size and checksum, skipping the files pg_verifybackup ignores. Tablespaces
+// are read from their pg_tblspc links unless tablespaces maps their OID to
+// another directory.
+func VerifyManifest(dataDir string, manifest *Manifest, tablespaces map[string]string) (*ManifestReport, error) {
+	if manifest.Version >= 2 {
+		control, err := ReadControlData(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		if control.SystemIdentifier != manifest.SystemIdentifier {
+			return nil, fmt.Errorf("manifest system identifier %d does not match pg_control's %d", manifest.SystemIdentifier, control.SystemIdentifier)
+		}
+	}
+
+	onDisk, err := manifestFiles(dataDir, tablespaces)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ManifestReport{Files: len(manifest.Files)}
+	listed := make(map[string]bool, len(manifest.Files))
+	for _, f := range manifest.Files {
+		listed[f.Path] = true
+		if ignoredByManifest(f.Path) {
+			continue
+		}
+		file, ok := onDisk[f.Path]
+		if !ok {
+			report.Missing = append(report.Missing, f.Path)
+			continue
+		}
+		if problem, err := verifyManifestFile(file, f); err != nil {
+			return nil, err
+		} else if problem != "" {
+			report.Mismatched = append(report.Mismatched, fmt.Sprintf("%s: %s", f.Path, problem))
+		}
+	}
+	for name := range onDisk {
+		if !listed[name] {
+			report.Unexpected = append(report.Unexpected, name)
+		}
+	}
+
+	slices.Sort(report.Missing)
+	slices.Sort(report.Unexpected)
+	slices.Sort(report.Mismatched)
+	return report, nil
+}
+
+// ignoredByManifest reports whether pg_verifybackup skips a path
+func ignoredByManifest(name string) bool {
+	for _, ignored := range manifestIgnored {
+		if name == ignored || strings.HasPrefix(name, ignored+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// manifestFiles returns the regular files of a data directory and its
+// tablespaces by their manifest path
+func manifestFiles(dataDir string, tablespaces map[string]string) (map[string]string, error) {
+	files := make(map[string]string)
+	walk := func(root, prefix string) error {
+		return filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			name := path.Join(prefix, filepath.ToSlash(rel))
+			if ignoredByManifest(name) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			// Tablespaces are walked through their own root
+			if prefix == "" && path.Dir(name) == TablespaceDir {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.Type().IsRegular() {
+				files[name] = p
+			}
+			return nil
+		})
+	}
+
+	if err := walk(dataDir, ""); err != nil {
+		return nil, fmt.Errorf("failed to list data directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dataDir, TablespaceDir))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to list tablespaces: %w", err)
+	}
+	for _, entry := range entries {
+		root, ok := tablespaces[entry.Name()]
+		if !ok {
+			// Resolve the link, WalkDir doesn't follow a symlink root
+			if root, err = filepath.EvalSymlinks(filepath.Join(dataDir, TablespaceDir, entry.Name())); err != nil {
+				return nil, fmt.Errorf("failed to resolve tablespace %s: %w", entry.Name(), err)
+			}
+		}
+		if err := walk(root, path.Join(TablespaceDir, entry.Name())); err != nil {
+			return nil, fmt.Errorf("failed to list tablespace %s: %w", entry.Name(), err)
+		}
+	}
+	return files, nil
+}
+
+// verifyManifestFile compares a file with its manifest entry, returning the
+// difference found
+func verifyManifestFile(file string, entry ManifestFile) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat %s: %w", entry.Path, err)
+	}
+	if info.Size() != entry.Size {
+		return fmt.Sprintf("size %d, manifest says %d", info.Size(), entry.Size), nil
+	}
+
+	h, err := manifestHash(entry.ChecksumAlgorithm)
+	if err != nil || h == nil {
+		return "", err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", entry.Path, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", entry.Path, err)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, entry.Checksum) {
+		return fmt.Sprintf("%s checksum %s, manifest says %s", entry.ChecksumAlgorithm, sum, entry.Checksum), nil
+	}
+	return "", nil
+}
+
+// manifestHash returns the hash of a manifest checksum algorithm, nil for
+// files without checksum
+func manifestHash(algorithm string) (hash.Hash, error) {
+	switch strings.ToUpper(algorithm) {
+	case "", "NONE":
+		return nil, nil
+	case "CRC32C":
+		return &crc32cLE{crc32.New(crc32cTable)}, nil
+	case "SHA224":
+		return sha256.New224(), nil
+	case "SHA256":
+		return sha256.New(), nil
+	case "SHA384":
+		return sha512.New384(), nil
+	case "SHA512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+}
+
+// crc32cLE sums CRC32C in the byte order PostgreSQL writes it, that of the
+// little-endian machines backups come from
+type crc32cLE struct {
+	hash.Hash32
+}
+
+func (h *crc32cLE) Sum(b []byte) []byte {
+	return binary.LittleEndian.AppendUint32(b, h.Sum32())
+}
@@ -0,0 +1,128 @@
+package pgdata
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManifest_MarshalParse(t *testing.T) {
+	modified := time.Date(2026, 3, 1, 15, 16, 54, 0, time.UTC)
+	manifest := &Manifest{Version: 1}
+	for name, content := range map[string]string{"check": "123456789", "base/1/\xff": "x"} {
+		if err := manifest.AddFile(name, modified, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest.WALRanges = []WALRange{{Timeline: 1, StartLSN: "0/2000028", EndLSN: "0/2000100"}}
+
+	data := manifest.Marshal()
+	if !bytes.HasPrefix(data, []byte("{ \"PostgreSQL-Backup-Manifest-Version\": 1,\n\"Files\": [\n{ ")) {
+		t.Errorf("manifest starts with %q", data[:60])
+	}
+	if !bytes.Contains(data, []byte(`"Encoded-Path": "626173652f312fff"`)) {
+		t.Error("path that isn't UTF-8 not hex encoded")
+	}
+
+	parsed, err := ParseManifest(data)
+	if err != nil {
+		t.Fatalf("ParseManifest() error = %v", err)
+	}
+	for _, f := range parsed.Files {
+		f.EncodedPath = ""
+		found := false
+		for _, want := range manifest.Files {
+			found = found || reflect.DeepEqual(f, want)
+		}
+		if !found {
+			t.Errorf("parsed %+v, not in %+v", f, manifest.Files)
+		}
+		// CRC32C of the check input is e3069283, written little-endian
+		if f.Path == "check" && (f.Checksum != "839206e3" || f.LastModified != "2026-03-01 15:16:54 GMT") {
+			t.Errorf("check entry = %+v", f)
+		}
+	}
+	if !reflect.DeepEqual(parsed.WALRanges, manifest.WALRanges) {
+		t.Errorf("WALRanges = %+v", parsed.WALRanges)
+	}
+
+	tampered := bytes.Replace(data, []byte(`"Size": 9`), []byte(`"Size": 8`), 1)
+	if _, err := ParseManifest(tampered); err == nil {
+		t.Error("ParseManifest() of a tampered manifest should fail")
+	}
+}
+
+func TestVerifyManifest(t *testing.T) {
+	dataDir := t.TempDir()
+	tablespace := t.TempDir()
+	write := func(dir, name, content string) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(dataDir, "PG_VERSION", "16\n")
+	write(dataDir, "base/1/1259", "relation")
+	write(dataDir, "base/1/2608", "catalog")
+	write(tablespace, "PG_16_202307071/5/16390", "tablespace relation")
+	if err := os.MkdirAll(filepath.Join(dataDir, "pg_tblspc"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(tablespace, filepath.Join(dataDir, "pg_tblspc", "16385")); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := &Manifest{Version: 1}
+	for name, content := range map[string]string{
+		"PG_VERSION":  "16\n",
+		"base/1/1259": "relation",
+		"base/1/2608": "catalog",
+		"pg_tblspc/16385/PG_16_202307071/5/16390": "tablespace relation",
+	} {
+		if err := manifest.AddFile(name, time.Now(), strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := VerifyManifest(dataDir, manifest, nil)
+	if err != nil || !report.OK() || report.Files != 4 {
+		t.Fatalf("VerifyManifest() = %+v, %v", report, err)
+	}
+
+	// Files pg_verifybackup ignores may differ
+	write(dataDir, "pg_wal/000000010000000000000002", "wal")
+	write(dataDir, "backup_manifest", "{}")
+	write(dataDir, "base/1/2608", "catalg!")
+	write(dataDir, "base/1/16384", "new")
+	if err := os.Remove(filepath.Join(dataDir, "base/1/1259")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tablespace is found where it was restored rather than linked
+	moved := t.TempDir()
+	write(moved, "PG_16_202307071/5/16390", "tablespace relation")
+	report, err = VerifyManifest(dataDir, manifest, map[string]string{"16385": moved})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ManifestReport{
+		Files:      4,
+		Missing:    []string{"base/1/1259"},
+		Unexpected: []string{"base/1/16384"},
+	}
+	if len(report.Mismatched) != 1 || !strings.HasPrefix(report.Mismatched[0], "base/1/2608: CRC32C checksum") {
+		t.Errorf("Mismatched = %v", report.Mismatched)
+	}
+	report.Mismatched = nil
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("VerifyManifest() = %+v, want %+v", report, want)
+	}
+}
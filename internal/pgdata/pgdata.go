@@ -0,0 +1,169 @@
+// Package pgdata reads metadata from PostgreSQL data directories.
+package pgdata
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ControlFilePath is the location of pg_control relative to the data directory
+	ControlFilePath = "global/pg_control"
+	// VersionFilePath is the location of PG_VERSION relative to the data directory
+	VersionFilePath = "PG_VERSION"
+	// PostmasterPIDPath is the lock file of a running server relative to
+	// the data directory
+	PostmasterPIDPath = "postmaster.pid"
+
+	// Offsets into ControlFileData, stable since PostgreSQL 11
+	systemIdentifierOffset = 0
+	controlVersionOffset   = 8
+	catalogVersionOffset   = 12
+	timelineOffset         = 48
+	// data_checksum_version moved when PostgreSQL 12 widened the
+	// checkpoint's next XID and added max_wal_senders
+	dataChecksumVersionOffset   = 252
+	dataChecksumVersionOffset11 = 244
+	controlVersion12            = 1201
+	minControlFileSize          = dataChecksumVersionOffset + 4
+)
+
+// ControlData holds the fields of pg_control used by the plugin
+type ControlData struct {
+	SystemIdentifier uint64
+	ControlVersion   uint32
+	CatalogVersion   uint32
+	TimelineID       uint32
+	// DataChecksumVersion is zero for clusters without data checksums
+	DataChecksumVersion uint32
+}
+
+// ChecksumsEnabled reports whether the cluster has data checksums
+func (c *ControlData) ChecksumsEnabled() bool {
+	return c.DataChecksumVersion != 0
+}
+
+// ReadControlData reads pg_control from the given data directory
+func ReadControlData(dataDir string) (*ControlData, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, ControlFilePath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pg_control: %w", err)
+	}
+	return ParseControlData(data)
+}
+
+// ParseControlData parses the contents of pg_control
+func ParseControlData(data []byte) (*ControlData, error) {
+	if len(data) < minControlFileSize {
+		return nil, fmt.Errorf("pg_control too short: %d bytes", len(data))
+	}
+
+	control := &ControlData{
+		SystemIdentifier: binary.LittleEndian.Uint64(data[systemIdentifierOffset:]),
+		ControlVersion:   binary.LittleEndian.Uint32(data[controlVersionOffset:]),
+		CatalogVersion:   binary.LittleEndian.Uint32(data[catalogVersionOffset:]),
+		TimelineID:       binary.LittleEndian.Uint32(data[timelineOffset:]),
+	}
+	checksumOffset := dataChecksumVersionOffset
+	if control.ControlVersion < controlVersion12 {
+		checksumOffset = dataChecksumVersionOffset11
+	}
+	control.DataChecksumVersion = binary.LittleEndian.Uint32(data[checksumOffset:])
+	return control, nil
+}
+
+// ReadServerVersion reads the major server version from PG_VERSION
+func ReadServerVersion(dataDir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, VersionFilePath))
+	if err != nil {
+		return "", fmt.Errorf("failed to read PG_VERSION: %w", err)
+	}
+
+	version := strings.TrimSpace(string(data))
+	if version == "" {
+		return "", fmt.Errorf("PG_VERSION is empty")
+	}
+	return version, nil
+}
+
+// ReadPostmasterPID reads the PID of the server running on the data
+// directory from postmaster.pid. The file outlives a crashed server, so the
+// server may be gone.
+func ReadPostmasterPID(dataDir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, PostmasterPIDPath))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read postmaster.pid: %w", err)
+	}
+
+	line, _, _ := strings.Cut(string(data), "\n")
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid PID %q in postmaster.pid", line)
+	}
+	return pid, nil
+}
+
+// InstanceTags returns the snapshot tags identifying the PostgreSQL instance
+// owning the data directory. It returns no tags if the directory holds no
+// initialized cluster.
+func InstanceTags(dataDir string) ([]string, error) {
+	control, err := ReadControlData(dataDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := ReadServerVersion(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return FormatInstanceTags(control.SystemIdentifier, version), nil
+}
+
+// FormatInstanceTags returns the snapshot tags identifying the instance of a
+// system identifier and major version
+func FormatInstanceTags(systemID uint64, version string) []string {
+	return []string{
+		fmt.Sprintf("system_id:%d", systemID),
+		fmt.Sprintf("pg_version:%s", version),
+	}
+}
+
+// RequireInstanceTags returns the tags of InstanceTags, failing if the data
+// directory holds no initialized cluster
+func RequireInstanceTags(dataDir string) ([]string, error) {
+	tags, err := InstanceTags(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if tags == nil {
+		return nil, fmt.Errorf("no PostgreSQL cluster in %s", dataDir)
+	}
+	return tags, nil
+}
+
+// ClearDir removes the contents of dir, keeping dir itself as it may be a
+// mount point
+func ClearDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", entry.Name(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package pgdata
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeDataDir creates a minimal data directory with pg_control and PG_VERSION
+func writeDataDir(t *testing.T, systemID uint64, timeline uint32, version string) string {
+	t.Helper()
+	dir := t.TempDir()
+
+	control := make([]byte, 8192)
+	binary.LittleEndian.PutUint64(control[systemIdentifierOffset:], systemID)
+	binary.LittleEndian.PutUint32(control[controlVersionOffset:], 1300)
+	binary.LittleEndian.PutUint32(control[catalogVersionOffset:], 202307071)
+	binary.LittleEndian.PutUint32(control[timelineOffset:], timeline)
+
+	if err := os.MkdirAll(filepath.Join(dir, "global"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ControlFilePath), control, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, VersionFilePath), []byte(version+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestReadControlData(t *testing.T) {
+	dir := writeDataDir(t, 7301234567890123456, 3, "16")
+
+	got, err := ReadControlData(dir)
+	if err != nil {
+		t.Fatalf("ReadControlData() error = %v", err)
+	}
+	if got.SystemIdentifier != 7301234567890123456 {
+		t.Errorf("SystemIdentifier = %d, want 7301234567890123456", got.SystemIdentifier)
+	}
+	if got.ControlVersion != 1300 {
+		t.Errorf("ControlVersion = %d, want 1300", got.ControlVersion)
+	}
+	if got.TimelineID != 3 {
+		t.Errorf("TimelineID = %d, want 3", got.TimelineID)
+	}
+	if got.ChecksumsEnabled() {
+		t.Error("ChecksumsEnabled() = true for a cluster without data checksums")
+	}
+
+	// Truncated control file
+	if err := os.WriteFile(filepath.Join(dir, ControlFilePath), []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadControlData(dir); err == nil {
+		t.Error("ReadControlData() with truncated file should return error")
+	}
+}
+
+func TestParseControlData_Checksums(t *testing.T) {
+	tests := []struct {
+		name           string
+		controlVersion uint32
+		offset         int
+		want           bool
+	}{
+		{name: "PostgreSQL 16 with checksums", controlVersion: 1300, offset: dataChecksumVersionOffset, want: true},
+		{name: "PostgreSQL 11 with checksums", controlVersion: 1100, offset: dataChecksumVersionOffset11, want: true},
+		{name: "PostgreSQL 16 without checksums", controlVersion: 1300, offset: dataChecksumVersionOffset11},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			control := make([]byte, 8192)
+			binary.LittleEndian.PutUint32(control[controlVersionOffset:], tt.controlVersion)
+			binary.LittleEndian.PutUint32(control[tt.offset:], 1)
+
+			got, err := ParseControlData(control)
+			if err != nil {
+				t.Fatalf("ParseControlData() error = %v", err)
+			}
+			if got.ChecksumsEnabled() != tt.want {
+				t.Errorf("ChecksumsEnabled() = %v, want %v", got.ChecksumsEnabled(), tt.want)
+			}
+		})
+	}
+}
+
+func TestInstanceTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		dataDir string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "initialized data directory",
+			dataDir: writeDataDir(t, 42, 1, "16"),
+			want:    []string{"system_id:42", "pg_version:16"},
+		},
+		{
+			name:    "empty directory",
+			dataDir: t.TempDir(),
+			want:    nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := InstanceTags(tt.dataDir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("InstanceTags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("InstanceTags() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("InstanceTags()[%d] = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReadPostmasterPID(t *testing.T) {
+	dataDir := t.TempDir()
+	if _, err := ReadPostmasterPID(dataDir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ReadPostmasterPID() without postmaster.pid error = %v, want not exist", err)
+	}
+
+	content := "4242\n/var/lib/postgresql/data/pgdata\n1753628645\n5432\n"
+	if err := os.WriteFile(filepath.Join(dataDir, PostmasterPIDPath), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := ReadPostmasterPID(dataDir); err != nil || pid != 4242 {
+		t.Errorf("ReadPostmasterPID() = %d, %v, want 4242", pid, err)
+	}
+}
+
+func TestRequireInstanceTags(t *testing.T) {
+	if tags, err := RequireInstanceTags(writeDataDir(t, 42, 1, "16")); err != nil || len(tags) != 2 {
+		t.Errorf("RequireInstanceTags() = %v, %v, want the instance tags", tags, err)
+	}
+	if tags, err := RequireInstanceTags(t.TempDir()); err == nil {
+		t.Errorf("RequireInstanceTags() = %v without a cluster, want an error", tags)
+	}
+}
+
+func TestParseBackupLabel(t *testing.T) {
+	label := `START WAL LOCATION: 0/2000028 (file 000000010000000000000002)
+CHECKPOINT LOCATION: 0/2000060
+BACKUP METHOD: streamed
+BACKUP FROM: primary
+START TIME: 2025-07-27 15:04:05 UTC
+LABEL: pg_basebackup base backup
+START TIMELINE: 1
+`
+
+	got, err := ParseBackupLabel([]byte(label))
+	if err != nil {
+		t.Fatalf("ParseBackupLabel() error = %v", err)
+	}
+	if got.StartWALLocation != "0/2000028" {
+		t.Errorf("StartWALLocation = %q", got.StartWALLocation)
+	}
+	if got.StartWALFile != "000000010000000000000002" {
+		t.Errorf("StartWALFile = %q", got.StartWALFile)
+	}
+	if got.BackupFrom != "primary" {
+		t.Errorf("BackupFrom = %q", got.BackupFrom)
+	}
+	if got.StartTimeline != 1 {
+		t.Errorf("StartTimeline = %d", got.StartTimeline)
+	}
+
+	if _, err := ParseBackupLabel([]byte("LABEL: incomplete\n")); err == nil {
+		t.Error("ParseBackupLabel() without START WAL LOCATION should return error")
+	}
+}
+
+// newPage returns a non-empty page with a valid checksum for the block
+func newPage(blkno uint32, fill byte) []byte {
+	page := make([]byte, BlockSize)
+	for i := 24; i < BlockSize; i++ {
+		page[i] = fill + byte(i)
+	}
+	binary.LittleEndian.PutUint16(page[upperOffset:], 8000)
+	binary.LittleEndian.PutUint16(page[checksumOffset:], PageChecksum(page, blkno))
+	return page
+}
+
+func TestPageChecksum(t *testing.T) {
+	page := newPage(0, 1)
+	stored := binary.LittleEndian.Uint16(page[checksumOffset:])
+
+	// The stored checksum does not influence the computation
+	if got := PageChecksum(page, 0); got != stored {
+		t.Errorf("PageChecksum() = %d, want %d", got, stored)
+	}
+	// The block number does
+	if got := PageChecksum(page, 1); got == stored {
+		t.Error("PageChecksum() should depend on the block number")
+	}
+	// So does the content
+	page[100] ^= 0xFF
+	if got := PageChecksum(page, 0); got == stored {
+		t.Error("PageChecksum() should detect modified content")
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	dir := t.TempDir()
+	dbDir := filepath.Join(dir, "base", "5")
+	if err := os.MkdirAll(dbDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Healthy relation with a new page
+	var healthy []byte
+	healthy = append(healthy, newPage(0, 1)...)
+	healthy = append(healthy, make([]byte, BlockSize)...)
+	healthy = append(healthy, newPage(2, 3)...)
+	if err := os.WriteFile(filepath.Join(dbDir, "16384"), healthy, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Second segment of a relation, checksummed with its absolute block number
+	if err := os.WriteFile(filepath.Join(dbDir, "16385.1"), newPage(RelSegSize, 4), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupted free space map
+	corrupted := newPage(0, 5)
+	corrupted[4000] ^= 0xFF
+	if err := os.WriteFile(filepath.Join(dbDir, "16386_fsm"), corrupted, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files that are not relations are ignored
+	if err := os.WriteFile(filepath.Join(dbDir, "pg_filenode.map"), []byte("map"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := VerifyChecksums(dir)
+	if err != nil {
+		t.Fatalf("VerifyChecksums() error = %v", err)
+	}
+	if report.FilesScanned != 3 {
+		t.Errorf("FilesScanned = %d, want 3", report.FilesScanned)
+	}
+	if report.PagesScanned != 4 {
+		t.Errorf("PagesScanned = %d, want 4", report.PagesScanned)
+	}
+	if report.PagesSkipped != 1 {
+		t.Errorf("PagesSkipped = %d, want 1", report.PagesSkipped)
+	}
+	if report.FailuresTotal != 1 || len(report.Failures) != 1 {
+		t.Fatalf("Failures = %v, want one failure", report.Failures)
+	}
+	if report.Failures[0].File != filepath.Join("base", "5", "16386_fsm") {
+		t.Errorf("Failure file = %q", report.Failures[0].File)
+	}
+}
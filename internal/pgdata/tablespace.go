@@ -0,0 +1,178 @@
+package pgdata
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// TablespaceDir holds the tablespace symlinks, relative to the data directory
+	TablespaceDir = "pg_tblspc"
+	// TablespaceMapPath is the location of tablespace_map relative to the
+	// data directory, written by non-exclusive backups
+	TablespaceMapPath = "tablespace_map"
+
+	// tablespaceTagPrefix prefixes the snapshot tags recording tablespaces
+	tablespaceTagPrefix = "tablespace:"
+)
+
+// oidRegex matches the entries of pg_tblspc
+var oidRegex = regexp.MustCompile(`^[0-9]+$`)
+
+// Tablespace is a tablespace linked from pg_tblspc
+type Tablespace struct {
+	OID      string
+	Location string
+}
+
+// Tag returns the snapshot tag recording the tablespace
+func (t Tablespace) Tag() string {
+	return tablespaceTagPrefix + t.OID + ":" + t.Location
+}
+
+// ParseTablespaceTags returns the tablespaces recorded in snapshot tags
+func ParseTablespaceTags(tags []string) []Tablespace {
+	var tablespaces []Tablespace
+	for _, tag := range tags {
+		value, ok := strings.CutPrefix(tag, tablespaceTagPrefix)
+		if !ok {
+			continue
+		}
+		oid, location, ok := strings.Cut(value, ":")
+		if ok && oidRegex.MatchString(oid) && location != "" {
+			tablespaces = append(tablespaces, Tablespace{OID: oid, Location: location})
+		}
+	}
+	return tablespaces
+}
+
+// RestoredDataDir returns where a snapshot of paths restored into targetDir
+// placed its data directory, as restic recreates the backed up paths below
+// the target. The data directory is the path that is no tablespace location,
+// wherever it sorts among them.
+func RestoredDataDir(targetDir string, paths []string, tablespaces []Tablespace) string {
+	if IsDataDir(targetDir) {
+		return targetDir
+	}
+	locations := make(map[string]bool)
+	for _, tablespace := range tablespaces {
+		locations[tablespace.Location] = true
+	}
+	for _, path := range paths {
+		if !locations[path] {
+			return filepath.Join(targetDir, path)
+		}
+	}
+	return targetDir
+}
+
+// ReadTablespaces returns the tablespaces linked from pg_tblspc. In-place
+// tablespaces, directories inside the data directory, are left out as they
+// are backed up with it.
+func ReadTablespaces(dataDir string) ([]Tablespace, error) {
+	dir := filepath.Join(dataDir, TablespaceDir)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tablespaces: %w", err)
+	}
+
+	var tablespaces []Tablespace
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSymlink == 0 || !oidRegex.MatchString(entry.Name()) {
+			continue
+		}
+		location, err := os.Readlink(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tablespace %s: %w", entry.Name(), err)
+		}
+		if !filepath.IsAbs(location) {
+			location = filepath.Join(dir, location)
+		}
+		// Tags are separated by commas, a location can't contain one
+		if strings.ContainsAny(location, ",\n") {
+			return nil, fmt.Errorf("tablespace %s: unsupported location %q", entry.Name(), location)
+		}
+		tablespaces = append(tablespaces, Tablespace{OID: entry.Name(), Location: filepath.Clean(location)})
+	}
+	return tablespaces, nil
+}
+
+// tablespaceDatabaseDirs returns the database directories of a tablespace,
+// found below its PG_<version>_<catalog version> directory
+func tablespaceDatabaseDirs(location string) ([]string, error) {
+	versions, err := filepath.Glob(filepath.Join(location, "PG_*"))
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, version := range versions {
+		databases, err := os.ReadDir(version)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tablespace databases: %w", err)
+		}
+		for _, db := range databases {
+			if db.IsDir() {
+				dirs = append(dirs, filepath.Join(version, db.Name()))
+			}
+		}
+	}
+	return dirs, nil
+}
+
+// RelinkTablespace points the pg_tblspc symlink of a tablespace to location
+func RelinkTablespace(dataDir, oid, location string) error {
+	link := filepath.Join(dataDir, TablespaceDir, oid)
+	if err := os.Remove(link); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to relink tablespace %s: %w", oid, err)
+	}
+	if err := os.Symlink(location, link); err != nil {
+		return fmt.Errorf("failed to relink tablespace %s: %w", oid, err)
+	}
+	return nil
+}
+
+// RewriteTablespaceMap replaces the locations of tablespace_map entries
+// found in locations, keyed by OID. A missing tablespace_map is left alone.
+func RewriteTablespaceMap(dataDir string, locations map[string]string) error {
+	path := filepath.Join(dataDir, TablespaceMapPath)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read tablespace_map: %w", err)
+	}
+
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if oid, _, ok := strings.Cut(line, " "); ok {
+			if location, ok := locations[oid]; ok {
+				line = oid + " " + location
+			}
+		}
+		out.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to parse tablespace_map: %w", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite tablespace_map: %w", err)
+	}
+	if err := os.WriteFile(path, out.Bytes(), info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to rewrite tablespace_map: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package pgdata
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadTablespaces(t *testing.T) {
+	dataDir := t.TempDir()
+	location := t.TempDir()
+	tblspc := filepath.Join(dataDir, TablespaceDir)
+	if err := os.MkdirAll(filepath.Join(tblspc, "16390"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(location, filepath.Join(tblspc, "16385")); err != nil {
+		t.Fatal(err)
+	}
+
+	tablespaces, err := ReadTablespaces(dataDir)
+	if err != nil {
+		t.Fatalf("ReadTablespaces() error = %v", err)
+	}
+	// The in-place tablespace 16390 is part of the data directory
+	want := []Tablespace{{OID: "16385", Location: location}}
+	if !reflect.DeepEqual(tablespaces, want) {
+		t.Errorf("ReadTablespaces() = %v, want %v", tablespaces, want)
+	}
+
+	if got := ParseTablespaceTags([]string{"type:full", want[0].Tag(), "tablespace:bad"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseTablespaceTags() = %v, want %v", got, want)
+	}
+
+	// Without pg_tblspc there are no tablespaces
+	if tablespaces, err := ReadTablespaces(t.TempDir()); err != nil || tablespaces != nil {
+		t.Errorf("ReadTablespaces() of empty directory = %v, %v", tablespaces, err)
+	}
+}
+
+func TestExcludePatterns_Tablespaces(t *testing.T) {
+	dataDir := t.TempDir()
+	location := t.TempDir()
+	dbDir := filepath.Join(location, "PG_16_202307071", "16384")
+	if err := os.MkdirAll(dbDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dbDir, "16400_init"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dataDir, TablespaceDir), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(location, filepath.Join(dataDir, TablespaceDir, "16385")); err != nil {
+		t.Fatal(err)
+	}
+
+	patterns, err := ExcludePatterns(dataDir)
+	if err != nil {
+		t.Fatalf("ExcludePatterns() error = %v", err)
+	}
+	for _, pattern := range patterns {
+		if pattern == filepath.Join(dbDir, "16400") {
+			return
+		}
+	}
+	t.Errorf("ExcludePatterns() lacks unlogged relation of tablespace: %v", patterns)
+}
+
+func TestRewriteTablespaceMap(t *testing.T) {
+	dataDir := t.TempDir()
+	path := filepath.Join(dataDir, TablespaceMapPath)
+	if err := os.WriteFile(path, []byte("16385 /mnt/ts1\n16386 /mnt/ts2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RewriteTablespaceMap(dataDir, map[string]string{"16385": "/restore/ts1"}); err != nil {
+		t.Fatalf("RewriteTablespaceMap() error = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "16385 /restore/ts1\n16386 /mnt/ts2\n"; string(data) != want {
+		t.Errorf("tablespace_map = %q, want %q", data, want)
+	}
+
+	// Backups taken without tablespace_map are left alone
+	if err := RewriteTablespaceMap(t.TempDir(), map[string]string{"16385": "/restore/ts1"}); err != nil {
+		t.Errorf("RewriteTablespaceMap() without map error = %v", err)
+	}
+}
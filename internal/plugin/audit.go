@@ -0,0 +1,128 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud-native-pg-restic-backup/internal/audit"
+	"cloud-native-pg-restic-backup/internal/auth"
+	"cloud-native-pg-restic-backup/internal/logging"
+)
+
+// AuditResponse reports the matching audit events and the integrity of the
+// audit log
+type AuditResponse struct {
+	Events     []audit.Event `json:"events"`
+	ChainValid bool          `json:"chainValid"`
+	ChainError string        `json:"chainError,omitempty"`
+}
+
+// auditParams returns the parameters of a restore recorded in the audit log
+func (req *RestoreRequest) auditParams() map[string]string {
+	params := map[string]string{
+		"backupID":   req.BackupID,
+		"destFolder": req.DestFolder,
+	}
+	if req.RecoveryTarget != nil {
+		if target, err := json.Marshal(req.RecoveryTarget); err == nil {
+			params["recoveryTarget"] = string(target)
+		}
+	}
+	if len(req.TablespaceMapping) > 0 {
+		if mapping, err := json.Marshal(req.TablespaceMapping); err == nil {
+			params["tablespaceMapping"] = string(mapping)
+		}
+	}
+	if req.Tuning != nil {
+		if tuning, err := json.Marshal(req.Tuning); err == nil {
+			params["tuning"] = string(tuning)
+		}
+	}
+	if req.Overwrite {
+		params["overwrite"] = "true"
+	}
+	if req.Stage {
+		params["stage"] = "true"
+	}
+	return params
+}
+
+// recordAudit records an operation in the audit log, if enabled
+func (p *Plugin) recordAudit(ctx context.Context, event audit.Event, opErr error, logger *logging.Logger) {
+	if p.options.Audit == nil {
+		return
+	}
+	if err := p.options.Audit.Record(ctx, event, opErr); err != nil {
+		logger.Error().Err(err).Str("action", event.Action).Msg("Failed to record audit event")
+	}
+}
+
+// handleAudit returns the audit events matching the query parameters action,
+// clusterName/namespace, since (RFC 3339) and limit
+func (p *Plugin) handleAudit(w http.ResponseWriter, r *http.Request, logger *logging.Logger) {
+	if r.Method != http.MethodGet {
+		logger.Warn().Str("allowed_method", "GET").Msg("Method not allowed")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.options.Audit == nil {
+		logger.Warn().Msg("Audit log not enabled")
+		http.Error(w, "Audit log not enabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := audit.Filter{Action: query.Get("action")}
+	id := tenantFromQuery(r)
+	if !id.IsZero() {
+		filter.Tenant = id.String()
+	}
+
+	// Principals restricted to some tenants only see the events of one of them
+	if principal := auth.PrincipalFrom(r.Context()); principal != nil && principal.Scoped() && id.IsZero() {
+		logger.Warn().Str("principal", principal.Name).Msg("Audit query without tenant")
+		http.Error(w, "Forbidden: specify clusterName and namespace", http.StatusForbidden)
+		return
+	}
+	if !authorizeTenant(w, r, id, logger) {
+		return
+	}
+	if since := query.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid since: %v", err), http.StatusBadRequest)
+			return
+		}
+		filter.Since = t
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("Invalid limit: %s", limit), http.StatusBadRequest)
+			return
+		}
+		filter.Limit = n
+	}
+
+	events, err := p.options.Audit.Query(filter)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to query audit log")
+		http.Error(w, fmt.Sprintf("Failed to query audit log: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	resp := AuditResponse{Events: events, ChainValid: true}
+	if resp.Events == nil {
+		resp.Events = []audit.Event{}
+	}
+	if err := p.options.Audit.Verify(); err != nil {
+		logger.Error().Err(err).Msg("Audit log hash chain is broken")
+		resp.ChainValid = false
+		resp.ChainError = err.Error()
+	}
+	writeJSON(w, resp, logger)
+}
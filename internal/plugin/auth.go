@@ -0,0 +1,64 @@
+package plugin
+
+import (
+	"net/http"
+
+	"cloud-native-pg-restic-backup/internal/auth"
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/tenant"
+)
+
+// pathOperations maps the API paths to the operations granted to principals.
+// Paths not listed, such as the health checks, need no authentication.
+var pathOperations = map[string]string{
+	"/backup":      auth.OpBackup,
+	"/restore":     auth.OpRestore,
+	"/wal-archive": auth.OpWALArchive,
+	"/wal-restore": auth.OpWALRestore,
+	"/replication": auth.OpReplication,
+	"/verify":      auth.OpVerify,
+	"/check":       auth.OpCheck,
+	"/audit":       auth.OpAudit,
+	"/metrics":     auth.OpMetrics,
+
+	"/logical-backup":  auth.OpLogicalBackup,
+	"/logical-restore": auth.OpLogicalRestore,
+}
+
+// authenticate identifies the caller and checks it may run the requested
+// operation, writing an error response if not. The principal is nil if
+// authentication is disabled or the path is public.
+func (p *Plugin) authenticate(w http.ResponseWriter, r *http.Request, logger *logging.Logger) (*auth.Principal, bool) {
+	op, ok := pathOperations[r.URL.Path]
+	if !ok || p.options.Auth == nil {
+		return nil, true
+	}
+
+	principal, err := p.options.Auth.Authenticate(r)
+	if err != nil {
+		logger.Warn().Err(err).Msg("Authentication failed")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="cnpg-restic-backup"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	if !principal.Allows(op) {
+		logger.Warn().Str("principal", principal.Name).Str("operation", op).Msg("Operation not permitted")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return principal, true
+}
+
+// authorizeTenant checks the caller may act on the tenant, writing an error
+// response if not
+func authorizeTenant(w http.ResponseWriter, r *http.Request, id tenant.Identity, logger *logging.Logger) bool {
+	principal := auth.PrincipalFrom(r.Context())
+	if principal == nil || principal.AllowsTenant(id) {
+		return true
+	}
+
+	logger.Warn().Str("principal", principal.Name).Msg("Tenant not permitted")
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
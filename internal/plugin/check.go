@@ -0,0 +1,81 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"cloud-native-pg-restic-backup/internal/integrity"
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/restic"
+	"cloud-native-pg-restic-backup/internal/tenant"
+)
+
+// CheckRequest represents the repository check API request
+type CheckRequest struct {
+	tenant.Identity
+	restic.CheckOptions
+}
+
+// handleCheck runs a repository check on POST and reports the retained
+// results on GET
+func (p *Plugin) handleCheck(w http.ResponseWriter, r *http.Request, logger *logging.Logger) {
+	switch r.Method {
+	case http.MethodGet:
+		id := tenantFromQuery(r)
+		logger = logger.WithFields(map[string]interface{}{
+			"tenant": id.String(),
+		})
+
+		h, ok := p.resolveTenant(w, r, id, logger)
+		if !ok {
+			return
+		}
+		writeJSON(w, h.checker.Status(), logger)
+
+	case http.MethodPost:
+		var req CheckRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error().Err(err).Msg("Invalid request")
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := req.CheckOptions.Validate(); err != nil {
+			logger.Error().Err(err).Msg("Invalid request")
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.WithFields(map[string]interface{}{
+			"tenant": req.Identity.String(),
+			"mode":   req.Mode,
+		})
+
+		h, ok := p.resolveTenant(w, r, req.Identity, logger)
+		if !ok {
+			return
+		}
+
+		logger.Info().Msg("Starting repository check")
+
+		result, err := h.checker.Check(h.context(r.Context()), req.CheckOptions)
+		if errors.Is(err, integrity.ErrInProgress) {
+			logger.Warn().Msg("Repository check already in progress")
+			http.Error(w, "Repository check already in progress", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			logger.Error().Err(err).Msg("Repository check failed")
+			http.Error(w, fmt.Sprintf("Repository check failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		logger.Info().Bool("ok", result.OK).Msg("Repository check completed")
+		writeJSON(w, result, logger)
+
+	default:
+		logger.Warn().Str("allowed_method", "GET, POST").Msg("Method not allowed")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,101 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"cloud-native-pg-restic-backup/internal/logging"
+)
+
+// ReadyResponse reports the readiness of the probed tenants. The probe is
+// unauthenticated, so it only counts them; details are logged.
+type ReadyResponse struct {
+	Ready bool `json:"ready"`
+	// Tenants is the number of tenants probed
+	Tenants int `json:"tenants"`
+	// NotReady is the number of tenants whose repository can't serve them
+	NotReady int `json:"notReady"`
+	// WALStale is the number of tenants without a recent WAL archival
+	WALStale int `json:"walStale"`
+}
+
+// handleHealthz reports the process is alive
+func (p *Plugin) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz probes the repository of the requested tenant, or of every
+// tenant initialized so far. The probe is unauthenticated, so it never
+// initializes tenants, and a tenant whose WAL archival stalled only fails
+// it when requested on its own.
+func (p *Plugin) handleReadyz(w http.ResponseWriter, r *http.Request, logger *logging.Logger) {
+	if r.Method != http.MethodGet {
+		logger.Warn().Str("allowed_method", "GET").Msg("Method not allowed")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := tenantFromQuery(r)
+	var probed []*tenantHandlers
+	if !id.IsZero() {
+		h, ok := p.initializedTenant(id)
+		if !ok {
+			http.Error(w, "Tenant not initialized", http.StatusNotFound)
+			return
+		}
+		probed = append(probed, h)
+	} else {
+		probed = p.initializedTenants()
+	}
+
+	resp := ReadyResponse{Ready: true, Tenants: len(probed)}
+	for _, h := range probed {
+		report := h.prober.Probe(r.Context())
+		ready := report.RepositoryReady()
+		if !id.IsZero() {
+			ready = report.Ready
+		}
+		if !ready {
+			resp.NotReady++
+			resp.Ready = false
+		}
+		if report.WALStale() {
+			resp.WALStale++
+		}
+		if !report.Ready {
+			logger.Warn().
+				Str("tenant", h.identity.String()).
+				Interface("checks", report.Checks).
+				Msg("Tenant not ready")
+		}
+	}
+
+	status := http.StatusOK
+	if !resp.Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error().Err(err).Msg("Failed to write response")
+	}
+}
+
+// initializedTenants returns the handlers of every tenant initialized so far
+func (p *Plugin) initializedTenants() []*tenantHandlers {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Handlers are registered under both the requested and resolved identity
+	seen := make(map[*tenantHandlers]bool)
+	var tenants []*tenantHandlers
+	for _, h := range p.handlers {
+		if !seen[h] {
+			seen[h] = true
+			tenants = append(tenants, h)
+		}
+	}
+	return tenants
+}
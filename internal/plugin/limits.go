@@ -0,0 +1,33 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+
+	"cloud-native-pg-restic-backup/internal/logging"
+)
+
+// walContext bounds a WAL archival or restore by the configured timeout
+func (p *Plugin) walContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.options.WALTimeout > 0 {
+		return context.WithTimeout(ctx, p.options.WALTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// acquireWAL waits for a WAL operation slot, writing an error response if
+// the request ends first. The returned function releases the slot.
+func (p *Plugin) acquireWAL(ctx context.Context, w http.ResponseWriter, logger *logging.Logger) (func(), bool) {
+	if p.walSlots == nil {
+		return func() {}, true
+	}
+
+	select {
+	case p.walSlots <- struct{}{}:
+		return func() { <-p.walSlots }, true
+	case <-ctx.Done():
+		logger.Warn().Err(ctx.Err()).Msg("Timed out waiting for a WAL operation slot")
+		http.Error(w, "Too many concurrent WAL operations", http.StatusServiceUnavailable)
+		return nil, false
+	}
+}
@@ -0,0 +1,170 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud-native-pg-restic-backup/internal/audit"
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/logical"
+	"cloud-native-pg-restic-backup/internal/restic"
+	"cloud-native-pg-restic-backup/internal/tenant"
+)
+
+// LogicalBackupRequest represents the logical backup API request
+type LogicalBackupRequest struct {
+	tenant.Identity
+	// Databases are dumped, the configured ones by default
+	Databases []string `json:"databases,omitempty"`
+}
+
+// LogicalRestoreRequest represents the logical restore API request
+type LogicalRestoreRequest struct {
+	tenant.Identity
+	logical.RestoreOptions
+}
+
+// auditParams returns the parameters of a logical restore recorded in the
+// audit log
+func (req *LogicalRestoreRequest) auditParams() map[string]string {
+	params := map[string]string{
+		"snapshotID":     req.SnapshotID,
+		"database":       req.Database,
+		"targetDatabase": req.TargetDatabase,
+	}
+	if len(req.Schemas) > 0 {
+		params["schemas"] = strings.Join(req.Schemas, ",")
+	}
+	if len(req.Tables) > 0 {
+		params["tables"] = strings.Join(req.Tables, ",")
+	}
+	if req.Clean {
+		params["clean"] = "true"
+	}
+	return params
+}
+
+// logicalManager returns the logical backup manager of a tenant, writing an
+// error response if logical backups are not configured
+func logicalManager(w http.ResponseWriter, h *tenantHandlers, logger *logging.Logger) (*logical.Manager, bool) {
+	if h.logical == nil {
+		logger.Warn().Msg("Logical backups not configured")
+		http.Error(w, "Logical backups not configured", http.StatusNotFound)
+		return nil, false
+	}
+	return h.logical, true
+}
+
+// handleLogicalBackup dumps databases into the repository and reports the
+// snapshot of each
+func (p *Plugin) handleLogicalBackup(w http.ResponseWriter, r *http.Request, logger *logging.Logger) {
+	if r.Method != http.MethodPost {
+		logger.Warn().Str("allowed_method", "POST").Msg("Method not allowed")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req LogicalBackupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error().Err(err).Msg("Invalid request")
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithFields(map[string]interface{}{
+		"tenant":    req.Identity.String(),
+		"databases": req.Databases,
+	})
+
+	h, ok := p.resolveTenant(w, r, req.Identity, logger)
+	if !ok {
+		return
+	}
+	manager, ok := logicalManager(w, h, logger)
+	if !ok {
+		return
+	}
+
+	logger.Info().Msg("Starting logical backup")
+
+	result, err := manager.Backup(h.context(r.Context()), req.Databases)
+	if err != nil {
+		logger.Error().Err(err).Msg("Logical backup failed")
+		http.Error(w, fmt.Sprintf("Logical backup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info().Msg("Logical backup completed successfully")
+	writeJSON(w, result, logger)
+}
+
+// handleLogicalRestore restores a database dump with pg_restore
+func (p *Plugin) handleLogicalRestore(w http.ResponseWriter, r *http.Request, logger *logging.Logger) {
+	if r.Method != http.MethodPost {
+		logger.Warn().Str("allowed_method", "POST").Msg("Method not allowed")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req LogicalRestoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error().Err(err).Msg("Invalid request")
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithFields(map[string]interface{}{
+		"tenant":          req.Identity.String(),
+		"snapshot_id":     req.SnapshotID,
+		"database":        req.Database,
+		"target_database": req.TargetDatabase,
+	})
+	if err := req.RestoreOptions.Validate(); err != nil {
+		logger.Warn().Err(err).Msg("Invalid request")
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	h, ok := p.resolveTenant(w, r, req.Identity, logger)
+	if !ok {
+		return
+	}
+	manager, ok := logicalManager(w, h, logger)
+	if !ok {
+		return
+	}
+	if !lockTenant(w, h, logger) {
+		return
+	}
+	defer h.lock.Unlock()
+
+	logger.Info().Msg("Starting logical restore")
+
+	err := manager.Restore(h.context(r.Context()), req.RestoreOptions)
+	p.recordAudit(r.Context(), audit.Event{
+		Action: audit.ActionLogicalRestore,
+		Tenant: h.identity.String(),
+		Params: req.auditParams(),
+	}, err, logger)
+	if errors.Is(err, restic.ErrSnapshotNotFound) {
+		logger.Warn().Err(err).Msg("Dump not found")
+		http.Error(w, fmt.Sprintf("Dump not found: %v", err), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, restic.ErrSnapshotAmbiguous) {
+		logger.Warn().Err(err).Msg("Ambiguous snapshot ID")
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("Logical restore failed")
+		http.Error(w, fmt.Sprintf("Logical restore failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info().Msg("Logical restore completed successfully")
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,38 @@
+package plugin
+
+import (
+	"context"
+	"time"
+
+	"cloud-native-pg-restic-backup/internal/metrics"
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+// snapshotTypes are the snapshot types counted in the repository metrics
+var snapshotTypes = []string{"full", "wal"}
+
+// refreshSnapshotMetrics counts the snapshots of each type in the tenant's
+// repository now and on every interval tick until the context is cancelled
+func (p *Plugin) refreshSnapshotMetrics(ctx context.Context, client restic.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, snapshotType := range snapshotTypes {
+			snapshots, err := client.FindSnapshots(ctx, []string{"type:" + snapshotType})
+			if err != nil {
+				if ctx.Err() == nil {
+					p.logger.Warn().Err(err).Str("type", snapshotType).Msg("Failed to count snapshots")
+				}
+				continue
+			}
+			metrics.SetSnapshotCount(ctx, snapshotType, len(snapshots))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/sandbox"
+	"cloud-native-pg-restic-backup/internal/wal"
+)
+
+// Paths confines the paths of requests. Nil sandboxes allow every absolute
+// path without ".." elements.
+type Paths struct {
+	// Data holds the data directories backups read
+	Data *sandbox.Sandbox
+	// Tablespaces holds the tablespace locations backups read
+	Tablespaces *sandbox.Sandbox
+	// WAL holds the WAL segments archivals read
+	WAL *sandbox.Sandbox
+	// Restore holds the directories restores write to
+	Restore *sandbox.Sandbox
+	// WALRestore holds the directories WAL restores write to, the WAL
+	// directory of a running instance or of a restored data directory
+	WALRestore *sandbox.Sandbox
+}
+
+// checkPath confines a request path to the sandbox and returns it resolved,
+// writing an error response if it is not allowed. Requests are checked this
+// way before their tenant is initialized.
+func checkPath(w http.ResponseWriter, s *sandbox.Sandbox, field, p string, logger *logging.Logger) (string, bool) {
+	cleaned, err := s.Path(p)
+	if err == nil {
+		return cleaned, true
+	}
+
+	logger.Warn().Err(err).Str("field", field).Msg("Path not allowed")
+	status := http.StatusBadRequest
+	if errors.Is(err, sandbox.ErrOutsideRoots) {
+		status = http.StatusForbidden
+	}
+	http.Error(w, fmt.Sprintf("Invalid %s: %v", field, err), status)
+	return "", false
+}
+
+// checkDataFolder confines the data directory of a WAL request to any of the
+// sandboxes and returns it resolved, writing an error response if it is not
+// allowed. Without a data directory in the request it is derived from the WAL
+// path as requested, as pg_wal may link to another volume.
+func checkDataFolder(w http.ResponseWriter, requested, derived string, logger *logging.Logger, sandboxes ...*sandbox.Sandbox) (string, bool) {
+	p := requested
+	if p == "" {
+		p = derived
+	}
+
+	var err error
+	for _, s := range sandboxes {
+		var resolved string
+		if resolved, err = s.Path(p); err == nil {
+			return resolved, true
+		}
+	}
+
+	logger.Warn().Err(err).Str("field", "dataFolder").Msg("Path not allowed")
+	status := http.StatusBadRequest
+	if errors.Is(err, sandbox.ErrOutsideRoots) {
+		status = http.StatusForbidden
+	}
+	http.Error(w, fmt.Sprintf("Invalid dataFolder: %v", err), status)
+	return "", false
+}
+
+// checkWALFileName checks the name of a WAL file before it is used in a
+// path, writing an error response if it is not a WAL or history file name
+func checkWALFileName(w http.ResponseWriter, name string, logger *logging.Logger) bool {
+	if wal.ValidFileName(name) {
+		return true
+	}
+
+	logger.Warn().Msg("Invalid WAL file name")
+	http.Error(w, fmt.Sprintf("Invalid walFileName: %q is not a WAL or history file name", name), http.StatusBadRequest)
+	return false
+}
@@ -2,41 +2,187 @@
 package plugin
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"path/filepath"
+	"sync"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+
+	"cloud-native-pg-restic-backup/internal/audit"
+	"cloud-native-pg-restic-backup/internal/auth"
 	"cloud-native-pg-restic-backup/internal/backup"
+	"cloud-native-pg-restic-backup/internal/basebackup"
+	"cloud-native-pg-restic-backup/internal/health"
 	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/logical"
+	"cloud-native-pg-restic-backup/internal/metrics"
+	"cloud-native-pg-restic-backup/internal/pgbackup"
 	"cloud-native-pg-restic-backup/internal/restic"
 	"cloud-native-pg-restic-backup/internal/restore"
+	"cloud-native-pg-restic-backup/internal/retention"
+	"cloud-native-pg-restic-backup/internal/tenant"
+	"cloud-native-pg-restic-backup/internal/tracing"
 )
 
+// Options configures optional plugin features
+type Options struct {
+	// ReplicationInterval schedules replication to secondary repositories,
+	// zero disables the schedule
+	ReplicationInterval time.Duration
+	// ReplicateAfterBackup replicates after each successful base backup
+	ReplicateAfterBackup bool
+	// VerifyScratchDir is where verifications restore backups, the system
+	// temporary directory if empty
+	VerifyScratchDir string
+	// CheckInterval schedules repository integrity checks, zero disables
+	// the schedule
+	CheckInterval time.Duration
+	// CheckOptions configures scheduled repository checks
+	CheckOptions restic.CheckOptions
+	// SnapshotMetricsInterval schedules counting the repository snapshots
+	// exported as metrics, zero disables the counts
+	SnapshotMetricsInterval time.Duration
+	// Health configures the readiness probe
+	Health health.Options
+	// Audit records restores and snapshot deletions, nil disables auditing
+	Audit *audit.Log
+	// Auth authenticates and authorizes requests, nil allows every request
+	Auth *auth.Authenticator
+	// Paths confines the paths of requests to allowed roots
+	Paths Paths
+	// BackupExclude are restic patterns base backups skip besides the files
+	// PostgreSQL does not need restored
+	BackupExclude []string
+	// BackupManifest stores a backup_manifest of each filesystem backup
+	BackupManifest bool
+	// BackupMode is the mode of backup requests that don't choose one
+	BackupMode string
+	// BackupCoordinate runs filesystem backups between pg_backup_start and
+	// pg_backup_stop, disabled without a connection string
+	BackupCoordinate pgbackup.Config
+	// BackupWALArchiveTimeout bounds the wait for the WAL a coordinated
+	// backup ends in to be archived
+	BackupWALArchiveTimeout time.Duration
+	// BackupInstance names the instance backups are taken on
+	BackupInstance string
+	// BasebackupStream configures pg_basebackup for streamed backups
+	BasebackupStream basebackup.Config
+	// BackupUpload tunes how filesystem backups write to the repository,
+	// requests may override it
+	BackupUpload restic.UploadOptions
+	// Restore tunes how restores and verifications read filesystem backups,
+	// requests may override it
+	Restore restic.RestoreOptions
+	// Logical configures logical backups, disabled without a connection
+	// string
+	Logical logical.Config
+	// Retention selects the base backups kept by scheduled retention
+	Retention retention.Policy
+	// RetentionInterval schedules the retention policy, zero disables the
+	// schedule
+	RetentionInterval time.Duration
+	// MaxWALOperations limits concurrent WAL archivals and restores, zero
+	// means no limit
+	MaxWALOperations int
+	// WALTimeout bounds each WAL archival or restore, including the wait for
+	// a slot, zero means no timeout
+	WALTimeout time.Duration
+	// MaxTenants limits the tenants initialized, zero means no limit
+	MaxTenants int
+}
+
 // Plugin implements the CloudNative PostgreSQL backup/restore plugin interface
 type Plugin struct {
-	backupHandler  backup.Handler
-	restoreHandler restore.Handler
-	logger         *logging.Logger
+	// ctx bounds background work such as scheduled replication
+	ctx       context.Context
+	tenants   *tenant.Registry
+	options   Options
+	newClient func(restic.Config) restic.Client
+	logger    *logging.Logger
+
+	// walSlots limits concurrent WAL operations, nil if unlimited
+	walSlots chan struct{}
+
+	mu       sync.Mutex
+	handlers map[tenant.Identity]*tenantHandlers
+	// initializing are the tenants whose repository is being initialized
+	initializing map[tenant.Identity]*tenantInit
 }
 
-// NewPlugin creates a new plugin instance
-func NewPlugin(config restic.Config, logger *logging.Logger) *Plugin {
-	client := restic.NewClient(config)
-	return &Plugin{
-		backupHandler:  backup.NewHandler(client),
-		restoreHandler: restore.NewHandler(client),
-		logger:        logger,
+// NewPlugin creates a new plugin instance serving the tenants of the registry
+func NewPlugin(ctx context.Context, tenants *tenant.Registry, options Options, logger *logging.Logger) *Plugin {
+	p := &Plugin{
+		ctx:       ctx,
+		tenants:   tenants,
+		options:   options,
+		newClient: restic.NewClient,
+		logger:    logger,
+		handlers:  make(map[tenant.Identity]*tenantHandlers),
+
+		initializing: make(map[tenant.Identity]*tenantInit),
+	}
+	if options.MaxWALOperations > 0 {
+		p.walSlots = make(chan struct{}, options.MaxWALOperations)
 	}
+	return p
 }
 
 // ServeHTTP implements the HTTP handler interface
 func (p *Plugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	logger := p.logger.Operation("http").WithFields(map[string]interface{}{
+	// Continue the trace of the caller, if any
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), r.Method+" "+r.URL.Path,
+		attribute.String("http.request.method", r.Method),
+		attribute.String("url.path", r.URL.Path),
+	)
+
+	// Correlate the log lines of the request, keeping the caller's ID if any
+	requestID := r.Header.Get(logging.RequestIDHeader)
+	if !logging.ValidRequestID(requestID) {
+		requestID = logging.NewRequestID()
+	}
+	ctx = logging.WithRequestID(ctx, requestID)
+	span.SetAttributes(attribute.String("request.id", requestID))
+	w.Header().Set(logging.RequestIDHeader, requestID)
+
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		var err error
+		if recorder.status >= http.StatusInternalServerError {
+			err = fmt.Errorf("%s", http.StatusText(recorder.status))
+		}
+		tracing.End(span, err)
+	}()
+	w, r = recorder, r.WithContext(ctx)
+
+	logger := p.logger.Context(ctx).Operation("http").WithFields(map[string]interface{}{
 		"method": r.Method,
 		"path":   r.URL.Path,
 	})
 
+	principal, ok := p.authenticate(w, r, logger)
+	if !ok {
+		return
+	}
+	actor := audit.Actor{
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+		RequestID:  requestID,
+	}
+	if principal != nil {
+		actor.Principal = principal.Name
+		ctx = auth.WithPrincipal(ctx, principal)
+		logger = logger.WithFields(map[string]interface{}{
+			"principal": principal.Name,
+		})
+	}
+	r = r.WithContext(audit.WithActor(ctx, actor))
+
 	switch r.URL.Path {
 	case "/backup":
 		p.handleBackup(w, r, logger)
@@ -46,17 +192,55 @@ func (p *Plugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		p.handleWALArchive(w, r, logger)
 	case "/wal-restore":
 		p.handleWALRestore(w, r, logger)
+	case "/replication":
+		p.handleReplication(w, r, logger)
+	case "/verify":
+		p.handleVerify(w, r, logger)
+	case "/logical-backup":
+		p.handleLogicalBackup(w, r, logger)
+	case "/logical-restore":
+		p.handleLogicalRestore(w, r, logger)
+	case "/check":
+		p.handleCheck(w, r, logger)
+	case "/audit":
+		p.handleAudit(w, r, logger)
+	case "/healthz":
+		p.handleHealthz(w, r)
+	case "/readyz":
+		p.handleReadyz(w, r, logger)
+	case "/metrics":
+		metrics.Handler().ServeHTTP(w, r)
 	default:
 		logger.Warn().Msg("Not found")
 		http.Error(w, "Not found", http.StatusNotFound)
 	}
 }
 
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
 // BackupRequest represents the backup API request
 type BackupRequest struct {
+	tenant.Identity
 	BackupID        string `json:"backupID"`
 	DataFolder      string `json:"dataFolder"`
 	DestinationPath string `json:"destinationPath"`
+	// Mode is filesystem or stream, the configured mode by default
+	Mode string `json:"mode,omitempty"`
+	// Incremental makes a streamed backup incremental to the previous one,
+	// as configured by default
+	Incremental *bool `json:"incremental,omitempty"`
+	// Tuning overrides the configured upload tuning of a filesystem
+	// backup, unset fields keep it
+	Tuning *restic.UploadOptions `json:"tuning,omitempty"`
 }
 
 func (p *Plugin) handleBackup(w http.ResponseWriter, r *http.Request, logger *logging.Logger) {
@@ -73,33 +257,140 @@ func (p *Plugin) handleBackup(w http.ResponseWriter, r *http.Request, logger *lo
 		return
 	}
 
+	mode := req.Mode
+	if mode == "" {
+		mode = p.options.BackupMode
+	}
+	if mode == "" {
+		mode = backup.ModeFilesystem
+	}
+	incremental := mode == backup.ModeStream && p.options.BasebackupStream.Incremental
+	if req.Incremental != nil {
+		incremental = *req.Incremental
+	}
 	logger = logger.WithFields(map[string]interface{}{
+		"tenant":      req.Identity.String(),
 		"backup_id":   req.BackupID,
 		"data_folder": req.DataFolder,
+		"mode":        mode,
+		"incremental": incremental,
 	})
+	if !backup.ValidMode(mode) {
+		logger.Warn().Msg("Invalid backup mode")
+		http.Error(w, fmt.Sprintf("Invalid mode %q, must be filesystem or stream", mode), http.StatusBadRequest)
+		return
+	}
+	if incremental && mode != backup.ModeStream {
+		logger.Warn().Msg("Incremental backup requested outside the stream mode")
+		http.Error(w, "Incremental backups need the stream mode", http.StatusBadRequest)
+		return
+	}
+	upload := p.options.BackupUpload
+	if req.Tuning != nil {
+		if mode != backup.ModeFilesystem {
+			logger.Warn().Msg("Upload tuning requested outside the filesystem mode")
+			http.Error(w, "Upload tuning needs the filesystem mode", http.StatusBadRequest)
+			return
+		}
+		if err := req.Tuning.Validate(); err != nil {
+			logger.Warn().Err(err).Msg("Invalid upload tuning")
+			http.Error(w, fmt.Sprintf("Invalid tuning: %v", err), http.StatusBadRequest)
+			return
+		}
+		upload = upload.Merge(*req.Tuning)
+	}
+
+	// Streamed backups read nothing from the plugin's filesystem
+	var dataFolder string
+	if mode == backup.ModeFilesystem {
+		var ok bool
+		if dataFolder, ok = checkPath(w, p.options.Paths.Data, "dataFolder", req.DataFolder, logger); !ok {
+			return
+		}
+	}
+	h, ok := p.resolveTenant(w, r, req.Identity, logger)
+	if !ok {
+		return
+	}
+	if !lockTenant(w, h, logger) {
+		return
+	}
+	defer h.lock.Unlock()
+
 	logger.Info().Msg("Starting backup")
 
-	if err := p.backupHandler.CreateBackup(r.Context(), req.DataFolder); err != nil {
+	var err error
+	if mode == backup.ModeStream {
+		err = h.backupHandler.StreamBackup(h.context(r.Context()), backup.StreamOptions{Incremental: incremental})
+	} else {
+		err = h.backupHandler.CreateBackup(h.context(r.Context()), dataFolder, backup.CreateOptions{Upload: upload})
+	}
+	if err != nil {
 		logger.Error().Err(err).Msg("Backup failed")
 		http.Error(w, fmt.Sprintf("Backup failed: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	logger.Info().Msg("Backup completed successfully")
+	if h.replicator != nil && p.options.ReplicateAfterBackup {
+		h.replicator.Trigger()
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
 // RestoreRequest represents the restore API request
 type RestoreRequest struct {
-	BackupID    string `json:"backupID"`
-	DestFolder  string `json:"destFolder"`
+	tenant.Identity
+	BackupID       string `json:"backupID"`
+	DestFolder     string `json:"destFolder"`
 	RecoveryTarget *struct {
-		TargetTime     string `json:"targetTime,omitempty"`
-		TargetXID      string `json:"targetXID,omitempty"`
-		TargetLSN      string `json:"targetLSN,omitempty"`
-		TargetName     string `json:"targetName,omitempty"`
+		TargetTime      string `json:"targetTime,omitempty"`
+		TargetXID       string `json:"targetXID,omitempty"`
+		TargetLSN       string `json:"targetLSN,omitempty"`
+		TargetName      string `json:"targetName,omitempty"`
 		TargetInclusive bool   `json:"targetInclusive,omitempty"`
 	} `json:"recoveryTarget,omitempty"`
+	// TablespaceMapping relocates tablespaces, keyed by OID or original
+	// location
+	TablespaceMapping map[string]string `json:"tablespaceMapping,omitempty"`
+	// Tuning overrides the configured restore tuning, unset fields keep it
+	Tuning *RestoreTuning `json:"tuning,omitempty"`
+	// Overwrite replaces the contents of a non-empty destFolder
+	Overwrite bool `json:"overwrite,omitempty"`
+	// Stage restores next to destFolder first and swaps the result in
+	Stage bool `json:"stage,omitempty"`
+}
+
+// RestoreTuning overrides fields of the configured restore tuning
+type RestoreTuning struct {
+	Connections   *int    `json:"connections,omitempty"`
+	LimitDownload *int    `json:"limitDownload,omitempty"`
+	CacheDir      *string `json:"cacheDir,omitempty"`
+	Verify        *bool   `json:"verify,omitempty"`
+	Sparse        *bool   `json:"sparse,omitempty"`
+}
+
+// apply returns opts with the fields set in t replacing its own
+func (t *RestoreTuning) apply(opts restic.RestoreOptions) restic.RestoreOptions {
+	if t == nil {
+		return opts
+	}
+	if t.Connections != nil {
+		opts.Connections = *t.Connections
+	}
+	if t.LimitDownload != nil {
+		opts.LimitDownload = *t.LimitDownload
+	}
+	if t.CacheDir != nil {
+		opts.CacheDir = *t.CacheDir
+	}
+	if t.Verify != nil {
+		opts.Verify = *t.Verify
+	}
+	if t.Sparse != nil {
+		opts.Sparse = *t.Sparse
+	}
+	return opts
 }
 
 func (p *Plugin) handleRestore(w http.ResponseWriter, r *http.Request, logger *logging.Logger) {
@@ -117,6 +408,7 @@ func (p *Plugin) handleRestore(w http.ResponseWriter, r *http.Request, logger *l
 	}
 
 	logger = logger.WithFields(map[string]interface{}{
+		"tenant":      req.Identity.String(),
 		"backup_id":   req.BackupID,
 		"dest_folder": req.DestFolder,
 	})
@@ -125,9 +417,66 @@ func (p *Plugin) handleRestore(w http.ResponseWriter, r *http.Request, logger *l
 			"recovery_target": req.RecoveryTarget,
 		})
 	}
+
+	destFolder, ok := checkPath(w, p.options.Paths.Restore, "destFolder", req.DestFolder, logger)
+	if !ok {
+		return
+	}
+	opts := restore.Options{TablespaceMapping: make(map[string]string, len(req.TablespaceMapping))}
+	for from, to := range req.TablespaceMapping {
+		location, ok := checkPath(w, p.options.Paths.Restore, "tablespaceMapping", to, logger)
+		if !ok {
+			return
+		}
+		opts.TablespaceMapping[from] = location
+	}
+	opts.Overwrite = req.Overwrite
+	opts.Stage = req.Stage
+	opts.Restic = req.Tuning.apply(p.options.Restore)
+	if err := opts.Restic.Validate(); err != nil {
+		logger.Warn().Err(err).Msg("Invalid restore tuning")
+		http.Error(w, fmt.Sprintf("Invalid tuning: %v", err), http.StatusBadRequest)
+		return
+	}
+	// restic writes its cache where the request says
+	if req.Tuning != nil && req.Tuning.CacheDir != nil && *req.Tuning.CacheDir != "" {
+		if opts.Restic.CacheDir, ok = checkPath(w, p.options.Paths.Restore, "tuning.cacheDir", *req.Tuning.CacheDir, logger); !ok {
+			return
+		}
+	}
+	h, ok := p.resolveTenant(w, r, req.Identity, logger)
+	if !ok {
+		return
+	}
+	if !lockTenant(w, h, logger) {
+		return
+	}
+	defer h.lock.Unlock()
+
 	logger.Info().Msg("Starting restore")
 
-	if err := p.restoreHandler.RestoreBackup(r.Context(), req.BackupID, req.DestFolder); err != nil {
+	err := h.restoreHandler.RestoreBackup(h.context(r.Context()), req.BackupID, destFolder, opts)
+	p.recordAudit(r.Context(), audit.Event{
+		Action: audit.ActionRestore,
+		Tenant: h.identity.String(),
+		Params: req.auditParams(),
+	}, err, logger)
+	if errors.Is(err, restic.ErrSnapshotNotFound) {
+		logger.Warn().Err(err).Msg("Backup not found")
+		http.Error(w, fmt.Sprintf("Backup not found: %v", err), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, restic.ErrSnapshotAmbiguous) {
+		logger.Warn().Err(err).Msg("Ambiguous backup ID")
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, restore.ErrTargetNotEmpty) || errors.Is(err, restore.ErrServerRunning) || errors.Is(err, restore.ErrTargetMountPoint) {
+		logger.Warn().Err(err).Msg("Restore refused")
+		http.Error(w, fmt.Sprintf("Restore refused: %v", err), http.StatusConflict)
+		return
+	}
+	if err != nil {
 		logger.Error().Err(err).Msg("Restore failed")
 		http.Error(w, fmt.Sprintf("Restore failed: %v", err), http.StatusInternalServerError)
 		return
@@ -139,8 +488,12 @@ func (p *Plugin) handleRestore(w http.ResponseWriter, r *http.Request, logger *l
 
 // WALArchiveRequest represents the WAL archive API request
 type WALArchiveRequest struct {
+	tenant.Identity
 	WalFileName string `json:"walFileName"`
 	WalFilePath string `json:"walFilePath"`
+	// DataFolder is the data directory of the instance archiving the
+	// segment, the parent of the directory of walFilePath if empty
+	DataFolder string `json:"dataFolder,omitempty"`
 }
 
 func (p *Plugin) handleWALArchive(w http.ResponseWriter, r *http.Request, logger *logging.Logger) {
@@ -158,25 +511,62 @@ func (p *Plugin) handleWALArchive(w http.ResponseWriter, r *http.Request, logger
 	}
 
 	logger = logger.WithFields(map[string]interface{}{
+		"tenant":   req.Identity.String(),
 		"wal_file": req.WalFileName,
 		"wal_path": req.WalFilePath,
 	})
+
+	if !checkWALFileName(w, req.WalFileName, logger) {
+		return
+	}
+	walPath, ok := checkPath(w, p.options.Paths.WAL, "walFilePath", req.WalFilePath, logger)
+	if !ok {
+		return
+	}
+	// The archived file is named after the file it resolves to
+	if filepath.Base(req.WalFilePath) != req.WalFileName || filepath.Base(walPath) != req.WalFileName {
+		logger.Warn().Msg("WAL file path does not match the WAL file name")
+		http.Error(w, "Invalid walFilePath: file name does not match walFileName", http.StatusBadRequest)
+		return
+	}
+	dataFolder, ok := checkDataFolder(w, req.DataFolder, filepath.Dir(filepath.Dir(filepath.Clean(req.WalFilePath))), logger, p.options.Paths.Data)
+	if !ok {
+		return
+	}
+	h, ok := p.resolveTenant(w, r, req.Identity, logger)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := p.walContext(r.Context())
+	defer cancel()
+	release, ok := p.acquireWAL(ctx, w, logger)
+	if !ok {
+		return
+	}
+	defer release()
+
 	logger.Info().Msg("Starting WAL archival")
 
-	if err := p.backupHandler.ArchiveWAL(r.Context(), req.WalFilePath); err != nil {
+	if err := h.backupHandler.ArchiveWAL(h.context(ctx), walPath, dataFolder); err != nil {
 		logger.Error().Err(err).Msg("WAL archiving failed")
 		http.Error(w, fmt.Sprintf("WAL archiving failed: %v", err), http.StatusInternalServerError)
 		return
 	}
 
+	h.prober.RecordWALArchive(time.Now())
 	logger.Info().Msg("WAL archival completed successfully")
 	w.WriteHeader(http.StatusOK)
 }
 
 // WALRestoreRequest represents the WAL restore API request
 type WALRestoreRequest struct {
+	tenant.Identity
 	WalFileName string `json:"walFileName"`
 	DestFolder  string `json:"destFolder"`
+	// DataFolder is the data directory of the recovering instance, the
+	// parent of destFolder if empty
+	DataFolder string `json:"dataFolder,omitempty"`
 }
 
 func (p *Plugin) handleWALRestore(w http.ResponseWriter, r *http.Request, logger *logging.Logger) {
@@ -194,13 +584,40 @@ func (p *Plugin) handleWALRestore(w http.ResponseWriter, r *http.Request, logger
 	}
 
 	logger = logger.WithFields(map[string]interface{}{
+		"tenant":      req.Identity.String(),
 		"wal_file":    req.WalFileName,
 		"dest_folder": req.DestFolder,
 	})
+
+	if !checkWALFileName(w, req.WalFileName, logger) {
+		return
+	}
+	destFolder, ok := checkPath(w, p.options.Paths.WALRestore, "destFolder", req.DestFolder, logger)
+	if !ok {
+		return
+	}
+	// The instance recovers from a restored or its own data directory
+	dataFolder, ok := checkDataFolder(w, req.DataFolder, filepath.Dir(filepath.Clean(req.DestFolder)), logger, p.options.Paths.Data, p.options.Paths.Restore)
+	if !ok {
+		return
+	}
+	h, ok := p.resolveTenant(w, r, req.Identity, logger)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := p.walContext(r.Context())
+	defer cancel()
+	release, ok := p.acquireWAL(ctx, w, logger)
+	if !ok {
+		return
+	}
+	defer release()
+
 	logger.Info().Msg("Starting WAL restore")
 
-	destPath := filepath.Join(req.DestFolder, req.WalFileName)
-	if err := p.restoreHandler.RestoreWAL(r.Context(), req.WalFileName, destPath); err != nil {
+	destPath := filepath.Join(destFolder, req.WalFileName)
+	if err := h.restoreHandler.RestoreWAL(h.context(ctx), req.WalFileName, destPath, dataFolder); err != nil {
 		logger.Error().Err(err).Msg("WAL restore failed")
 		http.Error(w, fmt.Sprintf("WAL restore failed: %v", err), http.StatusInternalServerError)
 		return
@@ -4,38 +4,76 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"cloud-native-pg-restic-backup/internal/audit"
+	"cloud-native-pg-restic-backup/internal/auth"
+	"cloud-native-pg-restic-backup/internal/backup"
+	"cloud-native-pg-restic-backup/internal/basebackup"
+	"cloud-native-pg-restic-backup/internal/health"
+	"cloud-native-pg-restic-backup/internal/integrity"
 	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/logical"
+	"cloud-native-pg-restic-backup/internal/replication"
+	"cloud-native-pg-restic-backup/internal/restic"
+	"cloud-native-pg-restic-backup/internal/restore"
+	"cloud-native-pg-restic-backup/internal/sandbox"
+	"cloud-native-pg-restic-backup/internal/tenant"
+	"cloud-native-pg-restic-backup/internal/tracing"
+	"cloud-native-pg-restic-backup/internal/verify"
 )
 
 // Mock implementations
 type mockBackupHandler struct {
 	createBackupErr error
+	streamBackupErr error
 	archiveWALErr   error
+	streamOptions   backup.StreamOptions
+	createOptions   backup.CreateOptions
+	walDataDir      string
 }
 
-func (m *mockBackupHandler) CreateBackup(_ context.Context, _ string) error {
+func (m *mockBackupHandler) CreateBackup(_ context.Context, _ string, opts backup.CreateOptions) error {
+	m.createOptions = opts
 	return m.createBackupErr
 }
 
-func (m *mockBackupHandler) ArchiveWAL(_ context.Context, _ string) error {
+func (m *mockBackupHandler) StreamBackup(_ context.Context, opts backup.StreamOptions) error {
+	m.streamOptions = opts
+	return m.streamBackupErr
+}
+
+func (m *mockBackupHandler) ArchiveWAL(_ context.Context, _, dataDir string) error {
+	m.walDataDir = dataDir
 	return m.archiveWALErr
 }
 
 type mockRestoreHandler struct {
 	restoreBackupErr error
 	restoreWALErr    error
+	restoreOptions   restore.Options
+	walDataDir       string
 }
 
-func (m *mockRestoreHandler) RestoreBackup(_ context.Context, _, _ string) error {
+func (m *mockRestoreHandler) RestoreBackup(_ context.Context, _, _ string, opts restore.Options) error {
+	m.restoreOptions = opts
 	return m.restoreBackupErr
 }
 
-func (m *mockRestoreHandler) RestoreWAL(_ context.Context, _, _ string) error {
+func (m *mockRestoreHandler) RestoreWAL(_ context.Context, _, _, dataDir string) error {
+	m.walDataDir = dataDir
 	return m.restoreWALErr
 }
 
@@ -49,9 +87,14 @@ func newTestPlugin() (*Plugin, *mockBackupHandler, *mockRestoreHandler) {
 	})
 
 	p := &Plugin{
-		backupHandler:  backupHandler,
-		restoreHandler: restoreHandler,
-		logger:        logger,
+		logger: logger,
+		handlers: map[tenant.Identity]*tenantHandlers{
+			{}: {
+				backupHandler:  backupHandler,
+				restoreHandler: restoreHandler,
+				prober:         health.NewProber(&mockResticClient{}, health.Options{}),
+			},
+		},
 	}
 
 	return p, backupHandler, restoreHandler
@@ -59,13 +102,15 @@ func newTestPlugin() (*Plugin, *mockBackupHandler, *mockRestoreHandler) {
 
 func TestPlugin_HandleBackup(t *testing.T) {
 	p, backupHandler, _ := newTestPlugin()
+	incremental := true
 
 	tests := []struct {
-		name           string
-		method         string
-		request        BackupRequest
-		backupError    error
-		expectedStatus int
+		name            string
+		method          string
+		request         BackupRequest
+		backupError     error
+		expectedStatus  int
+		wantIncremental bool
 	}{
 		{
 			name:   "successful backup",
@@ -87,6 +132,55 @@ func TestPlugin_HandleBackup(t *testing.T) {
 			backupError:    fmt.Errorf("backup failed"),
 			expectedStatus: http.StatusInternalServerError,
 		},
+		{
+			name:   "streamed backup without data folder",
+			method: http.MethodPost,
+			request: BackupRequest{
+				BackupID: "test-backup",
+				Mode:     "stream",
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "failed streamed backup",
+			method: http.MethodPost,
+			request: BackupRequest{
+				BackupID: "test-backup",
+				Mode:     "stream",
+			},
+			backupError:    fmt.Errorf("pg_basebackup failed"),
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:   "incremental streamed backup",
+			method: http.MethodPost,
+			request: BackupRequest{
+				BackupID:    "test-backup",
+				Mode:        "stream",
+				Incremental: &incremental,
+			},
+			expectedStatus:  http.StatusOK,
+			wantIncremental: true,
+		},
+		{
+			name:   "incremental filesystem backup",
+			method: http.MethodPost,
+			request: BackupRequest{
+				BackupID:    "test-backup",
+				DataFolder:  "/data",
+				Incremental: &incremental,
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "unknown mode",
+			method: http.MethodPost,
+			request: BackupRequest{
+				BackupID: "test-backup",
+				Mode:     "snapshot",
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
 		{
 			name:           "wrong method",
 			method:         http.MethodGet,
@@ -97,6 +191,7 @@ func TestPlugin_HandleBackup(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			backupHandler.createBackupErr = tt.backupError
+			backupHandler.streamBackupErr = tt.backupError
 
 			var body []byte
 			var err error
@@ -107,6 +202,7 @@ func TestPlugin_HandleBackup(t *testing.T) {
 				}
 			}
 
+			backupHandler.streamOptions = backup.StreamOptions{}
 			req := httptest.NewRequest(tt.method, "/backup", bytes.NewReader(body))
 			w := httptest.NewRecorder()
 
@@ -115,6 +211,9 @@ func TestPlugin_HandleBackup(t *testing.T) {
 			if w.Code != tt.expectedStatus {
 				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, w.Code)
 			}
+			if backupHandler.streamOptions.Incremental != tt.wantIncremental {
+				t.Errorf("incremental = %v, want %v", backupHandler.streamOptions.Incremental, tt.wantIncremental)
+			}
 		})
 	}
 }
@@ -211,6 +310,59 @@ func TestPlugin_HandleRestore(t *testing.T) {
 			restoreError:   fmt.Errorf("restore failed"),
 			expectedStatus: http.StatusInternalServerError,
 		},
+		{
+			name:   "non-empty destination",
+			method: http.MethodPost,
+			request: RestoreRequest{
+				BackupID:   "test-backup",
+				DestFolder: "/restore",
+			},
+			restoreError:   fmt.Errorf("%w: /restore", restore.ErrTargetNotEmpty),
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:   "staged restore into a mount point",
+			method: http.MethodPost,
+			request: RestoreRequest{
+				BackupID:   "test-backup",
+				DestFolder: "/restore",
+				Stage:      true,
+			},
+			restoreError:   fmt.Errorf("%w: /restore", restore.ErrTargetMountPoint),
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:   "ambiguous backup ID",
+			method: http.MethodPost,
+			request: RestoreRequest{
+				BackupID:   "4f",
+				DestFolder: "/restore",
+			},
+			restoreError:   fmt.Errorf("%w: 4f", restic.ErrSnapshotAmbiguous),
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "backup of another tenant",
+			method: http.MethodPost,
+			request: RestoreRequest{
+				BackupID:   "other-backup",
+				DestFolder: "/restore",
+			},
+			restoreError:   fmt.Errorf("%w: other-backup", restic.ErrSnapshotNotFound),
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:   "running server",
+			method: http.MethodPost,
+			request: RestoreRequest{
+				BackupID:   "test-backup",
+				DestFolder: "/restore",
+				Overwrite:  true,
+				Stage:      true,
+			},
+			restoreError:   restore.ErrServerRunning,
+			expectedStatus: http.StatusConflict,
+		},
 		{
 			name:           "wrong method",
 			method:         http.MethodGet,
@@ -239,6 +391,1189 @@ func TestPlugin_HandleRestore(t *testing.T) {
 			if w.Code != tt.expectedStatus {
 				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, w.Code)
 			}
+			if tt.method == http.MethodPost && (restoreHandler.restoreOptions.Overwrite != tt.request.Overwrite || restoreHandler.restoreOptions.Stage != tt.request.Stage) {
+				t.Errorf("overwrite, stage = %v, %v, want %v, %v", restoreHandler.restoreOptions.Overwrite, restoreHandler.restoreOptions.Stage, tt.request.Overwrite, tt.request.Stage)
+			}
+		})
+	}
+}
+
+func TestPlugin_Tuning(t *testing.T) {
+	p, backupHandler, restoreHandler := newTestPlugin()
+	p.options.BackupUpload = restic.UploadOptions{LimitUpload: 1024, PackSize: 32}
+	p.options.Restore = restic.RestoreOptions{Connections: 8, Sparse: true}
+
+	post := func(path string, request interface{}) int {
+		body, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+		return w.Code
+	}
+
+	code := post("/backup", BackupRequest{BackupID: "b", DataFolder: "/data", Tuning: &restic.UploadOptions{PackSize: 64}})
+	want := restic.UploadOptions{LimitUpload: 1024, PackSize: 64}
+	if code != http.StatusOK || backupHandler.createOptions.Upload != want {
+		t.Errorf("backup = %d with %+v, want %+v", code, backupHandler.createOptions.Upload, want)
+	}
+	if code := post("/backup", BackupRequest{BackupID: "b", DataFolder: "/data", Tuning: &restic.UploadOptions{PackSize: 512}}); code != http.StatusBadRequest {
+		t.Errorf("backup with invalid tuning = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := post("/backup", BackupRequest{BackupID: "b", Mode: "stream", Tuning: &restic.UploadOptions{PackSize: 64}}); code != http.StatusBadRequest {
+		t.Errorf("streamed backup with tuning = %d, want %d", code, http.StatusBadRequest)
+	}
+
+	sparse, connections := false, 2
+	code = post("/restore", RestoreRequest{BackupID: "b", DestFolder: "/restore", Tuning: &RestoreTuning{Connections: &connections, Sparse: &sparse}})
+	wantRestore := restic.RestoreOptions{Connections: 2}
+	if code != http.StatusOK || restoreHandler.restoreOptions.Restic != wantRestore {
+		t.Errorf("restore = %d with %+v, want %+v", code, restoreHandler.restoreOptions.Restic, wantRestore)
+	}
+	code = post("/restore", RestoreRequest{BackupID: "b", DestFolder: "/restore"})
+	if code != http.StatusOK || restoreHandler.restoreOptions.Restic != p.options.Restore {
+		t.Errorf("restore = %d with %+v, want the defaults", code, restoreHandler.restoreOptions.Restic)
+	}
+	connections = -1
+	if code := post("/restore", RestoreRequest{BackupID: "b", DestFolder: "/restore", Tuning: &RestoreTuning{Connections: &connections}}); code != http.StatusBadRequest {
+		t.Errorf("restore with invalid tuning = %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+// mockResticClient records the configuration it was created with
+type mockResticClient struct {
+	restic.Client
+	config restic.Config
+}
+
+func (m *mockResticClient) InitRepository(_ context.Context) error {
+	return nil
+}
+
+func (m *mockResticClient) FindSnapshots(_ context.Context, _ []string) ([]*restic.Snapshot, error) {
+	return nil, nil
+}
+
+func (m *mockResticClient) Check(_ context.Context, opts restic.CheckOptions) (*restic.CheckResult, error) {
+	return &restic.CheckResult{Mode: opts.Mode, OK: true}, nil
+}
+
+func (m *mockResticClient) Locks(_ context.Context) ([]*restic.Lock, error) {
+	return nil, nil
+}
+
+func TestPlugin_TenantRouting(t *testing.T) {
+	p, _, _ := newTestPlugin()
+
+	tenantA := tenant.Identity{ClusterName: "pg-a", Namespace: "db"}
+	tenantB := tenant.Identity{ClusterName: "pg-b", Namespace: "db"}
+	backupA := &mockBackupHandler{}
+	backupB := &mockBackupHandler{archiveWALErr: fmt.Errorf("archive failed")}
+	prober := health.NewProber(&mockResticClient{}, health.Options{})
+	p.handlers[tenantA] = &tenantHandlers{backupHandler: backupA, restoreHandler: &mockRestoreHandler{}, prober: prober}
+	p.handlers[tenantB] = &tenantHandlers{backupHandler: backupB, restoreHandler: &mockRestoreHandler{}, prober: prober}
+
+	tests := []struct {
+		name           string
+		identity       tenant.Identity
+		expectedStatus int
+	}{
+		{
+			name:           "routes to tenant A",
+			identity:       tenantA,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "routes to tenant B",
+			identity:       tenantB,
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:           "rejects identities escaping directories",
+			identity:       tenant.Identity{ClusterName: "..", Namespace: "db/pg-a"},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(WALArchiveRequest{
+				Identity:    tt.identity,
+				WalFileName: "000000010000000000000001",
+				WalFilePath: "/wal/000000010000000000000001",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/wal-archive", bytes.NewReader(body))
+			w := httptest.NewRecorder()
+
+			p.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestPlugin_TenantResolution(t *testing.T) {
+	defaultConfig := restic.Config{Repository: "/repo/default", Password: "secret"}
+	registry, err := tenant.NewRegistry(tenant.Config{Default: &defaultConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var clients []*mockResticClient
+	p := NewPlugin(context.Background(), registry, Options{}, logging.NewLogger(logging.Config{Level: "info"}))
+	p.newClient = func(cfg restic.Config) restic.Client {
+		c := &mockResticClient{config: cfg}
+		clients = append(clients, c)
+		return c
+	}
+
+	id := tenant.Identity{ClusterName: "pg-a", Namespace: "db"}
+	first, err := p.handlersFor(context.Background(), id)
+	if err != nil {
+		t.Fatalf("handlersFor() error = %v", err)
+	}
+	second, err := p.handlersFor(context.Background(), id)
+	if err != nil {
+		t.Fatalf("handlersFor() error = %v", err)
+	}
+
+	if first != second {
+		t.Error("Expected handlers to be cached per tenant")
+	}
+	if len(clients) != 1 {
+		t.Fatalf("Expected one client to be created, got %d", len(clients))
+	}
+	if clients[0].config.Repository != defaultConfig.Repository {
+		t.Errorf("Expected fallback to default repository, got %q", clients[0].config.Repository)
+	}
+}
+
+// blockingInitClient initializes its repository once released
+type blockingInitClient struct {
+	mockResticClient
+	release chan struct{}
+}
+
+func (c *blockingInitClient) InitRepository(ctx context.Context) error {
+	select {
+	case <-c.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestPlugin_TenantInit(t *testing.T) {
+	defaultConfig := restic.Config{Repository: "/repo/default", Password: "secret"}
+	tenantsFile := filepath.Join(t.TempDir(), "tenants.json")
+	if err := os.WriteFile(tenantsFile, []byte(`{"tenants": [{"clusterName": "pg-slow", "namespace": "db", "repository": "/repo/slow", "password": "p"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	registry, err := tenant.NewRegistry(tenant.Config{Default: &defaultConfig, File: tenantsFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var slowClients int
+	p := NewPlugin(context.Background(), registry, Options{MaxTenants: 2}, logging.NewLogger(logging.Config{Level: "info"}))
+	p.newClient = func(cfg restic.Config) restic.Client {
+		if cfg.Repository != "/repo/slow" {
+			return &mockResticClient{config: cfg}
+		}
+		mu.Lock()
+		slowClients++
+		mu.Unlock()
+		return &blockingInitClient{mockResticClient: mockResticClient{config: cfg}, release: release}
+	}
+
+	// Concurrent requests of a slow tenant share its initialization
+	slow := tenant.Identity{ClusterName: "pg-slow", Namespace: "db"}
+	results := make(chan *tenantHandlers, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			h, _ := p.handlersFor(context.Background(), slow)
+			results <- h
+		}()
+	}
+
+	// Meanwhile, other tenants are served
+	done := make(chan error)
+	go func() {
+		_, err := p.handlersFor(context.Background(), tenant.Identity{ClusterName: "pg-a", Namespace: "db"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("handlersFor() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tenant blocked by the initialization of another")
+	}
+
+	close(release)
+	first, second := <-results, <-results
+	if first == nil || first != second || slowClients != 1 {
+		t.Errorf("slow tenant initialized %d times, handlers %p and %p", slowClients, first, second)
+	}
+
+	// Two tenants are initialized, a third is over the limit
+	_, err = p.handlersFor(context.Background(), tenant.Identity{ClusterName: "pg-b", Namespace: "db"})
+	if !errors.Is(err, errTenantLimit) {
+		t.Errorf("handlersFor() beyond the limit error = %v, want %v", err, errTenantLimit)
+	}
+}
+
+func TestPlugin_AuthBeforeTenantInit(t *testing.T) {
+	defaultConfig := restic.Config{Repository: "/repo/default", Password: "secret"}
+	registry, err := tenant.NewRegistry(tenant.Config{Default: &defaultConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator, err := auth.New(auth.Config{Principals: []auth.PrincipalConfig{
+		{Name: "instance", Token: "instance-token", Operations: []string{auth.OpWALArchive}, Tenants: []string{"db/*"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var clients int
+	p := NewPlugin(context.Background(), registry, Options{Auth: authenticator}, logging.NewLogger(logging.Config{Level: "info"}))
+	p.newClient = func(cfg restic.Config) restic.Client {
+		clients++
+		return &mockResticClient{config: cfg}
+	}
+
+	body, err := json.Marshal(WALArchiveRequest{
+		Identity:    tenant.Identity{ClusterName: "pg-x", Namespace: "other"},
+		WalFileName: "000000010000000000000001",
+		WalFilePath: "/wal/000000010000000000000001",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/wal-archive", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer instance-token")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d, got %d", http.StatusForbidden, w.Code)
+	}
+	if clients != 0 || len(p.handlers) != 0 {
+		t.Errorf("tenant not permitted was initialized: %d clients, %d handlers", clients, len(p.handlers))
+	}
+}
+
+func TestPlugin_ValidateBeforeTenantInit(t *testing.T) {
+	defaultConfig := restic.Config{Repository: "/repo/default", Password: "secret"}
+	registry, err := tenant.NewRegistry(tenant.Config{Default: &defaultConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := tenant.Identity{ClusterName: "pg-x", Namespace: "db"}
+
+	tests := []struct {
+		name    string
+		path    string
+		request interface{}
+	}{
+		{
+			name:    "invalid WAL file name",
+			path:    "/wal-archive",
+			request: WALArchiveRequest{Identity: identity, WalFileName: "../pg_control", WalFilePath: "/wal/pg_control"},
+		},
+		{
+			name:    "relative WAL path",
+			path:    "/wal-archive",
+			request: WALArchiveRequest{Identity: identity, WalFileName: "000000010000000000000001", WalFilePath: "wal/000000010000000000000001"},
+		},
+		{
+			name:    "relative WAL restore folder",
+			path:    "/wal-restore",
+			request: WALRestoreRequest{Identity: identity, WalFileName: "000000010000000000000001", DestFolder: "pg_wal"},
+		},
+		{
+			name:    "traversing restore folder",
+			path:    "/restore",
+			request: RestoreRequest{Identity: identity, BackupID: "b", DestFolder: "/restore/../etc"},
+		},
+		{
+			name:    "relative data folder",
+			path:    "/backup",
+			request: BackupRequest{Identity: identity, BackupID: "b", DataFolder: "data"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var clients int
+			p := NewPlugin(context.Background(), registry, Options{}, logging.NewLogger(logging.Config{Level: "info"}))
+			p.newClient = func(cfg restic.Config) restic.Client {
+				clients++
+				return &mockResticClient{config: cfg}
+			}
+
+			body, err := json.Marshal(tt.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(body)))
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, w.Code)
+			}
+			if clients != 0 || len(p.handlers) != 0 {
+				t.Errorf("tenant of an invalid request was initialized: %d clients, %d handlers", clients, len(p.handlers))
+			}
+		})
+	}
+}
+
+func TestPlugin_TenantLock(t *testing.T) {
+	p, _, _ := newTestPlugin()
+
+	h := p.handlers[tenant.Identity{}]
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	body, err := json.Marshal(BackupRequest{BackupID: "test-backup", DataFolder: "/data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/backup", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d, got %d", http.StatusConflict, w.Code)
+	}
+}
+
+func TestPlugin_HandleReplication(t *testing.T) {
+	p, _, _ := newTestPlugin()
+
+	replicated := tenant.Identity{ClusterName: "pg-a", Namespace: "db"}
+	secondary := &mockResticClient{}
+	p.handlers[replicated] = &tenantHandlers{
+		backupHandler:  &mockBackupHandler{},
+		restoreHandler: &mockRestoreHandler{},
+		replicator: replication.NewReplicator(
+			&mockResticClient{},
+			[]replication.Target{{Name: "secondary-0", Client: secondary}},
+			p.logger,
+		),
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		query          string
+		expectedStatus int
+	}{
+		{
+			name:           "replication status",
+			method:         http.MethodGet,
+			query:          "?clusterName=pg-a&namespace=db",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "no secondary repositories",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "wrong method",
+			method:         http.MethodDelete,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/replication"+tt.query, nil)
+			w := httptest.NewRecorder()
+
+			p.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestPlugin_HandleVerify(t *testing.T) {
+	p, _, _ := newTestPlugin()
+	p.handlers[tenant.Identity{}].verifier = verify.NewVerifier(&mockResticClient{}, t.TempDir(), basebackup.Config{}, p.logger)
+
+	tests := []struct {
+		name           string
+		method         string
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:           "verification summary",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "no base backup to verify",
+			method:         http.MethodPost,
+			body:           `{"verifyChecksums": true}`,
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:           "unknown backup",
+			method:         http.MethodPost,
+			body:           `{"snapshotID": "4fa1b2c3"}`,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "invalid request",
+			method:         http.MethodPost,
+			body:           `{`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "wrong method",
+			method:         http.MethodDelete,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/verify", bytes.NewReader([]byte(tt.body)))
+			w := httptest.NewRecorder()
+
+			p.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestPlugin_HandleCheck(t *testing.T) {
+	p, _, _ := newTestPlugin()
+	p.handlers[tenant.Identity{}].checker = integrity.NewChecker(&mockResticClient{}, p.logger)
+
+	tests := []struct {
+		name           string
+		method         string
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:           "structure check",
+			method:         http.MethodPost,
+			body:           `{"mode": "structure"}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "subset check",
+			method:         http.MethodPost,
+			body:           `{"mode": "read-data-subset", "subset": "1/5"}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "invalid subset",
+			method:         http.MethodPost,
+			body:           `{"mode": "read-data-subset", "subset": "half"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "last check status",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "wrong method",
+			method:         http.MethodPut,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/check", bytes.NewReader([]byte(tt.body)))
+			w := httptest.NewRecorder()
+
+			p.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+
+	var status integrity.Status
+	req := httptest.NewRequest(http.MethodGet, "/check", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.History) != 2 {
+		t.Errorf("Expected 2 retained results, got %d", len(status.History))
+	}
+}
+
+func TestPlugin_HandleMetrics(t *testing.T) {
+	p, _, _ := newTestPlugin()
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte("go_goroutines")) {
+		t.Error("metrics do not include the runtime collectors")
+	}
+}
+
+func TestPlugin_HandleHealthz(t *testing.T) {
+	p, _, _ := newTestPlugin()
+
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestPlugin_HandleReadyz(t *testing.T) {
+	p, _, _ := newTestPlugin()
+
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	var resp ReadyResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	// Whether restic is installed depends on the test environment, so only
+	// check the status code agrees with the report
+	wantStatus := http.StatusServiceUnavailable
+	if resp.Ready {
+		wantStatus = http.StatusOK
+	}
+	if w.Code != wantStatus {
+		t.Errorf("Expected status code %d, got %d", wantStatus, w.Code)
+	}
+
+	if resp.Tenants != 1 {
+		t.Errorf("Tenants = %d, want the default tenant probed", resp.Tenants)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/readyz", nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status code %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+func TestPlugin_HandleReadyz_Tenants(t *testing.T) {
+	defaultConfig := restic.Config{Repository: "/repo/default", Password: "secret"}
+	registry, err := tenant.NewRegistry(tenant.Config{Default: &defaultConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clients []*mockResticClient
+	p := NewPlugin(context.Background(), registry, Options{}, logging.NewLogger(logging.Config{Level: "info"}))
+	p.newClient = func(cfg restic.Config) restic.Client {
+		c := &mockResticClient{config: cfg}
+		clients = append(clients, c)
+		return c
+	}
+
+	// Tenants are never initialized from the public probe
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz?clusterName=pg-x&namespace=other", nil))
+	if w.Code != http.StatusNotFound || len(clients) != 0 {
+		t.Errorf("probe of unknown tenant = %d with %d clients, want %d and none", w.Code, len(clients), http.StatusNotFound)
+	}
+
+	// Nor is the default repository, which is initialized at startup
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var resp ReadyResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if w.Code != http.StatusOK || resp.Tenants != 0 || len(clients) != 0 {
+		t.Errorf("probe without tenants = %d, %+v with %d clients, want nothing probed", w.Code, resp, len(clients))
+	}
+
+	// Tenants are counted, not named, and a stalled WAL archival is only
+	// reported
+	p.options.Health = health.Options{MaxWALAge: time.Nanosecond}
+	if err := p.InitTenant(context.Background(), tenant.Identity{ClusterName: "pg-a", Namespace: "db"}); err != nil {
+		t.Fatalf("InitTenant() error = %v", err)
+	}
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	body := w.Body.Bytes()
+	resp = ReadyResponse{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Tenants != 1 || resp.WALStale != 1 {
+		t.Errorf("response = %+v, want one tenant with a stale WAL archival", resp)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(body, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 4 || bytes.Contains(body, []byte("pg-a")) {
+		t.Errorf("response %s exposes tenant details", body)
+	}
+
+	// Requested on its own, the tenant isn't ready
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz?clusterName=pg-a&namespace=db", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("probe of a tenant with a stale WAL archival = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestPlugin_Tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+	if _, err := tracing.Setup(context.Background(), tracing.Config{}); err != nil {
+		t.Fatal(err)
+	}
+
+	p, _, _ := newTestPlugin()
+
+	req := httptest.NewRequest(http.MethodPost, "/backup", bytes.NewReader([]byte(`{"dataFolder": "/data"}`)))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	p.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("recorded %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "POST /backup" {
+		t.Errorf("span name = %q, want POST /backup", span.Name())
+	}
+	if got := span.Parent().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("span continues trace %s, want the caller's", got)
+	}
+
+	var status int64
+	for _, attr := range span.Attributes() {
+		if attr.Key == "http.response.status_code" {
+			status = attr.Value.AsInt64()
+		}
+	}
+	if status != http.StatusOK {
+		t.Errorf("http.response.status_code = %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestPlugin_RequestID(t *testing.T) {
+	p, _, _ := newTestPlugin()
+
+	tests := []struct {
+		name      string
+		requestID string
+		wantEcho  bool
+	}{
+		{
+			name:      "caller's request ID",
+			requestID: "req-42",
+			wantEcho:  true,
+		},
+		{
+			name: "generated request ID",
+		},
+		{
+			name:      "invalid request ID replaced",
+			requestID: "forged\tline",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+			if tt.requestID != "" {
+				req.Header.Set(logging.RequestIDHeader, tt.requestID)
+			}
+			w := httptest.NewRecorder()
+
+			p.ServeHTTP(w, req)
+
+			got := w.Header().Get(logging.RequestIDHeader)
+			if !logging.ValidRequestID(got) {
+				t.Fatalf("response request ID = %q, want a valid ID", got)
+			}
+			if (got == tt.requestID) != tt.wantEcho {
+				t.Errorf("response request ID = %q, caller sent %q", got, tt.requestID)
+			}
+		})
+	}
+}
+
+func TestPlugin_HandleAudit(t *testing.T) {
+	p, _, _ := newTestPlugin()
+
+	req := httptest.NewRequest(http.MethodGet, "/audit", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d without audit log, got %d", http.StatusNotFound, w.Code)
+	}
+
+	auditLog, err := audit.Open(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+	p.options.Audit = auditLog
+
+	req = httptest.NewRequest(http.MethodPost, "/restore", bytes.NewReader([]byte(`{"backupID": "abc", "destFolder": "/restore"}`)))
+	req.Header.Set(logging.RequestIDHeader, "req-restore")
+	p.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest(http.MethodGet, "/audit?action=restore&limit=10", nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var resp AuditResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.ChainValid || len(resp.Events) != 1 {
+		t.Fatalf("AuditResponse = %+v, want one restore in a valid chain", resp)
+	}
+	event := resp.Events[0]
+	if event.Actor.RequestID != "req-restore" || event.Params["backupID"] != "abc" || event.Outcome != audit.OutcomeSuccess {
+		t.Errorf("restore event = %+v", event)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/audit?since=yesterday", nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for invalid since, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestPlugin_Auth(t *testing.T) {
+	p, _, _ := newTestPlugin()
+
+	tenantA := tenant.Identity{ClusterName: "pg-a", Namespace: "db"}
+	tenantB := tenant.Identity{ClusterName: "pg-b", Namespace: "other"}
+	prober := health.NewProber(&mockResticClient{}, health.Options{})
+	p.handlers[tenantA] = &tenantHandlers{identity: tenantA, backupHandler: &mockBackupHandler{}, restoreHandler: &mockRestoreHandler{}, prober: prober}
+	p.handlers[tenantB] = &tenantHandlers{identity: tenantB, backupHandler: &mockBackupHandler{}, restoreHandler: &mockRestoreHandler{}, prober: prober}
+
+	authenticator, err := auth.New(auth.Config{Principals: []auth.PrincipalConfig{
+		{Name: "instance", Token: "instance-token", Operations: []string{auth.OpWALArchive}, Tenants: []string{"db/*"}},
+		{Name: "monitoring", Token: "monitoring-token", Operations: []string{auth.OpMetrics}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.options.Auth = authenticator
+
+	tests := []struct {
+		name           string
+		path           string
+		token          string
+		identity       tenant.Identity
+		expectedStatus int
+	}{
+		{
+			name:           "missing token",
+			path:           "/wal-archive",
+			identity:       tenantA,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "invalid token",
+			path:           "/wal-archive",
+			token:          "wrong",
+			identity:       tenantA,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "permitted operation and tenant",
+			path:           "/wal-archive",
+			token:          "instance-token",
+			identity:       tenantA,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "tenant not permitted",
+			path:           "/wal-archive",
+			token:          "instance-token",
+			identity:       tenantB,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "operation not permitted",
+			path:           "/wal-archive",
+			token:          "monitoring-token",
+			identity:       tenantA,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "health checks are public",
+			path:           "/healthz",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(WALArchiveRequest{
+				Identity:    tt.identity,
+				WalFileName: "000000010000000000000001",
+				WalFilePath: "/wal/000000010000000000000001",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			method := http.MethodPost
+			if tt.path == "/healthz" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, tt.path, bytes.NewReader(body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+
+			p.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if tt.expectedStatus == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("Expected WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestPlugin_PathSandbox(t *testing.T) {
+	p, _, _ := newTestPlugin()
+
+	dir := t.TempDir()
+	pgdata := filepath.Join(dir, "pgdata")
+	restoreDir := filepath.Join(dir, "restore")
+	for _, d := range []string{filepath.Join(pgdata, "pg_wal"), restoreDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := sandbox.New(pgdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoreRoots, err := sandbox.New(restoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	walRestore, err := sandbox.New(pgdata, restoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.options.Paths = Paths{Data: data, WAL: data, Restore: restoreRoots, WALRestore: walRestore}
+
+	const walFile = "000000010000000000000001"
+	tests := []struct {
+		name           string
+		path           string
+		request        interface{}
+		expectedStatus int
+	}{
+		{
+			name:           "backup of the data directory",
+			path:           "/backup",
+			request:        BackupRequest{DataFolder: pgdata},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "backup outside the roots",
+			path:           "/backup",
+			request:        BackupRequest{DataFolder: "/etc"},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "backup with traversal",
+			path:           "/backup",
+			request:        BackupRequest{DataFolder: pgdata + "/../../etc"},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "WAL archive",
+			path:           "/wal-archive",
+			request:        WALArchiveRequest{WalFileName: walFile, WalFilePath: filepath.Join(pgdata, "pg_wal", walFile)},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "WAL archive of a file that is not WAL",
+			path:           "/wal-archive",
+			request:        WALArchiveRequest{WalFileName: walFile, WalFilePath: filepath.Join(pgdata, "pg_wal", "postgresql.conf")},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "WAL archive outside the roots",
+			path:           "/wal-archive",
+			request:        WALArchiveRequest{WalFileName: walFile, WalFilePath: filepath.Join(restoreDir, walFile)},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "WAL restore of a history file",
+			path:           "/wal-restore",
+			request:        WALRestoreRequest{WalFileName: "00000002.history", DestFolder: filepath.Join(restoreDir, "pg_wal")},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "WAL restore with an invalid name",
+			path:           "/wal-restore",
+			request:        WALRestoreRequest{WalFileName: "../../postgresql.auto.conf", DestFolder: filepath.Join(pgdata, "pg_wal")},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "restore into a restore directory",
+			path:           "/restore",
+			request:        RestoreRequest{BackupID: "abc", DestFolder: filepath.Join(restoreDir, "pg-a")},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "restore into the data directory",
+			path:           "/restore",
+			request:        RestoreRequest{BackupID: "abc", DestFolder: pgdata},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name: "restore relocating a tablespace",
+			path: "/restore",
+			request: RestoreRequest{BackupID: "abc", DestFolder: filepath.Join(restoreDir, "pg-a"),
+				TablespaceMapping: map[string]string{"16385": filepath.Join(restoreDir, "ts")}},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "restore relocating a tablespace outside the roots",
+			path: "/restore",
+			request: RestoreRequest{BackupID: "abc", DestFolder: filepath.Join(restoreDir, "pg-a"),
+				TablespaceMapping: map[string]string{"16385": "/etc/ts"}},
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(tt.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(body))
+			w := httptest.NewRecorder()
+
+			p.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestPlugin_WALDataFolder(t *testing.T) {
+	p, backupHandler, restoreHandler := newTestPlugin()
+
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pgdata := filepath.Join(dir, "pgdata")
+	walVolume := filepath.Join(dir, "wal")
+	restoreDir := filepath.Join(dir, "restore")
+	for _, d := range []string{pgdata, walVolume, filepath.Join(restoreDir, "pg-a", "pg_wal")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// pg_wal on its own volume
+	if err := os.Symlink(walVolume, filepath.Join(pgdata, "pg_wal")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := sandbox.New(pgdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	walRoots, err := sandbox.New(pgdata, walVolume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoreRoots, err := sandbox.New(restoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	walRestore, err := sandbox.New(pgdata, walVolume, restoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.options.Paths = Paths{Data: data, WAL: walRoots, Restore: restoreRoots, WALRestore: walRestore}
+
+	const walFile = "000000010000000000000001"
+	tests := []struct {
+		name           string
+		path           string
+		request        interface{}
+		expectedStatus int
+		wantDataDir    func() string
+		want           string
+	}{
+		{
+			name:           "archive through a linked pg_wal",
+			path:           "/wal-archive",
+			request:        WALArchiveRequest{WalFileName: walFile, WalFilePath: filepath.Join(pgdata, "pg_wal", walFile)},
+			expectedStatus: http.StatusOK,
+			wantDataDir:    func() string { return backupHandler.walDataDir },
+			want:           pgdata,
+		},
+		{
+			name:           "archive with an explicit data directory",
+			path:           "/wal-archive",
+			request:        WALArchiveRequest{WalFileName: walFile, WalFilePath: filepath.Join(walVolume, walFile), DataFolder: pgdata},
+			expectedStatus: http.StatusOK,
+			wantDataDir:    func() string { return backupHandler.walDataDir },
+			want:           pgdata,
+		},
+		{
+			name:           "archive with a data directory outside the roots",
+			path:           "/wal-archive",
+			request:        WALArchiveRequest{WalFileName: walFile, WalFilePath: filepath.Join(pgdata, "pg_wal", walFile), DataFolder: restoreDir},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "restore into a restored data directory",
+			path:           "/wal-restore",
+			request:        WALRestoreRequest{WalFileName: walFile, DestFolder: filepath.Join(restoreDir, "pg-a", "pg_wal")},
+			expectedStatus: http.StatusOK,
+			wantDataDir:    func() string { return restoreHandler.walDataDir },
+			want:           filepath.Join(restoreDir, "pg-a"),
+		},
+		{
+			name:           "restore through a linked pg_wal",
+			path:           "/wal-restore",
+			request:        WALRestoreRequest{WalFileName: walFile, DestFolder: filepath.Join(pgdata, "pg_wal")},
+			expectedStatus: http.StatusOK,
+			wantDataDir:    func() string { return restoreHandler.walDataDir },
+			want:           pgdata,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(tt.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(body)))
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status code %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if tt.wantDataDir != nil && tt.wantDataDir() != tt.want {
+				t.Errorf("data directory = %q, want %q", tt.wantDataDir(), tt.want)
+			}
+		})
+	}
+}
+
+func TestPlugin_Logical(t *testing.T) {
+	p, _, _ := newTestPlugin()
+
+	tests := []struct {
+		name           string
+		path           string
+		method         string
+		request        interface{}
+		expectedStatus int
+	}{
+		{
+			name:           "backup without configuration",
+			path:           "/logical-backup",
+			method:         http.MethodPost,
+			request:        LogicalBackupRequest{Databases: []string{"app"}},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "restore without configuration",
+			path:           "/logical-restore",
+			method:         http.MethodPost,
+			request:        LogicalRestoreRequest{RestoreOptions: logical.RestoreOptions{Database: "app"}},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "restore without database or snapshot",
+			path:           "/logical-restore",
+			method:         http.MethodPost,
+			request:        LogicalRestoreRequest{},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "wrong method",
+			path:           "/logical-backup",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(tt.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(tt.method, tt.path, bytes.NewReader(body))
+			w := httptest.NewRecorder()
+
+			p.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
 		})
 	}
 }
@@ -0,0 +1,51 @@
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/replication"
+)
+
+// ReplicationResponse reports the replication state of a tenant
+type ReplicationResponse struct {
+	Targets []replication.Status `json:"targets"`
+}
+
+// handleReplication reports the replication status on GET and runs a
+// replication on POST
+func (p *Plugin) handleReplication(w http.ResponseWriter, r *http.Request, logger *logging.Logger) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		logger.Warn().Str("allowed_method", "GET, POST").Msg("Method not allowed")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := tenantFromQuery(r)
+	logger = logger.WithFields(map[string]interface{}{
+		"tenant": id.String(),
+	})
+
+	h, ok := p.resolveTenant(w, r, id, logger)
+	if !ok {
+		return
+	}
+	if h.replicator == nil {
+		logger.Warn().Msg("No secondary repositories configured")
+		http.Error(w, "No secondary repositories configured", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		logger.Info().Msg("Starting replication")
+		if err := h.replicator.Replicate(h.context(r.Context())); err != nil {
+			logger.Error().Err(err).Msg("Replication failed")
+			http.Error(w, fmt.Sprintf("Replication failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		logger.Info().Msg("Replication completed successfully")
+	}
+
+	writeJSON(w, ReplicationResponse{Targets: h.replicator.Status()}, logger)
+}
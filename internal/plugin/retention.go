@@ -0,0 +1,29 @@
+package plugin
+
+import (
+	"context"
+	"time"
+)
+
+// runRetention applies the retention policy to the tenant's repository on
+// every interval tick until the context is cancelled. Runs wait for running
+// base backups and restores of the tenant.
+func (p *Plugin) runRetention(ctx context.Context, h *tenantHandlers, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		h.lock.Lock()
+		_, err := h.retention.Apply(ctx)
+		h.lock.Unlock()
+		if err != nil && ctx.Err() == nil {
+			p.logger.Error().Err(err).Str("tenant", h.identity.String()).Msg("Scheduled retention failed")
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"cloud-native-pg-restic-backup/internal/audit"
+	"cloud-native-pg-restic-backup/internal/backup"
+	"cloud-native-pg-restic-backup/internal/health"
+	"cloud-native-pg-restic-backup/internal/integrity"
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/logical"
+	"cloud-native-pg-restic-backup/internal/metrics"
+	"cloud-native-pg-restic-backup/internal/replication"
+	"cloud-native-pg-restic-backup/internal/restic"
+	"cloud-native-pg-restic-backup/internal/restore"
+	"cloud-native-pg-restic-backup/internal/retention"
+	"cloud-native-pg-restic-backup/internal/tenant"
+	"cloud-native-pg-restic-backup/internal/verify"
+)
+
+// tenantHandlers holds the handlers serving a single tenant
+type tenantHandlers struct {
+	identity       tenant.Identity
+	backupHandler  backup.Handler
+	restoreHandler restore.Handler
+	// replicator is nil if the tenant has no secondary repositories
+	replicator *replication.Replicator
+	verifier   *verify.Verifier
+	checker    *integrity.Checker
+	prober     *health.Prober
+	// retention is nil if no retention policy is configured
+	retention *retention.Enforcer
+	// logical is nil if logical backups are not configured
+	logical *logical.Manager
+	// lock serializes base backups and restores of the tenant
+	lock sync.Mutex
+}
+
+// errTenantLimit is returned when initializing a tenant would exceed
+// Options.MaxTenants
+var errTenantLimit = errors.New("tenant limit reached")
+
+// tenantInit is a tenant being initialized, which concurrent requests wait
+// for rather than initializing it again
+type tenantInit struct {
+	done chan struct{}
+	h    *tenantHandlers
+	err  error
+}
+
+// handlersFor returns the handlers of a tenant, initializing its repository
+// on first use. The repository is initialized without holding p.mu, so a
+// slow repository only delays requests of its own tenant.
+func (p *Plugin) handlersFor(ctx context.Context, id tenant.Identity) (*tenantHandlers, error) {
+	if h, ok := p.initializedTenant(id); ok {
+		return h, nil
+	}
+
+	t, err := p.tenants.Resolve(id)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	// Requests without identity resolve to the default cluster
+	if h, ok := p.handlers[t.Identity]; ok {
+		p.handlers[id] = h
+		p.mu.Unlock()
+		return h, nil
+	}
+	pending, ok := p.initializing[t.Identity]
+	if !ok {
+		if p.options.MaxTenants > 0 && p.tenantCount() >= p.options.MaxTenants {
+			p.mu.Unlock()
+			return nil, fmt.Errorf("%w: %d tenants initialized", errTenantLimit, p.options.MaxTenants)
+		}
+		pending = &tenantInit{done: make(chan struct{})}
+		p.initializing[t.Identity] = pending
+		p.mu.Unlock()
+
+		pending.h, pending.err = p.initTenant(ctx, t)
+
+		p.mu.Lock()
+		delete(p.initializing, t.Identity)
+		if pending.err == nil {
+			p.handlers[t.Identity] = pending.h
+		}
+		close(pending.done)
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-pending.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if pending.err != nil {
+		return nil, pending.err
+	}
+
+	p.mu.Lock()
+	p.handlers[id] = pending.h
+	p.mu.Unlock()
+	return pending.h, nil
+}
+
+// tenantCount returns the number of tenants initialized or being
+// initialized, p.mu must be held
+func (p *Plugin) tenantCount() int {
+	// Handlers are registered under both the requested and resolved identity
+	seen := make(map[*tenantHandlers]bool)
+	for _, h := range p.handlers {
+		seen[h] = true
+	}
+	return len(seen) + len(p.initializing)
+}
+
+// initTenant initializes the repository of a tenant and starts its
+// background work
+func (p *Plugin) initTenant(ctx context.Context, t *tenant.Tenant) (*tenantHandlers, error) {
+	id := t.Identity
+	client := p.newClient(t.Config)
+	if err := client.InitRepository(ctx); err != nil {
+		return nil, fmt.Errorf("failed to initialize repository for tenant %s: %w", id, err)
+	}
+	client = restic.WithTags(client, t.Tags()...)
+	if p.options.Audit != nil {
+		client = audit.WrapClient(client, p.options.Audit, t.Identity.String(), p.logger)
+	}
+
+	var targets []replication.Target
+	for i, cfg := range t.Secondaries {
+		targets = append(targets, replication.Target{
+			Name:   fmt.Sprintf("secondary-%d", i),
+			Config: cfg,
+			Client: restic.WithTags(p.newClient(cfg), t.Tags()...),
+		})
+	}
+
+	restoreClient := replication.NewFallbackClient(client, targets, p.logger)
+	h := &tenantHandlers{
+		identity: t.Identity,
+		backupHandler: backup.NewHandler(client, backup.Options{
+			Exclude:     p.options.BackupExclude,
+			Tablespaces: p.options.Paths.Tablespaces,
+			Stream:      p.options.BasebackupStream,
+			Manifest:    p.options.BackupManifest,
+
+			Coordinate:        p.options.BackupCoordinate,
+			WALArchiveTimeout: p.options.BackupWALArchiveTimeout,
+			Instance:          p.options.BackupInstance,
+		}, p.logger),
+		restoreHandler: restore.NewHandler(restoreClient, p.options.BasebackupStream, p.logger),
+		verifier:       verify.NewVerifier(restoreClient, p.options.VerifyScratchDir, p.options.BasebackupStream, p.logger),
+		checker:        integrity.NewChecker(client, p.logger),
+		prober:         health.NewProber(client, p.options.Health),
+	}
+	background := h.context(p.ctx)
+	if p.options.CheckInterval > 0 {
+		go h.checker.Run(background, p.options.CheckInterval, p.options.CheckOptions)
+	}
+	if len(targets) > 0 {
+		h.replicator = replication.NewReplicator(client, targets, p.logger)
+		if p.options.ReplicationInterval > 0 || p.options.ReplicateAfterBackup {
+			go h.replicator.Run(background, p.options.ReplicationInterval)
+		}
+	}
+	if p.options.Logical.Enabled() {
+		h.logical = logical.NewManager(client, p.options.Logical, p.logger)
+	}
+	if p.options.Retention.Enabled() {
+		h.retention = retention.NewEnforcer(client, p.options.Retention, p.logger)
+		if p.options.RetentionInterval > 0 {
+			go p.runRetention(background, h, p.options.RetentionInterval)
+		}
+	}
+	if p.options.SnapshotMetricsInterval > 0 {
+		go p.refreshSnapshotMetrics(background, client, p.options.SnapshotMetricsInterval)
+	}
+
+	p.logger.Info().
+		Str("tenant", id.String()).
+		Msg("Initialized tenant")
+
+	return h, nil
+}
+
+// context returns ctx recording metrics for the tenant
+func (h *tenantHandlers) context(ctx context.Context) context.Context {
+	return metrics.WithTenant(ctx, h.identity.ClusterName, h.identity.Namespace)
+}
+
+// resolveTenant looks up the handlers of the request's tenant and writes an
+// error response if that fails. The principal is authorized before a tenant
+// is initialized, which creates its repository and background work.
+func (p *Plugin) resolveTenant(w http.ResponseWriter, r *http.Request, id tenant.Identity, logger *logging.Logger) (*tenantHandlers, bool) {
+	h, ok := p.initializedTenant(id)
+	if !ok {
+		t, err := p.tenants.Resolve(id)
+		if err != nil {
+			tenantError(w, err, logger)
+			return nil, false
+		}
+		if !authorizeTenant(w, r, t.Identity, logger) {
+			return nil, false
+		}
+		if h, err = p.handlersFor(r.Context(), id); err != nil {
+			tenantError(w, err, logger)
+			return nil, false
+		}
+	}
+	if !authorizeTenant(w, r, h.identity, logger) {
+		return nil, false
+	}
+
+	trace.SpanFromContext(r.Context()).SetAttributes(
+		attribute.String("cnpg.cluster", h.identity.ClusterName),
+		attribute.String("cnpg.namespace", h.identity.Namespace),
+	)
+	return h, true
+}
+
+// initializedTenant returns the handlers of a tenant initialized already
+func (p *Plugin) initializedTenant(id tenant.Identity) (*tenantHandlers, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h, ok := p.handlers[id]
+	return h, ok
+}
+
+// tenantError writes the response of a tenant that can't be resolved
+func tenantError(w http.ResponseWriter, err error, logger *logging.Logger) {
+	logger.Error().Err(err).Msg("Failed to resolve tenant")
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, tenant.ErrUnknownTenant):
+		status = http.StatusNotFound
+	case errors.Is(err, tenant.ErrInvalidIdentity):
+		status = http.StatusBadRequest
+	case errors.Is(err, errTenantLimit):
+		status = http.StatusServiceUnavailable
+	}
+	http.Error(w, fmt.Sprintf("Failed to resolve tenant: %v", err), status)
+}
+
+// lockTenant acquires the tenant lock for an exclusive operation and writes a
+// conflict response if another one is already running
+func lockTenant(w http.ResponseWriter, h *tenantHandlers, logger *logging.Logger) bool {
+	if !h.lock.TryLock() {
+		logger.Warn().Msg("Another backup or restore is in progress")
+		http.Error(w, "Another backup or restore is in progress for this cluster", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// InitTenant initializes the repository and background work of a tenant
+// ahead of its first request
+func (p *Plugin) InitTenant(ctx context.Context, id tenant.Identity) error {
+	_, err := p.handlersFor(ctx, id)
+	return err
+}
+
+// tenantFromQuery reads the tenant identity of a GET request
+func tenantFromQuery(r *http.Request) tenant.Identity {
+	return tenant.Identity{
+		ClusterName: r.URL.Query().Get("clusterName"),
+		Namespace:   r.URL.Query().Get("namespace"),
+	}
+}
@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/restic"
+	"cloud-native-pg-restic-backup/internal/tenant"
+	"cloud-native-pg-restic-backup/internal/verify"
+)
+
+// VerifyRequest represents the verify API request
+type VerifyRequest struct {
+	tenant.Identity
+	verify.Options
+}
+
+// handleVerify runs a test restore on POST and reports the verifications run
+// so far on GET
+func (p *Plugin) handleVerify(w http.ResponseWriter, r *http.Request, logger *logging.Logger) {
+	switch r.Method {
+	case http.MethodGet:
+		id := tenantFromQuery(r)
+		logger = logger.WithFields(map[string]interface{}{
+			"tenant": id.String(),
+		})
+
+		h, ok := p.resolveTenant(w, r, id, logger)
+		if !ok {
+			return
+		}
+		writeJSON(w, h.verifier.Summary(), logger)
+
+	case http.MethodPost:
+		var req VerifyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error().Err(err).Msg("Invalid request")
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.WithFields(map[string]interface{}{
+			"tenant":      req.Identity.String(),
+			"snapshot_id": req.SnapshotID,
+		})
+
+		h, ok := p.resolveTenant(w, r, req.Identity, logger)
+		if !ok {
+			return
+		}
+
+		logger.Info().Msg("Starting verification")
+
+		req.Options.Restore = p.options.Restore
+		result, err := h.verifier.Verify(h.context(r.Context()), req.Options)
+		if errors.Is(err, verify.ErrInProgress) {
+			logger.Warn().Msg("Verification already in progress")
+			http.Error(w, "Verification already in progress", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, restic.ErrSnapshotNotFound) {
+			logger.Warn().Err(err).Msg("Backup not found")
+			http.Error(w, fmt.Sprintf("Backup not found: %v", err), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, restic.ErrSnapshotAmbiguous) {
+			logger.Warn().Err(err).Msg("Ambiguous backup ID")
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			logger.Error().Err(err).Msg("Verification failed")
+			http.Error(w, fmt.Sprintf("Verification failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		logger.Info().Bool("passed", result.Passed).Msg("Verification completed")
+		writeJSON(w, result, logger)
+
+	default:
+		logger.Warn().Str("allowed_method", "GET, POST").Msg("Method not allowed")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, v interface{}, logger *logging.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error().Err(err).Msg("Failed to write response")
+	}
+}
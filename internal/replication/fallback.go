@@ -0,0 +1,154 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/pgdata"
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+// fallbackClient reads from secondary repositories when the primary can't be
+// opened. Writes always go to the primary.
+type fallbackClient struct {
+	restic.Client
+	secondaries []Target
+	logger      *logging.Logger
+}
+
+// NewFallbackClient returns a Client whose restore and lookup operations fall
+// back to the secondaries, in order, when the primary repository is unavailable
+func NewFallbackClient(primary restic.Client, secondaries []Target, logger *logging.Logger) restic.Client {
+	if len(secondaries) == 0 {
+		return primary
+	}
+	return &fallbackClient{
+		Client:      primary,
+		secondaries: secondaries,
+		logger:      logger.Component("replication"),
+	}
+}
+
+func (c *fallbackClient) FindSnapshots(ctx context.Context, tags []string) ([]*restic.Snapshot, error) {
+	snapshots, err := c.Client.FindSnapshots(ctx, tags)
+	if !c.fallBack(ctx, err) {
+		return snapshots, err
+	}
+
+	for _, target := range c.secondaries {
+		c.warn(err, target, "find_snapshots")
+		snapshots, err = target.Client.FindSnapshots(ctx, tags)
+		if err == nil {
+			return snapshots, nil
+		}
+	}
+	return nil, err
+}
+
+func (c *fallbackClient) Restore(ctx context.Context, snapshotID, targetPath string, opts restic.RestoreOptions) error {
+	err := c.Client.Restore(ctx, snapshotID, targetPath, opts)
+	if !c.fallBack(ctx, err) {
+		return err
+	}
+
+	for _, target := range c.secondaries {
+		c.warn(err, target, "restore")
+		err = c.onSecondary(ctx, target, snapshotID, func(id string) error {
+			// don't mix files of a failed attempt into the restored data
+			if err := pgdata.ClearDir(targetPath); err != nil {
+				return err
+			}
+			return target.Client.Restore(ctx, id, targetPath, opts)
+		})
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (c *fallbackClient) RestoreFile(ctx context.Context, snapshotID, filePath, targetPath string) error {
+	err := c.Client.RestoreFile(ctx, snapshotID, filePath, targetPath)
+	if !c.fallBack(ctx, err) {
+		return err
+	}
+
+	for _, target := range c.secondaries {
+		c.warn(err, target, "restore_file")
+		err = c.onSecondary(ctx, target, snapshotID, func(id string) error {
+			return target.Client.RestoreFile(ctx, id, filePath, targetPath)
+		})
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (c *fallbackClient) Dump(ctx context.Context, snapshotID, filePath string, w io.Writer) error {
+	// Only an attempt that wrote nothing can be retried, the primary
+	// fails to open before it does
+	written := &countingWriter{w: w}
+	err := c.Client.Dump(ctx, snapshotID, filePath, written)
+	if !c.fallBack(ctx, err) || written.n > 0 {
+		return err
+	}
+
+	for _, target := range c.secondaries {
+		c.warn(err, target, "dump")
+		err = c.onSecondary(ctx, target, snapshotID, func(id string) error {
+			return target.Client.Dump(ctx, id, filePath, written)
+		})
+		if err == nil || written.n > 0 {
+			return err
+		}
+	}
+	return err
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// fallBack reports whether err of the primary is worth retrying on the
+// secondaries: the primary repository couldn't be opened, and the caller
+// still waits for the result
+func (c *fallbackClient) fallBack(ctx context.Context, err error) bool {
+	return err != nil && ctx.Err() == nil && errors.Is(err, restic.ErrRepositoryUnavailable)
+}
+
+// onSecondary runs fn with the ID the snapshot has in the secondary
+// repository. Copies get new IDs but record the source one as original. The
+// secondary clients are scoped to the same tags as the primary, so only
+// snapshots of the tenant match.
+func (c *fallbackClient) onSecondary(ctx context.Context, target Target, snapshotID string, fn func(id string) error) error {
+	snapshots, err := target.Client.FindSnapshots(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots of %s: %w", target.Name, err)
+	}
+
+	snapshot, err := restic.FindByID(snapshots, snapshotID)
+	if err != nil {
+		return fmt.Errorf("%w in %s", err, target.Name)
+	}
+	return fn(snapshot.ID)
+}
+
+func (c *fallbackClient) warn(err error, target Target, operation string) {
+	c.logger.Warn().
+		Err(err).
+		Str("operation", operation).
+		Str("target", target.Name).
+		Msg("Primary repository unavailable, falling back to secondary")
+}
@@ -0,0 +1,189 @@
+// Package replication copies snapshots to secondary repositories for
+// off-site disaster recovery.
+package replication
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+// Target is a secondary repository snapshots are replicated to
+type Target struct {
+	// Name identifies the target in logs and status reports
+	Name string
+	// Config is passed to restic copy as the destination
+	Config restic.Config
+	// Client reads the secondary repository
+	Client restic.Client
+}
+
+// Status reports the replication state of a target
+type Status struct {
+	Target      string    `json:"target"`
+	LastRun     time.Time `json:"lastRun,omitempty"`
+	LastSuccess time.Time `json:"lastSuccess,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+	Copied      int       `json:"copied"`
+	Pending     int       `json:"pending"`
+}
+
+// Replicator copies the snapshots of a source repository to its targets
+type Replicator struct {
+	source  restic.Client
+	targets []Target
+	logger  *logging.Logger
+
+	// run serializes replication runs
+	run     sync.Mutex
+	mu      sync.Mutex
+	status  map[string]*Status
+	trigger chan struct{}
+}
+
+// NewReplicator creates a new replicator
+func NewReplicator(source restic.Client, targets []Target, logger *logging.Logger) *Replicator {
+	status := make(map[string]*Status, len(targets))
+	for _, t := range targets {
+		status[t.Name] = &Status{Target: t.Name}
+	}
+
+	return &Replicator{
+		source:  source,
+		targets: targets,
+		logger:  logger.Component("replication"),
+		status:  status,
+		trigger: make(chan struct{}, 1),
+	}
+}
+
+// Replicate copies all snapshots missing from the targets
+func (r *Replicator) Replicate(ctx context.Context) error {
+	r.run.Lock()
+	defer r.run.Unlock()
+
+	logger := r.logger.Context(ctx).Operation("replicate")
+	logger.Info().Msg("Starting replication")
+
+	snapshots, err := r.source.FindSnapshots(ctx, nil)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to list source snapshots")
+		return fmt.Errorf("failed to list source snapshots: %v", err)
+	}
+
+	var failed []string
+	for _, target := range r.targets {
+		if err := r.replicateTo(ctx, target, snapshots); err != nil {
+			failed = append(failed, target.Name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("replication failed for targets: %v", failed)
+	}
+
+	logger.Info().Msg("Replication completed successfully")
+	return nil
+}
+
+func (r *Replicator) replicateTo(ctx context.Context, target Target, snapshots []*restic.Snapshot) error {
+	logger := r.logger.Context(ctx).Operation("replicate").WithFields(map[string]interface{}{
+		"target": target.Name,
+	})
+
+	pending, err := r.pendingSnapshots(ctx, target, snapshots)
+	if err == nil && len(pending) > 0 {
+		logger.Info().Int("snapshots", len(pending)).Msg("Copying snapshots")
+		err = r.source.Copy(ctx, target.Config, pending)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := r.status[target.Name]
+	status.LastRun = time.Now()
+	if err != nil {
+		logger.Error().Err(err).Msg("Replication failed")
+		status.LastError = err.Error()
+		status.Pending = len(pending)
+		return err
+	}
+
+	status.LastSuccess = status.LastRun
+	status.LastError = ""
+	status.Copied += len(pending)
+	status.Pending = 0
+	return nil
+}
+
+// pendingSnapshots returns the IDs of the snapshots not yet copied to the target
+func (r *Replicator) pendingSnapshots(ctx context.Context, target Target, snapshots []*restic.Snapshot) ([]string, error) {
+	copied, err := target.Client.FindSnapshots(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list target snapshots: %v", err)
+	}
+
+	present := make(map[string]bool, len(copied))
+	for _, s := range copied {
+		if s.Original != "" {
+			present[s.Original] = true
+		}
+	}
+
+	var pending []string
+	for _, s := range snapshots {
+		if !present[s.ID] {
+			pending = append(pending, s.ID)
+		}
+	}
+	return pending, nil
+}
+
+// Trigger requests an asynchronous replication run from Run
+func (r *Replicator) Trigger() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+		// A run is already pending
+	}
+}
+
+// Run replicates on every interval tick and trigger until the context is
+// cancelled. A zero interval only replicates on triggers.
+func (r *Replicator) Run(ctx context.Context, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case <-r.trigger:
+		}
+
+		if err := r.Replicate(ctx); err != nil {
+			r.logger.Error().Err(err).Msg("Scheduled replication failed")
+		}
+	}
+}
+
+// Status returns the replication state of all targets
+func (r *Replicator) Status() []Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]Status, 0, len(r.targets))
+	for _, t := range r.targets {
+		result = append(result, *r.status[t.Name])
+	}
+	return result
+}
@@ -0,0 +1,277 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+// mockResticClient implements the restic.Client interface for testing
+type mockResticClient struct {
+	restic.Client
+	snapshots  []*restic.Snapshot
+	findErr    error
+	restoreErr error
+	copyErr    error
+	copied     []string
+	restoredID string
+	// leftover is a file Restore leaves in the target, as a failed restore may
+	leftover string
+}
+
+func (m *mockResticClient) FindSnapshots(_ context.Context, _ []string) ([]*restic.Snapshot, error) {
+	return m.snapshots, m.findErr
+}
+
+func (m *mockResticClient) Copy(_ context.Context, _ restic.Config, snapshotIDs []string) error {
+	if m.copyErr != nil {
+		return m.copyErr
+	}
+	m.copied = append(m.copied, snapshotIDs...)
+	return nil
+}
+
+func (m *mockResticClient) Restore(_ context.Context, snapshotID, targetPath string, _ restic.RestoreOptions) error {
+	m.restoredID = snapshotID
+	if m.leftover != "" {
+		path := filepath.Join(targetPath, m.leftover)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			return err
+		}
+	}
+	return m.restoreErr
+}
+
+func (m *mockResticClient) RestoreFile(_ context.Context, snapshotID, _, _ string) error {
+	m.restoredID = snapshotID
+	return m.restoreErr
+}
+
+func newLogger() *logging.Logger {
+	return logging.NewLogger(logging.Config{
+		Level:      "info",
+		JSONOutput: false,
+	})
+}
+
+func TestReplicate(t *testing.T) {
+	tests := []struct {
+		name        string
+		source      []*restic.Snapshot
+		target      []*restic.Snapshot
+		copyErr     error
+		wantErr     bool
+		wantCopied  []string
+		wantPending int
+	}{
+		{
+			name:       "copies missing snapshots",
+			source:     []*restic.Snapshot{{ID: "aaa"}, {ID: "bbb"}, {ID: "ccc"}},
+			target:     []*restic.Snapshot{{ID: "xxx", Original: "aaa"}},
+			wantCopied: []string{"bbb", "ccc"},
+		},
+		{
+			name:       "nothing to copy",
+			source:     []*restic.Snapshot{{ID: "aaa"}},
+			target:     []*restic.Snapshot{{ID: "xxx", Original: "aaa"}},
+			wantCopied: nil,
+		},
+		{
+			name:        "copy error",
+			source:      []*restic.Snapshot{{ID: "aaa"}},
+			copyErr:     fmt.Errorf("copy failed"),
+			wantErr:     true,
+			wantPending: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &mockResticClient{snapshots: tt.source, copyErr: tt.copyErr}
+			target := &mockResticClient{snapshots: tt.target}
+
+			r := NewReplicator(source, []Target{{Name: "offsite", Client: target}}, newLogger())
+
+			err := r.Replicate(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Replicate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if fmt.Sprint(source.copied) != fmt.Sprint(tt.wantCopied) {
+				t.Errorf("copied = %v, want %v", source.copied, tt.wantCopied)
+			}
+
+			status := r.Status()
+			if len(status) != 1 {
+				t.Fatalf("Status() returned %d entries, want 1", len(status))
+			}
+			if status[0].Pending != tt.wantPending {
+				t.Errorf("Pending = %d, want %d", status[0].Pending, tt.wantPending)
+			}
+			if (status[0].LastError != "") != tt.wantErr {
+				t.Errorf("LastError = %q, wantErr %v", status[0].LastError, tt.wantErr)
+			}
+			if status[0].Copied != len(tt.wantCopied) {
+				t.Errorf("Copied = %d, want %d", status[0].Copied, len(tt.wantCopied))
+			}
+		})
+	}
+}
+
+func TestFallbackClient(t *testing.T) {
+	unavailable := fmt.Errorf("restore failed: %w: exit status 10", restic.ErrRepositoryUnavailable)
+
+	tests := []struct {
+		name          string
+		ctx           func() context.Context
+		primaryErr    error
+		snapshotID    string
+		secondary     []*restic.Snapshot
+		wantErr       error
+		wantPrimary   string
+		wantSecondary string
+	}{
+		{
+			name:        "primary available",
+			primaryErr:  nil,
+			wantPrimary: "aaa",
+		},
+		{
+			name:          "falls back to copied snapshot",
+			primaryErr:    unavailable,
+			wantPrimary:   "aaa",
+			wantSecondary: "xxx",
+		},
+		{
+			name:        "no fallback on other errors",
+			primaryErr:  fmt.Errorf("restore failed: disk full"),
+			wantErr:     errors.New("restore failed: disk full"),
+			wantPrimary: "aaa",
+		},
+		{
+			name: "no fallback once cancelled",
+			ctx: func() context.Context {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				return ctx
+			},
+			primaryErr:  unavailable,
+			wantErr:     restic.ErrRepositoryUnavailable,
+			wantPrimary: "aaa",
+		},
+		{
+			name:          "exact original wins over prefix",
+			primaryErr:    unavailable,
+			snapshotID:    "aaa",
+			secondary:     []*restic.Snapshot{{ID: "yyy", Original: "aaab"}, {ID: "xxx", Original: "aaa"}},
+			wantPrimary:   "aaa",
+			wantSecondary: "xxx",
+		},
+		{
+			name:        "ambiguous prefix",
+			primaryErr:  unavailable,
+			snapshotID:  "aa",
+			secondary:   []*restic.Snapshot{{ID: "yyy", Original: "aaab"}, {ID: "xxx", Original: "aaac"}},
+			wantErr:     restic.ErrSnapshotAmbiguous,
+			wantPrimary: "aa",
+		},
+		{
+			name:        "snapshot missing from secondary",
+			primaryErr:  unavailable,
+			secondary:   []*restic.Snapshot{},
+			wantErr:     restic.ErrSnapshotNotFound,
+			wantPrimary: "aaa",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.ctx != nil {
+				ctx = tt.ctx()
+			}
+			snapshotID := tt.snapshotID
+			if snapshotID == "" {
+				snapshotID = "aaa"
+			}
+			snapshots := tt.secondary
+			if snapshots == nil {
+				snapshots = []*restic.Snapshot{{ID: "xxx", Original: "aaa"}}
+			}
+			primary := &mockResticClient{restoreErr: tt.primaryErr}
+			secondary := &mockResticClient{snapshots: snapshots}
+
+			client := NewFallbackClient(primary, []Target{{Name: "offsite", Client: secondary}}, newLogger())
+
+			err := client.Restore(ctx, snapshotID, t.TempDir(), restic.RestoreOptions{})
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("Restore() error = %v", err)
+			case tt.wantErr != nil && err == nil:
+				t.Fatalf("Restore() error = nil, want %v", tt.wantErr)
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr) && err.Error() != tt.wantErr.Error():
+				t.Fatalf("Restore() error = %v, want %v", err, tt.wantErr)
+			}
+			if primary.restoredID != tt.wantPrimary {
+				t.Errorf("primary restored %q, want %q", primary.restoredID, tt.wantPrimary)
+			}
+			if secondary.restoredID != tt.wantSecondary {
+				t.Errorf("secondary restored %q, want %q", secondary.restoredID, tt.wantSecondary)
+			}
+		})
+	}
+
+	t.Run("clears the target before the secondary", func(t *testing.T) {
+		dir := t.TempDir()
+		primary := &mockResticClient{restoreErr: unavailable, leftover: "base/1"}
+		secondary := &mockResticClient{snapshots: []*restic.Snapshot{{ID: "xxx", Original: "aaa"}}}
+
+		client := NewFallbackClient(primary, []Target{{Name: "offsite", Client: secondary}}, newLogger())
+
+		if err := client.Restore(context.Background(), "aaa", dir, restic.RestoreOptions{}); err != nil {
+			t.Fatalf("Restore() error = %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "base")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("files of the failed attempt are left in the target: %v", err)
+		}
+	})
+
+	t.Run("restore file falls back", func(t *testing.T) {
+		primary := &mockResticClient{restoreErr: unavailable}
+		secondary := &mockResticClient{snapshots: []*restic.Snapshot{{ID: "xxx", Original: "aaa"}}}
+
+		client := NewFallbackClient(primary, []Target{{Name: "offsite", Client: secondary}}, newLogger())
+
+		if err := client.RestoreFile(context.Background(), "aaa", "wal", "/restore/wal"); err != nil {
+			t.Fatalf("RestoreFile() error = %v", err)
+		}
+		if secondary.restoredID != "xxx" {
+			t.Errorf("secondary restored %q, want %q", secondary.restoredID, "xxx")
+		}
+	})
+
+	t.Run("find snapshots falls back only when unavailable", func(t *testing.T) {
+		secondary := &mockResticClient{snapshots: []*restic.Snapshot{{ID: "xxx"}}}
+
+		primary := &mockResticClient{findErr: unavailable}
+		client := NewFallbackClient(primary, []Target{{Name: "offsite", Client: secondary}}, newLogger())
+		if snapshots, err := client.FindSnapshots(context.Background(), nil); err != nil || len(snapshots) != 1 {
+			t.Errorf("FindSnapshots() = %v, %v, want the secondary snapshots", snapshots, err)
+		}
+
+		primary = &mockResticClient{findErr: fmt.Errorf("invalid tag")}
+		client = NewFallbackClient(primary, []Target{{Name: "offsite", Client: secondary}}, newLogger())
+		if _, err := client.FindSnapshots(context.Background(), nil); err == nil {
+			t.Error("FindSnapshots() should return the primary error")
+		}
+	})
+}
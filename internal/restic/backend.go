@@ -0,0 +1,340 @@
+package restic
+
+import (
+	"fmt"
+	"net/url"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// Backend is the storage backend of a repository, the scheme of its URL
+type Backend string
+
+const (
+	BackendLocal  Backend = "local"
+	BackendS3     Backend = "s3"
+	BackendAzure  Backend = "azure"
+	BackendGCS    Backend = "gs"
+	BackendB2     Backend = "b2"
+	BackendSFTP   Backend = "sftp"
+	BackendREST   Backend = "rest"
+	BackendRclone Backend = "rclone"
+	BackendSwift  Backend = "swift"
+)
+
+// backends are the backends restic supports
+var backends = map[Backend]bool{
+	BackendLocal:  true,
+	BackendS3:     true,
+	BackendAzure:  true,
+	BackendGCS:    true,
+	BackendB2:     true,
+	BackendSFTP:   true,
+	BackendREST:   true,
+	BackendRclone: true,
+	BackendSwift:  true,
+}
+
+// Backend returns the backend of the repository, a path without scheme
+// being a local repository
+func (c Config) Backend() Backend {
+	scheme, _, found := strings.Cut(c.Repository, ":")
+	if !found || scheme == "" || strings.ContainsAny(scheme, `/\.`) {
+		return BackendLocal
+	}
+	return Backend(scheme)
+}
+
+// Validate checks the repository configuration for its backend
+func (c Config) Validate() error {
+	if err := c.ValidateCredentials(); err != nil {
+		return err
+	}
+
+	backend := c.Backend()
+	if !backends[backend] {
+		return fmt.Errorf("unsupported backend %q", backend)
+	}
+
+	switch backend {
+	case BackendS3:
+		accessKey := c.S3AccessKey != "" || c.S3AccessKeyFile != ""
+		secretKey := c.S3SecretKey != "" || c.S3SecretKeyFile != ""
+		if accessKey != secretKey {
+			return fmt.Errorf("s3 backend: access key and secret key must be set together")
+		}
+	case BackendAzure:
+		if c.AzureAccountName == "" {
+			return fmt.Errorf("azure backend: azureAccountName is required")
+		}
+		if c.AzureAccountSAS != "" && (c.AzureAccountKey != "" || c.AzureAccountKeyFile != "") {
+			return fmt.Errorf("azure backend: account key and SAS token are mutually exclusive")
+		}
+	case BackendB2:
+		if c.B2AccountID == "" || (c.B2AccountKey == "" && c.B2AccountKeyFile == "") {
+			return fmt.Errorf("b2 backend: b2AccountID and b2AccountKey are required")
+		}
+	case BackendREST:
+		password := c.RESTPassword != "" || c.RESTPasswordFile != ""
+		if (c.RESTUsername != "") != password {
+			return fmt.Errorf("rest backend: restUsername and restPassword must be set together")
+		}
+	}
+
+	if c.S3PathStyle && backend != BackendS3 {
+		return fmt.Errorf("s3PathStyle requires an s3 repository")
+	}
+	if c.SFTPCommand != "" && backend != BackendSFTP {
+		return fmt.Errorf("sftpCommand requires an sftp repository")
+	}
+	return nil
+}
+
+// globalArgs returns the options of the backend passed on the command line
+func (c Config) globalArgs() []string {
+	var args []string
+	if c.CACertFile != "" {
+		args = append(args, "--cacert", c.CACertFile)
+	}
+	if c.InsecureTLS {
+		args = append(args, "--insecure-tls")
+	}
+	if c.S3PathStyle {
+		args = append(args, "-o", "s3.bucket-lookup=path")
+	}
+	if c.SFTPCommand != "" {
+		args = append(args, "-o", "sftp.command="+c.SFTPCommand)
+	}
+	return args
+}
+
+// backendEnv returns the variables configuring the backend, leaving out
+// unset ones so restic falls back to its own defaults
+func (c Config) backendEnv() ([]string, error) {
+	secrets := make(map[string]string)
+	for _, s := range c.secrets() {
+		value, err := s.read()
+		if err != nil {
+			return nil, err
+		}
+		secrets[s.name] = value
+	}
+
+	vars := []struct {
+		name, value string
+	}{
+		{"AWS_ACCESS_KEY_ID", secrets["s3AccessKey"]},
+		{"AWS_SECRET_ACCESS_KEY", secrets["s3SecretKey"]},
+		{"AWS_SESSION_TOKEN", secrets["s3SessionToken"]},
+		{"AWS_DEFAULT_REGION", c.S3Region},
+		{"AWS_ENDPOINT", c.S3Endpoint},
+		{"AZURE_ACCOUNT_NAME", c.AzureAccountName},
+		{"AZURE_ACCOUNT_KEY", secrets["azureAccountKey"]},
+		{"AZURE_ACCOUNT_SAS", c.AzureAccountSAS},
+		{"AZURE_ENDPOINT_SUFFIX", c.AzureEndpointSuffix},
+		{"GOOGLE_PROJECT_ID", c.GCSProjectID},
+		{"GOOGLE_APPLICATION_CREDENTIALS", c.GCSCredentialsFile},
+		{"B2_ACCOUNT_ID", c.B2AccountID},
+		{"B2_ACCOUNT_KEY", secrets["b2AccountKey"]},
+		{"RESTIC_REST_USERNAME", c.RESTUsername},
+		{"RESTIC_REST_PASSWORD", secrets["restPassword"]},
+	}
+
+	var env []string
+	for _, v := range vars {
+		if v.value != "" {
+			env = append(env, v.name+"="+v.value)
+		}
+	}
+	return env, nil
+}
+
+// backendPrefixes map the variables of backendEnv to the backend reading them
+var backendPrefixes = []struct {
+	prefix  string
+	backend Backend
+}{
+	{"AWS_", BackendS3},
+	{"AZURE_", BackendAzure},
+	{"GOOGLE_", BackendGCS},
+	{"B2_", BackendB2},
+	{"RESTIC_REST_", BackendREST},
+}
+
+// envBackend returns the backend reading the variable of backendEnv
+func envBackend(variable string) Backend {
+	for _, p := range backendPrefixes {
+		if strings.HasPrefix(variable, p.prefix) {
+			return p.backend
+		}
+	}
+	return ""
+}
+
+// configureCopy sets up cmd to copy snapshots from c to dest. restic reads
+// the backend settings of both repositories from the same options and
+// variables, so each one gets its own, and settings that two repositories
+// of the same backend would need different values of are refused rather than
+// sharing the credentials of one with the other.
+func (c Config) configureCopy(cmd *exec.Cmd, dest Config) error {
+	from, err := c.withRESTCredentialsInURL()
+	if err != nil {
+		return err
+	}
+	to, err := dest.withRESTCredentialsInURL()
+	if err != nil {
+		return err
+	}
+
+	args, err := copyArgs(from, to)
+	if err != nil {
+		return err
+	}
+	env, err := copyEnv(from, to)
+	if err != nil {
+		return err
+	}
+
+	cmd.Args = append(cmd.Args, args...)
+	cmd.Env = append(cmd.Env, processEnv()...)
+	cmd.Env = append(cmd.Env, "RESTIC_REPOSITORY="+to.Repository)
+	cmd.Env = append(cmd.Env, to.passwordEnv("RESTIC_")...)
+	cmd.Env = append(cmd.Env, "RESTIC_FROM_REPOSITORY="+from.Repository)
+	cmd.Env = append(cmd.Env, from.passwordEnv("RESTIC_FROM_")...)
+	cmd.Env = append(cmd.Env, env...)
+	if to.Compression != "" {
+		cmd.Env = append(cmd.Env, "RESTIC_COMPRESSION="+to.Compression)
+	}
+	return nil
+}
+
+// withRESTCredentialsInURL moves the credentials of a REST repository into
+// its URL, where restic prefers them over the variables both repositories
+// of a copy share
+func (c Config) withRESTCredentialsInURL() (Config, error) {
+	if c.Backend() != BackendREST || c.RESTUsername == "" {
+		return c, nil
+	}
+	password, err := secretSource{"restPassword", c.RESTPassword, c.RESTPasswordFile}.read()
+	if err != nil {
+		return c, err
+	}
+	u, err := url.Parse(strings.TrimPrefix(c.Repository, "rest:"))
+	if err != nil {
+		return c, fmt.Errorf("rest backend: invalid repository URL: %w", err)
+	}
+	u.User = url.UserPassword(c.RESTUsername, password)
+	c.Repository = "rest:" + u.String()
+	c.RESTUsername, c.RESTPassword, c.RESTPasswordFile = "", "", ""
+	return c, nil
+}
+
+// copyArgs returns the options of the backends of both repositories of a copy
+func copyArgs(from, to Config) ([]string, error) {
+	if from.InsecureTLS != to.InsecureTLS {
+		return nil, fmt.Errorf("insecureTLS differs between the repositories, restic copy applies it to both")
+	}
+
+	var args []string
+	for _, file := range []string{from.CACertFile, to.CACertFile} {
+		if file != "" && !slices.Contains(args, file) {
+			args = append(args, "--cacert", file)
+		}
+	}
+	if from.InsecureTLS {
+		args = append(args, "--insecure-tls")
+	}
+
+	options := []struct {
+		name     string
+		backend  Backend
+		from, to string
+	}{
+		{"s3.bucket-lookup", BackendS3, pathStyle(from), pathStyle(to)},
+		{"sftp.command", BackendSFTP, from.SFTPCommand, to.SFTPCommand},
+	}
+	for _, o := range options {
+		value, err := shared(o.name, o.backend, from, to, o.from, o.to)
+		if err != nil {
+			return nil, err
+		}
+		if value != "" {
+			args = append(args, "-o", o.name+"="+value)
+		}
+	}
+	return args, nil
+}
+
+// pathStyle returns the bucket lookup of an S3 repository
+func pathStyle(c Config) string {
+	if c.S3PathStyle {
+		return "path"
+	}
+	return ""
+}
+
+// copyEnv returns the backend variables of both repositories of a copy
+func copyEnv(from, to Config) ([]string, error) {
+	fromEnv, err := from.backendEnv()
+	if err != nil {
+		return nil, err
+	}
+	toEnv, err := to.backendEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	values := func(env []string) map[string]string {
+		m := make(map[string]string, len(env))
+		for _, v := range env {
+			name, value, _ := strings.Cut(v, "=")
+			m[name] = value
+		}
+		return m
+	}
+	fromValues, toValues := values(fromEnv), values(toEnv)
+
+	var names []string
+	for name := range fromValues {
+		names = append(names, name)
+	}
+	for name := range toValues {
+		if _, ok := fromValues[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	var env []string
+	for _, name := range names {
+		value, err := shared(name, envBackend(name), from, to, fromValues[name], toValues[name])
+		if err != nil {
+			return nil, err
+		}
+		if value != "" {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env, nil
+}
+
+// shared returns the value of a setting of backend that both repositories
+// of a copy see, the one of the repository using backend. Repositories both
+// using backend must agree on it.
+func shared(name string, backend Backend, from, to Config, fromValue, toValue string) (string, error) {
+	fromUses, toUses := from.Backend() == backend, to.Backend() == backend
+	switch {
+	case fromUses && toUses:
+		if fromValue != toValue {
+			return "", fmt.Errorf("%s differs between the %s repositories, restic copy can only use one value for both", name, backend)
+		}
+		return fromValue, nil
+	case fromUses:
+		return fromValue, nil
+	case toUses:
+		return toValue, nil
+	default:
+		return "", nil
+	}
+}
@@ -0,0 +1,144 @@
+package restic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CheckMode selects how thoroughly a repository check reads the data
+type CheckMode string
+
+const (
+	// CheckStructure verifies the repository structure without reading pack data
+	CheckStructure CheckMode = "structure"
+	// CheckReadData reads and verifies all pack data
+	CheckReadData CheckMode = "read-data"
+	// CheckReadDataSubset reads and verifies a subset of the pack data
+	CheckReadDataSubset CheckMode = "read-data-subset"
+)
+
+// CheckOptions configures a repository check
+type CheckOptions struct {
+	Mode CheckMode `json:"mode,omitempty"`
+	// Subset is the part of the data read in CheckReadDataSubset mode,
+	// either n/t (e.g. 1/5) or a percentage (e.g. 10%)
+	Subset string `json:"subset,omitempty"`
+}
+
+// CheckResult is the outcome of a repository check
+type CheckResult struct {
+	Mode             CheckMode     `json:"mode"`
+	Subset           string        `json:"subset,omitempty"`
+	StartedAt        time.Time     `json:"startedAt"`
+	Duration         time.Duration `json:"duration"`
+	OK               bool          `json:"ok"`
+	Errors           []string      `json:"errors,omitempty"`
+	PacksChecked     int           `json:"packsChecked"`
+	SnapshotsChecked int           `json:"snapshotsChecked"`
+}
+
+var (
+	subsetRegex    = regexp.MustCompile(`^([0-9]+/[0-9]+|[0-9]+(\.[0-9]+)?%)$`)
+	packsRegex     = regexp.MustCompile(`([0-9]+) / ([0-9]+) packs`)
+	snapshotsRegex = regexp.MustCompile(`([0-9]+) / ([0-9]+) snapshots`)
+)
+
+// Validate checks the options are consistent
+func (o CheckOptions) Validate() error {
+	switch o.Mode {
+	case "", CheckStructure, CheckReadData:
+		if o.Subset != "" {
+			return fmt.Errorf("subset is only valid in %s mode", CheckReadDataSubset)
+		}
+	case CheckReadDataSubset:
+		if !subsetRegex.MatchString(o.Subset) {
+			return fmt.Errorf("invalid subset %q, expected n/t or a percentage", o.Subset)
+		}
+	default:
+		return fmt.Errorf("unknown check mode %q", o.Mode)
+	}
+	return nil
+}
+
+func (c *clientImpl) Check(ctx context.Context, opts CheckOptions) (*CheckResult, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Mode == "" {
+		opts.Mode = CheckStructure
+	}
+
+	args := []string{"check"}
+	switch opts.Mode {
+	case CheckReadData:
+		args = append(args, "--read-data")
+	case CheckReadDataSubset:
+		args = append(args, "--read-data-subset", opts.Subset)
+	}
+
+	cmd := exec.CommandContext(ctx, "restic", args...)
+	if err := c.configure(cmd); err != nil {
+		return nil, fmt.Errorf("check failed: %w", err)
+	}
+
+	started := time.Now()
+	output, err := runCombinedOutput(ctx, cmd)
+
+	result := parseCheckOutput(string(output))
+	result.Mode = opts.Mode
+	result.Subset = opts.Subset
+	result.StartedAt = started
+	result.Duration = time.Since(started)
+
+	if err != nil {
+		// restic exits with 1 when it found errors, anything else means the
+		// check itself could not run
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || len(result.Errors) == 0 {
+			return nil, fmt.Errorf("check failed: %w: %s", err, string(output))
+		}
+		result.OK = false
+		return result, nil
+	}
+
+	result.OK = len(result.Errors) == 0
+	return result, nil
+}
+
+// parseCheckOutput extracts errors and progress counters from restic check output
+func parseCheckOutput(output string) *CheckResult {
+	result := &CheckResult{}
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if matches := packsRegex.FindAllStringSubmatch(line, -1); matches != nil {
+			result.PacksChecked, _ = strconv.Atoi(matches[len(matches)-1][1])
+			continue
+		}
+		if matches := snapshotsRegex.FindAllStringSubmatch(line, -1); matches != nil {
+			result.SnapshotsChecked, _ = strconv.Atoi(matches[len(matches)-1][1])
+			continue
+		}
+
+		lower := strings.ToLower(line)
+		if lower == "no errors were found" {
+			continue
+		}
+		if strings.Contains(lower, "error") || strings.HasPrefix(lower, "fatal:") ||
+			strings.Contains(lower, "does not match") {
+			result.Errors = append(result.Errors, line)
+		}
+	}
+
+	return result
+}
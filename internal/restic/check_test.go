@@ -0,0 +1,86 @@
+package restic
+
+import "testing"
+
+func TestCheckOptions_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    CheckOptions
+		wantErr bool
+	}{
+		{name: "default mode", opts: CheckOptions{}},
+		{name: "structure", opts: CheckOptions{Mode: CheckStructure}},
+		{name: "read data", opts: CheckOptions{Mode: CheckReadData}},
+		{name: "subset group", opts: CheckOptions{Mode: CheckReadDataSubset, Subset: "1/5"}},
+		{name: "subset percentage", opts: CheckOptions{Mode: CheckReadDataSubset, Subset: "2.5%"}},
+		{name: "subset missing", opts: CheckOptions{Mode: CheckReadDataSubset}, wantErr: true},
+		{name: "subset invalid", opts: CheckOptions{Mode: CheckReadDataSubset, Subset: "half"}, wantErr: true},
+		{name: "subset without mode", opts: CheckOptions{Subset: "1/5"}, wantErr: true},
+		{name: "unknown mode", opts: CheckOptions{Mode: "thorough"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseCheckOutput(t *testing.T) {
+	tests := []struct {
+		name          string
+		output        string
+		wantErrors    int
+		wantPacks     int
+		wantSnapshots int
+	}{
+		{
+			name: "no errors",
+			output: `using temporary cache in /tmp/restic-check-cache-123
+create exclusive lock for repository
+load indexes
+check all packs
+check snapshots, trees and blobs
+[0:00] 100.00%  3 / 3 snapshots
+read all data
+[0:01] 100.00%  12 / 12 packs
+no errors were found
+`,
+			wantPacks:     12,
+			wantSnapshots: 3,
+		},
+		{
+			name: "damaged pack",
+			output: `load indexes
+check all packs
+check snapshots, trees and blobs
+[0:00] 100.00%  3 / 3 snapshots
+read group #1 of 5 data packs (out of total 12 packs in 5 groups)
+[0:00] 100.00%  3 / 3 packs
+Pack ID does not match, want 2a3f, got 9c1e
+error for tree 4b2f: blob 7e1d not found
+Fatal: repository contains errors
+`,
+			wantErrors:    3,
+			wantPacks:     3,
+			wantSnapshots: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseCheckOutput(tt.output)
+			if len(got.Errors) != tt.wantErrors {
+				t.Errorf("Errors = %v, want %d", got.Errors, tt.wantErrors)
+			}
+			if got.PacksChecked != tt.wantPacks {
+				t.Errorf("PacksChecked = %d, want %d", got.PacksChecked, tt.wantPacks)
+			}
+			if got.SnapshotsChecked != tt.wantSnapshots {
+				t.Errorf("SnapshotsChecked = %d, want %d", got.SnapshotsChecked, tt.wantSnapshots)
+			}
+		})
+	}
+}
@@ -1,21 +1,36 @@
 package restic
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"cloud-native-pg-restic-backup/internal/metrics"
+	"cloud-native-pg-restic-backup/internal/tracing"
 )
 
 // Implementation of the Client interface using the Restic CLI
 
 func (c *clientImpl) InitRepository(ctx context.Context) error {
 	cmd := exec.CommandContext(ctx, "restic", "init")
-	c.setEnvironment(cmd)
+	if err := c.configure(cmd); err != nil {
+		return fmt.Errorf("failed to initialize repository: %w", err)
+	}
 
-	if output, err := cmd.CombinedOutput(); err != nil {
+	if output, err := runCombinedOutput(ctx, cmd); err != nil {
 		if strings.Contains(string(output), "repository master key and config already initialized") {
 			// Case for trying to intitialize already present s3 repos
 			return nil
@@ -29,52 +44,206 @@ func (c *clientImpl) InitRepository(ctx context.Context) error {
 	return nil
 }
 
-func (c *clientImpl) Backup(ctx context.Context, path string, tags []string) error {
-	args := []string{"backup", path}
+func (c *clientImpl) Backup(ctx context.Context, path string, tags []string, opts BackupOptions) (*BackupSummary, error) {
+	args := append([]string{"backup", path}, opts.Paths...)
+	args = append(args, "--json")
+	if c.config.Host != "" {
+		args = append(args, "--host", c.config.Host)
+	}
 	for _, tag := range tags {
 		args = append(args, "--tag", tag)
 	}
+	if len(opts.Exclude) > 0 {
+		// Patterns go through a file, there may be one per unlogged relation
+		excludeFile, err := writeExcludeFile(opts.Exclude)
+		if err != nil {
+			return nil, fmt.Errorf("backup failed: %w", err)
+		}
+		defer os.Remove(excludeFile)
+		args = append(args, "--exclude-file", excludeFile)
+	}
+	args = append(args, opts.Upload.args()...)
 
 	cmd := exec.CommandContext(ctx, "restic", args...)
-	c.setEnvironment(cmd)
+	if err := c.configure(cmd); err != nil {
+		return nil, fmt.Errorf("backup failed: %w", err)
+	}
 
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("backup failed: %w: %s", err, string(output))
+	output, err := runOutput(ctx, cmd)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("backup failed: %w: %s", err, string(exitErr.Stderr))
+		}
+		return nil, fmt.Errorf("backup failed: %w", err)
 	}
-	return nil
+
+	summary, err := parseBackupSummary(output)
+	if err != nil {
+		return nil, fmt.Errorf("backup failed: %w", err)
+	}
+	return summary, nil
 }
 
-func (c *clientImpl) Restore(ctx context.Context, snapshotID, targetPath string) error {
-	cmd := exec.CommandContext(ctx, "restic", "restore", snapshotID, "--target", targetPath)
-	c.setEnvironment(cmd)
+func (c *clientImpl) BackupStdin(ctx context.Context, filename string, tags []string, stdin io.Reader) (*BackupSummary, error) {
+	args := []string{"backup", "--stdin", "--stdin-filename", filename, "--json"}
+	if c.config.Host != "" {
+		args = append(args, "--host", c.config.Host)
+	}
+	for _, tag := range tags {
+		args = append(args, "--tag", tag)
+	}
 
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("restore failed: %w: %s", err, string(output))
+	cmd := exec.CommandContext(ctx, "restic", args...)
+	if err := c.configure(cmd); err != nil {
+		return nil, fmt.Errorf("backup failed: %w", err)
+	}
+	cmd.Stdin = stdin
+
+	output, err := runOutput(ctx, cmd)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("backup failed: %w: %s", err, string(exitErr.Stderr))
+		}
+		return nil, fmt.Errorf("backup failed: %w", err)
+	}
+
+	summary, err := parseBackupSummary(output)
+	if err != nil {
+		return nil, fmt.Errorf("backup failed: %w", err)
+	}
+	return summary, nil
+}
+
+// writeExcludeFile writes exclude patterns to a temporary file, one per line
+func writeExcludeFile(patterns []string) (string, error) {
+	f, err := os.CreateTemp("", "restic-exclude-")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(strings.Join(patterns, "\n") + "\n"); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// parseBackupSummary extracts the summary message from restic backup --json
+// output
+func parseBackupSummary(output []byte) (*BackupSummary, error) {
+	var summary *BackupSummary
+	for _, line := range bytes.Split(output, []byte("\n")) {
+		var message struct {
+			MessageType string `json:"message_type"`
+			BackupSummary
+		}
+		if err := json.Unmarshal(line, &message); err != nil || message.MessageType != "summary" {
+			continue
+		}
+		summary = &message.BackupSummary
+	}
+
+	if summary == nil {
+		return nil, fmt.Errorf("no summary in restic output")
+	}
+	return summary, nil
+}
+
+func (c *clientImpl) Restore(ctx context.Context, snapshotID, targetPath string, opts RestoreOptions) error {
+	args := append([]string{"restore", snapshotID, "--target", targetPath}, opts.args(c.config.Backend())...)
+	cmd := exec.CommandContext(ctx, "restic", args...)
+	if err := c.configure(cmd); err != nil {
+		return fmt.Errorf("restore failed: %w", err)
+	}
+
+	if output, err := runCombinedOutput(ctx, cmd); err != nil {
+		return fmt.Errorf("restore failed: %w: %s", commandError(err, output), string(output))
 	}
 	return nil
 }
 
 func (c *clientImpl) RestoreFile(ctx context.Context, snapshotID, filePath, targetPath string) error {
-	cmd := exec.CommandContext(ctx, "restic", "restore", snapshotID, "--include", filePath, "--target", targetPath)
-	c.setEnvironment(cmd)
+	// restic recreates the original directory structure below the target, so
+	// restore into a scratch directory and move the file into place
+	tmpDir, err := os.MkdirTemp(filepath.Dir(targetPath), ".restic-restore-")
+	if err != nil {
+		return fmt.Errorf("file restore failed: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cmd := exec.CommandContext(ctx, "restic", "restore", snapshotID, "--include", filePath, "--target", tmpDir)
+	if err := c.configure(cmd); err != nil {
+		return fmt.Errorf("file restore failed: %w", err)
+	}
+
+	if output, err := runCombinedOutput(ctx, cmd); err != nil {
+		return fmt.Errorf("file restore failed: %w: %s", commandError(err, output), string(output))
+	}
+
+	var restored string
+	err = filepath.WalkDir(tmpDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && d.Name() == filepath.Base(filePath) {
+			restored = path
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("file restore failed: %w", err)
+	}
+	if restored == "" {
+		return fmt.Errorf("file restore failed: %s not found in snapshot %s", filePath, snapshotID)
+	}
+
+	if err := os.Rename(restored, targetPath); err != nil {
+		return fmt.Errorf("file restore failed: %w", err)
+	}
+	return nil
+}
+
+func (c *clientImpl) Dump(ctx context.Context, snapshotID, filePath string, w io.Writer) error {
+	cmd := exec.CommandContext(ctx, "restic", "dump", snapshotID, filePath)
+	if err := c.configure(cmd); err != nil {
+		return fmt.Errorf("dump failed: %w", err)
+	}
+	var stderr bytes.Buffer
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
 
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("file restore failed: %w: %s", err, string(output))
+	ctx, span := startCommand(ctx, cmd)
+	started := time.Now()
+	err := cmd.Run()
+	endCommand(ctx, span, cmd, started, err)
+	if err != nil {
+		return fmt.Errorf("dump failed: %w: %s", commandError(err, stderr.Bytes()), stderr.String())
 	}
 	return nil
 }
 
 func (c *clientImpl) FindSnapshots(ctx context.Context, tags []string) ([]*Snapshot, error) {
 	args := []string{"snapshots", "--json"}
-	for _, tag := range tags {
-		args = append(args, "--tag", tag)
+	if len(tags) > 0 {
+		// A comma separated list requires all tags, repeated --tag flags match any
+		args = append(args, "--tag", strings.Join(tags, ","))
 	}
 
 	cmd := exec.CommandContext(ctx, "restic", args...)
-	c.setEnvironment(cmd)
+	if err := c.configure(cmd); err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
 
-	output, err := cmd.Output()
+	output, err := runOutput(ctx, cmd)
 	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("failed to list snapshots: %w: %s", commandError(err, exitErr.Stderr), string(exitErr.Stderr))
+		}
 		return nil, fmt.Errorf("failed to list snapshots: %w", err)
 	}
 
@@ -89,28 +258,206 @@ func (c *clientImpl) FindSnapshots(ctx context.Context, tags []string) ([]*Snaps
 func (c *clientImpl) DeleteSnapshots(ctx context.Context, snapshotIDs []string) error {
 	args := append([]string{"forget", "--prune"}, snapshotIDs...)
 	cmd := exec.CommandContext(ctx, "restic", args...)
-	c.setEnvironment(cmd)
+	if err := c.configure(cmd); err != nil {
+		return fmt.Errorf("failed to delete snapshots: %w", err)
+	}
 
-	if output, err := cmd.CombinedOutput(); err != nil {
+	if output, err := runCombinedOutput(ctx, cmd); err != nil {
 		return fmt.Errorf("failed to delete snapshots: %w: %s", err, string(output))
 	}
 	return nil
 }
 
+func (c *clientImpl) Copy(ctx context.Context, dest Config, snapshotIDs []string) error {
+	args := append([]string{"copy"}, snapshotIDs...)
+	cmd := exec.CommandContext(ctx, "restic", args...)
+
+	// restic copy reads from RESTIC_FROM_* and writes to RESTIC_*
+	if err := c.config.configureCopy(cmd, dest); err != nil {
+		return fmt.Errorf("failed to copy snapshots: %w", err)
+	}
+
+	if output, err := runCombinedOutput(ctx, cmd); err != nil {
+		return fmt.Errorf("failed to copy snapshots: %w: %s", err, string(output))
+	}
+	return nil
+}
+
+func (c *clientImpl) Locks(ctx context.Context) ([]*Lock, error) {
+	// Listing must not take a lock itself, and opening the repository
+	// proves it is reachable with valid credentials
+	cmd := exec.CommandContext(ctx, "restic", "list", "locks", "--no-lock")
+	if err := c.configure(cmd); err != nil {
+		return nil, fmt.Errorf("failed to list locks: %w", err)
+	}
+
+	output, err := runCombinedOutput(ctx, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list locks: %w: %s", err, string(output))
+	}
+
+	var locks []*Lock
+	for _, id := range strings.Fields(string(output)) {
+		cmd := exec.CommandContext(ctx, "restic", "cat", "lock", id, "--no-lock")
+		if err := c.configure(cmd); err != nil {
+			return nil, fmt.Errorf("failed to list locks: %w", err)
+		}
+
+		data, err := runOutput(ctx, cmd)
+		if err != nil {
+			// The lock was released since it was listed
+			continue
+		}
+
+		lock := &Lock{ID: id}
+		if err := json.Unmarshal(data, lock); err != nil {
+			return nil, fmt.Errorf("failed to parse lock %s: %w", id, err)
+		}
+		locks = append(locks, lock)
+	}
+
+	return locks, nil
+}
+
 func (c *clientImpl) EnsureDirectory(ctx context.Context, path string) error {
 	return os.MkdirAll(path, 0755)
 }
 
-// setEnvironment sets the required environment variables for the Restic command
-func (c *clientImpl) setEnvironment(cmd *exec.Cmd) {
-	cmd.Env = append(cmd.Env,
-		"RESTIC_REPOSITORY="+c.config.Repository,
-		"RESTIC_PASSWORD="+c.config.Password,
-		"AWS_ACCESS_KEY_ID="+c.config.S3AccessKey,
-		"AWS_SECRET_ACCESS_KEY="+c.config.S3SecretKey,
+// exitRepositoryNotFound is the exit code of restic for a repository that
+// doesn't exist
+const exitRepositoryNotFound = 10
+
+// unavailableMessages are restic messages of a repository that can't be opened
+var unavailableMessages = []string{
+	"unable to open config file",
+	"unable to open repository",
+	"repository does not exist",
+}
+
+// commandError marks the error of a restic command failing because the
+// repository can't be opened, such as when its backend is unreachable, with
+// ErrRepositoryUnavailable
+func commandError(err error, output []byte) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	if exitErr.ExitCode() == exitRepositoryNotFound {
+		return fmt.Errorf("%w: %w", ErrRepositoryUnavailable, err)
+	}
+	for _, message := range unavailableMessages {
+		if bytes.Contains(output, []byte(message)) {
+			return fmt.Errorf("%w: %w", ErrRepositoryUnavailable, err)
+		}
+	}
+	return err
+}
+
+// runCombinedOutput runs a restic command, recording its duration, and
+// returns its combined standard output and error
+func runCombinedOutput(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	ctx, span := startCommand(ctx, cmd)
+	started := time.Now()
+	output, err := cmd.CombinedOutput()
+	endCommand(ctx, span, cmd, started, err)
+	return output, err
+}
+
+// runOutput runs a restic command, recording its duration, and returns its
+// standard output
+func runOutput(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	ctx, span := startCommand(ctx, cmd)
+	started := time.Now()
+	output, err := cmd.Output()
+	endCommand(ctx, span, cmd, started, err)
+	return output, err
+}
+
+// startCommand starts the span of a restic subprocess
+func startCommand(ctx context.Context, cmd *exec.Cmd) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "restic "+cmd.Args[1],
+		attribute.StringSlice("restic.args", redactArgs(cmd.Args[1:])),
 	)
+}
+
+// endCommand records the outcome of a restic subprocess
+func endCommand(ctx context.Context, span trace.Span, cmd *exec.Cmd, started time.Time, err error) {
+	if cmd.ProcessState != nil {
+		span.SetAttributes(attribute.Int("process.exit.code", cmd.ProcessState.ExitCode()))
+	}
+	tracing.End(span, err)
+	metrics.ObserveResticCommand(ctx, cmd.Args[1], time.Since(started), err)
+}
+
+// secretFlagRegex matches flags whose value may be a secret
+var secretFlagRegex = regexp.MustCompile(`(?i)^--[a-z0-9-]*(password|secret|key|token)[a-z0-9-]*$`)
+
+// redactArgs returns restic arguments safe to record, without secret flag
+// values and URL credentials
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		if i > 0 && secretFlagRegex.MatchString(args[i-1]) {
+			redacted[i] = "REDACTED"
+			continue
+		}
+		if flag, _, ok := strings.Cut(arg, "="); ok && secretFlagRegex.MatchString(flag) {
+			redacted[i] = flag + "=REDACTED"
+			continue
+		}
+		redacted[i] = redactURL(arg)
+	}
+	return redacted
+}
+
+// redactURL removes the password of a URL, possibly prefixed with a restic
+// backend such as rest: or s3:
+func redactURL(arg string) string {
+	scheme := strings.Index(arg, "://")
+	if scheme < 0 {
+		return arg
+	}
+	at := strings.LastIndex(arg, "@")
+	if at < scheme {
+		return arg
+	}
+	userinfo := arg[scheme+3 : at]
+	if user, _, ok := strings.Cut(userinfo, ":"); ok {
+		return arg[:scheme+3] + user + ":REDACTED" + arg[at:]
+	}
+	return arg
+}
 
-	if c.config.S3Endpoint != "" {
-		cmd.Env = append(cmd.Env, "AWS_ENDPOINT="+c.config.S3Endpoint)
+// passedEnv are the variables of the plugin's environment restic gets,
+// for its cache and for password commands to find their tools. Credentials
+// in the rest of the environment are never passed on.
+var passedEnv = []string{"PATH", "HOME", "TMPDIR", "XDG_CACHE_HOME"}
+
+// processEnv returns the variables of passedEnv the plugin has set
+func processEnv() []string {
+	var env []string
+	for _, name := range passedEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// configure sets the environment variables and backend options of the
+// Restic command, reading credential files anew
+func (c *clientImpl) configure(cmd *exec.Cmd) error {
+	env, err := c.config.backendEnv()
+	if err != nil {
+		return err
 	}
+	cmd.Args = append(cmd.Args, c.config.globalArgs()...)
+	cmd.Env = append(cmd.Env, processEnv()...)
+	cmd.Env = append(cmd.Env, "RESTIC_REPOSITORY="+c.config.Repository)
+	cmd.Env = append(cmd.Env, c.config.passwordEnv("RESTIC_")...)
+	cmd.Env = append(cmd.Env, env...)
+	if c.config.Compression != "" {
+		cmd.Env = append(cmd.Env, "RESTIC_COMPRESSION="+c.config.Compression)
+	}
+	return nil
 }
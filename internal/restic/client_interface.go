@@ -2,6 +2,10 @@ package restic
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
 	"time"
 )
 
@@ -11,15 +15,22 @@ type Client interface {
 	InitRepository(ctx context.Context) error
 
 	// Backup creates a new backup of the specified path
-	Backup(ctx context.Context, path string, tags []string) error
+	Backup(ctx context.Context, path string, tags []string, opts BackupOptions) (*BackupSummary, error)
+
+	// BackupStdin creates a new backup of a single file read from stdin,
+	// stored under filename
+	BackupStdin(ctx context.Context, filename string, tags []string, stdin io.Reader) (*BackupSummary, error)
 
 	// Restore restores a snapshot to the specified path
-	Restore(ctx context.Context, snapshotID, targetPath string) error
+	Restore(ctx context.Context, snapshotID, targetPath string, opts RestoreOptions) error
 
-	// RestoreFile restores a single file from a snapshot
+	// RestoreFile restores a single file from a snapshot to targetPath
 	RestoreFile(ctx context.Context, snapshotID, filePath, targetPath string) error
 
-	// FindSnapshots finds snapshots matching the given tags
+	// Dump writes a file of a snapshot to w
+	Dump(ctx context.Context, snapshotID, filePath string, w io.Writer) error
+
+	// FindSnapshots finds snapshots carrying all of the given tags
 	FindSnapshots(ctx context.Context, tags []string) ([]*Snapshot, error)
 
 	// DeleteSnapshots deletes the specified snapshots
@@ -27,6 +38,15 @@ type Client interface {
 
 	// EnsureDirectory ensures a directory exists
 	EnsureDirectory(ctx context.Context, path string) error
+
+	// Copy copies the specified snapshots into the destination repository
+	Copy(ctx context.Context, dest Config, snapshotIDs []string) error
+
+	// Check verifies the integrity of the repository
+	Check(ctx context.Context, opts CheckOptions) (*CheckResult, error)
+
+	// Locks lists the locks held on the repository
+	Locks(ctx context.Context) ([]*Lock, error)
 }
 
 // Snapshot represents a Restic snapshot
@@ -35,17 +55,158 @@ type Snapshot struct {
 	Time     time.Time `json:"time"`
 	Hostname string    `json:"hostname"`
 	Tags     []string  `json:"tags"`
+	Paths    []string  `json:"paths"`
+	// Original is the ID of the source snapshot if this one was copied
+	Original string `json:"original,omitempty"`
+}
+
+// SourceID returns the ID the snapshot was taken with, which tags of other
+// snapshots refer to it by. Copies keep it as their original ID.
+func (s *Snapshot) SourceID() string {
+	if s.Original != "" {
+		return s.Original
+	}
+	return s.ID
+}
+
+// Lock is a lock held on the repository
+type Lock struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Exclusive bool      `json:"exclusive"`
+	Hostname  string    `json:"hostname"`
+	PID       int       `json:"pid"`
+}
+
+// BackupOptions adjusts what a backup stores
+type BackupOptions struct {
+	// Paths are backed up in the same snapshot as the main path
+	Paths []string
+	// Exclude are restic patterns of files left out of the snapshot
+	Exclude []string
+	// Upload tunes how the snapshot is written
+	Upload UploadOptions
+}
+
+// BackupSummary reports what a backup stored
+type BackupSummary struct {
+	SnapshotID          string `json:"snapshot_id"`
+	FilesNew            int    `json:"files_new"`
+	FilesChanged        int    `json:"files_changed"`
+	FilesUnmodified     int    `json:"files_unmodified"`
+	DataAdded           uint64 `json:"data_added"`
+	TotalFilesProcessed int    `json:"total_files_processed"`
+	TotalBytesProcessed uint64 `json:"total_bytes_processed"`
 }
 
 // Config holds the configuration for the Restic client
 type Config struct {
-	Repository  string
-	Password    string
-	S3Endpoint  string
-	S3AccessKey string
-	S3SecretKey string
+	Repository string `json:"repository,omitempty"`
+	Password   string `json:"password,omitempty"`
+	// PasswordFile is read by restic on every command, so a rotated
+	// password takes effect without a restart
+	PasswordFile string `json:"passwordFile,omitempty"`
+	// PasswordCommand prints the password, run by restic on every command
+	PasswordCommand string `json:"passwordCommand,omitempty"`
+	S3Endpoint      string `json:"s3Endpoint,omitempty"`
+	S3AccessKey     string `json:"s3AccessKey,omitempty"`
+	S3SecretKey     string `json:"s3SecretKey,omitempty"`
+	// S3AccessKeyFile and S3SecretKeyFile are read before every command
+	S3AccessKeyFile string `json:"s3AccessKeyFile,omitempty"`
+	S3SecretKeyFile string `json:"s3SecretKeyFile,omitempty"`
+	S3Region        string `json:"s3Region,omitempty"`
+	// S3SessionToken accompanies temporary keys
+	S3SessionToken     string `json:"s3SessionToken,omitempty"`
+	S3SessionTokenFile string `json:"s3SessionTokenFile,omitempty"`
+	// S3PathStyle addresses buckets by path rather than by virtual host,
+	// as most self-hosted S3 servers require
+	S3PathStyle bool `json:"s3PathStyle,omitempty"`
+
+	// Azure Blob Storage, authenticated with an account key or SAS token
+	AzureAccountName    string `json:"azureAccountName,omitempty"`
+	AzureAccountKey     string `json:"azureAccountKey,omitempty"`
+	AzureAccountKeyFile string `json:"azureAccountKeyFile,omitempty"`
+	AzureAccountSAS     string `json:"azureAccountSAS,omitempty"`
+	AzureEndpointSuffix string `json:"azureEndpointSuffix,omitempty"`
+
+	// Google Cloud Storage, without a credentials file the workload's
+	// default credentials are used
+	GCSProjectID       string `json:"gcsProjectID,omitempty"`
+	GCSCredentialsFile string `json:"gcsCredentialsFile,omitempty"`
+
+	// Backblaze B2
+	B2AccountID      string `json:"b2AccountID,omitempty"`
+	B2AccountKey     string `json:"b2AccountKey,omitempty"`
+	B2AccountKeyFile string `json:"b2AccountKeyFile,omitempty"`
+
+	// SFTPCommand replaces the ssh command restic connects to SFTP
+	// repositories with
+	SFTPCommand string `json:"sftpCommand,omitempty"`
+
+	// REST server credentials, also accepted in the repository URL
+	RESTUsername     string `json:"restUsername,omitempty"`
+	RESTPassword     string `json:"restPassword,omitempty"`
+	RESTPasswordFile string `json:"restPasswordFile,omitempty"`
+
+	// CACertFile is a PEM bundle of CAs trusted by TLS connections to the
+	// backend, for servers with private certificates
+	CACertFile string `json:"caCertFile,omitempty"`
+	// InsecureTLS skips verification of the backend's TLS certificate
+	InsecureTLS bool `json:"insecureTLS,omitempty"`
+
+	// Host overrides the hostname recorded in snapshots
+	Host string `json:"host,omitempty"`
+	// Compression is the restic compression mode: auto, off or max
+	Compression string `json:"compression,omitempty"`
+}
+
+// compressionModes are the compression modes restic supports
+var compressionModes = map[string]bool{"": true, "auto": true, "off": true, "max": true}
+
+// ValidCompression reports whether mode is a restic compression mode, empty
+// meaning the restic default
+func ValidCompression(mode string) bool {
+	return compressionModes[mode]
 }
 
+// ErrSnapshotNotFound is returned for snapshot IDs matching no snapshot the
+// client can access
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// ErrSnapshotAmbiguous is returned for snapshot ID prefixes matching more
+// than one snapshot
+var ErrSnapshotAmbiguous = errors.New("snapshot ID is ambiguous")
+
+// FindByID returns the snapshot with the given ID or ID prefix among
+// snapshots, failing unless exactly one matches. Copies also match by their
+// original ID, so a snapshot is found by the same ID in every repository.
+func FindByID(snapshots []*Snapshot, id string) (*Snapshot, error) {
+	if id == "" {
+		return nil, fmt.Errorf("%w: empty snapshot ID", ErrSnapshotNotFound)
+	}
+	var matches []*Snapshot
+	for _, snapshot := range snapshots {
+		if snapshot.ID == id || snapshot.Original == id {
+			return snapshot, nil
+		}
+		if strings.HasPrefix(snapshot.ID, id) || (snapshot.Original != "" && strings.HasPrefix(snapshot.Original, id)) {
+			matches = append(matches, snapshot)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, id)
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotAmbiguous, id)
+	}
+}
+
+// ErrRepositoryUnavailable is returned when a repository can't be opened,
+// as opposed to an operation failing on it
+var ErrRepositoryUnavailable = errors.New("repository unavailable")
+
 // clientImpl implements the Client interface using the Restic CLI
 type clientImpl struct {
 	config Config
@@ -57,3 +218,93 @@ func NewClient(cfg Config) Client {
 		config: cfg,
 	}
 }
+
+// taggedClient scopes a Client to the snapshots carrying a fixed set of tags
+type taggedClient struct {
+	Client
+	tags []string
+}
+
+// WithTags returns a Client that adds tags to every backup and only finds
+// snapshots carrying all of them, isolating data in a shared repository
+func WithTags(client Client, tags ...string) Client {
+	if len(tags) == 0 {
+		return client
+	}
+	return &taggedClient{
+		Client: client,
+		tags:   tags,
+	}
+}
+
+func (c *taggedClient) Backup(ctx context.Context, path string, tags []string, opts BackupOptions) (*BackupSummary, error) {
+	return c.Client.Backup(ctx, path, append(append([]string{}, tags...), c.tags...), opts)
+}
+
+func (c *taggedClient) BackupStdin(ctx context.Context, filename string, tags []string, stdin io.Reader) (*BackupSummary, error) {
+	return c.Client.BackupStdin(ctx, filename, append(append([]string{}, tags...), c.tags...), stdin)
+}
+
+func (c *taggedClient) FindSnapshots(ctx context.Context, tags []string) ([]*Snapshot, error) {
+	return c.Client.FindSnapshots(ctx, append(append([]string{}, tags...), c.tags...))
+}
+
+func (c *taggedClient) Restore(ctx context.Context, snapshotID, targetPath string, opts RestoreOptions) error {
+	ids, err := c.resolve(ctx, []string{snapshotID})
+	if err != nil {
+		return err
+	}
+	return c.Client.Restore(ctx, ids[0], targetPath, opts)
+}
+
+func (c *taggedClient) RestoreFile(ctx context.Context, snapshotID, filePath, targetPath string) error {
+	ids, err := c.resolve(ctx, []string{snapshotID})
+	if err != nil {
+		return err
+	}
+	return c.Client.RestoreFile(ctx, ids[0], filePath, targetPath)
+}
+
+func (c *taggedClient) Dump(ctx context.Context, snapshotID, filePath string, w io.Writer) error {
+	ids, err := c.resolve(ctx, []string{snapshotID})
+	if err != nil {
+		return err
+	}
+	return c.Client.Dump(ctx, ids[0], filePath, w)
+}
+
+func (c *taggedClient) DeleteSnapshots(ctx context.Context, snapshotIDs []string) error {
+	ids, err := c.resolve(ctx, snapshotIDs)
+	if err != nil {
+		return err
+	}
+	return c.Client.DeleteSnapshots(ctx, ids)
+}
+
+func (c *taggedClient) Copy(ctx context.Context, dest Config, snapshotIDs []string) error {
+	ids, err := c.resolve(ctx, snapshotIDs)
+	if err != nil {
+		return err
+	}
+	return c.Client.Copy(ctx, dest, ids)
+}
+
+// resolve returns the full IDs of the snapshots with the given IDs or ID
+// prefixes, failing unless each names a single snapshot carrying the tags,
+// so that snapshots of other tenants can't be read or deleted by ID
+func (c *taggedClient) resolve(ctx context.Context, snapshotIDs []string) ([]string, error) {
+	snapshots, err := c.Client.FindSnapshots(ctx, c.tags)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(snapshotIDs))
+	for _, id := range snapshotIDs {
+		snapshot, err := FindByID(snapshots, id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, snapshot.ID)
+	}
+	return ids, nil
+}
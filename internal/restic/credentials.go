@@ -0,0 +1,80 @@
+package restic
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// HasPassword reports whether the configuration has a password source
+func (c Config) HasPassword() bool {
+	return c.Password != "" || c.PasswordFile != "" || c.PasswordCommand != ""
+}
+
+// secretSource is a credential given either as a value or as a file
+type secretSource struct {
+	name, value, file string
+}
+
+// secrets returns the credentials that may be read from files
+func (c Config) secrets() []secretSource {
+	return []secretSource{
+		{"s3AccessKey", c.S3AccessKey, c.S3AccessKeyFile},
+		{"s3SecretKey", c.S3SecretKey, c.S3SecretKeyFile},
+		{"s3SessionToken", c.S3SessionToken, c.S3SessionTokenFile},
+		{"azureAccountKey", c.AzureAccountKey, c.AzureAccountKeyFile},
+		{"b2AccountKey", c.B2AccountKey, c.B2AccountKeyFile},
+		{"restPassword", c.RESTPassword, c.RESTPasswordFile},
+	}
+}
+
+// read returns the credential, reading the file anew so rotated Secrets are
+// picked up by the next command
+func (s secretSource) read() (string, error) {
+	if s.file == "" {
+		return s.value, nil
+	}
+	return ReadSecretFile(s.file)
+}
+
+// ValidateCredentials checks that each credential has at most one source
+func (c Config) ValidateCredentials() error {
+	sources := 0
+	for _, source := range []string{c.Password, c.PasswordFile, c.PasswordCommand} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return fmt.Errorf("password, passwordFile and passwordCommand are mutually exclusive")
+	}
+	for _, s := range c.secrets() {
+		if s.value != "" && s.file != "" {
+			return fmt.Errorf("%s and %sFile are mutually exclusive", s.name, s.name)
+		}
+	}
+	return nil
+}
+
+// passwordEnv returns the variable passing the password source to restic,
+// prefix being RESTIC_ or RESTIC_FROM_
+func (c Config) passwordEnv(prefix string) []string {
+	switch {
+	case c.PasswordCommand != "":
+		return []string{prefix + "PASSWORD_COMMAND=" + c.PasswordCommand}
+	case c.PasswordFile != "":
+		return []string{prefix + "PASSWORD_FILE=" + c.PasswordFile}
+	default:
+		return []string{prefix + "PASSWORD=" + c.Password}
+	}
+}
+
+// ReadSecretFile reads a credential from a file, such as a key of a mounted
+// Secret, without surrounding whitespace
+func ReadSecretFile(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read credentials: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
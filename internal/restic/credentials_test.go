@@ -0,0 +1,138 @@
+package restic
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigure_Credentials(t *testing.T) {
+	dir := t.TempDir()
+	accessKeyFile := filepath.Join(dir, "AWS_ACCESS_KEY_ID")
+	if err := os.WriteFile(accessKeyFile, []byte("access-1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+		want   []string
+		absent []string
+	}{
+		{
+			name:   "password value",
+			config: Config{Repository: "/repo", Password: "secret"},
+			want:   []string{"RESTIC_PASSWORD=secret"},
+			absent: []string{"RESTIC_PASSWORD_FILE", "RESTIC_PASSWORD_COMMAND"},
+		},
+		{
+			name:   "password file",
+			config: Config{Repository: "/repo", PasswordFile: "/secrets/password"},
+			want:   []string{"RESTIC_PASSWORD_FILE=/secrets/password"},
+			absent: []string{"RESTIC_PASSWORD=", "RESTIC_PASSWORD_COMMAND"},
+		},
+		{
+			name:   "password command",
+			config: Config{Repository: "/repo", PasswordCommand: "/bin/vault-password"},
+			want:   []string{"RESTIC_PASSWORD_COMMAND=/bin/vault-password"},
+			absent: []string{"RESTIC_PASSWORD=", "RESTIC_PASSWORD_FILE"},
+		},
+		{
+			name:   "key file",
+			config: Config{Repository: "/repo", Password: "secret", S3AccessKeyFile: accessKeyFile, S3SecretKey: "secret-key"},
+			want:   []string{"AWS_ACCESS_KEY_ID=access-1", "AWS_SECRET_ACCESS_KEY=secret-key"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command("restic")
+			if err := (&clientImpl{config: tt.config}).configure(cmd); err != nil {
+				t.Fatalf("configure() error = %v", err)
+			}
+			env := strings.Join(cmd.Env, "\n")
+			for _, want := range tt.want {
+				if !strings.Contains(env, want) {
+					t.Errorf("environment lacks %q:\n%s", want, env)
+				}
+			}
+			for _, absent := range tt.absent {
+				if strings.Contains(env, absent) {
+					t.Errorf("environment contains %q:\n%s", absent, env)
+				}
+			}
+		})
+	}
+
+	t.Run("rotated key file", func(t *testing.T) {
+		client := &clientImpl{config: Config{Repository: "/repo", Password: "secret", S3AccessKeyFile: accessKeyFile}}
+		if err := os.WriteFile(accessKeyFile, []byte("access-2"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("restic")
+		if err := client.configure(cmd); err != nil {
+			t.Fatalf("configure() error = %v", err)
+		}
+		if !strings.Contains(strings.Join(cmd.Env, "\n"), "AWS_ACCESS_KEY_ID=access-2") {
+			t.Errorf("environment lacks rotated key: %v", cmd.Env)
+		}
+	})
+
+	t.Run("process environment", func(t *testing.T) {
+		t.Setenv("PATH", "/usr/local/bin:/usr/bin")
+		t.Setenv("HOME", "/home/plugin")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "plugin-key")
+		for _, configure := range []func(*exec.Cmd) error{
+			(&clientImpl{config: Config{Repository: "/repo", PasswordCommand: "vault-password"}}).configure,
+			func(cmd *exec.Cmd) error {
+				return Config{Repository: "/repo", Password: "secret"}.configureCopy(cmd, Config{Repository: "/copy", Password: "secret"})
+			},
+		} {
+			cmd := exec.Command("restic")
+			if err := configure(cmd); err != nil {
+				t.Fatalf("configure() error = %v", err)
+			}
+			env := strings.Join(cmd.Env, "\n")
+			for _, want := range []string{"PATH=/usr/local/bin:/usr/bin", "HOME=/home/plugin"} {
+				if !strings.Contains(env, want) {
+					t.Errorf("environment lacks %q:\n%s", want, env)
+				}
+			}
+			if strings.Contains(env, "plugin-key") {
+				t.Errorf("environment passes the plugin's credentials:\n%s", env)
+			}
+		}
+	})
+
+	t.Run("missing key file", func(t *testing.T) {
+		client := &clientImpl{config: Config{Repository: "/repo", Password: "secret", S3SecretKeyFile: filepath.Join(dir, "missing")}}
+		if err := client.configure(exec.Command("restic")); err == nil {
+			t.Error("configure() with missing key file should return error")
+		}
+	})
+}
+
+func TestConfig_ValidateCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"password", Config{Password: "p"}, false},
+		{"password file and key files", Config{PasswordFile: "/p", S3AccessKeyFile: "/a", S3SecretKeyFile: "/s"}, false},
+		{"password and file", Config{Password: "p", PasswordFile: "/p"}, true},
+		{"file and command", Config{PasswordFile: "/p", PasswordCommand: "/bin/p"}, true},
+		{"access key and file", Config{S3AccessKey: "a", S3AccessKeyFile: "/a"}, true},
+		{"secret key and file", Config{S3SecretKey: "s", S3SecretKeyFile: "/s"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.ValidateCredentials(); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateCredentials() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package restic
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// BackupFrom stores what produce writes as a single file snapshot. A failing
+// producer cancels the backup, and a snapshot already stored from its
+// truncated output is deleted.
+func BackupFrom(ctx context.Context, client Client, filename string, tags []string, produce func(ctx context.Context, w io.Writer) error) (*BackupSummary, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	produceErr := make(chan error, 1)
+	go func() {
+		err := produce(ctx, pw)
+		if err != nil {
+			cancel()
+		}
+		pw.CloseWithError(err)
+		produceErr <- err
+	}()
+
+	summary, err := client.BackupStdin(ctx, filename, tags, pr)
+	// Unless the producer failed first, a failing backup ends it
+	backupFailed := err != nil && ctx.Err() == nil
+	cancel()
+	pr.Close()
+	if pErr := <-produceErr; pErr != nil && !backupFailed {
+		if summary != nil {
+			if err := client.DeleteSnapshots(context.WithoutCancel(ctx), []string{summary.SnapshotID}); err != nil {
+				return nil, fmt.Errorf("%w, incomplete snapshot %s not deleted: %v", pErr, summary.SnapshotID, err)
+			}
+		}
+		return nil, pErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// DumpTo pipes a file of a snapshot into consume. The dump is cancelled if
+// consume fails, what consume leaves unread is discarded.
+func DumpTo(ctx context.Context, client Client, snapshotID, filePath string, consume func(r io.Reader) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	dumpErr := make(chan error, 1)
+	go func() {
+		err := client.Dump(ctx, snapshotID, filePath, pw)
+		pw.CloseWithError(err)
+		dumpErr <- err
+	}()
+
+	err := consume(pr)
+	if err == nil {
+		_, err = io.Copy(io.Discard, pr)
+	} else {
+		cancel()
+	}
+	pr.CloseWithError(err)
+	if dErr := <-dumpErr; err == nil && dErr != nil {
+		err = dErr
+	}
+	return err
+}
@@ -0,0 +1,124 @@
+package restic
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// recordingClient serves a fixed set of snapshots and records the IDs
+// passed to the operations reading or deleting them
+type recordingClient struct {
+	Client
+	snapshots []*Snapshot
+	ids       []string
+}
+
+func (c *recordingClient) FindSnapshots(_ context.Context, tags []string) ([]*Snapshot, error) {
+	var found []*Snapshot
+	for _, snapshot := range c.snapshots {
+		if hasTags(snapshot, tags) {
+			found = append(found, snapshot)
+		}
+	}
+	return found, nil
+}
+
+func (c *recordingClient) Restore(_ context.Context, snapshotID, _ string, _ RestoreOptions) error {
+	c.ids = append(c.ids, snapshotID)
+	return nil
+}
+
+func (c *recordingClient) Dump(_ context.Context, snapshotID, _ string, _ io.Writer) error {
+	c.ids = append(c.ids, snapshotID)
+	return nil
+}
+
+func (c *recordingClient) DeleteSnapshots(_ context.Context, snapshotIDs []string) error {
+	c.ids = append(c.ids, snapshotIDs...)
+	return nil
+}
+
+func hasTags(snapshot *Snapshot, tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range snapshot.Tags {
+			found = found || t == tag
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func TestWithTags_ScopesSnapshotIDs(t *testing.T) {
+	inner := &recordingClient{snapshots: []*Snapshot{
+		{ID: "aaa111", Tags: []string{"cluster:a"}},
+		{ID: "aaa222", Tags: []string{"cluster:a"}},
+		{ID: "bbb111", Tags: []string{"cluster:b"}},
+	}}
+	client := WithTags(inner, "cluster:a")
+	ctx := context.Background()
+
+	if err := client.Restore(ctx, "aaa1", "/restore", RestoreOptions{}); err != nil {
+		t.Fatalf("Restore() of own snapshot error = %v", err)
+	}
+	if err := client.Restore(ctx, "bbb111", "/restore", RestoreOptions{}); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("Restore() of other tenant's snapshot error = %v, want not found", err)
+	}
+	if err := client.Dump(ctx, "aaa", "/base.tar", io.Discard); !errors.Is(err, ErrSnapshotAmbiguous) {
+		t.Errorf("Dump() of ambiguous prefix error = %v, want ambiguous", err)
+	}
+	if err := client.DeleteSnapshots(ctx, []string{"aaa222", "bbb111"}); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("DeleteSnapshots() including other tenant's snapshot error = %v, want not found", err)
+	}
+
+	// Only the own snapshot reached the repository, by its full ID
+	if want := []string{"aaa111"}; !reflect.DeepEqual(inner.ids, want) {
+		t.Errorf("IDs passed on = %v, want %v", inner.ids, want)
+	}
+}
+
+func TestFindByID(t *testing.T) {
+	snapshots := []*Snapshot{
+		{ID: "aaa111"},
+		{ID: "aaa222"},
+		{ID: "aaa2ff"},
+		{ID: "aaa2"},
+		{ID: "bbb111"},
+	}
+
+	tests := []struct {
+		id      string
+		want    string
+		wantErr error
+	}{
+		{id: "bbb111", want: "bbb111"},
+		{id: "bbb", want: "bbb111"},
+		{id: "aaa1", want: "aaa111"},
+		{id: "aaa22", want: "aaa222"},
+		// An exact match wins over longer IDs sharing it as prefix
+		{id: "aaa2", want: "aaa2"},
+		{id: "aaa", wantErr: ErrSnapshotAmbiguous},
+		{id: "ccc", wantErr: ErrSnapshotNotFound},
+		{id: "", wantErr: ErrSnapshotNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			got, err := FindByID(snapshots, tt.id)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("FindByID() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got.ID != tt.want {
+				t.Errorf("FindByID() = %v, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}
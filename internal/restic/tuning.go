@@ -0,0 +1,104 @@
+package restic
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// UploadOptions tunes how backups write to the repository, zero values keep
+// the restic defaults
+type UploadOptions struct {
+	// LimitUpload caps the upload rate in KiB/s
+	LimitUpload int `json:"limitUpload,omitempty"`
+	// ReadConcurrency is the number of files read at once
+	ReadConcurrency int `json:"readConcurrency,omitempty"`
+	// PackSize is the target size of new pack files in MiB
+	PackSize int `json:"packSize,omitempty"`
+}
+
+// Validate checks the upload options
+func (o UploadOptions) Validate() error {
+	if o.LimitUpload < 0 || o.ReadConcurrency < 0 || o.PackSize < 0 {
+		return fmt.Errorf("limitUpload, readConcurrency and packSize must not be negative")
+	}
+	if o.PackSize > 128 {
+		return fmt.Errorf("packSize must be at most 128 MiB")
+	}
+	return nil
+}
+
+// Merge returns o with the fields set in override replacing its own
+func (o UploadOptions) Merge(override UploadOptions) UploadOptions {
+	if override.LimitUpload != 0 {
+		o.LimitUpload = override.LimitUpload
+	}
+	if override.ReadConcurrency != 0 {
+		o.ReadConcurrency = override.ReadConcurrency
+	}
+	if override.PackSize != 0 {
+		o.PackSize = override.PackSize
+	}
+	return o
+}
+
+// args returns the restic backup flags of the options
+func (o UploadOptions) args() []string {
+	var args []string
+	if o.LimitUpload > 0 {
+		args = append(args, "--limit-upload", strconv.Itoa(o.LimitUpload))
+	}
+	if o.ReadConcurrency > 0 {
+		args = append(args, "--read-concurrency", strconv.Itoa(o.ReadConcurrency))
+	}
+	if o.PackSize > 0 {
+		args = append(args, "--pack-size", strconv.Itoa(o.PackSize))
+	}
+	return args
+}
+
+// RestoreOptions tunes how restores read from the repository, zero values
+// keep the restic defaults
+type RestoreOptions struct {
+	// Connections is the number of backend connections, which bounds the
+	// pack files downloaded in parallel
+	Connections int `json:"connections,omitempty"`
+	// LimitDownload caps the download rate in KiB/s
+	LimitDownload int `json:"limitDownload,omitempty"`
+	// CacheDir is the restic cache directory, restic's own default if empty
+	CacheDir string `json:"cacheDir,omitempty"`
+	// Verify reads the restored files back and checks their contents
+	Verify bool `json:"verify,omitempty"`
+	// Sparse restores runs of zeros as holes, saving space on file systems
+	// supporting them
+	Sparse bool `json:"sparse,omitempty"`
+}
+
+// Validate checks the restore options
+func (o RestoreOptions) Validate() error {
+	if o.Connections < 0 || o.LimitDownload < 0 {
+		return fmt.Errorf("connections and limitDownload must not be negative")
+	}
+	return nil
+}
+
+// args returns the restic restore flags of the options for a repository on
+// backend
+func (o RestoreOptions) args(backend Backend) []string {
+	var args []string
+	if o.Connections > 0 {
+		args = append(args, "-o", fmt.Sprintf("%s.connections=%d", backend, o.Connections))
+	}
+	if o.LimitDownload > 0 {
+		args = append(args, "--limit-download", strconv.Itoa(o.LimitDownload))
+	}
+	if o.CacheDir != "" {
+		args = append(args, "--cache-dir", o.CacheDir)
+	}
+	if o.Verify {
+		args = append(args, "--verify")
+	}
+	if o.Sparse {
+		args = append(args, "--sparse")
+	}
+	return args
+}
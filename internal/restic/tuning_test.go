@@ -0,0 +1,38 @@
+package restic
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUploadOptions(t *testing.T) {
+	opts := UploadOptions{LimitUpload: 1024, ReadConcurrency: 4}.Merge(UploadOptions{ReadConcurrency: 8, PackSize: 64})
+	want := []string{"--limit-upload", "1024", "--read-concurrency", "8", "--pack-size", "64"}
+	if got := opts.args(); !reflect.DeepEqual(got, want) {
+		t.Errorf("args() = %v, want %v", got, want)
+	}
+	if got := (UploadOptions{}).args(); len(got) != 0 {
+		t.Errorf("args() of defaults = %v, want none", got)
+	}
+
+	for _, invalid := range []UploadOptions{{LimitUpload: -1}, {PackSize: 129}} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("Validate() of %+v should fail", invalid)
+		}
+	}
+}
+
+func TestRestoreOptions(t *testing.T) {
+	opts := RestoreOptions{Connections: 16, LimitDownload: 2048, CacheDir: "/cache", Verify: true, Sparse: true}
+	want := []string{"-o", "s3.connections=16", "--limit-download", "2048", "--cache-dir", "/cache", "--verify", "--sparse"}
+	if got := opts.args(BackendS3); !reflect.DeepEqual(got, want) {
+		t.Errorf("args() = %v, want %v", got, want)
+	}
+	if got := (RestoreOptions{}).args(BackendS3); len(got) != 0 {
+		t.Errorf("args() of defaults = %v, want none", got)
+	}
+
+	if err := (RestoreOptions{LimitDownload: -1}).Validate(); err == nil {
+		t.Error("Validate() of negative limit should fail")
+	}
+}
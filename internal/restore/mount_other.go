@@ -0,0 +1,8 @@
+//go:build !unix
+
+package restore
+
+// isMountPoint reports no mount points, they are only detected on Unix
+func isMountPoint(string) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package restore
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// isMountPoint reports whether dir is on another device than its parent.
+// Bind mounts of the same file system go unnoticed.
+func isMountPoint(dir string) (bool, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return false, err
+	}
+	parent, err := os.Stat(filepath.Dir(filepath.Clean(dir)))
+	if err != nil {
+		return false, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	parentStat, parentOK := parent.Sys().(*syscall.Stat_t)
+	if !ok || !parentOK {
+		return false, nil
+	}
+	return stat.Dev != parentStat.Dev || stat.Ino == parentStat.Ino, nil
+}
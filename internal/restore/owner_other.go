@@ -0,0 +1,10 @@
+//go:build !unix
+
+package restore
+
+import "io/fs"
+
+// fileOwner reports no owner, file ownership is only kept on Unix
+func fileOwner(fs.FileInfo) (owner, bool) {
+	return owner{}, false
+}
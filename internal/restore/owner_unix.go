@@ -0,0 +1,17 @@
+//go:build unix
+
+package restore
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileOwner returns the owner of a file
+func fileOwner(info fs.FileInfo) (owner, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return owner{}, false
+	}
+	return owner{uid: int(stat.Uid), gid: int(stat.Gid)}, true
+}
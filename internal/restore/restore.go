@@ -3,41 +3,66 @@ package restore
 import (
 	"context"
 	"fmt"
+	"os"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+
+	"cloud-native-pg-restic-backup/internal/basebackup"
 	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/metrics"
+	"cloud-native-pg-restic-backup/internal/pgdata"
 	"cloud-native-pg-restic-backup/internal/restic"
+	"cloud-native-pg-restic-backup/internal/tracing"
 	"cloud-native-pg-restic-backup/internal/wal"
 )
 
 // Handler interface defines the operations for restore handling
 type Handler interface {
-	RestoreBackup(ctx context.Context, snapshotID, targetDir string) error
-	RestoreWAL(ctx context.Context, walFile, targetPath string) error
+	RestoreBackup(ctx context.Context, snapshotID, targetDir string, opts Options) error
+	RestoreWAL(ctx context.Context, walFile, targetPath, dataDir string) error
+}
+
+// Options adjusts a restore
+type Options struct {
+	// TablespaceMapping relocates tablespaces, keyed by OID or original
+	// location. Other tablespaces are restored below the target directory.
+	TablespaceMapping map[string]string
+	// Restic tunes how restic restores filesystem backups, streamed ones
+	// are read with restic dump
+	Restic restic.RestoreOptions
+	// Overwrite replaces the contents of a non-empty target directory,
+	// which is refused otherwise
+	Overwrite bool
+	// Stage restores into a directory next to the target first, which then
+	// takes the place of the target. A failed restore leaves the target as
+	// it was.
+	Stage bool
 }
 
 // handlerImpl implements the Handler interface
 type handlerImpl struct {
 	client     restic.Client
 	walManager *wal.Manager
+	stream     basebackup.Config
 	logger     *logging.Logger
 }
 
-// NewHandler creates a new restore handler
-func NewHandler(client restic.Client) Handler {
-	logger := logging.NewLogger(logging.Config{
-		Level:      "info",
-		JSONOutput: false,
-	}).Component("restore")
+// NewHandler creates a new restore handler. stream configures the
+// pg_combinebackup restores of incremental backups run.
+func NewHandler(client restic.Client, stream basebackup.Config, logger *logging.Logger) Handler {
+	logger = logger.Component("restore")
 
 	return &handlerImpl{
 		client:     client,
 		walManager: wal.NewManager(client, logger),
+		stream:     stream,
 		logger:     logger,
 	}
 }
 
 // RestoreBackup restores a full backup to the specified directory
-func (h *handlerImpl) RestoreBackup(ctx context.Context, snapshotID, targetDir string) error {
+func (h *handlerImpl) RestoreBackup(ctx context.Context, snapshotID, targetDir string, opts Options) (err error) {
 	if h.client == nil {
 		return fmt.Errorf("client not initialized")
 	}
@@ -50,23 +75,175 @@ func (h *handlerImpl) RestoreBackup(ctx context.Context, snapshotID, targetDir s
 		return fmt.Errorf("target directory not specified")
 	}
 
-	logger := h.logger.Operation("restore_backup").WithFields(map[string]interface{}{
+	logger := h.logger.Context(ctx).Operation("restore_backup").WithFields(map[string]interface{}{
 		"snapshot_id": snapshotID,
-		"target_dir": targetDir,
+		"target_dir":  targetDir,
 	})
 	logger.Info().Msg("Starting backup restore")
 
-	if err := h.client.Restore(ctx, snapshotID, targetDir); err != nil {
+	ctx, span := tracing.Start(ctx, "restore.RestoreBackup",
+		attribute.String("snapshot_id", snapshotID),
+		attribute.String("target_dir", targetDir),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	// Only snapshots of the tenant are found, which keeps restores from
+	// reading those of others sharing the repository. The snapshot records
+	// the tablespaces backed up with the data directory.
+	snapshot, err := h.findSnapshot(ctx, snapshotID)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to find snapshot")
+		return err
+	}
+	tablespaces := pgdata.ParseTablespaceTags(snapshot.Tags)
+	if len(opts.TablespaceMapping) > 0 {
+		if err := validateMapping(tablespaces, opts.TablespaceMapping); err != nil {
+			return err
+		}
+	}
+
+	// A staged restore interrupted by a crash leaves the previous target
+	// moved aside or a staging directory behind
+	if recovered, err := recoverSwap(targetDir); err != nil {
+		logger.Error().Err(err).Msg("Failed to recover interrupted staged restore")
+		return fmt.Errorf("failed to recover interrupted staged restore: %v", err)
+	} else if recovered {
+		logger.Warn().Msg("Recovered interrupted staged restore")
+	}
+
+	if err := checkTarget(targetDir, restoredDataDir(snapshot, tablespaces, targetDir), opts.Overwrite); err != nil {
+		logger.Warn().Err(err).Msg("Refusing to restore into target directory")
+		return err
+	}
+	if opts.Stage {
+		if err := checkStage(targetDir); err != nil {
+			logger.Warn().Err(err).Msg("Refusing to stage restore")
+			return err
+		}
+	}
+	owner, chown := targetOwner(targetDir)
+
+	restoreDir := targetDir
+	if opts.Stage {
+		if restoreDir, err = stageDir(targetDir); err != nil {
+			logger.Error().Err(err).Msg("Failed to stage restore")
+			return fmt.Errorf("failed to stage restore: %v", err)
+		}
+		// Whatever the restore left next to the target is removed
+		defer func() {
+			if _, err := recoverSwap(targetDir); err != nil {
+				logger.Error().Err(err).Msg("Failed to clean up staged restore")
+			}
+		}()
+	} else if opts.Overwrite {
+		if err := pgdata.ClearDir(targetDir); err != nil {
+			logger.Error().Err(err).Msg("Failed to clear target directory")
+			return fmt.Errorf("failed to clear target directory: %v", err)
+		}
+	}
+
+	started := time.Now()
+	if basebackup.IsStreamed(snapshot) {
+		err = basebackup.RestoreSnapshot(ctx, h.client, h.stream, snapshot, restoreDir)
+	} else {
+		err = h.client.Restore(ctx, snapshot.ID, restoreDir, opts.Restic)
+	}
+	metrics.ObserveRestore(ctx, time.Since(started), err)
+	if err != nil {
 		logger.Error().Err(err).Msg("Backup restore failed")
 		return fmt.Errorf("failed to restore backup: %v", err)
 	}
 
+	// A staged restore is completed in the staging directory, tablespaces
+	// are linked to their final locations below targetDir
+	dataDir := restoredDataDir(snapshot, tablespaces, restoreDir)
+	if pgdata.IsDataDir(dataDir) {
+		// Base backups leave out the contents of these directories, the
+		// server needs them to exist
+		if err := pgdata.CreatePlaceholderDirs(dataDir); err != nil {
+			logger.Error().Err(err).Msg("Failed to recreate excluded directories")
+			return fmt.Errorf("failed to recreate excluded directories: %v", err)
+		}
+
+		// Streamed backups carry their label and manifest, those of a
+		// filesystem backup are stored next to it. Without its label, the
+		// server can't recover a coordinated backup.
+		if snapshot != nil && !basebackup.IsStreamed(snapshot) {
+			if _, err := basebackup.RestoreLabel(ctx, h.client, snapshot.SourceID(), dataDir); err != nil {
+				logger.Error().Err(err).Msg("Failed to restore backup label")
+				return fmt.Errorf("failed to restore backup label: %v", err)
+			}
+			if _, err := basebackup.RestoreManifest(ctx, h.client, snapshot.SourceID(), dataDir); err != nil {
+				logger.Warn().Err(err).Msg("Backup manifest not restored")
+			}
+		}
+
+		// The server refuses to start on a data directory others can read
+		if err := os.Chmod(dataDir, 0700); err != nil {
+			logger.Error().Err(err).Msg("Failed to set data directory permissions")
+			return fmt.Errorf("failed to set data directory permissions: %v", err)
+		}
+
+		// Relocated tablespaces leave the restore last, so that nothing
+		// fails once they are moved
+		if err := restoreTablespaces(dataDir, restoreDir, targetDir, tablespaces, opts.TablespaceMapping); err != nil {
+			logger.Error().Err(err).Msg("Failed to restore tablespaces")
+			return fmt.Errorf("failed to restore tablespaces: %v", err)
+		}
+		if len(tablespaces) > 0 {
+			logger.Info().Int("tablespaces", len(tablespaces)).Msg("Restored tablespaces")
+		}
+	}
+
+	if chown {
+		dirs := []string{restoreDir}
+		for _, location := range opts.TablespaceMapping {
+			dirs = append(dirs, location)
+		}
+		for _, dir := range dirs {
+			if err := chownTree(dir, owner); err != nil {
+				logger.Error().Err(err).Msg("Failed to change owner of restored files")
+				return fmt.Errorf("failed to change owner of restored files: %v", err)
+			}
+		}
+		logger.Info().Int("uid", owner.uid).Int("gid", owner.gid).Msg("Changed owner of restored files")
+	}
+
+	// The previous target is removed along with the staging directory once
+	// the staged restore has taken its place
+	if opts.Stage {
+		if err := swapDir(restoreDir, targetDir); err != nil {
+			logger.Error().Err(err).Msg("Failed to swap in staged restore")
+			return fmt.Errorf("failed to swap in staged restore: %v", err)
+		}
+	}
+
 	logger.Info().Msg("Backup restore completed successfully")
 	return nil
 }
 
-// RestoreWAL restores a WAL segment for PITR
-func (h *handlerImpl) RestoreWAL(ctx context.Context, walFile, targetPath string) error {
+// findSnapshot returns the snapshot with the given ID or ID prefix, which
+// must name a single snapshot
+func (h *handlerImpl) findSnapshot(ctx context.Context, snapshotID string) (*restic.Snapshot, error) {
+	snapshots, err := h.client.FindSnapshots(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	return restic.FindByID(snapshots, snapshotID)
+}
+
+// restoredDataDir returns where a snapshot restored into targetDir placed
+// its data directory
+func restoredDataDir(snapshot *restic.Snapshot, tablespaces []pgdata.Tablespace, targetDir string) string {
+	if snapshot == nil {
+		return targetDir
+	}
+	return pgdata.RestoredDataDir(targetDir, snapshot.Paths, tablespaces)
+}
+
+// RestoreWAL restores a WAL segment for PITR, archived by the instance
+// owning dataDir
+func (h *handlerImpl) RestoreWAL(ctx context.Context, walFile, targetPath, dataDir string) (err error) {
 	if h.client == nil {
 		return fmt.Errorf("client not initialized")
 	}
@@ -79,13 +256,32 @@ func (h *handlerImpl) RestoreWAL(ctx context.Context, walFile, targetPath string
 		return fmt.Errorf("target path not specified")
 	}
 
-	logger := h.logger.Operation("restore_wal").WithFields(map[string]interface{}{
-		"wal_file": walFile,
+	if dataDir == "" {
+		return fmt.Errorf("data directory not specified")
+	}
+
+	logger := h.logger.Context(ctx).Operation("restore_wal").WithFields(map[string]interface{}{
+		"wal_file":    walFile,
 		"target_path": targetPath,
+		"data_dir":    dataDir,
 	})
 	logger.Info().Msg("Starting WAL restore")
 
-	if err := h.walManager.RestoreWALSegment(ctx, walFile, targetPath); err != nil {
+	ctx, span := tracing.Start(ctx, "restore.RestoreWAL",
+		attribute.String("wal_file", walFile),
+		attribute.String("target_path", targetPath),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	// During recovery pg_control of the data directory identifies the
+	// instance the segment must belong to
+	instanceTags, err := pgdata.RequireInstanceTags(dataDir)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to read instance metadata")
+		return fmt.Errorf("failed to read instance metadata: %v", err)
+	}
+
+	if err := h.walManager.RestoreWALSegment(ctx, walFile, targetPath, instanceTags); err != nil {
 		logger.Error().Err(err).Msg("WAL restore failed")
 		return fmt.Errorf("failed to restore WAL segment: %v", err)
 	}
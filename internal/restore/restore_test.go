@@ -1,35 +1,71 @@
 package restore
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 
+	"cloud-native-pg-restic-backup/internal/basebackup"
 	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/replication"
 	"cloud-native-pg-restic-backup/internal/restic"
 	"cloud-native-pg-restic-backup/internal/wal"
 )
 
 // mockResticClient implements the restic.Client interface for testing
 type mockResticClient struct {
-	restoreErr    error
+	restoreErr     error
 	restoreFileErr error
-	snapshots     []*restic.Snapshot
-	restored      bool
-	restoredFile  string
+	snapshots      []*restic.Snapshot
+	foundTags      []string
+	restored       bool
+	restoredID     string
+	restoredFile   string
+	restoreOptions restic.RestoreOptions
+	// restoreTo writes what restic would restore into the target
+	restoreTo func(targetPath string) error
+	// dump is the content of the file dumped from snapshots
+	dump    []byte
+	dumpErr error
 }
 
 func (m *mockResticClient) InitRepository(_ context.Context) error {
 	return nil
 }
 
-func (m *mockResticClient) Backup(_ context.Context, _ string, _ []string) error {
-	return nil
+func (m *mockResticClient) Backup(_ context.Context, _ string, _ []string, _ restic.BackupOptions) (*restic.BackupSummary, error) {
+	return &restic.BackupSummary{}, nil
+}
+
+func (m *mockResticClient) BackupStdin(_ context.Context, _ string, _ []string, _ io.Reader) (*restic.BackupSummary, error) {
+	return &restic.BackupSummary{}, nil
+}
+
+func (m *mockResticClient) Dump(_ context.Context, _, _ string, w io.Writer) error {
+	m.restored = true
+	if m.dumpErr != nil {
+		return m.dumpErr
+	}
+	_, err := w.Write(m.dump)
+	return err
 }
 
-func (m *mockResticClient) Restore(_ context.Context, _, _ string) error {
+func (m *mockResticClient) Restore(_ context.Context, snapshotID, targetPath string, opts restic.RestoreOptions) error {
 	m.restored = true
+	m.restoredID = snapshotID
+	m.restoreOptions = opts
+	if m.restoreTo != nil && m.restoreErr == nil {
+		return m.restoreTo(targetPath)
+	}
 	return m.restoreErr
 }
 
@@ -38,7 +74,8 @@ func (m *mockResticClient) RestoreFile(_ context.Context, _, file, _ string) err
 	return m.restoreFileErr
 }
 
-func (m *mockResticClient) FindSnapshots(_ context.Context, _ []string) ([]*restic.Snapshot, error) {
+func (m *mockResticClient) FindSnapshots(_ context.Context, tags []string) ([]*restic.Snapshot, error) {
+	m.foundTags = tags
 	return m.snapshots, nil
 }
 
@@ -50,13 +87,25 @@ func (m *mockResticClient) EnsureDirectory(_ context.Context, _ string) error {
 	return nil
 }
 
+func (m *mockResticClient) Copy(_ context.Context, _ restic.Config, _ []string) error {
+	return nil
+}
+
+func (m *mockResticClient) Check(_ context.Context, _ restic.CheckOptions) (*restic.CheckResult, error) {
+	return &restic.CheckResult{OK: true}, nil
+}
+
+func (m *mockResticClient) Locks(_ context.Context) ([]*restic.Lock, error) {
+	return nil, nil
+}
+
 func newMockResticClient() *mockResticClient {
 	return &mockResticClient{
 		snapshots: []*restic.Snapshot{
 			{
 				ID:   "test-snapshot-1",
 				Time: time.Now(),
-				Tags: []string{"type:wal", "000000010000000000000001"},
+				Tags: []string{"type:wal", "wal_file:000000010000000000000001"},
 			},
 		},
 	}
@@ -95,6 +144,13 @@ func TestRestoreBackup(t *testing.T) {
 			wantErr:     true,
 			wantRestore: false,
 		},
+		{
+			name:        "snapshot out of scope",
+			snapshotID:  "other-tenant-snapshot",
+			targetDir:   "/restore",
+			wantErr:     true,
+			wantRestore: false,
+		},
 		{
 			name:        "empty target directory",
 			snapshotID:  "test-snapshot-1",
@@ -125,7 +181,7 @@ func TestRestoreBackup(t *testing.T) {
 			}
 
 			// Execute restore
-			err := handler.RestoreBackup(context.Background(), tt.snapshotID, tt.targetDir)
+			err := handler.RestoreBackup(context.Background(), tt.snapshotID, tt.targetDir, Options{})
 
 			// Verify results
 			if (err != nil) != tt.wantErr {
@@ -141,41 +197,608 @@ func TestRestoreBackup(t *testing.T) {
 	}
 }
 
+func TestRestoreBackup_SnapshotID(t *testing.T) {
+	tests := []struct {
+		name       string
+		snapshotID string
+		wantErr    error
+		wantID     string
+	}{
+		{name: "full ID", snapshotID: "4fa1b2c3d4e5", wantID: "4fa1b2c3d4e5"},
+		{name: "unique prefix", snapshotID: "4fa1b", wantID: "4fa1b2c3d4e5"},
+		{name: "ambiguous prefix", snapshotID: "4fa1", wantErr: restic.ErrSnapshotAmbiguous},
+		{name: "unknown ID", snapshotID: "5ab", wantErr: restic.ErrSnapshotNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := newMockResticClient()
+			mockClient.snapshots = append(mockClient.snapshots,
+				&restic.Snapshot{ID: "4fa1b2c3d4e5", Tags: []string{"type:full"}},
+				&restic.Snapshot{ID: "4fa1c9d8e7f6", Tags: []string{"type:full"}},
+			)
+			logger := logging.NewLogger(logging.Config{Level: "info"})
+			handler := &handlerImpl{client: mockClient, walManager: wal.NewManager(mockClient, logger), logger: logger}
+
+			err := handler.RestoreBackup(context.Background(), tt.snapshotID, t.TempDir(), Options{})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) || mockClient.restored {
+					t.Errorf("RestoreBackup() error = %v, restored = %v, want %v", err, mockClient.restored, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RestoreBackup() error = %v", err)
+			}
+			if mockClient.restoredID != tt.wantID {
+				t.Errorf("restored %q, want %q", mockClient.restoredID, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestRestoreBackup_PlaceholderDirs(t *testing.T) {
+	target := t.TempDir()
+	dataDir := filepath.Join(target, "var/lib/postgresql/data")
+
+	mockClient := newMockResticClient()
+	// Simulate restic recreating the backed up path below the target
+	mockClient.restoreTo = func(target string) error {
+		dataDir := filepath.Join(target, "var/lib/postgresql/data")
+		if err := os.MkdirAll(dataDir, 0700); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dataDir, "PG_VERSION"), []byte("16\n"), 0600)
+	}
+	mockClient.snapshots = append(mockClient.snapshots, &restic.Snapshot{
+		ID:    "4fa1b2c3d4e5",
+		Tags:  []string{"type:full"},
+		Paths: []string{"/var/lib/postgresql/data"},
+	})
+	logger := logging.NewLogger(logging.Config{Level: "info"})
+	handler := &handlerImpl{
+		client:     mockClient,
+		walManager: wal.NewManager(mockClient, logger),
+		logger:     logger,
+	}
+
+	if err := handler.RestoreBackup(context.Background(), "4fa1b2c3", target, Options{}); err != nil {
+		t.Fatalf("RestoreBackup() error = %v", err)
+	}
+	for _, dir := range []string{"pg_wal/archive_status", "pg_replslot", "pg_stat_tmp", "pg_subtrans"} {
+		if info, err := os.Stat(filepath.Join(dataDir, dir)); err != nil || !info.IsDir() {
+			t.Errorf("%s not recreated: %v", dir, err)
+		}
+	}
+}
+
+func TestRestoreBackup_Tablespaces(t *testing.T) {
+	target := t.TempDir()
+	dataDir := filepath.Join(target, "var/lib/postgresql/data")
+
+	mockClient := newMockResticClient()
+	// Simulate restic restoring the data directory and a tablespace
+	mockClient.restoreTo = func(target string) error {
+		dataDir := filepath.Join(target, "var/lib/postgresql/data")
+		restoredTablespace := filepath.Join(target, "mnt/ts1")
+		for _, dir := range []string{filepath.Join(dataDir, "pg_tblspc"), restoredTablespace} {
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return err
+			}
+		}
+		if err := os.WriteFile(filepath.Join(dataDir, "PG_VERSION"), []byte("16\n"), 0600); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dataDir, "tablespace_map"), []byte("16385 /mnt/ts1\n"), 0600); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(restoredTablespace, "PG_16_202307071"), nil, 0600); err != nil {
+			return err
+		}
+		return os.Symlink("/mnt/ts1", filepath.Join(dataDir, "pg_tblspc", "16385"))
+	}
+	mockClient.snapshots = append(mockClient.snapshots, &restic.Snapshot{
+		ID:    "4fa1b2c3d4e5",
+		Tags:  []string{"type:full", "tablespace:16385:/mnt/ts1"},
+		Paths: []string{"/mnt/ts1", "/var/lib/postgresql/data"},
+	})
+	logger := logging.NewLogger(logging.Config{Level: "info"})
+	handler := &handlerImpl{
+		client:     mockClient,
+		walManager: wal.NewManager(mockClient, logger),
+		logger:     logger,
+	}
+
+	// Unknown tablespaces are rejected before restoring
+	err := handler.RestoreBackup(context.Background(), "4fa1b2c3", target, Options{
+		TablespaceMapping: map[string]string{"16999": "/elsewhere"},
+	})
+	if err == nil || mockClient.restored {
+		t.Fatalf("RestoreBackup() with unknown tablespace error = %v, restored = %v", err, mockClient.restored)
+	}
+
+	relocated := filepath.Join(t.TempDir(), "ts1")
+	err = handler.RestoreBackup(context.Background(), "4fa1b2c3", target, Options{
+		TablespaceMapping: map[string]string{"/mnt/ts1": relocated},
+	})
+	if err != nil {
+		t.Fatalf("RestoreBackup() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(relocated, "PG_16_202307071")); err != nil {
+		t.Errorf("tablespace not moved: %v", err)
+	}
+	if link, err := os.Readlink(filepath.Join(dataDir, "pg_tblspc", "16385")); err != nil || link != relocated {
+		t.Errorf("pg_tblspc/16385 -> %q, %v, want %q", link, err, relocated)
+	}
+	if data, err := os.ReadFile(filepath.Join(dataDir, "tablespace_map")); err != nil || string(data) != "16385 "+relocated+"\n" {
+		t.Errorf("tablespace_map = %q, %v", data, err)
+	}
+
+	// Staged tablespaces are linked to where the staging directory ends up
+	inPlace := filepath.Join(target, "mnt/ts1")
+	if err := handler.RestoreBackup(context.Background(), "4fa1b2c3", target, Options{Overwrite: true, Stage: true}); err != nil {
+		t.Fatalf("staged RestoreBackup() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(inPlace, "PG_16_202307071")); err != nil {
+		t.Errorf("tablespace not restored: %v", err)
+	}
+	if link, err := os.Readlink(filepath.Join(dataDir, "pg_tblspc", "16385")); err != nil || link != inPlace {
+		t.Errorf("pg_tblspc/16385 -> %q, %v, want %q", link, err, inPlace)
+	}
+	if data, err := os.ReadFile(filepath.Join(dataDir, "tablespace_map")); err != nil || string(data) != "16385 "+inPlace+"\n" {
+		t.Errorf("tablespace_map = %q, %v", data, err)
+	}
+}
+
+func TestRestoreBackup_Target(t *testing.T) {
+	newHandler := func(restoreErr, dumpErr error) (*handlerImpl, *mockResticClient) {
+		mockClient := newMockResticClient()
+		mockClient.restoreErr = restoreErr
+		mockClient.dumpErr = dumpErr
+		mockClient.snapshots = append(mockClient.snapshots, &restic.Snapshot{
+			ID:    "4fa1b2c3d4e5",
+			Tags:  []string{"type:full"},
+			Paths: []string{"/pgdata"},
+		})
+		mockClient.restoreTo = func(target string) error {
+			dataDir := filepath.Join(target, "pgdata")
+			if err := os.MkdirAll(dataDir, 0750); err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(dataDir, "PG_VERSION"), []byte("17\n"), 0600)
+		}
+		logger := logging.NewLogger(logging.Config{Level: "info"})
+		return &handlerImpl{client: mockClient, walManager: wal.NewManager(mockClient, logger), logger: logger}, mockClient
+	}
+	// existing returns a target holding a file of a previous data directory
+	existing := func(t *testing.T, files ...string) string {
+		target := filepath.Join(t.TempDir(), "restore")
+		for _, file := range append([]string{"pgdata/PG_VERSION"}, files...) {
+			if err := os.MkdirAll(filepath.Dir(filepath.Join(target, file)), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(target, file), []byte("16\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return target
+	}
+	version := func(target string) string {
+		data, _ := os.ReadFile(filepath.Join(target, "pgdata", "PG_VERSION"))
+		return string(data)
+	}
+
+	tests := []struct {
+		name        string
+		files       []string
+		opts        Options
+		restoreErr  error
+		dumpErr     error
+		wantErr     error
+		wantVersion string
+	}{
+		{
+			name:        "non-empty target",
+			wantErr:     ErrTargetNotEmpty,
+			wantVersion: "16\n",
+		},
+		{
+			name:        "overwrite",
+			files:       []string{"stray"},
+			opts:        Options{Overwrite: true},
+			wantVersion: "17\n",
+		},
+		{
+			name:        "staged overwrite",
+			files:       []string{"stray"},
+			opts:        Options{Overwrite: true, Stage: true},
+			wantVersion: "17\n",
+		},
+		{
+			name:        "failed staged overwrite",
+			opts:        Options{Overwrite: true, Stage: true},
+			restoreErr:  fmt.Errorf("restic failed"),
+			wantVersion: "16\n",
+		},
+		{
+			name:        "staged overwrite without its label",
+			opts:        Options{Overwrite: true, Stage: true},
+			dumpErr:     fmt.Errorf("label not readable"),
+			wantVersion: "16\n",
+		},
+		{
+			name:        "running server",
+			files:       []string{"pgdata/postmaster.pid"},
+			opts:        Options{Overwrite: true},
+			wantErr:     ErrServerRunning,
+			wantVersion: "16\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mockClient := newHandler(tt.restoreErr, tt.dumpErr)
+			target := existing(t, tt.files...)
+
+			err := handler.RestoreBackup(context.Background(), "4fa1b2c3", target, tt.opts)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) || mockClient.restored {
+					t.Errorf("RestoreBackup() error = %v, restored = %v, want %v", err, mockClient.restored, tt.wantErr)
+				}
+			} else if (err != nil) != (tt.restoreErr != nil || tt.dumpErr != nil) {
+				t.Fatalf("RestoreBackup() error = %v", err)
+			}
+			if got := version(target); got != tt.wantVersion {
+				t.Errorf("PG_VERSION = %q, want %q", got, tt.wantVersion)
+			}
+			if tt.wantVersion == "17\n" {
+				if _, err := os.Stat(filepath.Join(target, "stray")); !os.IsNotExist(err) {
+					t.Errorf("previous contents kept: %v", err)
+				}
+				if info, err := os.Stat(filepath.Join(target, "pgdata")); err != nil || info.Mode().Perm() != 0700 {
+					t.Errorf("data directory mode = %v, %v, want 0700", info.Mode().Perm(), err)
+				}
+			}
+			// Nothing is left next to the target
+			if entries, _ := os.ReadDir(filepath.Dir(target)); len(entries) != 1 {
+				t.Errorf("parent of target holds %d entries, want 1", len(entries))
+			}
+		})
+	}
+}
+
+func TestRecoverSwap(t *testing.T) {
+	tests := []struct {
+		name string
+		// dirs exist next to the target besides the marker, named by
+		// what they hold
+		target, staged, old bool
+		wantVersion         string
+	}{
+		{name: "crash while restoring", target: true, staged: true, wantVersion: "previous"},
+		{name: "crash after moving the target aside", staged: true, old: true, wantVersion: "previous"},
+		{name: "crash after swapping", target: true, old: true, wantVersion: "restored"},
+		{name: "crash while restoring into a new target", staged: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := filepath.Join(t.TempDir(), "restore")
+			staged, err := stageDir(target)
+			if err != nil {
+				t.Fatalf("stageDir() error = %v", err)
+			}
+			write := func(dir, version string) {
+				if err := os.MkdirAll(dir, 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, "PG_VERSION"), []byte(version), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.old {
+				write(staged+".old", "previous")
+			}
+			// The previous contents are only moved aside for the restored
+			// ones to take their place
+			if tt.target && tt.old {
+				write(target, "restored")
+			} else if tt.target {
+				write(target, "previous")
+			}
+			if tt.staged {
+				write(staged, "restored")
+			} else if err := os.Remove(staged); err != nil {
+				t.Fatal(err)
+			}
+
+			recovered, err := recoverSwap(target)
+			if err != nil || !recovered {
+				t.Fatalf("recoverSwap() = %v, %v", recovered, err)
+			}
+			data, _ := os.ReadFile(filepath.Join(target, "PG_VERSION"))
+			if string(data) != tt.wantVersion {
+				t.Errorf("target holds %q, want %q", data, tt.wantVersion)
+			}
+			// Only the target is left
+			want := 0
+			if tt.wantVersion != "" {
+				want = 1
+			}
+			if entries, _ := os.ReadDir(filepath.Dir(target)); len(entries) != want {
+				t.Errorf("parent of target holds %d entries, want %d", len(entries), want)
+			}
+
+			if recovered, err := recoverSwap(target); err != nil || recovered {
+				t.Errorf("recoverSwap() without marker = %v, %v", recovered, err)
+			}
+		})
+	}
+
+	// A marker naming anything but a staging directory is not followed
+	target := filepath.Join(t.TempDir(), "restore")
+	if err := os.WriteFile(swapMarker(target), []byte("../etc\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := recoverSwap(target); err == nil {
+		t.Error("recoverSwap() followed an invalid marker")
+	}
+}
+
+func TestCheckStage(t *testing.T) {
+	if err := checkStage(t.TempDir()); err != nil {
+		t.Errorf("checkStage() of a directory error = %v", err)
+	}
+	if err := checkStage(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Errorf("checkStage() of a missing directory error = %v", err)
+	}
+	if err := checkStage("/"); !errors.Is(err, ErrTargetMountPoint) {
+		t.Errorf("checkStage() of the root error = %v, want %v", err, ErrTargetMountPoint)
+	}
+}
+
+// tarEntry is a regular file of a test tar stream
+type tarEntry struct {
+	name string
+	body string
+}
+
+// streamedBackup returns the tar stream of a streamed base backup
+func streamedBackup(t *testing.T) []byte {
+	t.Helper()
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, entry := range []tarEntry{
+		{name: "PG_VERSION", body: "16\n"},
+		{name: "global/pg_control", body: "control"},
+		{name: "backup_label", body: "START WAL LOCATION: 0/2000028 (file 000000010000000000000002)\n"},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: entry.name, Mode: 0600, Size: int64(len(entry.body)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+func TestRestoreBackup_Streamed(t *testing.T) {
+	mockClient := newMockResticClient()
+	mockClient.dump = streamedBackup(t)
+	mockClient.snapshots = append(mockClient.snapshots, &restic.Snapshot{
+		ID:    "7c0ffee12345",
+		Tags:  []string{"type:full", "format:tar"},
+		Paths: []string{"/base.tar"},
+	})
+	logger := logging.NewLogger(logging.Config{Level: "info"})
+	handler := &handlerImpl{
+		client:     mockClient,
+		walManager: wal.NewManager(mockClient, logger),
+		logger:     logger,
+	}
+
+	target := filepath.Join(t.TempDir(), "pgdata")
+	if err := handler.RestoreBackup(context.Background(), "7c0ffee1", target, Options{}); err != nil {
+		t.Fatalf("RestoreBackup() error = %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(target, "global", "pg_control")); err != nil || string(data) != "control" {
+		t.Errorf("pg_control = %q, %v", data, err)
+	}
+	if info, err := os.Stat(target); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("data directory mode = %v, %v, want 0700", info.Mode().Perm(), err)
+	}
+	if _, err := os.Stat(filepath.Join(target, "pg_wal", "archive_status")); err != nil {
+		t.Errorf("placeholder directories not created: %v", err)
+	}
+}
+
+// repository serves snapshots and their files from memory, as a secondary
+// repository holding copies does
+type repository struct {
+	restic.Client
+	snapshots []*restic.Snapshot
+	// files are the contents of each snapshot by path
+	files    map[string]map[string]string
+	restored []string
+}
+
+func (r *repository) FindSnapshots(_ context.Context, tags []string) ([]*restic.Snapshot, error) {
+	var found []*restic.Snapshot
+	for _, s := range r.snapshots {
+		if !slices.ContainsFunc(tags, func(tag string) bool { return !slices.Contains(s.Tags, tag) }) {
+			found = append(found, s)
+		}
+	}
+	return found, nil
+}
+
+func (r *repository) Restore(_ context.Context, snapshotID, targetPath string, _ restic.RestoreOptions) error {
+	r.restored = append(r.restored, snapshotID)
+	for path, body := range r.files[snapshotID] {
+		file := filepath.Join(targetPath, path)
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, []byte(body), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *repository) Dump(_ context.Context, snapshotID, filePath string, w io.Writer) error {
+	r.restored = append(r.restored, snapshotID)
+	body, ok := r.files[snapshotID][filePath]
+	if !ok {
+		return fmt.Errorf("%s not found in snapshot %s", filePath, snapshotID)
+	}
+	_, err := io.WriteString(w, body)
+	return err
+}
+
+// unreachableRepository fails like a primary whose backend is down
+type unreachableRepository struct {
+	restic.Client
+}
+
+func (unreachableRepository) FindSnapshots(context.Context, []string) ([]*restic.Snapshot, error) {
+	return nil, fmt.Errorf("%w: dial tcp: connection refused", restic.ErrRepositoryUnavailable)
+}
+
+func (unreachableRepository) Restore(context.Context, string, string, restic.RestoreOptions) error {
+	return fmt.Errorf("%w: dial tcp: connection refused", restic.ErrRepositoryUnavailable)
+}
+
+func (unreachableRepository) Dump(context.Context, string, string, io.Writer) error {
+	return fmt.Errorf("%w: dial tcp: connection refused", restic.ErrRepositoryUnavailable)
+}
+
+func TestRestoreBackup_PrimaryUnavailable(t *testing.T) {
+	const label = "START WAL LOCATION: 0/2000028 (file 000000010000000000000002)\n"
+
+	// The secondary holds copies of the backups, taken in the primary as
+	// 4fa1b2c3d4e5 and 7c0ffee12345, and of the label of the first one
+	secondary := &repository{
+		snapshots: []*restic.Snapshot{
+			{ID: "e1e1e1e1e1e1", Original: "4fa1b2c3d4e5", Tags: []string{"type:full"}, Paths: []string{"/pgdata"}},
+			{ID: "e2e2e2e2e2e2", Original: "5d5d5d5d5d5d", Tags: basebackup.LabelTags("4fa1b2c3d4e5")},
+			{ID: "e3e3e3e3e3e3", Original: "7c0ffee12345", Tags: []string{"type:full", basebackup.FormatTag}, Paths: []string{"/" + basebackup.FileName}},
+		},
+		files: map[string]map[string]string{
+			"e1e1e1e1e1e1": {"pgdata/PG_VERSION": "16\n"},
+			"e2e2e2e2e2e2": {"/" + basebackup.LabelFileName: label},
+			"e3e3e3e3e3e3": {"/" + basebackup.FileName: string(streamedBackup(t))},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		snapshotID string
+		dataDir    string
+		wantRead   []string
+	}{
+		{
+			name:       "filesystem backup and its label",
+			snapshotID: "4fa1b2c3",
+			dataDir:    "pgdata",
+			wantRead:   []string{"e1e1e1e1e1e1", "e2e2e2e2e2e2"},
+		},
+		{
+			name:       "streamed backup",
+			snapshotID: "7c0ffee1",
+			wantRead:   []string{"e3e3e3e3e3e3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secondary.restored = nil
+			logger := logging.NewLogger(logging.Config{Level: "info"})
+			client := replication.NewFallbackClient(unreachableRepository{}, []replication.Target{{Name: "offsite", Client: secondary}}, logger)
+			handler := NewHandler(client, basebackup.Config{}, logger)
+
+			target := filepath.Join(t.TempDir(), "restore")
+			if err := handler.RestoreBackup(context.Background(), tt.snapshotID, target, Options{}); err != nil {
+				t.Fatalf("RestoreBackup() error = %v", err)
+			}
+			if !slices.Equal(secondary.restored, tt.wantRead) {
+				t.Errorf("read %v from the secondary, want %v", secondary.restored, tt.wantRead)
+			}
+			if data, err := os.ReadFile(filepath.Join(target, tt.dataDir, "backup_label")); err != nil || string(data) != label {
+				t.Errorf("backup_label = %q, %v", data, err)
+			}
+		})
+	}
+}
+
+// writeDataDir creates a minimal data directory with pg_control and PG_VERSION
+func writeDataDir(t *testing.T, systemID uint64) string {
+	t.Helper()
+	dir := t.TempDir()
+
+	control := make([]byte, 8192)
+	binary.LittleEndian.PutUint64(control, systemID)
+	if err := os.MkdirAll(filepath.Join(dir, "global"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "global", "pg_control"), control, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "PG_VERSION"), []byte("16\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
 func TestRestoreWAL(t *testing.T) {
+	dataDir := writeDataDir(t, 42)
+
 	tests := []struct {
 		name           string
-		walFile       string
-		targetPath    string
+		walFile        string
+		targetPath     string
+		dataDir        string
 		restoreFileErr error
-		wantErr       bool
+		wantErr        bool
 	}{
 		{
 			name:           "successful WAL restore",
-			walFile:       "000000010000000000000001",
-			targetPath:    "/restore/000000010000000000000001",
+			walFile:        "000000010000000000000001",
+			targetPath:     "/restore/000000010000000000000001",
 			restoreFileErr: nil,
-			wantErr:       false,
+			wantErr:        false,
 		},
 		{
 			name:           "WAL restore error",
-			walFile:       "000000010000000000000001",
-			targetPath:    "/restore/000000010000000000000001",
+			walFile:        "000000010000000000000001",
+			targetPath:     "/restore/000000010000000000000001",
 			restoreFileErr: fmt.Errorf("restore failed"),
-			wantErr:       true,
+			wantErr:        true,
 		},
 		{
 			name:           "invalid WAL file",
-			walFile:       "invalid",
-			targetPath:    "/restore/invalid",
+			walFile:        "invalid",
+			targetPath:     "/restore/invalid",
 			restoreFileErr: nil,
-			wantErr:       true,
+			wantErr:        true,
 		},
 		{
 			name:           "empty WAL file",
-			walFile:       "",
-			targetPath:    "/restore",
+			walFile:        "",
+			targetPath:     "/restore",
 			restoreFileErr: nil,
-			wantErr:       true,
+			wantErr:        true,
+		},
+		{
+			name:       "data directory without a cluster",
+			walFile:    "000000010000000000000001",
+			targetPath: "/restore/000000010000000000000001",
+			dataDir:    t.TempDir(),
+			wantErr:    true,
 		},
 	}
 
@@ -199,7 +822,11 @@ func TestRestoreWAL(t *testing.T) {
 			}
 
 			// Execute WAL restore
-			err := handler.RestoreWAL(context.Background(), tt.walFile, tt.targetPath)
+			dir := tt.dataDir
+			if dir == "" {
+				dir = dataDir
+			}
+			err := handler.RestoreWAL(context.Background(), tt.walFile, tt.targetPath, dir)
 
 			// Verify results
 			if (err != nil) != tt.wantErr {
@@ -211,6 +838,9 @@ func TestRestoreWAL(t *testing.T) {
 			if !tt.wantErr && mockClient.restoredFile != tt.walFile {
 				t.Errorf("RestoreWAL() restored file = %v, want %v", mockClient.restoredFile, tt.walFile)
 			}
+			if !tt.wantErr && !slices.Contains(mockClient.foundTags, "system_id:42") {
+				t.Errorf("RestoreWAL() searched %v, want the segment of the instance", mockClient.foundTags)
+			}
 		})
 	}
 }
@@ -226,13 +856,13 @@ func TestRestoreWithInvalidClient(t *testing.T) {
 	}
 
 	// Test restore backup with nil client
-	err := handler.RestoreBackup(context.Background(), "test-snapshot", "/restore")
+	err := handler.RestoreBackup(context.Background(), "test-snapshot", "/restore", Options{})
 	if err == nil {
 		t.Error("RestoreBackup() with nil client should return error")
 	}
 
 	// Test restore WAL with nil client
-	err = handler.RestoreWAL(context.Background(), "000000010000000000000001", "/restore")
+	err = handler.RestoreWAL(context.Background(), "000000010000000000000001", "/restore", "/restore")
 	if err == nil {
 		t.Error("RestoreWAL() with nil client should return error")
 	}
@@ -0,0 +1,87 @@
+package restore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"cloud-native-pg-restic-backup/internal/pgdata"
+)
+
+// validateMapping checks that a tablespace mapping only names tablespaces of
+// the snapshot and relocates them to absolute paths
+func validateMapping(tablespaces []pgdata.Tablespace, mapping map[string]string) error {
+	known := make(map[string]bool)
+	for _, tablespace := range tablespaces {
+		known[tablespace.OID] = true
+		known[tablespace.Location] = true
+	}
+	for from, to := range mapping {
+		if !known[from] {
+			return fmt.Errorf("tablespace mapping: snapshot has no tablespace %s", from)
+		}
+		if !filepath.IsAbs(to) {
+			return fmt.Errorf("tablespace mapping: %s must be relocated to an absolute path", from)
+		}
+	}
+	return nil
+}
+
+// restoreTablespaces moves the tablespaces restored below restoreDir to
+// their mapped locations, then points pg_tblspc and tablespace_map at them.
+// Tablespaces that aren't mapped stay where restoreDir ends up, targetDir.
+func restoreTablespaces(dataDir, restoreDir, targetDir string, tablespaces []pgdata.Tablespace, mapping map[string]string) error {
+	if len(tablespaces) == 0 {
+		return nil
+	}
+
+	locations := make(map[string]string)
+	for _, tablespace := range tablespaces {
+		restored := filepath.Join(restoreDir, tablespace.Location)
+		location, ok := mapping[tablespace.OID]
+		if !ok {
+			location, ok = mapping[tablespace.Location]
+		}
+		if !ok {
+			location = filepath.Join(targetDir, tablespace.Location)
+		}
+
+		if location != filepath.Join(targetDir, tablespace.Location) {
+			if err := moveDir(restored, location); err != nil {
+				return fmt.Errorf("tablespace %s: %v", tablespace.OID, err)
+			}
+		}
+		if err := pgdata.RelinkTablespace(dataDir, tablespace.OID, location); err != nil {
+			return err
+		}
+		locations[tablespace.OID] = location
+	}
+
+	return pgdata.RewriteTablespaceMap(dataDir, locations)
+}
+
+// moveDir moves a restored directory to dst, which must not exist or be an
+// empty directory. Both must be on the same file system.
+func moveDir(src, dst string) error {
+	entries, err := os.ReadDir(dst)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("failed to read %s: %w", dst, err)
+	case len(entries) > 0:
+		return fmt.Errorf("%s is not empty", dst)
+	default:
+		if err := os.Remove(dst); err != nil {
+			return fmt.Errorf("failed to replace %s: %w", dst, err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(dst), err)
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return fmt.Errorf("failed to move tablespace to %s: %w", dst, err)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package restore
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud-native-pg-restic-backup/internal/pgdata"
+)
+
+var (
+	// ErrTargetNotEmpty is returned for restores into a non-empty directory
+	// that don't overwrite it
+	ErrTargetNotEmpty = errors.New("target directory is not empty")
+	// ErrServerRunning is returned for restores into a data directory a
+	// server may be running on
+	ErrServerRunning = errors.New("server may be running on the target directory")
+	// ErrTargetMountPoint is returned for staged restores into a mount
+	// point, which can't be renamed
+	ErrTargetMountPoint = errors.New("target directory is a mount point")
+)
+
+// checkTarget refuses to restore where a server may be running, whether its
+// data directory is targetDir or dataDir, and into a non-empty targetDir
+// unless overwrite is set
+func checkTarget(targetDir, dataDir string, overwrite bool) error {
+	for _, dir := range []string{targetDir, dataDir} {
+		pid, err := pgdata.ReadPostmasterPID(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrServerRunning, err)
+		}
+		return fmt.Errorf("%w: postmaster.pid in %s names PID %d, stop the server or remove the file if it is stale", ErrServerRunning, dir, pid)
+	}
+
+	entries, err := os.ReadDir(targetDir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil
+	case err != nil:
+		return fmt.Errorf("failed to read %s: %w", targetDir, err)
+	case len(entries) > 0 && !overwrite:
+		return fmt.Errorf("%w: %s, set overwrite to replace its contents", ErrTargetNotEmpty, targetDir)
+	}
+	return nil
+}
+
+// checkStage refuses to stage a restore of targetDir if the staged
+// directory can't take its place
+func checkStage(targetDir string) error {
+	mountPoint, err := isMountPoint(targetDir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil
+	case err != nil:
+		return fmt.Errorf("failed to check %s: %w", targetDir, err)
+	case mountPoint:
+		return fmt.Errorf("%w: %s can't be replaced by a staged restore, restore without stage", ErrTargetMountPoint, targetDir)
+	}
+	return nil
+}
+
+// stagePrefix starts the names of the staging directories of targetDir
+func stagePrefix(targetDir string) string {
+	return "." + filepath.Base(targetDir) + ".restore-"
+}
+
+// swapMarker returns the file naming the staging directory of targetDir
+// while a staged restore is in progress, so that an interrupted one can be
+// rolled back
+func swapMarker(targetDir string) string {
+	return filepath.Join(filepath.Dir(targetDir), stagePrefix(targetDir)+"marker")
+}
+
+// stageDir creates an empty directory next to targetDir to restore into, on
+// the same file system so that it can take the place of targetDir. The
+// marker naming it is written before anything is restored.
+func stageDir(targetDir string) (string, error) {
+	targetDir = filepath.Clean(targetDir)
+	if err := os.MkdirAll(filepath.Dir(targetDir), 0700); err != nil {
+		return "", fmt.Errorf("failed to create parent of %s: %w", targetDir, err)
+	}
+	staged, err := os.MkdirTemp(filepath.Dir(targetDir), stagePrefix(targetDir))
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	if err := writeSynced(swapMarker(targetDir), []byte(filepath.Base(staged)+"\n")); err != nil {
+		os.RemoveAll(staged)
+		return "", fmt.Errorf("failed to write staging marker: %w", err)
+	}
+	return staged, nil
+}
+
+// swapDir replaces targetDir with staged. The previous targetDir is moved
+// aside until staged has taken its place, and moved back if that fails.
+func swapDir(staged, targetDir string) error {
+	old := ""
+	if _, err := os.Lstat(targetDir); err == nil {
+		old = staged + ".old"
+		if err := os.Rename(targetDir, old); err != nil {
+			return fmt.Errorf("failed to move %s aside: %w", targetDir, err)
+		}
+	}
+	if err := os.Rename(staged, targetDir); err != nil {
+		if old != "" {
+			_ = os.Rename(old, targetDir)
+		}
+		return fmt.Errorf("failed to move restored data to %s: %w", targetDir, err)
+	}
+	if err := syncDir(filepath.Dir(targetDir)); err != nil {
+		return err
+	}
+	if old != "" {
+		if err := os.RemoveAll(old); err != nil {
+			return fmt.Errorf("failed to remove previous contents of %s: %w", targetDir, err)
+		}
+	}
+	return nil
+}
+
+// recoverSwap finishes a staged restore of targetDir according to its
+// marker: the previous targetDir is moved back if the restore hadn't taken
+// its place, and the staging directories are removed. Staged restores end
+// with it, restores start with it to recover from a crash.
+func recoverSwap(targetDir string) (bool, error) {
+	targetDir = filepath.Clean(targetDir)
+	marker := swapMarker(targetDir)
+	data, err := os.ReadFile(marker)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read staging marker: %w", err)
+	}
+	name := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(name, stagePrefix(targetDir)) || filepath.Base(name) != name {
+		return false, fmt.Errorf("invalid staging marker %s: %q", marker, name)
+	}
+	staged := filepath.Join(filepath.Dir(targetDir), name)
+	old := staged + ".old"
+
+	// Without targetDir, the swap stopped between its renames
+	if _, err := os.Lstat(targetDir); errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Lstat(old); err == nil {
+			if err := os.Rename(old, targetDir); err != nil {
+				return false, fmt.Errorf("failed to move %s back: %w", targetDir, err)
+			}
+		}
+	}
+	for _, dir := range []string{old, staged} {
+		if err := os.RemoveAll(dir); err != nil {
+			return false, fmt.Errorf("failed to remove %s: %w", dir, err)
+		}
+	}
+	if err := os.Remove(marker); err != nil {
+		return false, fmt.Errorf("failed to remove staging marker: %w", err)
+	}
+	return true, syncDir(filepath.Dir(targetDir))
+}
+
+// writeSynced writes a file and flushes it and its directory to disk
+func writeSynced(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(name))
+}
+
+// syncDir flushes the entries of dir to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", dir, err)
+	}
+	return nil
+}
+
+// owner is a user and group owning files
+type owner struct {
+	uid, gid int
+}
+
+// targetOwner returns who restored files are handed to: the owner of
+// targetDir or of its closest existing parent. Only root can hand files
+// over, and it restores them with their backed up owners if it owns the
+// target itself.
+func targetOwner(targetDir string) (owner, bool) {
+	if os.Geteuid() != 0 {
+		return owner{}, false
+	}
+	for dir := filepath.Clean(targetDir); ; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err == nil {
+			o, ok := fileOwner(info)
+			return o, ok && o.uid != 0
+		}
+		if dir == filepath.Dir(dir) {
+			return owner{}, false
+		}
+	}
+}
+
+// chownTree hands dir and everything below it to o, symlinks included
+func chownTree(dir string, o owner) error {
+	return filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(path, o.uid, o.gid); err != nil {
+			return fmt.Errorf("failed to change owner of %s: %w", path, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,153 @@
+// Package retention deletes the base backups a retention policy no longer
+// keeps, together with the WAL segments only they needed.
+package retention
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"cloud-native-pg-restic-backup/internal/basebackup"
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/restic"
+	"cloud-native-pg-restic-backup/internal/wal"
+)
+
+// Policy selects the base backups to keep. The most recent base backup is
+// always kept, and so are the backups a kept incremental backup depends on.
+type Policy struct {
+	// KeepLast keeps the given number of most recent base backups
+	KeepLast int
+	// KeepWithin keeps the base backups taken within this duration
+	KeepWithin time.Duration
+}
+
+// Enabled reports whether the policy deletes anything
+func (p Policy) Enabled() bool {
+	return p.KeepLast > 0 || p.KeepWithin > 0
+}
+
+// Validate checks the policy values
+func (p Policy) Validate() error {
+	if p.KeepLast < 0 {
+		return fmt.Errorf("keepLast must not be negative")
+	}
+	if p.KeepWithin < 0 {
+		return fmt.Errorf("keepWithin must not be negative")
+	}
+	return nil
+}
+
+// Result reports what a policy run deleted
+type Result struct {
+	Kept    []string `json:"kept"`
+	Deleted []string `json:"deleted,omitempty"`
+	// WALBefore is the time WAL segments were deleted before, the start of
+	// the oldest kept base backup
+	WALBefore time.Time `json:"walBefore,omitempty"`
+}
+
+// Enforcer applies a retention policy to a repository
+type Enforcer struct {
+	client     restic.Client
+	walManager *wal.Manager
+	policy     Policy
+	logger     *logging.Logger
+	now        func() time.Time
+}
+
+// NewEnforcer creates a new enforcer
+func NewEnforcer(client restic.Client, policy Policy, logger *logging.Logger) *Enforcer {
+	return &Enforcer{
+		client:     client,
+		walManager: wal.NewManager(client, logger),
+		policy:     policy,
+		logger:     logger.Component("retention"),
+		now:        time.Now,
+	}
+}
+
+// Apply deletes the base backups outside the policy and the WAL segments
+// archived before the oldest kept one
+func (e *Enforcer) Apply(ctx context.Context) (*Result, error) {
+	logger := e.logger.Context(ctx).Operation("apply_retention").WithFields(map[string]interface{}{
+		"keep_last":   e.policy.KeepLast,
+		"keep_within": e.policy.KeepWithin.String(),
+	})
+
+	snapshots, err := e.client.FindSnapshots(ctx, []string{"type:full"})
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to list base backups")
+		return nil, fmt.Errorf("failed to list base backups: %v", err)
+	}
+
+	result := &Result{}
+	if len(snapshots) == 0 {
+		logger.Info().Msg("No base backups, nothing to delete")
+		return result, nil
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.After(snapshots[j].Time)
+	})
+
+	now := e.now()
+	oldestKept := snapshots[0]
+	// Parents are older than their incremental backups, so they are reached
+	// after the backups needing them
+	needed := make(map[string]bool)
+	deleted := make(map[string]bool)
+	for i, snapshot := range snapshots {
+		keep := i == 0 ||
+			i < e.policy.KeepLast ||
+			(e.policy.KeepWithin > 0 && now.Sub(snapshot.Time) <= e.policy.KeepWithin) ||
+			needed[snapshot.ID]
+		if keep {
+			result.Kept = append(result.Kept, snapshot.ID)
+			oldestKept = snapshot
+			if parent := basebackup.ParentID(snapshot); parent != "" {
+				needed[parent] = true
+			}
+		} else {
+			result.Deleted = append(result.Deleted, snapshot.ID)
+			deleted[snapshot.ID] = true
+		}
+	}
+
+	if len(result.Deleted) > 0 {
+		// The manifests and labels of deleted backups are of no use anymore
+		ids := append([]string{}, result.Deleted...)
+		for _, typeTag := range basebackup.CompanionTypeTags {
+			companions, err := e.client.FindSnapshots(ctx, []string{typeTag})
+			if err != nil {
+				logger.Error().Err(err).Str("type", typeTag).Msg("Failed to list companion snapshots")
+				return nil, fmt.Errorf("failed to list %s snapshots: %v", typeTag, err)
+			}
+			for _, companion := range companions {
+				if deleted[basebackup.CompanionOf(companion)] {
+					ids = append(ids, companion.ID)
+				}
+			}
+		}
+
+		if err := e.client.DeleteSnapshots(ctx, ids); err != nil {
+			logger.Error().Err(err).Msg("Failed to delete base backups")
+			return nil, fmt.Errorf("failed to delete base backups: %v", err)
+		}
+	}
+
+	// Segments archived before the oldest kept backup started can't be
+	// replayed on top of any kept backup
+	result.WALBefore = oldestKept.Time
+	if err := e.walManager.CleanupWALSegments(ctx, result.WALBefore); err != nil {
+		return nil, err
+	}
+
+	logger.Info().
+		Int("kept", len(result.Kept)).
+		Int("deleted", len(result.Deleted)).
+		Time("wal_before", result.WALBefore).
+		Msg("Applied retention policy")
+	return result, nil
+}
@@ -0,0 +1,161 @@
+package retention
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud-native-pg-restic-backup/internal/basebackup"
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+// mockResticClient implements the restic.Client interface for testing
+type mockResticClient struct {
+	restic.Client
+	snapshots []*restic.Snapshot
+	deleted   []string
+}
+
+func (m *mockResticClient) FindSnapshots(_ context.Context, tags []string) ([]*restic.Snapshot, error) {
+	var found []*restic.Snapshot
+	for _, s := range m.snapshots {
+		for _, tag := range s.Tags {
+			if tag == tags[0] {
+				found = append(found, s)
+				break
+			}
+		}
+	}
+	return found, nil
+}
+
+func (m *mockResticClient) DeleteSnapshots(_ context.Context, ids []string) error {
+	m.deleted = append(m.deleted, ids...)
+	return nil
+}
+
+func TestEnforcer_Apply(t *testing.T) {
+	now := time.Date(2025, 7, 20, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	base := func(id string, age time.Duration) *restic.Snapshot {
+		return &restic.Snapshot{ID: id, Time: now.Add(-age), Tags: []string{"type:full"}}
+	}
+	segment := func(id string, age time.Duration) *restic.Snapshot {
+		return &restic.Snapshot{ID: id, Time: now.Add(-age), Tags: []string{"type:wal"}}
+	}
+	incremental := func(id, parent string, age time.Duration) *restic.Snapshot {
+		return &restic.Snapshot{ID: id, Time: now.Add(-age), Tags: []string{"type:full", basebackup.ParentTag(parent)}}
+	}
+	manifest := func(id, backupID string, age time.Duration) *restic.Snapshot {
+		return &restic.Snapshot{ID: id, Time: now.Add(-age), Tags: basebackup.ManifestTags(backupID)}
+	}
+	label := func(id, backupID string, age time.Duration) *restic.Snapshot {
+		return &restic.Snapshot{ID: id, Time: now.Add(-age), Tags: basebackup.LabelTags(backupID)}
+	}
+	snapshots := []*restic.Snapshot{
+		base("full-1", 1*day),
+		base("full-3", 3*day),
+		base("full-7", 7*day),
+		base("full-14", 14*day),
+		segment("wal-2", 2*day),
+		segment("wal-5", 5*day),
+		segment("wal-10", 10*day),
+	}
+
+	tests := []struct {
+		name        string
+		policy      Policy
+		snapshots   []*restic.Snapshot
+		wantDeleted []string
+		wantKept    []string
+	}{
+		{
+			name:        "keep last",
+			policy:      Policy{KeepLast: 2},
+			snapshots:   snapshots,
+			wantKept:    []string{"full-1", "full-3"},
+			wantDeleted: []string{"full-7", "full-14", "wal-5", "wal-10"},
+		},
+		{
+			name:        "keep within",
+			policy:      Policy{KeepWithin: 8 * day},
+			snapshots:   snapshots,
+			wantKept:    []string{"full-1", "full-3", "full-7"},
+			wantDeleted: []string{"full-14", "wal-10"},
+		},
+		{
+			name:        "latest kept outside the policy",
+			policy:      Policy{KeepWithin: time.Hour},
+			snapshots:   snapshots,
+			wantKept:    []string{"full-1"},
+			wantDeleted: []string{"full-3", "full-7", "full-14", "wal-2", "wal-5", "wal-10"},
+		},
+		{
+			name:   "parents of kept incremental backups",
+			policy: Policy{KeepLast: 1},
+			snapshots: []*restic.Snapshot{
+				incremental("inc-1", "inc-7", 1*day),
+				incremental("inc-7", "full-14", 7*day),
+				base("full-14", 14*day),
+				base("full-20", 20*day),
+				manifest("manifest-14", "full-14", 14*day),
+				manifest("manifest-20", "full-20", 20*day),
+				segment("wal-16", 16*day),
+			},
+			wantKept:    []string{"inc-1", "inc-7", "full-14"},
+			wantDeleted: []string{"full-20", "manifest-20", "wal-16"},
+		},
+		{
+			name:   "companions of deleted backups",
+			policy: Policy{KeepLast: 1},
+			snapshots: []*restic.Snapshot{
+				base("full-1", 1*day),
+				base("full-3", 3*day),
+				manifest("manifest-1", "full-1", 1*day),
+				label("label-1", "full-1", 1*day),
+				manifest("manifest-3", "full-3", 3*day),
+				label("label-3", "full-3", 3*day),
+			},
+			wantKept:    []string{"full-1"},
+			wantDeleted: []string{"full-3", "manifest-3", "label-3"},
+		},
+		{
+			name:      "no base backups",
+			policy:    Policy{KeepLast: 1},
+			snapshots: []*restic.Snapshot{segment("wal-2", 2*day)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockResticClient{snapshots: tt.snapshots}
+			e := NewEnforcer(client, tt.policy, logging.NewLogger(logging.Config{Level: "error"}))
+			e.now = func() time.Time { return now }
+
+			result, err := e.Apply(context.Background())
+			if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+			if !reflect.DeepEqual(result.Kept, tt.wantKept) {
+				t.Errorf("Kept = %v, want %v", result.Kept, tt.wantKept)
+			}
+			if !reflect.DeepEqual(client.deleted, tt.wantDeleted) {
+				t.Errorf("deleted = %v, want %v", client.deleted, tt.wantDeleted)
+			}
+		})
+	}
+}
+
+func TestPolicy_Validate(t *testing.T) {
+	if err := (Policy{KeepLast: -1}).Validate(); err == nil {
+		t.Error("Validate() expected error for negative keepLast")
+	}
+	if err := (Policy{KeepWithin: -time.Hour}).Validate(); err == nil {
+		t.Error("Validate() expected error for negative keepWithin")
+	}
+	if (Policy{}).Enabled() {
+		t.Error("Expected empty policy to be disabled")
+	}
+}
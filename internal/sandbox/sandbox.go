@@ -0,0 +1,122 @@
+// Package sandbox confines client-supplied paths to configured root
+// directories.
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrInvalidPath is returned for relative paths and paths with ".."
+	// elements
+	ErrInvalidPath = errors.New("invalid path")
+	// ErrOutsideRoots is returned for paths resolving outside the allowed
+	// roots
+	ErrOutsideRoots = errors.New("path outside allowed roots")
+)
+
+// Sandbox restricts paths to a set of root directories
+type Sandbox struct {
+	// roots are canonical, an empty sandbox allows every absolute path
+	roots []string
+}
+
+// New creates a sandbox of the given root directories, which must exist.
+// Without roots every absolute path without ".." elements is allowed.
+func New(roots ...string) (*Sandbox, error) {
+	s := &Sandbox{}
+	for _, root := range roots {
+		if root == "" {
+			continue
+		}
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return nil, fmt.Errorf("invalid root %s: %v", root, err)
+		}
+		canonical, err := filepath.EvalSymlinks(abs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid root %s: %v", root, err)
+		}
+		s.roots = append(s.roots, canonical)
+	}
+	return s, nil
+}
+
+// Restricted reports whether the sandbox has roots, a nil sandbox has none
+func (s *Sandbox) Restricted() bool {
+	return s != nil && len(s.roots) > 0
+}
+
+// Roots returns the canonical root directories
+func (s *Sandbox) Roots() []string {
+	if s == nil {
+		return nil
+	}
+	return s.roots
+}
+
+// Path checks that p, with its symlinks resolved, lies within a root and
+// returns the resolved path, so that callers use the path that was checked
+// rather than follow the symlinks again. Paths that don't exist yet are
+// resolved through their closest existing ancestor. Without roots p is only
+// cleaned.
+func (s *Sandbox) Path(p string) (string, error) {
+	if p == "" || !filepath.IsAbs(p) || strings.ContainsRune(p, 0) {
+		return "", fmt.Errorf("%w: %q must be an absolute path", ErrInvalidPath, p)
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(p), "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("%w: %q contains \"..\"", ErrInvalidPath, p)
+		}
+	}
+	cleaned := filepath.Clean(p)
+
+	if !s.Restricted() {
+		return cleaned, nil
+	}
+
+	resolved, err := resolve(cleaned)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", p, err)
+	}
+	for _, root := range s.roots {
+		if within(root, resolved) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s resolves to %s", ErrOutsideRoots, p, resolved)
+}
+
+// resolve returns p with the symlinks of its longest existing prefix resolved
+func resolve(p string) (string, error) {
+	var missing []string
+	for {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", err
+		}
+		missing = append([]string{filepath.Base(p)}, missing...)
+		p = parent
+	}
+}
+
+// within reports whether p is root or inside it
+func within(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
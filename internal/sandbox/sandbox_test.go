@@ -0,0 +1,136 @@
+package sandbox
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSandbox_Path(t *testing.T) {
+	// Paths are returned resolved, so compare them below a resolved directory
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pgdata := filepath.Join(dir, "pgdata")
+	walVolume := filepath.Join(dir, "wal")
+	outside := filepath.Join(dir, "etc")
+	for _, d := range []string{filepath.Join(pgdata, "base"), walVolume, outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// pg_wal on its own volume, and a link escaping the data directory
+	if err := os.Symlink(walVolume, filepath.Join(pgdata, "pg_wal")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(pgdata, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(pgdata, walVolume)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr error
+	}{
+		{
+			name: "root",
+			path: pgdata,
+			want: pgdata,
+		},
+		{
+			name: "existing directory",
+			path: filepath.Join(pgdata, "base") + "/",
+			want: filepath.Join(pgdata, "base"),
+		},
+		{
+			name: "not yet existing file",
+			path: filepath.Join(pgdata, "restore", "000000010000000000000001"),
+			want: filepath.Join(pgdata, "restore", "000000010000000000000001"),
+		},
+		{
+			name: "symlink into another root",
+			path: filepath.Join(pgdata, "pg_wal", "000000010000000000000001"),
+			want: filepath.Join(walVolume, "000000010000000000000001"),
+		},
+		{
+			name:    "symlink escaping the roots",
+			path:    filepath.Join(pgdata, "escape", "passwd"),
+			wantErr: ErrOutsideRoots,
+		},
+		{
+			name:    "outside the roots",
+			path:    outside,
+			wantErr: ErrOutsideRoots,
+		},
+		{
+			name:    "sibling with root as prefix",
+			path:    pgdata + "2",
+			wantErr: ErrOutsideRoots,
+		},
+		{
+			name:    "traversal",
+			path:    filepath.Join(pgdata, "base") + "/../../etc",
+			wantErr: ErrInvalidPath,
+		},
+		{
+			name:    "traversal staying inside",
+			path:    pgdata + "/base/..",
+			wantErr: ErrInvalidPath,
+		},
+		{
+			name:    "relative path",
+			path:    "pgdata/base",
+			wantErr: ErrInvalidPath,
+		},
+		{
+			name:    "empty path",
+			path:    "",
+			wantErr: ErrInvalidPath,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Path(tt.path)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Path() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Path() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Path() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSandbox_Unrestricted(t *testing.T) {
+	var s *Sandbox
+	if s.Restricted() {
+		t.Error("Expected nil sandbox to be unrestricted")
+	}
+	if got, err := s.Path("/etc//passwd"); err != nil || got != "/etc/passwd" {
+		t.Errorf("Path() = %s, %v, want /etc/passwd", got, err)
+	}
+	if _, err := s.Path("/var/lib/../../etc"); !errors.Is(err, ErrInvalidPath) {
+		t.Errorf("Path() error = %v, want ErrInvalidPath", err)
+	}
+}
+
+func TestNew_MissingRoot(t *testing.T) {
+	if _, err := New(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("New() expected error for missing root")
+	}
+}
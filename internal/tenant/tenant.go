@@ -0,0 +1,320 @@
+// Package tenant resolves the repository configuration of each PostgreSQL
+// cluster served by the plugin, so one plugin process can back up a fleet.
+package tenant
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+var (
+	// ErrUnknownTenant is returned when no repository configuration exists for a cluster
+	ErrUnknownTenant = errors.New("unknown tenant")
+	// ErrInvalidIdentity is returned for cluster names and namespaces
+	// Kubernetes wouldn't accept
+	ErrInvalidIdentity = errors.New("invalid cluster identity")
+)
+
+// labelRegex matches DNS-1123 labels, which namespaces and cluster names are
+var labelRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// Identity identifies the PostgreSQL cluster a request belongs to
+type Identity struct {
+	ClusterName string `json:"clusterName,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+}
+
+// IsZero reports whether the identity is empty
+func (i Identity) IsZero() bool {
+	return i.ClusterName == "" && i.Namespace == ""
+}
+
+// String returns the identity as namespace/cluster
+func (i Identity) String() string {
+	if i.IsZero() {
+		return "default"
+	}
+	return i.Namespace + "/" + i.ClusterName
+}
+
+// Validate checks that the cluster name and namespace, if set, are DNS-1123
+// labels. They name directories below SecretsDir.
+func (i Identity) Validate() error {
+	if i.ClusterName != "" && !labelRegex.MatchString(i.ClusterName) {
+		return fmt.Errorf("%w: cluster name %q is not a DNS-1123 label", ErrInvalidIdentity, i.ClusterName)
+	}
+	if i.Namespace != "" && !labelRegex.MatchString(i.Namespace) {
+		return fmt.Errorf("%w: namespace %q is not a DNS-1123 label", ErrInvalidIdentity, i.Namespace)
+	}
+	return nil
+}
+
+// Tags returns the snapshot tags isolating this tenant's data in a shared repository
+func (i Identity) Tags() []string {
+	var tags []string
+	if i.ClusterName != "" {
+		tags = append(tags, "cluster:"+i.ClusterName)
+	}
+	if i.Namespace != "" {
+		tags = append(tags, "namespace:"+i.Namespace)
+	}
+	return tags
+}
+
+// Tenant is a resolved cluster together with its repository configuration
+type Tenant struct {
+	Identity
+	Config restic.Config
+	// Secondaries are the repositories backups are replicated to
+	Secondaries []restic.Config
+}
+
+// Config holds the sources tenants are resolved from
+type Config struct {
+	// Default is used for requests without an identity and for clusters
+	// without a dedicated configuration. Nil disables the fallback.
+	Default *restic.Config
+	// DefaultSecondaries are the replication targets of the default repository
+	DefaultSecondaries []restic.Config
+	// DefaultIdentity is the cluster requests without an identity belong to
+	DefaultIdentity Identity
+	// File is an optional JSON file listing tenants
+	File string
+	// SecretsDir is an optional directory of mounted Kubernetes Secrets,
+	// laid out as <SecretsDir>/<namespace>/<clusterName>/<KEY>
+	SecretsDir string
+	// RequireKnown rejects clusters without a dedicated configuration
+	// rather than falling back to Default, which then only serves requests
+	// without an identity or with DefaultIdentity
+	RequireKnown bool
+}
+
+// fileEntry is a single tenant in the tenants file
+type fileEntry struct {
+	Identity
+	restic.Config
+	// SecretDir points to a mounted Secret filling unset fields
+	SecretDir string `json:"secretDir,omitempty"`
+	// Secondaries are the repositories backups are replicated to
+	Secondaries []restic.Config `json:"secondaries,omitempty"`
+}
+
+// file is the layout of the tenants file
+type file struct {
+	Tenants []fileEntry `json:"tenants"`
+}
+
+// Registry resolves tenants from the configured sources
+type Registry struct {
+	config  Config
+	tenants map[Identity]fileEntry
+}
+
+// NewRegistry creates a registry and loads the tenants file if configured
+func NewRegistry(cfg Config) (*Registry, error) {
+	r := &Registry{
+		config:  cfg,
+		tenants: make(map[Identity]fileEntry),
+	}
+
+	if cfg.File != "" {
+		if err := r.loadFile(cfg.File); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+func (r *Registry) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read tenants file: %w", err)
+	}
+
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("failed to parse tenants file: %w", err)
+	}
+
+	for _, entry := range f.Tenants {
+		if entry.ClusterName == "" {
+			return fmt.Errorf("tenants file: entry without clusterName")
+		}
+		if err := entry.Identity.Validate(); err != nil {
+			return fmt.Errorf("tenants file: %w", err)
+		}
+		if _, ok := r.tenants[entry.Identity]; ok {
+			return fmt.Errorf("tenants file: duplicate tenant %s", entry.Identity)
+		}
+		r.tenants[entry.Identity] = entry
+	}
+	return nil
+}
+
+// Resolve returns the tenant for the given identity
+func (r *Registry) Resolve(id Identity) (*Tenant, error) {
+	if id.IsZero() {
+		if r.config.Default == nil {
+			return nil, fmt.Errorf("%w: request carries no cluster identity and no default repository is configured", ErrUnknownTenant)
+		}
+		return newTenant(r.config.DefaultIdentity, *r.config.Default, r.config.DefaultSecondaries)
+	}
+	if err := id.Validate(); err != nil {
+		return nil, err
+	}
+
+	if entry, ok := r.tenants[id]; ok {
+		cfg := entry.Config
+		if entry.SecretDir != "" {
+			fromSecret, err := readSecretDir(entry.SecretDir)
+			if err != nil {
+				return nil, err
+			}
+			cfg = merge(cfg, fromSecret)
+		}
+		return newTenant(id, cfg, entry.Secondaries)
+	}
+
+	if r.config.SecretsDir != "" {
+		dir := filepath.Join(r.config.SecretsDir, id.Namespace, id.ClusterName)
+		if _, err := os.Stat(dir); err == nil {
+			cfg, err := readSecretDir(dir)
+			if err != nil {
+				return nil, err
+			}
+			return newTenant(id, cfg, nil)
+		}
+	}
+
+	if r.config.Default != nil && (!r.config.RequireKnown || id == r.config.DefaultIdentity) {
+		return newTenant(id, *r.config.Default, r.config.DefaultSecondaries)
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownTenant, id)
+}
+
+func newTenant(id Identity, cfg restic.Config, secondaries []restic.Config) (*Tenant, error) {
+	if cfg.Repository == "" {
+		return nil, fmt.Errorf("tenant %s: repository not configured", id)
+	}
+	if !cfg.HasPassword() {
+		return nil, fmt.Errorf("tenant %s: password not configured", id)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("tenant %s: %v", id, err)
+	}
+	// Record the cluster rather than the pod as snapshot host, so snapshots
+	// keep their origin across pod restarts and failovers
+	if cfg.Host == "" {
+		cfg.Host = id.ClusterName
+	}
+	for i, secondary := range secondaries {
+		if secondary.Repository == "" || !secondary.HasPassword() {
+			return nil, fmt.Errorf("tenant %s: secondary repository %d needs repository and password", id, i)
+		}
+	}
+	return &Tenant{Identity: id, Config: cfg, Secondaries: secondaries}, nil
+}
+
+// secretKeys maps Secret keys to the restic configuration fields they set.
+// Both the plugin's own variable names and the AWS ones used in the example
+// Secret are accepted; later keys take precedence. Credentials are set to
+// the file rather than its content, so they are read on every command and
+// a rotated Secret takes effect without a restart.
+var secretKeys = []struct {
+	key string
+	// file is set for credentials referenced by path
+	file bool
+	set  func(*restic.Config, string)
+}{
+	{"RESTIC_REPOSITORY", false, func(c *restic.Config, v string) { c.Repository = v }},
+	{"RESTIC_PASSWORD", true, func(c *restic.Config, v string) { c.PasswordFile = v }},
+	{"S3_ENDPOINT", false, func(c *restic.Config, v string) { c.S3Endpoint = v }},
+	{"AWS_ENDPOINT", false, func(c *restic.Config, v string) { c.S3Endpoint = v }},
+	{"S3_ACCESS_KEY", true, func(c *restic.Config, v string) { c.S3AccessKeyFile = v }},
+	{"AWS_ACCESS_KEY_ID", true, func(c *restic.Config, v string) { c.S3AccessKeyFile = v }},
+	{"S3_SECRET_KEY", true, func(c *restic.Config, v string) { c.S3SecretKeyFile = v }},
+	{"AWS_SECRET_ACCESS_KEY", true, func(c *restic.Config, v string) { c.S3SecretKeyFile = v }},
+	{"AWS_SESSION_TOKEN", true, func(c *restic.Config, v string) { c.S3SessionTokenFile = v }},
+	{"AWS_DEFAULT_REGION", false, func(c *restic.Config, v string) { c.S3Region = v }},
+	{"AZURE_ACCOUNT_NAME", false, func(c *restic.Config, v string) { c.AzureAccountName = v }},
+	{"AZURE_ACCOUNT_KEY", true, func(c *restic.Config, v string) { c.AzureAccountKeyFile = v }},
+	{"AZURE_ACCOUNT_SAS", false, func(c *restic.Config, v string) { c.AzureAccountSAS = v }},
+	{"GOOGLE_PROJECT_ID", false, func(c *restic.Config, v string) { c.GCSProjectID = v }},
+	{"GOOGLE_APPLICATION_CREDENTIALS", true, func(c *restic.Config, v string) { c.GCSCredentialsFile = v }},
+	{"B2_ACCOUNT_ID", false, func(c *restic.Config, v string) { c.B2AccountID = v }},
+	{"B2_ACCOUNT_KEY", true, func(c *restic.Config, v string) { c.B2AccountKeyFile = v }},
+	{"RESTIC_REST_USERNAME", false, func(c *restic.Config, v string) { c.RESTUsername = v }},
+	{"RESTIC_REST_PASSWORD", true, func(c *restic.Config, v string) { c.RESTPasswordFile = v }},
+	{"RESTIC_CACERT", true, func(c *restic.Config, v string) { c.CACertFile = v }},
+}
+
+// readSecretDir reads a mounted Secret volume into a restic configuration
+func readSecretDir(dir string) (restic.Config, error) {
+	var cfg restic.Config
+	for _, k := range secretKeys {
+		path := filepath.Join(dir, k.key)
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("failed to read secret %s: %w", k.key, err)
+		}
+		if k.file {
+			k.set(&cfg, path)
+		} else {
+			k.set(&cfg, strings.TrimSpace(string(data)))
+		}
+	}
+	return cfg, nil
+}
+
+// merge fills the empty fields of cfg from other, a credential set either
+// as value or as file counting as set
+func merge(cfg, other restic.Config) restic.Config {
+	fill(&cfg.Repository, other.Repository)
+	if !cfg.HasPassword() {
+		cfg.Password = other.Password
+		cfg.PasswordFile = other.PasswordFile
+		cfg.PasswordCommand = other.PasswordCommand
+	}
+	fill(&cfg.S3Endpoint, other.S3Endpoint)
+	fill(&cfg.S3Region, other.S3Region)
+	fillSecret(&cfg.S3AccessKey, &cfg.S3AccessKeyFile, other.S3AccessKey, other.S3AccessKeyFile)
+	fillSecret(&cfg.S3SecretKey, &cfg.S3SecretKeyFile, other.S3SecretKey, other.S3SecretKeyFile)
+	fillSecret(&cfg.S3SessionToken, &cfg.S3SessionTokenFile, other.S3SessionToken, other.S3SessionTokenFile)
+	fill(&cfg.AzureAccountName, other.AzureAccountName)
+	fillSecret(&cfg.AzureAccountKey, &cfg.AzureAccountKeyFile, other.AzureAccountKey, other.AzureAccountKeyFile)
+	fill(&cfg.AzureAccountSAS, other.AzureAccountSAS)
+	fill(&cfg.GCSProjectID, other.GCSProjectID)
+	fill(&cfg.GCSCredentialsFile, other.GCSCredentialsFile)
+	fill(&cfg.B2AccountID, other.B2AccountID)
+	fillSecret(&cfg.B2AccountKey, &cfg.B2AccountKeyFile, other.B2AccountKey, other.B2AccountKeyFile)
+	fill(&cfg.RESTUsername, other.RESTUsername)
+	fillSecret(&cfg.RESTPassword, &cfg.RESTPasswordFile, other.RESTPassword, other.RESTPasswordFile)
+	fill(&cfg.CACertFile, other.CACertFile)
+	return cfg
+}
+
+// fill sets an empty field
+func fill(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
+
+// fillSecret sets a credential given neither as value nor as file
+func fillSecret(value, file *string, otherValue, otherFile string) {
+	if *value == "" && *file == "" {
+		*value, *file = otherValue, otherFile
+	}
+}
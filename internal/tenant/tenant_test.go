@@ -0,0 +1,266 @@
+package tenant
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// password returns the password restic would use, reading a password file
+func password(t *testing.T, cfg restic.Config) string {
+	t.Helper()
+	if cfg.PasswordFile == "" {
+		return cfg.Password
+	}
+	password, err := restic.ReadSecretFile(cfg.PasswordFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return password
+}
+
+func TestRegistry_Resolve(t *testing.T) {
+	dir := t.TempDir()
+
+	// Tenant defined in the tenants file, with the password from a Secret
+	writeFile(t, filepath.Join(dir, "secret-a", "RESTIC_PASSWORD"), "password-a\n")
+	tenantsFile := filepath.Join(dir, "tenants.json")
+	writeFile(t, tenantsFile, `{
+		"tenants": [
+			{
+				"clusterName": "pg-a",
+				"namespace": "db",
+				"repository": "s3:https://s3/bucket/pg-a",
+				"secretDir": "`+filepath.Join(dir, "secret-a")+`"
+			}
+		]
+	}`)
+
+	// Tenant only defined through the secrets directory
+	secretsDir := filepath.Join(dir, "secrets")
+	writeFile(t, filepath.Join(secretsDir, "db", "pg-b", "RESTIC_REPOSITORY"), "s3:https://s3/bucket/pg-b")
+	writeFile(t, filepath.Join(secretsDir, "db", "pg-b", "RESTIC_PASSWORD"), "password-b")
+	writeFile(t, filepath.Join(secretsDir, "db", "pg-b", "AWS_ACCESS_KEY_ID"), "access-b")
+	writeFile(t, filepath.Join(secretsDir, "db", "pg-b", "AWS_SECRET_ACCESS_KEY"), "secret-b")
+
+	// Tenant with an incomplete Secret
+	writeFile(t, filepath.Join(secretsDir, "db", "pg-c", "RESTIC_REPOSITORY"), "s3:https://s3/bucket/pg-c")
+
+	defaultConfig := restic.Config{Repository: "/repo/default", Password: "default"}
+
+	tests := []struct {
+		name     string
+		config   Config
+		id       Identity
+		wantID   Identity
+		wantRepo string
+		wantPass string
+		wantErr  error
+	}{
+		{
+			name:     "tenant from file with secret",
+			config:   Config{File: tenantsFile},
+			id:       Identity{ClusterName: "pg-a", Namespace: "db"},
+			wantRepo: "s3:https://s3/bucket/pg-a",
+			wantPass: "password-a",
+		},
+		{
+			name:     "tenant from secrets directory",
+			config:   Config{SecretsDir: secretsDir},
+			id:       Identity{ClusterName: "pg-b", Namespace: "db"},
+			wantRepo: "s3:https://s3/bucket/pg-b",
+			wantPass: "password-b",
+		},
+		{
+			name:     "empty identity uses default",
+			config:   Config{Default: &defaultConfig},
+			id:       Identity{},
+			wantRepo: "/repo/default",
+			wantPass: "default",
+		},
+		{
+			name:     "empty identity uses default identity",
+			config:   Config{Default: &defaultConfig, DefaultIdentity: Identity{ClusterName: "pg-main", Namespace: "db"}},
+			id:       Identity{},
+			wantID:   Identity{ClusterName: "pg-main", Namespace: "db"},
+			wantRepo: "/repo/default",
+			wantPass: "default",
+		},
+		{
+			name:     "unknown tenant falls back to default",
+			config:   Config{Default: &defaultConfig, File: tenantsFile},
+			id:       Identity{ClusterName: "pg-x", Namespace: "db"},
+			wantRepo: "/repo/default",
+			wantPass: "default",
+		},
+		{
+			name:    "unknown tenant rejected",
+			config:  Config{Default: &defaultConfig, File: tenantsFile, RequireKnown: true},
+			id:      Identity{ClusterName: "pg-x", Namespace: "db"},
+			wantErr: ErrUnknownTenant,
+		},
+		{
+			name:     "default identity with unknown tenants rejected",
+			config:   Config{Default: &defaultConfig, DefaultIdentity: Identity{ClusterName: "pg-main", Namespace: "db"}, RequireKnown: true},
+			id:       Identity{ClusterName: "pg-main", Namespace: "db"},
+			wantRepo: "/repo/default",
+			wantPass: "default",
+		},
+		{
+			name:    "unknown tenant without default",
+			config:  Config{File: tenantsFile},
+			id:      Identity{ClusterName: "pg-x", Namespace: "db"},
+			wantErr: ErrUnknownTenant,
+		},
+		{
+			name:    "cluster name escaping the secrets directory",
+			config:  Config{Default: &defaultConfig, SecretsDir: secretsDir},
+			id:      Identity{ClusterName: "..", Namespace: "db"},
+			wantErr: ErrInvalidIdentity,
+		},
+		{
+			name:    "namespace with a path separator",
+			config:  Config{Default: &defaultConfig, SecretsDir: secretsDir},
+			id:      Identity{ClusterName: "pg-b", Namespace: "db/../db"},
+			wantErr: ErrInvalidIdentity,
+		},
+		{
+			name:    "uppercase cluster name",
+			config:  Config{Default: &defaultConfig},
+			id:      Identity{ClusterName: "PG-A", Namespace: "db"},
+			wantErr: ErrInvalidIdentity,
+		},
+		{
+			name:    "empty identity without default",
+			config:  Config{File: tenantsFile},
+			id:      Identity{},
+			wantErr: ErrUnknownTenant,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRegistry(tt.config)
+			if err != nil {
+				t.Fatalf("NewRegistry() error = %v", err)
+			}
+
+			got, err := r.Resolve(tt.id)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Resolve() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			wantID := tt.wantID
+			if wantID.IsZero() {
+				wantID = tt.id
+			}
+			if got.Identity != wantID {
+				t.Errorf("Identity = %v, want %v", got.Identity, wantID)
+			}
+			if got.Config.Host != wantID.ClusterName {
+				t.Errorf("Host = %q, want %q", got.Config.Host, wantID.ClusterName)
+			}
+			if got.Config.Repository != tt.wantRepo {
+				t.Errorf("Repository = %q, want %q", got.Config.Repository, tt.wantRepo)
+			}
+			if password := password(t, got.Config); password != tt.wantPass {
+				t.Errorf("Password = %q, want %q", password, tt.wantPass)
+			}
+		})
+	}
+
+	t.Run("incomplete secret", func(t *testing.T) {
+		r, err := NewRegistry(Config{SecretsDir: secretsDir})
+		if err != nil {
+			t.Fatalf("NewRegistry() error = %v", err)
+		}
+		if _, err := r.Resolve(Identity{ClusterName: "pg-c", Namespace: "db"}); err == nil {
+			t.Error("Resolve() with missing password should return error")
+		}
+	})
+
+	t.Run("rotated secret", func(t *testing.T) {
+		r, err := NewRegistry(Config{SecretsDir: secretsDir})
+		if err != nil {
+			t.Fatalf("NewRegistry() error = %v", err)
+		}
+		got, err := r.Resolve(Identity{ClusterName: "pg-b", Namespace: "db"})
+		if err != nil {
+			t.Fatalf("Resolve() error = %v", err)
+		}
+		if got.Config.S3AccessKeyFile != filepath.Join(secretsDir, "db", "pg-b", "AWS_ACCESS_KEY_ID") {
+			t.Errorf("S3AccessKeyFile = %q", got.Config.S3AccessKeyFile)
+		}
+
+		// The resolved tenant reads the new password without resolving again
+		writeFile(t, filepath.Join(secretsDir, "db", "pg-b", "RESTIC_PASSWORD"), "rotated-b")
+		if password := password(t, got.Config); password != "rotated-b" {
+			t.Errorf("Password after rotation = %q, want rotated-b", password)
+		}
+	})
+}
+
+func TestNewRegistry_InvalidFile(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{
+			name:    "malformed JSON",
+			content: `{"tenants": [`,
+		},
+		{
+			name:    "missing cluster name",
+			content: `{"tenants": [{"namespace": "db"}]}`,
+		},
+		{
+			name:    "duplicate tenant",
+			content: `{"tenants": [{"clusterName": "pg-a"}, {"clusterName": "pg-a"}]}`,
+		},
+		{
+			name:    "invalid namespace",
+			content: `{"tenants": [{"clusterName": "pg-a", "namespace": "../db"}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "tenants.json")
+			writeFile(t, path, tt.content)
+			if _, err := NewRegistry(Config{File: path}); err == nil {
+				t.Error("NewRegistry() should return error")
+			}
+		})
+	}
+}
+
+func TestIdentity_Tags(t *testing.T) {
+	if tags := (Identity{}).Tags(); len(tags) != 0 {
+		t.Errorf("Tags() of empty identity = %v, want none", tags)
+	}
+
+	tags := Identity{ClusterName: "pg-a", Namespace: "db"}.Tags()
+	if len(tags) != 2 || tags[0] != "cluster:pg-a" || tags[1] != "namespace:db" {
+		t.Errorf("Tags() = %v, want [cluster:pg-a namespace:db]", tags)
+	}
+}
@@ -0,0 +1,195 @@
+// Package tlsconfig serves TLS with certificates reloaded from disk, so
+// rotations of a mounted Secret take effect without a restart.
+package tlsconfig
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"cloud-native-pg-restic-backup/internal/logging"
+)
+
+// DefaultReloadInterval is how often the certificate files are checked for
+// changes by default
+const DefaultReloadInterval = 10 * time.Second
+
+// Config configures TLS serving
+type Config struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile enables mutual TLS, client certificates are verified
+	// against its CA bundle when presented
+	ClientCAFile string
+	// MinVersion is "1.2" or "1.3", "1.2" if empty
+	MinVersion string
+	// ReloadInterval is how often the files are checked for changes
+	ReloadInterval time.Duration
+}
+
+// Enabled reports whether TLS is configured
+func (c Config) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// ParseMinVersion returns the TLS version of a "1.2" or "1.3" string
+func ParseMinVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported minimum TLS version %q, use 1.2 or 1.3", version)
+	}
+}
+
+// Reloader holds the current certificate and client CA pool, reloading them
+// when the files change
+type Reloader struct {
+	cfg        Config
+	minVersion uint16
+	logger     *logging.Logger
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	// contents of the files last loaded, to detect changes
+	loaded [][]byte
+}
+
+// New loads the certificate, key and client CA
+func New(cfg Config, logger *logging.Logger) (*Reloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, fmt.Errorf("both a TLS certificate and key file are required")
+	}
+	minVersion, err := ParseMinVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ReloadInterval <= 0 {
+		cfg.ReloadInterval = DefaultReloadInterval
+	}
+
+	r := &Reloader{
+		cfg:        cfg,
+		minVersion: minVersion,
+		logger:     logger.Component("tls"),
+	}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again and swaps in the new certificate and client
+// CA if they changed. On error the previous ones stay in use.
+func (r *Reloader) Reload() (bool, error) {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+
+	contents := make([][]byte, len(files))
+	for i, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return false, fmt.Errorf("failed to read %s: %v", file, err)
+		}
+		contents[i] = data
+	}
+
+	r.mu.RLock()
+	unchanged := r.loaded != nil
+	for i := range contents {
+		if unchanged && !bytes.Equal(contents[i], r.loaded[i]) {
+			unchanged = false
+		}
+	}
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(contents[0], contents[1])
+	if err != nil {
+		return false, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+
+	var clientCA *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		clientCA = x509.NewCertPool()
+		if !clientCA.AppendCertsFromPEM(contents[2]) {
+			return false, fmt.Errorf("no certificates found in client CA file %s", r.cfg.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCA = clientCA
+	r.loaded = contents
+	r.mu.Unlock()
+	return true, nil
+}
+
+// Run checks the files for changes until ctx is cancelled
+func (r *Reloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.Reload()
+			if err != nil {
+				r.logger.Error().Err(err).Msg("Failed to reload TLS certificate, keeping the current one")
+				continue
+			}
+			if reloaded {
+				r.logger.Info().Str("cert_file", r.cfg.CertFile).Msg("Reloaded TLS certificate")
+			}
+		}
+	}
+}
+
+// TLSConfig returns a server configuration always serving the current
+// certificate and verifying clients against the current CA
+func (r *Reloader) TLSConfig() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion:     r.minVersion,
+		GetCertificate: r.getCertificate,
+	}
+	if r.cfg.ClientCAFile == "" {
+		return cfg
+	}
+
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		// Callers may still authenticate by token, so a certificate is
+		// only verified when presented
+		return &tls.Config{
+			MinVersion:     r.minVersion,
+			GetCertificate: r.getCertificate,
+			ClientCAs:      r.clientCA,
+			ClientAuth:     tls.VerifyClientCertIfGiven,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}, nil
+	}
+	return cfg
+}
+
+// getCertificate returns the current certificate
+func (r *Reloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
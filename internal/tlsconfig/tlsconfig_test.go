@@ -0,0 +1,290 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud-native-pg-restic-backup/internal/logging"
+)
+
+// testCA issues certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of a leaf certificate
+func (ca *testCA) issue(t *testing.T, commonName string, serial int64, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startServer serves the reloader's TLS configuration, reporting the common
+// name of verified client certificates
+func startServer(t *testing.T, r *Reloader) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if len(req.TLS.VerifiedChains) > 0 {
+			w.Write([]byte(req.TLS.VerifiedChains[0][0].Subject.CommonName))
+		}
+	}))
+	server.TLS = r.TLSConfig()
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// servedSerial connects to the server and returns the serial number of its
+// certificate
+func servedSerial(t *testing.T, addr string, roots *x509.CertPool) int64 {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	ca := newTestCA(t, "ca")
+	cert, key := ca.issue(t, "localhost", 10, x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+
+	r, err := New(Config{CertFile: certFile, KeyFile: keyFile, ReloadInterval: 10 * time.Millisecond}, logging.NewLogger(logging.Config{Level: "error"}))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	server := startServer(t, r)
+	addr := server.Listener.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	if serial := servedSerial(t, addr, roots); serial != 10 {
+		t.Fatalf("served serial = %d, want 10", serial)
+	}
+
+	if reloaded, err := r.Reload(); err != nil || reloaded {
+		t.Errorf("Reload() of unchanged files = %v, %v, want false, nil", reloaded, err)
+	}
+
+	// A half-written rotation keeps the current certificate
+	writeFile(t, certFile, []byte("not a certificate"))
+	if _, err := r.Reload(); err == nil {
+		t.Error("Reload() expected error for invalid certificate")
+	}
+	if serial := servedSerial(t, addr, roots); serial != 10 {
+		t.Errorf("served serial after failed reload = %d, want 10", serial)
+	}
+
+	// The background reload picks up the rotated certificate
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	cert, key = ca.issue(t, "localhost", 11, x509.ExtKeyUsageServerAuth)
+	writeFile(t, keyFile, key)
+	writeFile(t, certFile, cert)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for servedSerial(t, addr, roots) != 11 {
+		if time.Now().After(deadline) {
+			t.Fatal("rotated certificate was not served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloader_ClientCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+
+	serverCA := newTestCA(t, "server-ca")
+	clientCA := newTestCA(t, "client-ca")
+	otherCA := newTestCA(t, "other-ca")
+	cert, key := serverCA.issue(t, "localhost", 10, x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+	writeFile(t, caFile, clientCA.pem)
+
+	r, err := New(Config{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, MinVersion: "1.3"}, logging.NewLogger(logging.Config{Level: "error"}))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	server := startServer(t, r)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+
+	client := func(ca *testCA, maxVersion uint16) *http.Client {
+		cfg := &tls.Config{RootCAs: roots, ServerName: "localhost", MaxVersion: maxVersion}
+		if ca != nil {
+			certPEM, keyPEM := ca.issue(t, "pg-a.db.svc", 20, x509.ExtKeyUsageClientAuth)
+			pair, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Present the certificate even if the server names other CAs
+			cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &pair, nil
+			}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	}
+
+	tests := []struct {
+		name       string
+		client     *http.Client
+		wantErr    bool
+		wantClient string
+	}{
+		{
+			name:       "verified client certificate",
+			client:     client(clientCA, 0),
+			wantClient: "pg-a.db.svc",
+		},
+		{
+			name:   "no client certificate",
+			client: client(nil, 0),
+		},
+		{
+			name:    "certificate of another CA",
+			client:  client(otherCA, 0),
+			wantErr: true,
+		},
+		{
+			name:    "below minimum version",
+			client:  client(clientCA, tls.VersionTLS12),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.client.Get(server.URL)
+			if tt.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("Get() expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			defer resp.Body.Close()
+
+			body := make([]byte, 64)
+			n, _ := resp.Body.Read(body)
+			if got := string(body[:n]); got != tt.wantClient {
+				t.Errorf("verified client = %q, want %q", got, tt.wantClient)
+			}
+		})
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	cert, key := newTestCA(t, "ca").issue(t, "localhost", 10, x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+	writeFile(t, filepath.Join(dir, "empty.crt"), nil)
+
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{name: "missing key", cfg: Config{CertFile: certFile}},
+		{name: "unknown min version", cfg: Config{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.1"}},
+		{name: "missing file", cfg: Config{CertFile: filepath.Join(dir, "missing.crt"), KeyFile: keyFile}},
+		{name: "mismatched key", cfg: Config{CertFile: certFile, KeyFile: certFile}},
+		{name: "empty client CA", cfg: Config{CertFile: certFile, KeyFile: keyFile, ClientCAFile: filepath.Join(dir, "empty.crt")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.cfg, logging.NewLogger(logging.Config{Level: "error"})); err == nil {
+				t.Error("New() expected error")
+			}
+		})
+	}
+}
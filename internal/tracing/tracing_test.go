@@ -0,0 +1,71 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSetup(t *testing.T) {
+	for _, exporter := range []string{"", ExporterNone, ExporterStdout} {
+		shutdown, err := Setup(context.Background(), Config{Exporter: exporter, ServiceName: "test"})
+		if err != nil {
+			t.Fatalf("Setup(%q) error = %v", exporter, err)
+		}
+		if err := shutdown(context.Background()); err != nil {
+			t.Errorf("shutdown of %q exporter error = %v", exporter, err)
+		}
+	}
+
+	if _, err := Setup(context.Background(), Config{Exporter: "zipkin"}); err == nil {
+		t.Error("Setup() with unknown exporter should return error")
+	}
+}
+
+func TestSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	if _, err := Setup(context.Background(), Config{}); err != nil {
+		t.Fatal(err)
+	}
+
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := Extract(context.Background(), header)
+
+	ctx, parent := Start(ctx, "parent")
+	_, child := Start(ctx, "child")
+	End(child, fmt.Errorf("restic exited with 1"))
+	End(parent, nil)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want 2", len(spans))
+	}
+
+	wantTrace, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	for _, span := range spans {
+		if span.SpanContext().TraceID() != wantTrace {
+			t.Errorf("span %s has trace %s, want the propagated %s", span.Name(), span.SpanContext().TraceID(), wantTrace)
+		}
+	}
+	if spans[0].Name() != "child" || spans[0].Status().Code != codes.Error {
+		t.Errorf("child span status = %+v, want error", spans[0].Status())
+	}
+	if spans[0].Parent().SpanID() != spans[1].SpanContext().SpanID() {
+		t.Error("child span is not a child of the parent span")
+	}
+	if spans[1].Status().Code == codes.Error {
+		t.Error("parent span recorded an error")
+	}
+}
@@ -0,0 +1,386 @@
+// Package verify performs test restores proving that base backups and their
+// WAL can actually be restored.
+package verify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud-native-pg-restic-backup/internal/basebackup"
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/metrics"
+	"cloud-native-pg-restic-backup/internal/pgdata"
+	"cloud-native-pg-restic-backup/internal/restic"
+	"cloud-native-pg-restic-backup/internal/wal"
+)
+
+// ErrInProgress is returned when a verification is already running
+var ErrInProgress = errors.New("verification already in progress")
+
+// Options selects what a verification restores and checks
+type Options struct {
+	// SnapshotID is the base backup to verify, the latest one if empty
+	SnapshotID string `json:"snapshotID,omitempty"`
+	// UntilWAL is the last WAL segment to restore, the latest archived one
+	// of the backup's timeline if empty
+	UntilWAL string `json:"untilWAL,omitempty"`
+	// VerifyChecksums verifies the data checksums of all relation pages
+	VerifyChecksums bool `json:"verifyChecksums,omitempty"`
+	// Restore tunes how restic restores filesystem backups, as configured
+	// for restores
+	Restore restic.RestoreOptions `json:"-"`
+}
+
+// Check is the outcome of a single verification step
+type Check struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Details string `json:"details,omitempty"`
+}
+
+// Result is the outcome of a verification
+type Result struct {
+	SnapshotID string                 `json:"snapshotID"`
+	StartedAt  time.Time              `json:"startedAt"`
+	FinishedAt time.Time              `json:"finishedAt"`
+	Passed     bool                   `json:"passed"`
+	Checks     []Check                `json:"checks"`
+	Checksums  *pgdata.ChecksumReport `json:"checksums,omitempty"`
+	Manifest   *pgdata.ManifestReport `json:"manifest,omitempty"`
+}
+
+func (r *Result) add(name string, passed bool, format string, args ...interface{}) bool {
+	r.Checks = append(r.Checks, Check{
+		Name:    name,
+		Passed:  passed,
+		Details: fmt.Sprintf(format, args...),
+	})
+	return passed
+}
+
+// Summary aggregates the verifications run so far
+type Summary struct {
+	Passed int     `json:"passed"`
+	Failed int     `json:"failed"`
+	Last   *Result `json:"last,omitempty"`
+}
+
+// Verifier restores base backups into a scratch directory and checks them
+type Verifier struct {
+	client     restic.Client
+	walManager *wal.Manager
+	scratchDir string
+	stream     basebackup.Config
+	logger     *logging.Logger
+
+	running sync.Mutex
+	mu      sync.Mutex
+	summary Summary
+}
+
+// NewVerifier creates a new verifier restoring below scratchDir. stream
+// configures the pg_combinebackup restores of incremental backups run.
+func NewVerifier(client restic.Client, scratchDir string, stream basebackup.Config, logger *logging.Logger) *Verifier {
+	if scratchDir == "" {
+		scratchDir = os.TempDir()
+	}
+	logger = logger.Component("verify")
+
+	return &Verifier{
+		client:     client,
+		walManager: wal.NewManager(client, logger),
+		scratchDir: scratchDir,
+		stream:     stream,
+		logger:     logger,
+	}
+}
+
+// Verify restores a base backup and its WAL and checks the result. Failed
+// checks are reported in the result, errors are returned only if the
+// verification could not run.
+func (v *Verifier) Verify(ctx context.Context, opts Options) (*Result, error) {
+	if !v.running.TryLock() {
+		return nil, ErrInProgress
+	}
+	defer v.running.Unlock()
+
+	logger := v.logger.Context(ctx).Operation("verify").WithFields(map[string]interface{}{
+		"snapshot_id": opts.SnapshotID,
+	})
+
+	snapshot, err := v.findBackup(ctx, opts.SnapshotID)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to find base backup")
+		metrics.ObserveVerification(ctx, false, err)
+		return nil, err
+	}
+
+	logger = logger.WithFields(map[string]interface{}{
+		"snapshot_id": snapshot.ID,
+	})
+	logger.Info().Msg("Starting verification")
+
+	scratch, err := os.MkdirTemp(v.scratchDir, "verify-")
+	if err != nil {
+		metrics.ObserveVerification(ctx, false, err)
+		return nil, fmt.Errorf("failed to create scratch directory: %v", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	result := &Result{
+		SnapshotID: snapshot.ID,
+		StartedAt:  time.Now(),
+	}
+	v.run(ctx, snapshot, scratch, opts, result)
+	result.FinishedAt = time.Now()
+
+	result.Passed = true
+	for _, check := range result.Checks {
+		result.Passed = result.Passed && check.Passed
+	}
+
+	v.mu.Lock()
+	if result.Passed {
+		v.summary.Passed++
+	} else {
+		v.summary.Failed++
+	}
+	v.summary.Last = result
+	v.mu.Unlock()
+	metrics.ObserveVerification(ctx, result.Passed, nil)
+
+	logger.Info().
+		Bool("passed", result.Passed).
+		Dur("duration", result.FinishedAt.Sub(result.StartedAt)).
+		Msg("Verification completed")
+
+	return result, nil
+}
+
+// run executes the verification steps, stopping at the first one the
+// following steps depend on
+func (v *Verifier) run(ctx context.Context, snapshot *restic.Snapshot, scratch string, opts Options, result *Result) {
+	// restic recreates the backed up path below the target, streamed
+	// backups are extracted into it
+	dataDir := scratch
+	var err error
+	if basebackup.IsStreamed(snapshot) {
+		err = basebackup.RestoreSnapshot(ctx, v.client, v.stream, snapshot, scratch)
+	} else {
+		err = v.client.Restore(ctx, snapshot.ID, scratch, opts.Restore)
+		dataDir = pgdata.RestoredDataDir(scratch, snapshot.Paths, pgdata.ParseTablespaceTags(snapshot.Tags))
+	}
+	if err != nil {
+		result.add("restore", false, "%v", err)
+		return
+	}
+	result.add("restore", true, "restored to scratch directory")
+	if !basebackup.IsStreamed(snapshot) {
+		if _, err := basebackup.RestoreLabel(ctx, v.client, snapshot.SourceID(), dataDir); err != nil {
+			result.add("backup_label", false, "%v", err)
+			return
+		}
+	}
+	v.verifyManifest(ctx, snapshot, scratch, dataDir, result)
+
+	version, err := pgdata.ReadServerVersion(dataDir)
+	if err != nil {
+		result.add("pg_version", false, "%v", err)
+	} else if tagged := tagValue(snapshot.Tags, "pg_version"); tagged != "" && tagged != version {
+		result.add("pg_version", false, "PG_VERSION is %s but the snapshot was taken from %s", version, tagged)
+	} else {
+		result.add("pg_version", true, "PostgreSQL %s", version)
+	}
+
+	label, err := pgdata.ReadBackupLabel(dataDir)
+	if err != nil {
+		result.add("backup_label", false, "%v", err)
+	} else {
+		result.add("backup_label", true, "starts at %s (%s)", label.StartWALLocation, label.StartWALFile)
+		v.verifyWALRange(ctx, dataDir, label, opts.UntilWAL, result)
+	}
+
+	if opts.VerifyChecksums {
+		control, err := pgdata.ReadControlData(dataDir)
+		if err != nil {
+			result.add("checksums", false, "%v", err)
+			return
+		}
+		// Pages of clusters without checksums carry none to verify
+		if !control.ChecksumsEnabled() {
+			result.add("checksums", true, "checksums disabled")
+			return
+		}
+		report, err := pgdata.VerifyChecksums(dataDir)
+		if err != nil {
+			result.add("checksums", false, "%v", err)
+			return
+		}
+		result.Checksums = report
+		result.add("checksums", report.FailuresTotal == 0, "%d pages verified, %d failures", report.PagesScanned, report.FailuresTotal)
+	}
+}
+
+// verifyManifest checks the restored files against the backup manifest, if
+// the backup has one
+func (v *Verifier) verifyManifest(ctx context.Context, snapshot *restic.Snapshot, scratch, dataDir string, result *Result) {
+	// Streamed backups carry their manifest, the one of a filesystem backup
+	// is stored next to it
+	if !basebackup.IsStreamed(snapshot) {
+		found, err := basebackup.RestoreManifest(ctx, v.client, snapshot.SourceID(), dataDir)
+		if err != nil {
+			result.add("manifest", false, "%v", err)
+			return
+		}
+		if !found {
+			return
+		}
+	}
+
+	manifest, err := pgdata.ReadManifest(dataDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		result.add("manifest", false, "%v", err)
+		return
+	}
+
+	// Tablespaces were restored below the scratch directory
+	tablespaces := make(map[string]string)
+	for _, tablespace := range pgdata.ParseTablespaceTags(snapshot.Tags) {
+		tablespaces[tablespace.OID] = filepath.Join(scratch, tablespace.Location)
+	}
+	report, err := pgdata.VerifyManifest(dataDir, manifest, tablespaces)
+	if err != nil {
+		result.add("manifest", false, "%v", err)
+		return
+	}
+	result.Manifest = report
+	result.add("manifest", report.OK(), "%d files, %d missing, %d unexpected, %d mismatched",
+		report.Files, len(report.Missing), len(report.Unexpected), len(report.Mismatched))
+}
+
+// verifyWALRange restores every segment from the backup's start up to the
+// end of the range into the scratch pg_wal
+func (v *Verifier) verifyWALRange(ctx context.Context, dataDir string, label *pgdata.BackupLabel, untilWAL string, result *Result) {
+	start, err := wal.ParseWALFileName(label.StartWALFile)
+	if err != nil {
+		result.add("wal_range", false, "%v", err)
+		return
+	}
+
+	// Only segments of the restored instance belong to the range
+	instanceTags, err := pgdata.RequireInstanceTags(dataDir)
+	if err != nil {
+		result.add("wal_range", false, "%v", err)
+		return
+	}
+
+	var end *wal.Segment
+	if untilWAL != "" {
+		if end, err = wal.ParseWALFileName(untilWAL); err != nil {
+			result.add("wal_range", false, "%v", err)
+			return
+		}
+	} else {
+		segments, err := v.walManager.ListSegments(ctx, start.Timeline, instanceTags...)
+		if err != nil {
+			result.add("wal_range", false, "%v", err)
+			return
+		}
+		for _, segment := range segments {
+			if end == nil || end.Before(segment) {
+				end = segment
+			}
+		}
+		if end == nil {
+			result.add("wal_range", false, "no WAL archived for timeline %d", start.Timeline)
+			return
+		}
+	}
+
+	if end.Before(start) {
+		result.add("wal_range", false, "range ends at %s before the backup start %s", end.FileName(), start.FileName())
+		return
+	}
+
+	walDir := filepath.Join(dataDir, "pg_wal")
+	if err := os.MkdirAll(walDir, 0700); err != nil {
+		result.add("wal_range", false, "%v", err)
+		return
+	}
+
+	restored := 0
+	var segmentSize int64
+	for segment := start; ; segment = segment.Next(segmentSize) {
+		name := segment.FileName()
+		target := filepath.Join(walDir, name)
+		if err := v.walManager.RestoreWALSegment(ctx, name, target, instanceTags); err != nil {
+			result.add("wal_range", false, "%d segments restored, missing %s: %v", restored, name, err)
+			return
+		}
+		restored++
+
+		if segmentSize == 0 {
+			info, err := os.Stat(target)
+			if err != nil || info.Size() == 0 {
+				result.add("wal_range", false, "cannot determine WAL segment size from %s", name)
+				return
+			}
+			segmentSize = info.Size()
+		}
+
+		if !segment.Before(end) {
+			break
+		}
+	}
+
+	result.add("wal_range", true, "%d segments restored from %s to %s", restored, start.FileName(), end.FileName())
+}
+
+// findBackup returns the base backup with the given ID, or the latest one
+func (v *Verifier) findBackup(ctx context.Context, snapshotID string) (*restic.Snapshot, error) {
+	snapshots, err := v.client.FindSnapshots(ctx, []string{"type:full"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list base backups: %v", err)
+	}
+
+	if snapshotID != "" {
+		return restic.FindByID(snapshots, snapshotID)
+	}
+
+	var found *restic.Snapshot
+	for _, s := range snapshots {
+		if found == nil || s.Time.After(found.Time) {
+			found = s
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no base backup found")
+	}
+	return found, nil
+}
+
+// Summary returns the verifications run so far
+func (v *Verifier) Summary() Summary {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.summary
+}
+
+// tagValue returns the value of a key:value tag
+func tagValue(tags []string, key string) string {
+	for _, tag := range tags {
+		if value, ok := strings.CutPrefix(tag, key+":"); ok {
+			return value
+		}
+	}
+	return ""
+}
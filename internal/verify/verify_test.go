@@ -0,0 +1,343 @@
+package verify
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud-native-pg-restic-backup/internal/basebackup"
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/pgdata"
+	"cloud-native-pg-restic-backup/internal/restic"
+)
+
+const backupLabel = `START WAL LOCATION: 0/2000028 (file 000000010000000000000002)
+CHECKPOINT LOCATION: 0/2000060
+BACKUP METHOD: streamed
+BACKUP FROM: primary
+START TIMELINE: 1
+`
+
+// mockResticClient serves a base backup and WAL segments from memory
+type mockResticClient struct {
+	restic.Client
+	withLabel bool
+	// storedLabel serves the label from a companion snapshot, as for a
+	// coordinated backup
+	storedLabel bool
+	walFiles    []string
+	manifest    []byte
+	// tablespace backs up a tablespace whose location sorts before the
+	// data directory
+	tablespace bool
+	// otherBackup is a second base backup sharing the prefix abc
+	otherBackup bool
+	// dataChecksums restores a cluster initialized with data checksums
+	dataChecksums bool
+}
+
+// tablespaceLocation is the location of the tablespace of the mock backup
+const tablespaceLocation = "/mnt/tablespace"
+
+func (m *mockResticClient) FindSnapshots(_ context.Context, tags []string) ([]*restic.Snapshot, error) {
+	if tags[0] == basebackup.ManifestTypeTag {
+		if m.manifest == nil {
+			return nil, nil
+		}
+		return []*restic.Snapshot{{ID: "manifest", Tags: tags}}, nil
+	}
+	if tags[0] == basebackup.LabelTypeTag {
+		if !m.storedLabel {
+			return nil, nil
+		}
+		return []*restic.Snapshot{{ID: "label", Tags: tags}}, nil
+	}
+	if tags[0] == "type:full" {
+		snapshot := &restic.Snapshot{
+			ID:    "abcdef",
+			Time:  time.Now(),
+			Tags:  []string{"type:full", "pg_version:16"},
+			Paths: []string{"/var/lib/postgresql/data"},
+		}
+		if m.tablespace {
+			snapshot.Tags = append(snapshot.Tags, pgdata.Tablespace{OID: "16385", Location: tablespaceLocation}.Tag())
+			snapshot.Paths = append([]string{tablespaceLocation}, snapshot.Paths...)
+		}
+		if m.otherBackup {
+			return []*restic.Snapshot{snapshot, {ID: "abc123", Time: time.Now(), Tags: []string{"type:full"}}}, nil
+		}
+		return []*restic.Snapshot{snapshot}, nil
+	}
+
+	var wanted string
+	for _, tag := range tags {
+		if name, ok := strings.CutPrefix(tag, "wal_file:"); ok {
+			wanted = name
+		}
+	}
+
+	var snapshots []*restic.Snapshot
+	for _, name := range m.walFiles {
+		if wanted == "" || wanted == name {
+			snapshots = append(snapshots, &restic.Snapshot{
+				ID:   "wal-" + name,
+				Tags: []string{"type:wal", "wal_file:" + name},
+			})
+		}
+	}
+	return snapshots, nil
+}
+
+func (m *mockResticClient) Restore(_ context.Context, _, targetPath string, _ restic.RestoreOptions) error {
+	if m.tablespace {
+		if err := os.MkdirAll(filepath.Join(targetPath, tablespaceLocation, "PG_16_202307071"), 0700); err != nil {
+			return err
+		}
+	}
+	dataDir := filepath.Join(targetPath, "var", "lib", "postgresql", "data")
+	if err := os.MkdirAll(filepath.Join(dataDir, "global"), 0700); err != nil {
+		return err
+	}
+
+	control := make([]byte, 8192)
+	binary.LittleEndian.PutUint64(control, 42)
+	if m.dataChecksums {
+		// pg_control_version and data_checksum_version of PostgreSQL 16
+		binary.LittleEndian.PutUint32(control[8:], 1300)
+		binary.LittleEndian.PutUint32(control[252:], 1)
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "global", "pg_control"), control, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "PG_VERSION"), []byte("16\n"), 0600); err != nil {
+		return err
+	}
+	if m.withLabel {
+		return os.WriteFile(filepath.Join(dataDir, "backup_label"), []byte(backupLabel), 0600)
+	}
+	return nil
+}
+
+func (m *mockResticClient) Dump(_ context.Context, snapshotID, _ string, w io.Writer) error {
+	if snapshotID == "label" {
+		_, err := io.WriteString(w, backupLabel)
+		return err
+	}
+	_, err := w.Write(m.manifest)
+	return err
+}
+
+// testManifest returns the manifest of the files Restore writes, with the
+// given PG_VERSION
+func testManifest(t *testing.T, version string) []byte {
+	t.Helper()
+	control := make([]byte, 8192)
+	binary.LittleEndian.PutUint64(control, 42)
+	manifest := &pgdata.Manifest{Version: 1}
+	for _, f := range []struct{ name, content string }{
+		{"PG_VERSION", version},
+		{"backup_label", backupLabel},
+		{"global/pg_control", string(control)},
+	} {
+		if err := manifest.AddFile(f.name, time.Now(), strings.NewReader(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return manifest.Marshal()
+}
+
+func (m *mockResticClient) RestoreFile(_ context.Context, _, filePath, targetPath string) error {
+	return os.WriteFile(targetPath, make([]byte, 1024*1024), 0600)
+}
+
+func (m *mockResticClient) EnsureDirectory(_ context.Context, path string) error {
+	return os.MkdirAll(path, 0700)
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name        string
+		withLabel   bool
+		storedLabel bool
+		walFiles    []string
+		untilWAL    string
+		manifest    string
+		tablespace  bool
+		wantPassed  bool
+		wantFailed  string
+	}{
+		{
+			name:      "complete backup",
+			withLabel: true,
+			walFiles: []string{
+				"000000010000000000000002",
+				"000000010000000000000003",
+				"000000010000000000000004",
+			},
+			wantPassed: true,
+		},
+		{
+			name:      "WAL gap",
+			withLabel: true,
+			walFiles: []string{
+				"000000010000000000000002",
+				"000000010000000000000004",
+			},
+			wantPassed: false,
+			wantFailed: "wal_range",
+		},
+		{
+			name:      "explicit end of range",
+			withLabel: true,
+			walFiles: []string{
+				"000000010000000000000002",
+				"000000010000000000000003",
+				"000000010000000000000005",
+			},
+			untilWAL:   "000000010000000000000003",
+			wantPassed: true,
+		},
+		{
+			name:       "matching manifest",
+			withLabel:  true,
+			walFiles:   []string{"000000010000000000000002"},
+			untilWAL:   "000000010000000000000002",
+			manifest:   "16\n",
+			wantPassed: true,
+		},
+		{
+			name:       "manifest mismatch",
+			withLabel:  true,
+			walFiles:   []string{"000000010000000000000002"},
+			untilWAL:   "000000010000000000000002",
+			manifest:   "15\n",
+			wantPassed: false,
+			wantFailed: "manifest",
+		},
+		{
+			name:        "label stored next to the backup",
+			storedLabel: true,
+			walFiles:    []string{"000000010000000000000002"},
+			untilWAL:    "000000010000000000000002",
+			manifest:    "16\n",
+			wantPassed:  true,
+		},
+		{
+			name:       "tablespace sorting before the data directory",
+			withLabel:  true,
+			walFiles:   []string{"000000010000000000000002"},
+			untilWAL:   "000000010000000000000002",
+			manifest:   "16\n",
+			tablespace: true,
+			wantPassed: true,
+		},
+		{
+			name:       "missing backup_label",
+			withLabel:  false,
+			wantPassed: false,
+			wantFailed: "backup_label",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockResticClient{withLabel: tt.withLabel, storedLabel: tt.storedLabel, walFiles: tt.walFiles, tablespace: tt.tablespace}
+			if tt.manifest != "" {
+				client.manifest = testManifest(t, tt.manifest)
+			}
+			logger := logging.NewLogger(logging.Config{
+				Level:      "info",
+				JSONOutput: false,
+			})
+			v := NewVerifier(client, t.TempDir(), basebackup.Config{}, logger)
+
+			result, err := v.Verify(context.Background(), Options{UntilWAL: tt.untilWAL})
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+
+			if (tt.manifest != "") != (result.Manifest != nil) {
+				t.Errorf("Manifest = %+v, want a report %v", result.Manifest, tt.manifest != "")
+			}
+			if result.Passed != tt.wantPassed {
+				t.Errorf("Passed = %v, want %v, checks: %+v", result.Passed, tt.wantPassed, result.Checks)
+			}
+			for _, check := range result.Checks {
+				if check.Name == tt.wantFailed && check.Passed {
+					t.Errorf("check %s passed, want failure", check.Name)
+				}
+			}
+
+			summary := v.Summary()
+			if summary.Last != result {
+				t.Error("Summary() does not report the last result")
+			}
+			if tt.wantPassed && summary.Passed != 1 || !tt.wantPassed && summary.Failed != 1 {
+				t.Errorf("Summary() = %+v", summary)
+			}
+		})
+	}
+}
+
+func TestVerify_Checksums(t *testing.T) {
+	tests := []struct {
+		name          string
+		dataChecksums bool
+		wantDetails   string
+		wantReport    bool
+	}{
+		{name: "checksums enabled", dataChecksums: true, wantDetails: "0 pages verified, 0 failures", wantReport: true},
+		{name: "checksums disabled", wantDetails: "checksums disabled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockResticClient{withLabel: true, walFiles: []string{"000000010000000000000002"}, dataChecksums: tt.dataChecksums}
+			logger := logging.NewLogger(logging.Config{Level: "info"})
+			v := NewVerifier(client, t.TempDir(), basebackup.Config{}, logger)
+
+			result, err := v.Verify(context.Background(), Options{UntilWAL: "000000010000000000000002", VerifyChecksums: true})
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if !result.Passed {
+				t.Errorf("Passed = false, checks: %+v", result.Checks)
+			}
+			if (result.Checksums != nil) != tt.wantReport {
+				t.Errorf("Checksums = %+v, want a report %v", result.Checksums, tt.wantReport)
+			}
+			last := result.Checks[len(result.Checks)-1]
+			if last.Name != "checksums" || last.Details != tt.wantDetails {
+				t.Errorf("last check = %+v, want checksums with %q", last, tt.wantDetails)
+			}
+		})
+	}
+}
+
+func TestVerify_UnknownSnapshot(t *testing.T) {
+	tests := []struct {
+		name       string
+		snapshotID string
+		wantErr    error
+	}{
+		{name: "unknown ID", snapshotID: "missing", wantErr: restic.ErrSnapshotNotFound},
+		{name: "ambiguous prefix", snapshotID: "abc", wantErr: restic.ErrSnapshotAmbiguous},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := logging.NewLogger(logging.Config{Level: "info"})
+			v := NewVerifier(&mockResticClient{otherBackup: true}, t.TempDir(), basebackup.Config{}, logger)
+
+			if _, err := v.Verify(context.Background(), Options{SnapshotID: tt.snapshotID}); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -4,13 +4,19 @@ package wal
 import (
 	"context"
 	"fmt"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+
 	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/metrics"
 	"cloud-native-pg-restic-backup/internal/restic"
+	"cloud-native-pg-restic-backup/internal/tracing"
 )
 
 // Timeline represents a PostgreSQL WAL timeline
@@ -21,17 +27,21 @@ type LSN uint64
 
 // Segment represents a WAL segment file
 type Segment struct {
-	Timeline    Timeline
-	LogicalID   uint64
-	SegmentID   uint64
-	Path        string
-	BackupID    string
-	ArchivedAt  time.Time
+	Timeline   Timeline
+	LogicalID  uint64
+	SegmentID  uint64
+	Path       string
+	BackupID   string
+	ArchivedAt time.Time
 }
 
 var (
 	// Example WAL file name: 000000010000000000000001
 	walFileRegex = regexp.MustCompile(`^([0-9A-F]{8})([0-9A-F]{8})([0-9A-F]{8})$`)
+
+	// Files PostgreSQL archives besides segments: timeline history files,
+	// partial segments and backup history files
+	archivedFileRegex = regexp.MustCompile(`^(?:[0-9A-F]{8}\.history|[0-9A-F]{24}\.partial|[0-9A-F]{24}\.[0-9A-F]{8}\.backup)$`)
 )
 
 // Manager handles WAL segment operations
@@ -77,66 +87,181 @@ func ParseWALFileName(name string) (*Segment, error) {
 	}, nil
 }
 
-// ArchiveWAL archives a WAL segment
-func (m *Manager) ArchiveWAL(ctx context.Context, walPath string) error {
-	logger := m.logger.Operation("archive_wal").WithFields(map[string]interface{}{
+// ParseArchivedFileName parses the name of any file PostgreSQL archives: a
+// WAL segment, a partial segment or backup history file, both named after a
+// segment, or a timeline history file, which only names a timeline
+func ParseArchivedFileName(name string) (*Segment, error) {
+	if !archivedFileRegex.MatchString(name) {
+		return ParseWALFileName(name)
+	}
+	if IsHistoryFile(name) {
+		timeline, err := strconv.ParseUint(strings.TrimSuffix(name, ".history"), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeline: %v", err)
+		}
+		return &Segment{Timeline: Timeline(timeline)}, nil
+	}
+	return ParseWALFileName(name[:24])
+}
+
+// IsHistoryFile reports whether name is a timeline history file name
+func IsHistoryFile(name string) bool {
+	return strings.HasSuffix(name, ".history") && archivedFileRegex.MatchString(name)
+}
+
+// ValidFileName reports whether name is a WAL segment, timeline history,
+// partial segment or backup history file name
+func ValidFileName(name string) bool {
+	return walFileRegex.MatchString(name) || archivedFileRegex.MatchString(name)
+}
+
+// FileName returns the WAL file name of the segment
+func (s *Segment) FileName() string {
+	return fmt.Sprintf("%08X%08X%08X", uint32(s.Timeline), s.LogicalID, s.SegmentID)
+}
+
+// Next returns the segment following s for the given WAL segment size
+func (s *Segment) Next(segmentSize int64) *Segment {
+	next := &Segment{
+		Timeline:  s.Timeline,
+		LogicalID: s.LogicalID,
+		SegmentID: s.SegmentID + 1,
+	}
+	if next.SegmentID >= uint64(0x100000000/segmentSize) {
+		next.LogicalID++
+		next.SegmentID = 0
+	}
+	return next
+}
+
+// Before reports whether s precedes other in WAL order
+func (s *Segment) Before(other *Segment) bool {
+	if s.Timeline != other.Timeline {
+		return s.Timeline < other.Timeline
+	}
+	if s.LogicalID != other.LogicalID {
+		return s.LogicalID < other.LogicalID
+	}
+	return s.SegmentID < other.SegmentID
+}
+
+// ParseLSN parses an LSN written as PostgreSQL prints it, such as 0/3000028
+func ParseLSN(s string) (LSN, error) {
+	high, low, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid LSN: %s", s)
+	}
+	hi, err := strconv.ParseUint(high, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN: %s", s)
+	}
+	lo, err := strconv.ParseUint(low, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN: %s", s)
+	}
+	return LSN(hi<<32 | lo), nil
+}
+
+// EndSegment returns the segment holding the last byte of WAL before lsn,
+// the one a backup stopping at lsn needs archived
+func EndSegment(timeline Timeline, lsn LSN, segmentSize int64) *Segment {
+	segmentNo := uint64(0)
+	if lsn > 0 {
+		segmentNo = (uint64(lsn) - 1) / uint64(segmentSize)
+	}
+	perLogicalID := uint64(0x100000000 / segmentSize)
+	return &Segment{
+		Timeline:  timeline,
+		LogicalID: segmentNo / perLogicalID,
+		SegmentID: segmentNo % perLogicalID,
+	}
+}
+
+// ArchiveWAL archives a WAL segment with the tags of the instance it belongs
+// to
+func (m *Manager) ArchiveWAL(ctx context.Context, walPath string, instanceTags []string) (err error) {
+	ctx, span := tracing.Start(ctx, "wal.ArchiveWAL", attribute.String("wal_path", walPath))
+	started := time.Now()
+	var size int64
+	defer func() {
+		metrics.ObserveWALArchive(ctx, filepath.Base(walPath), time.Since(started), size, err)
+		tracing.End(span, err)
+	}()
+
+	logger := m.logger.Context(ctx).Operation("archive_wal").WithFields(map[string]interface{}{
 		"wal_path": walPath,
 	})
 
 	walFileName := filepath.Base(walPath)
-	segment, err := ParseWALFileName(walFileName)
+	segment, err := ParseArchivedFileName(walFileName)
 	if err != nil {
 		logger.Error().Err(err).Msg("Failed to parse WAL file name")
 		return fmt.Errorf("failed to parse WAL file name: %v", err)
 	}
 
 	logger = logger.WithFields(map[string]interface{}{
-		"timeline":    segment.Timeline,
-		"logical_id":  segment.LogicalID,
-		"segment_id":  segment.SegmentID,
-		"wal_file":    walFileName,
+		"timeline":   segment.Timeline,
+		"logical_id": segment.LogicalID,
+		"segment_id": segment.SegmentID,
+		"wal_file":   walFileName,
 	})
 
 	logger.Info().Msg("Starting WAL segment archival")
 
-	// Set tags for WAL segment identification
+	// Set tags for WAL segment identification, history files belonging to a
+	// timeline rather than a segment
 	tags := []string{
 		"type:wal",
 		fmt.Sprintf("timeline:%d", segment.Timeline),
-		fmt.Sprintf("logical_id:%d", segment.LogicalID),
-		fmt.Sprintf("segment_id:%d", segment.SegmentID),
-		fmt.Sprintf("wal_file:%s", walFileName),
 	}
+	if !IsHistoryFile(walFileName) {
+		tags = append(tags,
+			fmt.Sprintf("logical_id:%d", segment.LogicalID),
+			fmt.Sprintf("segment_id:%d", segment.SegmentID),
+		)
+	}
+	tags = append(tags, fmt.Sprintf("wal_file:%s", walFileName))
+	tags = append(tags, instanceTags...)
 
 	// Archive the WAL segment
-	if err := m.client.Backup(ctx, walPath, tags); err != nil {
+	summary, err := m.client.Backup(ctx, walPath, tags, restic.BackupOptions{})
+	if err != nil {
 		logger.Error().Err(err).Msg("Failed to archive WAL segment")
 		return fmt.Errorf("failed to archive WAL segment: %v", err)
 	}
+	if summary != nil {
+		size = int64(summary.TotalBytesProcessed)
+	}
 
 	logger.Info().Msg("Successfully archived WAL segment")
 	return nil
 }
 
-// FindWALSegment finds a specific WAL segment in the repository
-func (m *Manager) FindWALSegment(ctx context.Context, walFileName string) (*Segment, error) {
-	logger := m.logger.Operation("find_wal").WithFields(map[string]interface{}{
-		"wal_file": walFileName,
+// FindWALSegment finds a WAL segment among the snapshots carrying the given
+// instance tags
+func (m *Manager) FindWALSegment(ctx context.Context, walFileName string, instanceTags ...string) (_ *Segment, err error) {
+	ctx, span := tracing.Start(ctx, "wal.FindWALSegment", attribute.String("wal_file", walFileName))
+	defer func() { tracing.End(span, err) }()
+
+	logger := m.logger.Context(ctx).Operation("find_wal").WithFields(map[string]interface{}{
+		"wal_file":      walFileName,
+		"instance_tags": instanceTags,
 	})
 
 	logger.Info().Msg("Searching for WAL segment")
 
-	segment, err := ParseWALFileName(walFileName)
+	segment, err := ParseArchivedFileName(walFileName)
 	if err != nil {
 		logger.Error().Err(err).Msg("Failed to parse WAL file name")
 		return nil, fmt.Errorf("failed to parse WAL file name: %v", err)
 	}
 
 	// Find snapshots with matching WAL file tag
-	snapshots, err := m.client.FindSnapshots(ctx, []string{
+	tags := []string{
 		"type:wal",
 		fmt.Sprintf("wal_file:%s", walFileName),
-	})
+	}
+	snapshots, err := m.client.FindSnapshots(ctx, append(tags, instanceTags...))
 	if err != nil {
 		logger.Error().Err(err).Msg("Failed to find WAL segment")
 		return nil, fmt.Errorf("failed to find WAL segment: %v", err)
@@ -160,16 +285,68 @@ func (m *Manager) FindWALSegment(ctx context.Context, walFileName string) (*Segm
 	return segment, nil
 }
 
-// RestoreWALSegment restores a specific WAL segment
-func (m *Manager) RestoreWALSegment(ctx context.Context, walFileName, targetPath string) error {
-	logger := m.logger.Operation("restore_wal").WithFields(map[string]interface{}{
-		"wal_file": walFileName,
+// WaitForWALSegment polls the repository until a WAL segment carrying the
+// given instance tags is archived, by this instance or any other of the
+// cluster, as they share the system identifier
+func (m *Manager) WaitForWALSegment(ctx context.Context, walFileName string, interval time.Duration, instanceTags ...string) (err error) {
+	ctx, span := tracing.Start(ctx, "wal.WaitForWALSegment", attribute.String("wal_file", walFileName))
+	defer func() { tracing.End(span, err) }()
+
+	logger := m.logger.Context(ctx).Operation("wait_for_wal").WithFields(map[string]interface{}{
+		"wal_file":      walFileName,
+		"instance_tags": instanceTags,
+	})
+	logger.Info().Msg("Waiting for WAL segment to be archived")
+
+	tags := []string{
+		"type:wal",
+		fmt.Sprintf("wal_file:%s", walFileName),
+	}
+	tags = append(tags, instanceTags...)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		snapshots, err := m.client.FindSnapshots(ctx, tags)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to find WAL segment")
+			return fmt.Errorf("failed to find WAL segment: %v", err)
+		}
+		if len(snapshots) > 0 {
+			logger.Info().Msg("WAL segment archived")
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Error().Err(ctx.Err()).Msg("WAL segment not archived in time")
+			return fmt.Errorf("WAL segment %s not archived: %v", walFileName, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// RestoreWALSegment restores a WAL segment archived with the given instance
+// tags
+func (m *Manager) RestoreWALSegment(ctx context.Context, walFileName, targetPath string, instanceTags []string) (err error) {
+	ctx, span := tracing.Start(ctx, "wal.RestoreWALSegment",
+		attribute.String("wal_file", walFileName),
+		attribute.String("target_path", targetPath),
+	)
+	started := time.Now()
+	var size int64
+	defer func() {
+		metrics.ObserveWALRestore(ctx, time.Since(started), size, err)
+		tracing.End(span, err)
+	}()
+
+	logger := m.logger.Context(ctx).Operation("restore_wal").WithFields(map[string]interface{}{
+		"wal_file":    walFileName,
 		"target_path": targetPath,
 	})
 
 	logger.Info().Msg("Starting WAL segment restoration")
 
-	segment, err := m.FindWALSegment(ctx, walFileName)
+	segment, err := m.FindWALSegment(ctx, walFileName, instanceTags...)
 	if err != nil {
 		return err
 	}
@@ -186,14 +363,60 @@ func (m *Manager) RestoreWALSegment(ctx context.Context, walFileName, targetPath
 		logger.Error().Err(err).Msg("Failed to restore WAL segment")
 		return fmt.Errorf("failed to restore WAL segment: %v", err)
 	}
+	if info, statErr := os.Stat(targetPath); statErr == nil {
+		size = info.Size()
+	}
 
 	logger.Info().Msg("Successfully restored WAL segment")
 	return nil
 }
 
+// ListSegments returns the archived WAL segments of a timeline carrying the
+// given instance tags
+func (m *Manager) ListSegments(ctx context.Context, timeline Timeline, instanceTags ...string) (_ []*Segment, err error) {
+	ctx, span := tracing.Start(ctx, "wal.ListSegments", attribute.Int64("timeline", int64(timeline)))
+	defer func() { tracing.End(span, err) }()
+
+	logger := m.logger.Context(ctx).Operation("list_wal").WithFields(map[string]interface{}{
+		"timeline": timeline,
+	})
+
+	tags := []string{
+		"type:wal",
+		fmt.Sprintf("timeline:%d", timeline),
+	}
+	snapshots, err := m.client.FindSnapshots(ctx, append(tags, instanceTags...))
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to list WAL segments")
+		return nil, fmt.Errorf("failed to list WAL segments: %v", err)
+	}
+
+	var segments []*Segment
+	for _, snapshot := range snapshots {
+		for _, tag := range snapshot.Tags {
+			name, ok := strings.CutPrefix(tag, "wal_file:")
+			if !ok {
+				continue
+			}
+			segment, err := ParseWALFileName(name)
+			if err != nil {
+				continue
+			}
+			segment.BackupID = snapshot.ID
+			segment.ArchivedAt = snapshot.Time
+			segments = append(segments, segment)
+		}
+	}
+
+	return segments, nil
+}
+
 // CleanupWALSegments removes WAL segments before a given time
-func (m *Manager) CleanupWALSegments(ctx context.Context, before time.Time) error {
-	logger := m.logger.Operation("cleanup_wal").WithFields(map[string]interface{}{
+func (m *Manager) CleanupWALSegments(ctx context.Context, before time.Time) (err error) {
+	ctx, span := tracing.Start(ctx, "wal.CleanupWALSegments", attribute.String("before", before.Format(time.RFC3339)))
+	defer func() { tracing.End(span, err) }()
+
+	logger := m.logger.Context(ctx).Operation("cleanup_wal").WithFields(map[string]interface{}{
 		"before": before,
 	})
 
@@ -231,13 +454,16 @@ func (m *Manager) CleanupWALSegments(ctx context.Context, before time.Time) erro
 	return nil
 }
 
-// GetWALTimeline returns the current WAL timeline
-func (m *Manager) GetWALTimeline(ctx context.Context) (Timeline, error) {
-	logger := m.logger.Operation("get_timeline")
+// GetWALTimeline returns the current WAL timeline of the instance
+// identified by the given tags
+func (m *Manager) GetWALTimeline(ctx context.Context, instanceTags ...string) (_ Timeline, err error) {
+	ctx, span := tracing.Start(ctx, "wal.GetWALTimeline")
+	defer func() { tracing.End(span, err) }()
+
+	logger := m.logger.Context(ctx).Operation("get_timeline")
 	logger.Info().Msg("Getting current WAL timeline")
 
-	// Find the most recent WAL segment
-	snapshots, err := m.client.FindSnapshots(ctx, []string{"type:wal"})
+	snapshots, err := m.client.FindSnapshots(ctx, append([]string{"type:wal"}, instanceTags...))
 	if err != nil {
 		logger.Error().Err(err).Msg("Failed to get WAL timeline")
 		return 0, fmt.Errorf("failed to get WAL timeline: %v", err)
@@ -248,21 +474,27 @@ func (m *Manager) GetWALTimeline(ctx context.Context) (Timeline, error) {
 		return 1, nil // Default timeline if no WAL segments exist
 	}
 
-	// Parse the WAL file name from the most recent snapshot
-	for _, tag := range snapshots[0].Tags {
-		if walFile := walFileRegex.FindString(tag); walFile != "" {
-			segment, err := ParseWALFileName(walFile)
-			if err != nil {
-				logger.Error().Err(err).Msg("Failed to parse WAL file name")
-				return 0, fmt.Errorf("failed to parse WAL file name: %v", err)
+	// Snapshots are listed oldest first, the current timeline is the latest
+	// one WAL was archived on
+	var timeline Timeline
+	for _, snapshot := range snapshots {
+		for _, tag := range snapshot.Tags {
+			name, ok := strings.CutPrefix(tag, "wal_file:")
+			if !ok {
+				continue
+			}
+			if segment, err := ParseArchivedFileName(name); err == nil && segment.Timeline > timeline {
+				timeline = segment.Timeline
 			}
-			logger.Info().
-				Uint32("timeline", uint32(segment.Timeline)).
-				Msg("Found current WAL timeline")
-			return segment.Timeline, nil
 		}
 	}
+	if timeline != 0 {
+		logger.Info().
+			Uint32("timeline", uint32(timeline)).
+			Msg("Found current WAL timeline")
+		return timeline, nil
+	}
 
-	logger.Error().Msg("No valid WAL file found in latest snapshot")
-	return 0, fmt.Errorf("no valid WAL file found in latest snapshot")
+	logger.Error().Msg("No valid WAL file found in WAL snapshots")
+	return 0, fmt.Errorf("no valid WAL file found in WAL snapshots")
 }
@@ -1,6 +1,17 @@
 package wal
 
-import "testing"
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"cloud-native-pg-restic-backup/internal/logging"
+	"cloud-native-pg-restic-backup/internal/restic"
+)
 
 func TestParseWALFileName(t *testing.T) {
 	tests := []struct {
@@ -109,3 +120,238 @@ func isSegmentBefore(a, b *Segment) bool {
 	}
 	return a.SegmentID < b.SegmentID
 }
+
+func TestValidFileName(t *testing.T) {
+	tests := []struct {
+		fileName string
+		want     bool
+	}{
+		{"000000010000000000000001", true},
+		{"00000002.history", true},
+		{"000000010000000000000001.partial", true},
+		{"000000010000000000000002.00000028.backup", true},
+		{"000000010000000000000001.backup", false},
+		{"0000000100000000000000", false},
+		{"000000010000000a00000001", false},
+		{"../000000010000000000000001", false},
+		{"000000010000000000000001/..", false},
+		{"00000002.history\n", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := ValidFileName(tt.fileName); got != tt.want {
+			t.Errorf("ValidFileName(%q) = %v, want %v", tt.fileName, got, tt.want)
+		}
+	}
+}
+
+func TestEndSegment(t *testing.T) {
+	tests := []struct {
+		lsn         string
+		segmentSize int64
+		want        string
+	}{
+		{"0/3000100", 16 << 20, "000000020000000000000003"},
+		// A backup stopping on a segment boundary ends in the previous one
+		{"0/4000000", 16 << 20, "000000020000000000000003"},
+		{"1/0", 16 << 20, "0000000200000000000000FF"},
+		{"1/8000028", 64 << 20, "000000020000000100000002"},
+	}
+
+	for _, tt := range tests {
+		lsn, err := ParseLSN(tt.lsn)
+		if err != nil {
+			t.Fatalf("ParseLSN(%q) error = %v", tt.lsn, err)
+		}
+		if got := EndSegment(2, lsn, tt.segmentSize).FileName(); got != tt.want {
+			t.Errorf("EndSegment(%s, %d) = %s, want %s", tt.lsn, tt.segmentSize, got, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{"", "3000100", "0/x", "100000000/0"} {
+		if _, err := ParseLSN(invalid); err == nil {
+			t.Errorf("ParseLSN(%q) should fail", invalid)
+		}
+	}
+}
+
+func TestParseArchivedFileName(t *testing.T) {
+	tests := []struct {
+		fileName string
+		want     *Segment
+		wantErr  bool
+	}{
+		{"000000010000000000000001", &Segment{Timeline: 1, SegmentID: 1}, false},
+		{"00000002.history", &Segment{Timeline: 2}, false},
+		{"000000010000000000000001.partial", &Segment{Timeline: 1, SegmentID: 1}, false},
+		{"000000010000000000000002.00000028.backup", &Segment{Timeline: 1, SegmentID: 2}, false},
+		{"000000010000000000000001.backup", nil, true},
+		{"invalid", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseArchivedFileName(tt.fileName)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseArchivedFileName(%q) error = %v, wantErr %v", tt.fileName, err, tt.wantErr)
+			continue
+		}
+		if got != nil && (got.Timeline != tt.want.Timeline || got.LogicalID != tt.want.LogicalID || got.SegmentID != tt.want.SegmentID) {
+			t.Errorf("ParseArchivedFileName(%q) = %+v, want %+v", tt.fileName, got, tt.want)
+		}
+	}
+}
+
+// archiveClient keeps the tags of archived files and finds them by tag
+type archiveClient struct {
+	restic.Client
+	snapshots []*restic.Snapshot
+	restored  string
+}
+
+func (c *archiveClient) Backup(_ context.Context, path string, tags []string, _ restic.BackupOptions) (*restic.BackupSummary, error) {
+	c.snapshots = append(c.snapshots, &restic.Snapshot{ID: fmt.Sprintf("snap-%d", len(c.snapshots)), Tags: tags, Paths: []string{path}})
+	return &restic.BackupSummary{}, nil
+}
+
+func (c *archiveClient) FindSnapshots(_ context.Context, tags []string) ([]*restic.Snapshot, error) {
+	var found []*restic.Snapshot
+	for _, s := range c.snapshots {
+		if len(tags) == 0 || slices.ContainsFunc(tags, func(tag string) bool { return !slices.Contains(s.Tags, tag) }) {
+			continue
+		}
+		found = append(found, s)
+	}
+	return found, nil
+}
+
+func (c *archiveClient) EnsureDirectory(_ context.Context, dir string) error {
+	return os.MkdirAll(dir, 0700)
+}
+
+func (c *archiveClient) RestoreFile(_ context.Context, snapshotID, _, _ string) error {
+	c.restored = snapshotID
+	return nil
+}
+
+func TestManager_ArchivedFiles(t *testing.T) {
+	instanceTags := []string{"system_id:42", "pg_version:16"}
+
+	tests := []struct {
+		fileName string
+		wantTags []string
+		// absent are tags that must not be set
+		absent []string
+	}{
+		{
+			fileName: "000000010000000000000003",
+			wantTags: []string{"timeline:1", "segment_id:3", "wal_file:000000010000000000000003"},
+		},
+		{
+			fileName: "00000002.history",
+			wantTags: []string{"timeline:2", "wal_file:00000002.history"},
+			absent:   []string{"logical_id:0", "segment_id:0"},
+		},
+		{
+			fileName: "000000010000000000000004.partial",
+			wantTags: []string{"timeline:1", "segment_id:4", "wal_file:000000010000000000000004.partial"},
+		},
+		{
+			fileName: "000000010000000000000005.00000028.backup",
+			wantTags: []string{"timeline:1", "segment_id:5", "wal_file:000000010000000000000005.00000028.backup"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fileName, func(t *testing.T) {
+			client := &archiveClient{}
+			m := NewManager(client, logging.NewLogger(logging.Config{Level: "error"}))
+			walPath := filepath.Join(t.TempDir(), "pg_wal", tt.fileName)
+
+			if err := m.ArchiveWAL(context.Background(), walPath, instanceTags); err != nil {
+				t.Fatalf("ArchiveWAL() error = %v", err)
+			}
+			tags := client.snapshots[0].Tags
+			for _, want := range tt.wantTags {
+				if !slices.Contains(tags, want) {
+					t.Errorf("tags = %v, want %s", tags, want)
+				}
+			}
+			for _, absent := range tt.absent {
+				if slices.Contains(tags, absent) {
+					t.Errorf("tags = %v, should not contain %s", tags, absent)
+				}
+			}
+
+			target := filepath.Join(t.TempDir(), "pg_wal", tt.fileName)
+			if err := m.RestoreWALSegment(context.Background(), tt.fileName, target, instanceTags); err != nil {
+				t.Fatalf("RestoreWALSegment() error = %v", err)
+			}
+			if client.restored != client.snapshots[0].ID {
+				t.Errorf("restored %q, want %q", client.restored, client.snapshots[0].ID)
+			}
+		})
+	}
+}
+
+func TestManager_InstanceFilter(t *testing.T) {
+	const walFile = "000000010000000000000001"
+	client := &archiveClient{}
+	m := NewManager(client, logging.NewLogger(logging.Config{Level: "error"}))
+	if err := m.ArchiveWAL(context.Background(), filepath.Join(t.TempDir(), walFile), []string{"system_id:1"}); err != nil {
+		t.Fatalf("ArchiveWAL() error = %v", err)
+	}
+
+	if _, err := m.FindWALSegment(context.Background(), walFile, "system_id:1"); err != nil {
+		t.Errorf("FindWALSegment() of the archiving instance error = %v", err)
+	}
+	if _, err := m.FindWALSegment(context.Background(), walFile, "system_id:2"); err == nil {
+		t.Error("FindWALSegment() found the segment of another instance")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := m.WaitForWALSegment(ctx, walFile, time.Millisecond, "system_id:2"); err == nil {
+		t.Error("WaitForWALSegment() returned for the segment of another instance")
+	}
+	if err := m.WaitForWALSegment(context.Background(), walFile, time.Millisecond, "system_id:1"); err != nil {
+		t.Errorf("WaitForWALSegment() of the archiving instance error = %v", err)
+	}
+}
+
+func TestManager_GetWALTimeline(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  Timeline
+	}{
+		{name: "no WAL archived", want: 1},
+		{name: "single timeline", files: []string{"000000010000000000000001", "000000010000000000000002"}, want: 1},
+		{name: "after a promotion", files: []string{"000000010000000000000001", "00000002.history", "000000020000000000000002"}, want: 2},
+		{name: "history file only", files: []string{"00000003.history"}, want: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &archiveClient{}
+			m := NewManager(client, logging.NewLogger(logging.Config{Level: "error"}))
+			for _, file := range tt.files {
+				if err := m.ArchiveWAL(context.Background(), filepath.Join(t.TempDir(), file), []string{"system_id:1"}); err != nil {
+					t.Fatalf("ArchiveWAL() error = %v", err)
+				}
+			}
+			// WAL of another instance doesn't count
+			if err := m.ArchiveWAL(context.Background(), filepath.Join(t.TempDir(), "000000090000000000000001"), []string{"system_id:2"}); err != nil {
+				t.Fatalf("ArchiveWAL() error = %v", err)
+			}
+
+			got, err := m.GetWALTimeline(context.Background(), "system_id:1")
+			if err != nil {
+				t.Fatalf("GetWALTimeline() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("GetWALTimeline() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
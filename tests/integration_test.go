@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"cloud-native-pg-restic-backup/internal/backup"
+	"cloud-native-pg-restic-backup/internal/logging"
 	"cloud-native-pg-restic-backup/internal/restic"
 )
 
@@ -44,11 +45,11 @@ func TestBackupRestore(t *testing.T) {
 	if err := client.InitRepository(ctx); err != nil {
 		t.Fatalf("Failed to initialize repository")
 	}
-	backupHandler := backup.NewHandler(client)
+	backupHandler := backup.NewHandler(client, backup.Options{}, logging.NewLogger(logging.Config{Level: "info"}))
 
 	// Test backup
 	t.Run("Backup", func(t *testing.T) {
-		err := backupHandler.CreateBackup(ctx, testDataDir)
+		err := backupHandler.CreateBackup(ctx, testDataDir, backup.CreateOptions{})
 		if err != nil {
 			t.Fatalf("Backup failed: %v", err)
 		}
@@ -87,10 +88,20 @@ func TestWALArchiving(t *testing.T) {
 	if err := client.InitRepository(ctx); err != nil {
 		t.Fatalf("Failed to initialize repository: %v", err)
 	}
-	backupHandler := backup.NewHandler(client)
+	backupHandler := backup.NewHandler(client, backup.Options{}, logging.NewLogger(logging.Config{Level: "info"}))
 
-	// Create test WAL file
-	testWALDir := filepath.Join(t.TempDir(), "wal")
+	// Create test WAL file in a data directory identifying its instance
+	dataDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dataDir, "global"), 0755); err != nil {
+		t.Fatalf("Failed to create test data directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "global", "pg_control"), make([]byte, 8192), 0644); err != nil {
+		t.Fatalf("Failed to create test pg_control: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "PG_VERSION"), []byte("16\n"), 0644); err != nil {
+		t.Fatalf("Failed to create test PG_VERSION: %v", err)
+	}
+	testWALDir := filepath.Join(dataDir, "pg_wal")
 	if err := os.MkdirAll(testWALDir, 0755); err != nil {
 		t.Fatalf("Failed to create test WAL directory: %v", err)
 	}
@@ -102,7 +113,7 @@ func TestWALArchiving(t *testing.T) {
 
 	// Test WAL archiving
 	t.Run("ArchiveWAL", func(t *testing.T) {
-		err := backupHandler.ArchiveWAL(ctx, testWALFile)
+		err := backupHandler.ArchiveWAL(ctx, testWALFile, dataDir)
 		if err != nil {
 			t.Fatalf("WAL archiving failed: %v", err)
 		}